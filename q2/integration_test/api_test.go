@@ -3,23 +3,46 @@ package integration_test
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Yougigun/meepshop_q2/internal/audit"
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/broker"
+	"github.com/Yougigun/meepshop_q2/internal/handler"
 	"github.com/Yougigun/meepshop_q2/internal/repository"
 	"github.com/Yougigun/meepshop_q2/internal/service"
 	"go.uber.org/zap"
 )
 
+// build returns the server of the service, failing the test if it cannot be
+// built.
+func build(t *testing.T, logger *zap.Logger, repo repository.AccountStore, cfg service.Config) *http.Server {
+	t.Helper()
+	srv, err := service.Build(context.Background(), logger, repo, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
 func TestCreateAccountAPI(t *testing.T) {
 	// Setup
 	logger := zap.NewNop()             
 	repo := repository.NewRepository() 
 
-	router := service.Build(context.Background(), logger, repo)
+	router := build(t, logger, repo, service.Config{Insecure: true})
 
 	reqBody := bytes.NewBufferString(`{}`)
 	req, err := http.NewRequest("POST", "/accounts", reqBody) // Adjust the HTTP method and endpoint as necessary
@@ -38,7 +61,7 @@ func TestCreateAccountAPI(t *testing.T) {
 	}
 
 	// Check the response body is what we expect.
-	expected := `{"AccountID":1}` // Adjust expected response as necessary
+	expected := `{"AccountID":"1"}` // Adjust expected response as necessary
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -49,7 +72,7 @@ func TestDepositAccountAPI(t *testing.T) {
 	logger := zap.NewNop()             
 	repo := repository.NewRepository() 
 
-	router := service.Build(context.Background(), logger, repo)
+	router := build(t, logger, repo, service.Config{Insecure: true})
 	
 	reqBody := bytes.NewBufferString(`{}`)
 	req, err := http.NewRequest("POST", "/accounts", reqBody) 
@@ -65,7 +88,7 @@ func TestDepositAccountAPI(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
 	}
 
-	expected := `{"AccountID":1}` // Adjust expected response as necessary
+	expected := `{"AccountID":"1"}` // Adjust expected response as necessary
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -94,7 +117,7 @@ func TestWithdrawAccountAPI(t *testing.T) {
     // Setup
     logger := zap.NewNop()             
     repo := repository.NewRepository() 
-    router := service.Build(context.Background(), logger, repo)
+    router := build(t, logger, repo, service.Config{Insecure: true})
 
     // Create an account
     createAccBody := bytes.NewBufferString(`{}`)
@@ -110,11 +133,11 @@ func TestWithdrawAccountAPI(t *testing.T) {
         t.Errorf("Create account handler returned wrong status code: got %v want %v", status, http.StatusOK)
     }
 
-    // Assuming the account creation returns JSON like {"AccountID": 1}
+    // Assuming the account creation returns JSON like {"AccountID": "1"}
     // Extract the account ID from the response for further operations
     // This part needs adjustment based on your actual response structure
     var account struct {
-        AccountID int64 `json:"AccountID"`
+        AccountID string `json:"AccountID"`
     }
     err = json.Unmarshal(createRR.Body.Bytes(), &account)
     if err != nil {
@@ -122,7 +145,7 @@ func TestWithdrawAccountAPI(t *testing.T) {
     }
 
     // Deposit to the account before withdrawal to ensure sufficient balance
-    depositBody := bytes.NewBufferString(fmt.Sprintf(`{"account_id":%d,"amount":100}`, account.AccountID))
+    depositBody := bytes.NewBufferString(fmt.Sprintf(`{"account_id":%q,"amount":100}`, account.AccountID))
     depositReq, err := http.NewRequest("POST", "/accounts/deposit", depositBody)
     if err != nil {
         t.Fatal(err)
@@ -136,7 +159,7 @@ func TestWithdrawAccountAPI(t *testing.T) {
     }
 
     // Withdraw from the account
-    withdrawBody := bytes.NewBufferString(fmt.Sprintf(`{"account_id":%d,"amount":50}`, account.AccountID))
+    withdrawBody := bytes.NewBufferString(fmt.Sprintf(`{"account_id":%q,"amount":50}`, account.AccountID))
     withdrawReq, err := http.NewRequest("POST", "/accounts/withdraw", withdrawBody)
     if err != nil {
         t.Fatal(err)
@@ -161,10 +184,10 @@ func TestWithdrawAccountAPI(t *testing.T) {
 func TestTransferAccountAPI(t *testing.T) {
 	logger := zap.NewNop()
 	repo := repository.NewRepository() // Initialize your repository here
-	router := service.Build(context.Background(), logger, repo)
+	router := build(t, logger, repo, service.Config{Insecure: true})
 
 	// Helper function to create an account and return its ID
-	createAccount := func() int64 {
+	createAccount := func() string {
 		reqBody := bytes.NewBufferString(`{}`)
 		req, err := http.NewRequest("POST", "/accounts", reqBody)
 		if err != nil {
@@ -179,7 +202,7 @@ func TestTransferAccountAPI(t *testing.T) {
 		}
 
 		var account struct {
-			AccountID int64 `json:"AccountID"`
+			AccountID string `json:"AccountID"`
 		}
 		if err := json.Unmarshal(rr.Body.Bytes(), &account); err != nil {
 			t.Fatalf("Failed to unmarshal response during account creation: %v", err)
@@ -193,7 +216,7 @@ func TestTransferAccountAPI(t *testing.T) {
 	toAccountID := createAccount()
 
 	// Deposit into the first account to ensure sufficient balance
-	depositBody := bytes.NewBufferString(fmt.Sprintf(`{"account_id":%d,"amount":100}`, fromAccountID))
+	depositBody := bytes.NewBufferString(fmt.Sprintf(`{"account_id":%q,"amount":100}`, fromAccountID))
 	depositReq, err := http.NewRequest("POST", "/accounts/deposit", depositBody)
 	if err != nil {
 		t.Fatal(err)
@@ -207,7 +230,7 @@ func TestTransferAccountAPI(t *testing.T) {
 	}
 
 	// Perform the transfer
-	transferBody := bytes.NewBufferString(fmt.Sprintf(`{"from_account_id":%d,"to_account_id":%d,"amount":50}`, fromAccountID, toAccountID))
+	transferBody := bytes.NewBufferString(fmt.Sprintf(`{"from_account_id":%q,"to_account_id":%q,"amount":50}`, fromAccountID, toAccountID))
 	transferReq, err := http.NewRequest("POST", "/accounts/transfer", transferBody)
 	if err != nil {
 		t.Fatal(err)
@@ -224,4 +247,1428 @@ func TestTransferAccountAPI(t *testing.T) {
 	if transferRR.Body.String() != expectedTransferResponse {
 		t.Errorf("Transfer handler returned unexpected body: got %v want %v", transferRR.Body.String(), expectedTransferResponse)
 	}
+
+	// a transfer to the same account is a bad request
+	selfReq, err := http.NewRequest("POST", "/accounts/transfer", bytes.NewBufferString(fmt.Sprintf(`{"from_account_id":%q,"to_account_id":%q,"amount":10}`, fromAccountID, fromAccountID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfRR := httptest.NewRecorder()
+	router.Handler.ServeHTTP(selfRR, selfReq)
+	if status := selfRR.Code; status != http.StatusBadRequest {
+		t.Errorf("Transfer to the same account returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+func TestLedgerCheckAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"POST", "/accounts", `{}`},
+		{"POST", "/accounts", `{}`},
+		{"POST", "/accounts/deposit", `{"account_id":1,"amount":100}`},
+		{"POST", "/accounts/withdraw", `{"account_id":1,"amount":30}`},
+		{"POST", "/accounts/transfer", `{"from_account_id":1,"to_account_id":2,"amount":20}`},
+	}
+	for _, r := range requests {
+		req, err := http.NewRequest(r.method, r.path, bytes.NewBufferString(r.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("%s %s returned wrong status code: got %v want %v", r.method, r.path, status, http.StatusOK)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/ledger/check", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.Handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("ledger check returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	expected := `"balanced"`
+	if rr.Body.String() != expected {
+		t.Errorf("ledger check returned unexpected body: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func TestIdempotentTransferAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	send := func(method, path, body, key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	send("POST", "/accounts", `{}`, "")
+	send("POST", "/accounts", `{}`, "")
+	send("POST", "/accounts/deposit", `{"account_id":1,"amount":100}`, "deposit-1")
+
+	transfer := `{"from_account_id":1,"to_account_id":2,"amount":30}`
+	first := send("POST", "/accounts/transfer", transfer, "transfer-1")
+	retry := send("POST", "/accounts/transfer", transfer, "transfer-1")
+	if first.Code != http.StatusOK || retry.Code != http.StatusOK {
+		t.Fatalf("transfer returned wrong status codes: got %v and %v want %v", first.Code, retry.Code, http.StatusOK)
+	}
+	if retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry was not replayed: got %v %q", retry.Body.String(), retry.Header().Get("Idempotent-Replayed"))
+	}
+
+	acc, _ := repo.GetAccount(context.Background(), "1")
+	if acc.Balance != 70 {
+		t.Errorf("retried transfer applied twice: balance got %v want %v", acc.Balance, 70)
+	}
+
+	// the same key with a different body is rejected
+	reused := send("POST", "/accounts/transfer", `{"from_account_id":1,"to_account_id":2,"amount":40}`, "transfer-1")
+	if reused.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key returned wrong status code: got %v want %v", reused.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestIdempotentReversalAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	send := func(method, path, body, key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	send("POST", "/accounts", `{}`, "")
+	send("POST", "/accounts", `{}`, "")
+	send("POST", "/accounts/deposit", `{"account_id":1,"amount":100}`, "")
+	// journal entries 2 and 3 are the transfers
+	send("POST", "/accounts/transfer", `{"from_account_id":1,"to_account_id":2,"amount":10}`, "")
+	send("POST", "/accounts/transfer", `{"from_account_id":1,"to_account_id":2,"amount":10}`, "")
+
+	if rr := send("POST", "/transactions/2/reverse", ``, "reverse-1"); rr.Code != http.StatusOK {
+		t.Fatalf("reversal returned wrong status code: got %v want %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	// the same key and body on another transaction is a different request
+	reused := send("POST", "/transactions/3/reverse", ``, "reverse-1")
+	if reused.Code != http.StatusUnprocessableEntity || reused.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("key reused on another transaction got %v %v, want %v", reused.Code, reused.Body.String(), http.StatusUnprocessableEntity)
+	}
+	acc, _ := repo.GetAccount(context.Background(), "1")
+	if acc.Balance != 90 {
+		t.Errorf("balance after one reversal got %v want %v", acc.Balance, 90)
+	}
+}
+
+func TestReverseTransactionAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	send("POST", "/accounts", `{}`)
+	send("POST", "/accounts", `{}`)
+	send("POST", "/accounts/deposit", `{"account_id":1,"amount":100}`)
+	send("POST", "/accounts/transfer", `{"from_account_id":1,"to_account_id":2,"amount":30}`)
+
+	// journal entry 2 is the transfer
+	if rr := send("POST", "/transactions/2/reverse", `{"amount":10,"memo":"refund"}`); rr.Code != http.StatusOK {
+		t.Fatalf("partial reversal returned wrong status code: got %v want %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if rr := send("POST", "/transactions/2/reverse", `{"amount":25}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reversal past the amount returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if rr := send("POST", "/transactions/99/reverse", ``); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown transaction returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := send("POST", "/transactions/2/reverse", ``); rr.Code != http.StatusOK {
+		t.Fatalf("reversal of the rest returned wrong status code: got %v want %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if rr := send("POST", "/transactions/2/reverse", ``); rr.Code != http.StatusConflict {
+		t.Errorf("double reversal returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := send("POST", "/transactions/abc/reverse", ``); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid id returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	// journal entry 1 is the deposit
+	if rr := send("POST", "/transactions/1/reverse", ``); rr.Code != http.StatusConflict {
+		t.Errorf("deposit reversal returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	acc, _ := repo.GetAccount(context.Background(), "1")
+	if acc.Balance != 100 {
+		t.Errorf("reversed balance got %v want %v", acc.Balance, 100)
+	}
+}
+
+func TestReverseOwnershipAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	aliceID, _ := repo.CreateAccount(context.Background())
+	bobID, _ := repo.CreateAccount(context.Background())
+	carolID, _ := repo.CreateAccount(context.Background())
+	// journal entry 1 is the deposit, 2 the transfer
+	if _, err := repo.DepositAccount(context.Background(), aliceID, repository.Money{Amount: 1000}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.TransferAccount(context.Background(), aliceID, bobID, repository.Money{Amount: 100}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := auth.New(&auth.Config{JWT: auth.JWTConfig{HS256Secret: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// customers may reverse the transfers they sent or received only
+	policy, err := auth.NewPolicy(auth.PolicyConfig{Roles: map[string][]string{
+		auth.RoleCustomer: {auth.PermReverse + auth.OwnSuffix},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Auth: authenticator, Policy: policy})
+
+	customer := func(account repository.AccountID) string {
+		return "Bearer " + hs256(t, "secret", map[string]interface{}{"sub": "c-" + string(account), "accounts": []repository.AccountID{account}})
+	}
+	send := func(bearer, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", bearer)
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name   string
+		bearer string
+		path   string
+		body   string
+		want   int
+	}{
+		{"stranger reverses", customer(carolID), "/transactions/2/reverse", ``, http.StatusForbidden},
+		{"unknown transaction", customer(carolID), "/transactions/99/reverse", ``, http.StatusNotFound},
+		{"owner reverses the deposit", customer(aliceID), "/transactions/1/reverse", ``, http.StatusConflict},
+		{"receiver reverses part", customer(bobID), "/transactions/2/reverse", `{"amount":40}`, http.StatusOK},
+		{"sender reverses the rest", customer(aliceID), "/transactions/2/reverse", ``, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.bearer, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: POST %v got %v %v, want %v", tt.name, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+	if acc, _ := repo.GetAccount(context.Background(), bobID); acc.Balance != 0 {
+		t.Errorf("receiver balance got %v want %v", acc.Balance, 0)
+	}
+}
+
+func TestTransactionRelayAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	// relay only when flushed below
+	router := build(t, logger, repo, service.Config{Insecure: true, RelayInterval: time.Hour})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	send("POST", "/accounts", `{}`)
+	send("POST", "/accounts/deposit", `{"account_id":"1","amount":100}`)
+	send("POST", "/accounts/withdraw", `{"account_id":"1","amount":30}`)
+
+	if rr := send("GET", "/metrics", ``); !strings.Contains(rr.Body.String(), "\ntransaction_outbox_depth 2\n") {
+		t.Errorf("metrics before flush got %v", rr.Body.String())
+	}
+
+	if err := handler.NewTransactionRelay(logger, repo, nil).Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	var page repository.TransactionPage
+	rr := send("GET", "/transactions", ``)
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil || len(page.Transactions) != 2 {
+		t.Errorf("transactions after flush got %v, %v", rr.Body.String(), err)
+	}
+	if rr := send("GET", "/metrics", ``); !strings.Contains(rr.Body.String(), "\ntransaction_outbox_depth 0\n") {
+		t.Errorf("metrics after flush got %v", rr.Body.String())
+	}
+}
+
+func TestEventsAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	events := broker.NewMemoryBroker(4)
+	defer events.Close()
+	router := build(t, logger, repo, service.Config{Insecure: true, RelayInterval: time.Hour, Events: events})
+
+	send := func(method, path, body string) {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("POST", "/accounts", `{}`)
+	send("POST", "/accounts", `{}`)
+	send("POST", "/accounts/deposit", `{"account_id":"1","amount":100}`)
+	send("POST", "/accounts/transfer", `{"from_account_id":"1","to_account_id":"2","amount":40}`)
+	if err := handler.NewTransactionRelay(logger, repo, events).Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	got := make(map[string][]string)
+	seen := 0
+	err := events.Subscribe(ctx, "test", func(_ context.Context, e broker.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got[e.Key] = append(got[e.Key], e.Type)
+		if seen++; seen == 5 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	want := map[string][]string{
+		"1": {"account.created", "transaction.deposit", "transaction.transfer"},
+		"2": {"account.created", "transaction.transfer"},
+	}
+	for key, types := range want {
+		if strings.Join(got[key], ",") != strings.Join(types, ",") {
+			t.Errorf("events of account %v got %v, want %v", key, got[key], types)
+		}
+	}
+}
+
+func TestListTransactionsAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	router := build(t, logger, repo, service.Config{Insecure: true, RelayInterval: time.Hour})
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		method := "GET"
+		if body != "" {
+			method = "POST"
+		}
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	send("/accounts", `{}`)
+	send("/accounts", `{}`)
+	for i := 1; i <= 5; i++ {
+		send("/accounts/deposit", fmt.Sprintf(`{"account_id":"1","amount":%d}`, i*100))
+	}
+	send("/accounts/transfer", `{"from_account_id":"1","to_account_id":"2","amount":50}`)
+	if err := handler.NewTransactionRelay(logger, repo, nil).Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	list := func(query string) repository.TransactionPage {
+		rr := send("/transactions?"+query, "")
+		var page repository.TransactionPage
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("GET /transactions?%v got %v %v", query, rr.Code, rr.Body.String())
+		}
+		return page
+	}
+
+	// walk the deposits of account 1 newest first, two per page
+	amounts := make([]int64, 0)
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		page := list("account=1&type=deposit&order=desc&limit=2&cursor=" + cursor)
+		for _, tl := range page.Transactions {
+			amounts = append(amounts, tl.Amount)
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if fmt.Sprint(amounts) != "[500 400 300 200 100]" {
+		t.Errorf("paged deposits got %v", amounts)
+	}
+
+	if page := list("account=2"); len(page.Transactions) != 1 || page.Transactions[0].Type != repository.TransactionTransfer {
+		t.Errorf("transactions of account 2 got %+v", page)
+	}
+	if page := list("min_amount=200&max_amount=400"); len(page.Transactions) != 3 {
+		t.Errorf("transactions between 200 and 400 got %+v", page)
+	}
+	if page := list("until=2000-01-01T00:00:00Z"); len(page.Transactions) != 0 {
+		t.Errorf("transactions before 2000 got %+v", page)
+	}
+
+	for _, query := range []string{"order=up", "since=yesterday", "cursor=!!", "limit=x"} {
+		if rr := send("/transactions?"+query, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("GET /transactions?%v got %v, want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAccountTransactionsAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	router := build(t, logger, repo, service.Config{Insecure: true, RelayInterval: time.Hour})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	send("POST", "/accounts", `{}`)
+	send("POST", "/accounts", `{}`)
+	send("POST", "/accounts/deposit", `{"account_id":"1","amount":100}`)
+	send("POST", "/accounts/transfer", `{"from_account_id":"1","to_account_id":"2","amount":40}`)
+	if err := handler.NewTransactionRelay(logger, repo, nil).Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	rr := send("GET", "/accounts/1/transactions?order=desc", ``)
+	var history repository.AccountHistory
+	if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("GET /accounts/1/transactions got %v %v", rr.Code, rr.Body.String())
+	}
+	if len(history.Entries) != 2 || history.Entries[0].Balance != 60 || history.Entries[1].Balance != 100 {
+		t.Errorf("history of account 1 got %v", rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"Balance":60`) || !strings.Contains(rr.Body.String(), `"Type":"transfer"`) {
+		t.Errorf("history entries are not flat: %v", rr.Body.String())
+	}
+
+	since := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	if rr := send("GET", "/accounts/1/transactions?since="+since, ``); !strings.Contains(rr.Body.String(), `"Entries":[]`) {
+		t.Errorf("history since an hour from now got %v", rr.Body.String())
+	}
+	if rr := send("GET", "/accounts/3/transactions", ``); rr.Code != http.StatusNotFound {
+		t.Errorf("history of an unknown account got %v", rr.Code)
+	}
+}
+
+func TestStatementAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	router := build(t, logger, repo, service.Config{Insecure: true, RelayInterval: time.Hour})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	send("POST", "/accounts", `{}`)
+	send("POST", "/accounts/deposit", `{"account_id":"1","amount":100,"memo":"salary"}`)
+	send("POST", "/accounts/withdraw", `{"account_id":"1","amount":30}`)
+	if err := handler.NewTransactionRelay(logger, repo, nil).Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	rr := send("GET", "/accounts/1/statements?format=csv&from="+today+"&to="+today, ``)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("csv statement got %v %v", rr.Code, rr.Header())
+	}
+	if body := rr.Body.String(); !strings.Contains(body, ",salary,,TWD,100,100\n") || !strings.Contains(body, ",closing_balance,,,,TWD,,70\n") {
+		t.Errorf("csv statement got %v", body)
+	}
+	if !strings.Contains(rr.Header().Get("Content-Disposition"), "statement-1-"+today+".csv") {
+		t.Errorf("csv statement disposition got %v", rr.Header().Get("Content-Disposition"))
+	}
+
+	rr = send("GET", "/accounts/1/statements", ``)
+	var s struct{ OpeningBalance, ClosingBalance int64 }
+	if err := json.Unmarshal(rr.Body.Bytes(), &s); err != nil || s.ClosingBalance != 70 {
+		t.Errorf("json statement got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr := send("GET", "/accounts/1/statements?format=pdf", ``); !strings.HasPrefix(rr.Body.String(), "%PDF-") {
+		t.Errorf("pdf statement got %v %.20q", rr.Code, rr.Body.String())
+	}
+
+	for _, query := range []string{"format=xml", "from=March", "from=2024-03-02&to=2024-03-01"} {
+		if rr := send("GET", "/accounts/1/statements?"+query, ``); rr.Code != http.StatusBadRequest {
+			t.Errorf("statement ?%v got %v, want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+	if rr := send("GET", "/accounts/9/statements", ``); rr.Code != http.StatusNotFound {
+		t.Errorf("statement of unknown account got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// hs256 returns a token of claims, valid for an hour, signed with secret.
+func hs256(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	signed := enc(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." + enc(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestBuildWithoutAuth(t *testing.T) {
+	if _, err := service.Build(context.Background(), zap.NewNop(), repository.NewRepository(), service.Config{}); !errors.Is(err, service.ErrNoAuth) {
+		t.Errorf("Build() without an authenticator error = %v, want %v", err, service.ErrNoAuth)
+	}
+}
+
+func TestAuthAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	authenticator, err := auth.New(&auth.Config{
+		APIKeys: []auth.APIKeyConfig{{Name: "backoffice", Key: "k-backoffice", Roles: []string{auth.RoleAdmin}}},
+		JWT:     auth.JWTConfig{HS256Secret: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Auth: authenticator})
+
+	alice := "Bearer " + hs256(t, "secret", map[string]interface{}{"sub": "alice", "accounts": []string{"1"}})
+	send := func(method, path, body string, header ...string) int {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	backoffice := []string{auth.APIKeyHeader, "k-backoffice"}
+	customer := []string{"Authorization", alice}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		header       []string
+		want         int
+	}{
+		{"no credentials", "GET", "/accounts/1", ``, nil, http.StatusUnauthorized},
+		{"wrong key", "GET", "/accounts/1", ``, []string{auth.APIKeyHeader, "nope"}, http.StatusUnauthorized},
+		{"bad token", "GET", "/accounts/1", ``, []string{"Authorization", "Bearer x.y.z"}, http.StatusUnauthorized},
+		{"service creates", "POST", "/accounts", `{}`, backoffice, http.StatusOK},
+		{"service creates again", "POST", "/accounts", `{}`, backoffice, http.StatusOK},
+		{"customer cannot create", "POST", "/accounts", `{}`, customer, http.StatusForbidden},
+		{"customer deposits to own", "POST", "/accounts/deposit", `{"account_id":"1","amount":100}`, customer, http.StatusOK},
+		{"customer reads own", "GET", "/accounts/1", ``, customer, http.StatusOK},
+		{"customer reads other", "GET", "/accounts/2", ``, customer, http.StatusForbidden},
+		{"customer withdraws from other", "POST", "/accounts/withdraw", `{"account_id":"2","amount":1}`, customer, http.StatusForbidden},
+		{"customer transfers to other", "POST", "/accounts/transfer", `{"from_account_id":"1","to_account_id":"2","amount":10}`, customer, http.StatusOK},
+		{"customer transfers from other", "POST", "/accounts/transfer", `{"from_account_id":"2","to_account_id":"1","amount":10}`, customer, http.StatusForbidden},
+		{"customer history of other", "GET", "/accounts/2/transactions", ``, customer, http.StatusForbidden},
+		{"customer statement of other", "GET", "/accounts/2/statements", ``, customer, http.StatusForbidden},
+		{"customer global log", "GET", "/transactions", ``, customer, http.StatusForbidden},
+		{"customer journal", "GET", "/journal", ``, customer, http.StatusForbidden},
+		{"service reads any", "GET", "/accounts/2", ``, backoffice, http.StatusOK},
+		{"service global log", "GET", "/transactions", ``, backoffice, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := send(tt.method, tt.path, tt.body, tt.header...); got != tt.want {
+			t.Errorf("%v: %v %v got %v, want %v", tt.name, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRBACAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	repo.CreateAccount(context.Background())
+	authenticator, err := auth.New(&auth.Config{JWT: auth.JWTConfig{HS256Secret: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := audit.NewMemoryLog()
+	router := build(t, logger, repo, service.Config{Auth: authenticator, Audit: auditLog})
+
+	token := func(sub string, roles ...string) string {
+		return "Bearer " + hs256(t, "secret", map[string]interface{}{"sub": sub, "roles": roles})
+	}
+	send := func(bearer, method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", bearer)
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	teller, auditor, admin := token("tom", "teller"), token("ada", "auditor"), token("root", "admin")
+
+	tests := []struct {
+		name         string
+		bearer       string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"teller deposits", teller, "POST", "/accounts/deposit", `{"account_id":"1","amount":100}`, http.StatusOK},
+		{"teller reads any account", teller, "GET", "/accounts/1", ``, http.StatusOK},
+		{"teller global log", teller, "GET", "/transactions", ``, http.StatusForbidden},
+		{"auditor global log", auditor, "GET", "/transactions", ``, http.StatusOK},
+		{"auditor reads any account", auditor, "GET", "/accounts/1", ``, http.StatusOK},
+		{"auditor deposits", auditor, "POST", "/accounts/deposit", `{"account_id":"1","amount":100}`, http.StatusForbidden},
+		{"auditor reverses", auditor, "POST", "/transactions/1/reverse", ``, http.StatusForbidden},
+		{"admin journal", admin, "GET", "/journal", ``, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.bearer, tt.method, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v, want %v", tt.name, tt.method, tt.path, rr.Code, tt.want)
+		}
+	}
+	send("", "GET", "/accounts/1", ``)
+
+	// the three denials and the unauthenticated request are audited
+	var entries []audit.Entry
+	rr := send(auditor, "GET", "/audit?outcome=denied", ``)
+	if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil || len(entries) != 4 {
+		t.Fatalf("audit log got %v %v", rr.Code, rr.Body.String())
+	}
+	if e := entries[1]; e.Actor != "ada" || e.Action != auth.PermReverse || e.Resource != "/transactions/1/reverse" {
+		t.Errorf("audit entry got %+v", e)
+	}
+	if e := entries[0]; e.Actor != "" || e.Action != "authenticate" {
+		t.Errorf("unauthenticated audit entry got %+v", e)
+	}
+	if rr := send(teller, "GET", "/audit", ``); rr.Code != http.StatusForbidden {
+		t.Errorf("teller audit log got %v", rr.Code)
+	}
+}
+
+func TestCustomersAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	authenticator, err := auth.New(&auth.Config{
+		APIKeys: []auth.APIKeyConfig{
+			{Name: "backoffice", Key: "k-backoffice", Roles: []string{auth.RoleTeller}},
+			{Name: "ops", Key: "k-ops", Roles: []string{auth.RoleAdmin}},
+		},
+		JWT: auth.JWTConfig{HS256Secret: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Auth: authenticator})
+
+	send := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	backoffice := []string{auth.APIKeyHeader, "k-backoffice"}
+	createCustomer := func(body string) repository.Customer {
+		var c repository.Customer
+		rr := send("POST", "/customers", body, backoffice...)
+		if err := json.Unmarshal(rr.Body.Bytes(), &c); rr.Code != http.StatusOK || err != nil {
+			t.Fatalf("create customer got %v %v", rr.Code, rr.Body.String())
+		}
+		return c
+	}
+	alice := createCustomer(`{"name":"Alice","email":"alice@example.com","external_reference":"crm-1"}`)
+	bob := createCustomer(`{"name":"Bob"}`)
+	if rr := send("POST", "/customers", `{"name":"","email":"x"}`, backoffice...); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid customer got %v", rr.Code)
+	}
+
+	// a joint account of alice and bob, and an account of bob alone
+	var created struct{ AccountID repository.AccountID }
+	rr := send("POST", "/accounts", fmt.Sprintf(`{"holders":[{"customer_id":%q,"role":"owner"},{"customer_id":%q,"role":"holder"}]}`, alice.ID, bob.ID), backoffice...)
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("create joint account got %v %v", rr.Code, rr.Body.String())
+	}
+	joint := created.AccountID
+	rr = send("POST", "/accounts", fmt.Sprintf(`{"holders":[{"customer_id":%q,"role":"owner"}]}`, bob.ID), backoffice...)
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("create account got %v %v", rr.Code, rr.Body.String())
+	}
+	bobs := created.AccountID
+	if rr := send("POST", "/accounts", fmt.Sprintf(`{"holders":[{"customer_id":%q,"role":"holder"}]}`, bob.ID), backoffice...); rr.Code != http.StatusConflict {
+		t.Errorf("account without owner got %v", rr.Code)
+	}
+
+	var accounts []repository.AccountHolder
+	rr = send("GET", "/customers/"+string(bob.ID)+"/accounts", ``, backoffice...)
+	if err := json.Unmarshal(rr.Body.Bytes(), &accounts); err != nil || len(accounts) != 2 ||
+		accounts[0].AccountID != joint || accounts[0].Role != repository.HolderJoint || accounts[1].AccountID != bobs {
+		t.Errorf("customer accounts got %v %v", rr.Code, rr.Body.String())
+	}
+
+	// customers sign in with their customer id as subject
+	customer := []string{"Authorization", "Bearer " + hs256(t, "secret", map[string]interface{}{"sub": string(alice.ID)})}
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"deposit to joint account", "POST", "/accounts/deposit", fmt.Sprintf(`{"account_id":%q,"amount":100}`, joint), http.StatusOK},
+		{"deposit to other account", "POST", "/accounts/deposit", fmt.Sprintf(`{"account_id":%q,"amount":100}`, bobs), http.StatusForbidden},
+		{"read holders", "GET", "/accounts/" + string(joint) + "/holders", ``, http.StatusOK},
+		{"read self", "GET", "/customers/" + string(alice.ID), ``, http.StatusOK},
+		{"read own accounts", "GET", "/customers/" + string(alice.ID) + "/accounts", ``, http.StatusOK},
+		{"read other customer", "GET", "/customers/" + string(bob.ID), ``, http.StatusForbidden},
+		{"list customers", "GET", "/customers", ``, http.StatusForbidden},
+		{"add holder", "PUT", "/accounts/" + string(joint) + "/holders", fmt.Sprintf(`{"customer_id":%q,"role":"owner"}`, bob.ID), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.method, tt.path, tt.body, customer...); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v, want %v", tt.name, tt.method, tt.path, rr.Code, tt.want)
+		}
+	}
+
+	// bob takes over the joint account and alice leaves it
+	if rr := send("PUT", "/accounts/"+string(joint)+"/holders", fmt.Sprintf(`{"customer_id":%q,"role":"owner"}`, bob.ID), backoffice...); rr.Code != http.StatusOK {
+		t.Errorf("promote holder got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr := send("DELETE", "/accounts/"+string(joint)+"/holders/"+string(alice.ID), ``, backoffice...); rr.Code != http.StatusOK {
+		t.Errorf("remove holder got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr := send("GET", "/accounts/"+string(joint), ``, customer...); rr.Code != http.StatusForbidden {
+		t.Errorf("former holder reads account got %v", rr.Code)
+	}
+
+	rr = send("PUT", "/customers/"+string(alice.ID), `{"name":"Alice Liddell","email":"alice@example.org"}`, backoffice...)
+	var updated repository.Customer
+	if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil || updated.Name != "Alice Liddell" || updated.ExternalReference != "" {
+		t.Errorf("update customer got %v %v", rr.Code, rr.Body.String())
+	}
+	var found []repository.Customer
+	rr = send("GET", "/customers?email=alice@example.org", ``, backoffice...)
+	if err := json.Unmarshal(rr.Body.Bytes(), &found); err != nil || len(found) != 1 || found[0].ID != alice.ID {
+		t.Errorf("find customer got %v %v", rr.Code, rr.Body.String())
+	}
+	// only admins delete customers
+	if rr := send("DELETE", "/customers/"+string(alice.ID), ``, backoffice...); rr.Code != http.StatusForbidden {
+		t.Errorf("teller deletes customer got %v", rr.Code)
+	}
+
+	admin := []string{auth.APIKeyHeader, "k-ops"}
+	errs := []struct {
+		name         string
+		method, path string
+		want         int
+	}{
+		{"unknown customer", "GET", "/customers/nope", http.StatusNotFound},
+		{"accounts of unknown customer", "GET", "/customers/nope/accounts", http.StatusNotFound},
+		{"remove non-holder", "DELETE", "/accounts/" + string(bobs) + "/holders/" + string(alice.ID), http.StatusNotFound},
+		{"remove last owner", "DELETE", "/accounts/" + string(bobs) + "/holders/" + string(bob.ID), http.StatusConflict},
+		{"delete customer with accounts", "DELETE", "/customers/" + string(bob.ID), http.StatusConflict},
+	}
+	for _, tt := range errs {
+		if rr := send(tt.method, tt.path, ``, admin...); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestAccountStatusAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	accID, _ := repo.CreateAccount(context.Background())
+	repo.DepositAccount(context.Background(), accID, repository.Money{Amount: 100}, repository.TransactionMeta{})
+	authenticator, err := auth.New(&auth.Config{APIKeys: []auth.APIKeyConfig{
+		{Name: "ops", Key: "k-ops", Roles: []string{auth.RoleAdmin}},
+		{Name: "desk", Key: "k-desk", Roles: []string{auth.RoleTeller}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := audit.NewMemoryLog()
+	router := build(t, logger, repo, service.Config{Auth: authenticator, Audit: auditLog})
+
+	send := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(auth.APIKeyHeader, key)
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	status := "/accounts/" + string(accID) + "/status"
+
+	tests := []struct {
+		name         string
+		key          string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"teller cannot freeze", "k-desk", "PUT", status, `{"status":"frozen","reason":"fraud check"}`, http.StatusForbidden},
+		{"reason required", "k-ops", "PUT", status, `{"status":"frozen"}`, http.StatusBadRequest},
+		{"unknown status", "k-ops", "PUT", status, `{"status":"dormant","reason":"idle"}`, http.StatusBadRequest},
+		{"freeze", "k-ops", "PUT", status, `{"status":"frozen","reason":"fraud check"}`, http.StatusOK},
+		{"frozen rejects debits", "k-desk", "POST", "/accounts/withdraw", fmt.Sprintf(`{"account_id":%q,"amount":10}`, accID), http.StatusConflict},
+		{"frozen takes credits", "k-desk", "POST", "/accounts/deposit", fmt.Sprintf(`{"account_id":%q,"amount":10}`, accID), http.StatusOK},
+		{"close with balance", "k-ops", "PUT", status, `{"status":"closed","reason":"customer request"}`, http.StatusConflict},
+		{"unfreeze", "k-ops", "PUT", status, `{"status":"active","reason":"cleared"}`, http.StatusOK},
+		{"empty account", "k-desk", "POST", "/accounts/withdraw", fmt.Sprintf(`{"account_id":%q,"amount":110}`, accID), http.StatusOK},
+		{"close", "k-ops", "PUT", status, `{"status":"closed","reason":"customer request"}`, http.StatusOK},
+		{"closed rejects credits", "k-desk", "POST", "/accounts/deposit", fmt.Sprintf(`{"account_id":%q,"amount":10}`, accID), http.StatusConflict},
+		{"already closed", "k-ops", "PUT", status, `{"status":"closed","reason":"customer request"}`, http.StatusConflict},
+		{"unknown account", "k-ops", "PUT", "/accounts/nope/status", `{"status":"frozen","reason":"fraud check"}`, http.StatusNotFound},
+		{"unknown account balance", "k-desk", "GET", "/accounts/nope", ``, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.key, tt.method, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+
+	var account repository.Account
+	if rr := send("k-ops", "GET", "/accounts/"+string(accID), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil || account.Status != repository.StatusClosed {
+		t.Errorf("get account got %v", rr.Body.String())
+	}
+	changes, _ := auditLog.List(context.Background(), audit.Query{Action: auth.PermAccountsStatus, Outcome: audit.OutcomeAllowed})
+	if len(changes) != 3 {
+		t.Fatalf("audited transitions got %+v", changes)
+	}
+	// newest first
+	if e := changes[0]; e.Actor != "ops" || e.Resource != "account/"+string(accID) || e.Reason != "customer request" || e.Detail != "active -> closed" {
+		t.Errorf("audit entry got %+v", e)
+	}
+	if e := changes[2]; e.Reason != "fraud check" || e.Detail != "active -> frozen" {
+		t.Errorf("audit entry got %+v", e)
+	}
+}
+
+func TestOverdraftAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	accID, _ := repo.CreateAccount(context.Background())
+	authenticator, err := auth.New(&auth.Config{APIKeys: []auth.APIKeyConfig{
+		{Name: "ops", Key: "k-ops", Roles: []string{auth.RoleAdmin}},
+		{Name: "desk", Key: "k-desk", Roles: []string{auth.RoleTeller}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := audit.NewMemoryLog()
+	router := build(t, logger, repo, service.Config{Auth: authenticator, Audit: auditLog})
+
+	send := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(auth.APIKeyHeader, key)
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	overdraft := "/accounts/" + string(accID) + "/overdraft"
+	withdraw := fmt.Sprintf(`{"account_id":%q,"amount":300}`, accID)
+
+	tests := []struct {
+		name         string
+		key          string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"no overdraft", "k-desk", "POST", "/accounts/withdraw", withdraw, http.StatusUnprocessableEntity},
+		{"teller cannot set", "k-desk", "PUT", overdraft, `{"limit":500,"reason":"credit line"}`, http.StatusForbidden},
+		{"reason required", "k-ops", "PUT", overdraft, `{"limit":500}`, http.StatusBadRequest},
+		{"negative limit", "k-ops", "PUT", overdraft, `{"limit":-1,"reason":"credit line"}`, http.StatusBadRequest},
+		{"unknown account", "k-ops", "PUT", "/accounts/nope/overdraft", `{"limit":500,"reason":"credit line"}`, http.StatusNotFound},
+		{"set", "k-ops", "PUT", overdraft, `{"limit":500,"interest_rate":1500,"reason":"credit line"}`, http.StatusOK},
+		{"overdraw", "k-desk", "POST", "/accounts/withdraw", withdraw, http.StatusOK},
+		{"past the limit", "k-desk", "POST", "/accounts/withdraw", withdraw, http.StatusUnprocessableEntity},
+		{"lower", "k-ops", "PUT", overdraft, `{"limit":300,"interest_rate":1500,"reason":"risk review"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.key, tt.method, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+
+	var account repository.Account
+	if rr := send("k-desk", "GET", "/accounts/"+string(accID), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil ||
+		account.Balance != -300 || account.Overdraft.Limit != 300 || account.Overdraft.InterestRate != 1500 {
+		t.Errorf("get account got %v", rr.Body.String())
+	}
+	var history []repository.OverdraftChange
+	rr := send("k-desk", "GET", overdraft, ``)
+	if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil || len(history) != 2 {
+		t.Fatalf("overdraft history got %v", rr.Body.String())
+	}
+	if c := history[1]; c.Limit != 300 || c.ChangedBy != "ops" || c.Reason != "risk review" {
+		t.Errorf("overdraft change got %+v", c)
+	}
+	changes, _ := auditLog.List(context.Background(), audit.Query{Action: auth.PermOverdraftManage, Outcome: audit.OutcomeAllowed})
+	if len(changes) != 2 || changes[0].Detail != "limit 300, interest rate 1500 bps" {
+		t.Errorf("audited overdraft changes got %+v", changes)
+	}
+}
+
+func TestCurrenciesAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	twdID, _ := repo.CreateAccount(context.Background())
+	authenticator, err := auth.New(&auth.Config{APIKeys: []auth.APIKeyConfig{
+		{Name: "ops", Key: "k-ops", Roles: []string{auth.RoleAdmin}},
+		{Name: "desk", Key: "k-desk", Roles: []string{auth.RoleTeller}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := audit.NewMemoryLog()
+	router := build(t, logger, repo, service.Config{Auth: authenticator, Audit: auditLog})
+
+	send := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(auth.APIKeyHeader, key)
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	var created struct{ AccountID repository.AccountID }
+	if rr := send("k-desk", "POST", "/accounts", `{"currency":"USD"}`); rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &created) != nil {
+		t.Fatalf("create USD account got %v %v", rr.Code, rr.Body.String())
+	}
+	usdID := created.AccountID
+	transfer := fmt.Sprintf(`{"from_account_id":%q,"to_account_id":%q,"amount":1000}`, usdID, twdID)
+
+	tests := []struct {
+		name         string
+		key          string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"unknown currency", "k-desk", "POST", "/accounts", `{"currency":"XYZ"}`, http.StatusBadRequest},
+		{"deposit", "k-desk", "POST", "/accounts/deposit", fmt.Sprintf(`{"account_id":%q,"amount":5000}`, usdID), http.StatusOK},
+		{"no rate", "k-desk", "POST", "/accounts/transfer", transfer, http.StatusUnprocessableEntity},
+		{"teller cannot set", "k-desk", "PUT", "/exchange-rates", `{"from":"USD","to":"TWD","rate":"31.5","reason":"daily fixing"}`, http.StatusForbidden},
+		{"reason required", "k-ops", "PUT", "/exchange-rates", `{"from":"USD","to":"TWD","rate":"31.5"}`, http.StatusBadRequest},
+		{"invalid rate", "k-ops", "PUT", "/exchange-rates", `{"from":"USD","to":"TWD","rate":"-1","reason":"daily fixing"}`, http.StatusBadRequest},
+		{"invalid currency", "k-ops", "PUT", "/exchange-rates", `{"from":"USD","to":"XYZ","rate":"1","reason":"daily fixing"}`, http.StatusBadRequest},
+		{"set", "k-ops", "PUT", "/exchange-rates", `{"from":"USD","to":"TWD","rate":"31.5","spread":100,"reason":"daily fixing"}`, http.StatusOK},
+		{"transfer", "k-desk", "POST", "/accounts/transfer", transfer, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.key, tt.method, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+
+	var rates []repository.ExchangeRate
+	if rr := send("k-desk", "GET", "/exchange-rates", ``); json.Unmarshal(rr.Body.Bytes(), &rates) != nil || len(rates) != 1 || rates[0].Rate != "31.5" {
+		t.Errorf("list exchange rates got %v", rr.Body.String())
+	}
+	journal, _ := repo.GetJournal(context.Background())
+	for _, e := range journal {
+		if e.Type != repository.TransactionTransfer {
+			continue
+		}
+		if rr := send("k-desk", "POST", fmt.Sprintf("/transactions/%d/reverse", e.ID), ``); rr.Code != http.StatusConflict {
+			t.Errorf("reverse converted transfer got %v %v, want %v", rr.Code, rr.Body.String(), http.StatusConflict)
+		}
+	}
+	// 10 USD at 31.5 less 1% is 311.85 TWD
+	var account repository.Account
+	if rr := send("k-desk", "GET", "/accounts/"+string(twdID), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil ||
+		account.Balance != 31185 || account.Currency != repository.DefaultCurrency {
+		t.Errorf("get account got %v", rr.Body.String())
+	}
+	if rr := send("k-desk", "GET", "/accounts/"+string(usdID), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil ||
+		account.Balance != 4000 || account.Currency != "USD" {
+		t.Errorf("get account got %v", rr.Body.String())
+	}
+	changes, _ := auditLog.List(context.Background(), audit.Query{Action: auth.PermRatesManage, Outcome: audit.OutcomeAllowed})
+	if len(changes) != 1 || changes[0].Resource != "exchange-rate/USD-TWD" || changes[0].Detail != "31.5, spread 100 bps" {
+		t.Errorf("audited rate changes got %+v", changes)
+	}
+}
+
+func TestInvalidAmountsAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	accID, _ := repo.CreateAccount(context.Background())
+	otherID, _ := repo.CreateAccount(context.Background())
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	deposit := func(amount string) string {
+		return fmt.Sprintf(`{"account_id":%q,"amount":%s}`, accID, amount)
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"negative deposit", "POST", "/accounts/deposit", deposit("-100"), http.StatusBadRequest},
+		{"zero deposit", "POST", "/accounts/deposit", deposit("0"), http.StatusBadRequest},
+		{"too large deposit", "POST", "/accounts/deposit", deposit("1000000000000001"), http.StatusBadRequest},
+		{"fractional deposit", "POST", "/accounts/deposit", deposit("1.5"), http.StatusBadRequest},
+		{"past int64", "POST", "/accounts/deposit", deposit("9223372036854775808"), http.StatusBadRequest},
+		{"unknown currency", "POST", "/accounts/deposit", fmt.Sprintf(`{"account_id":%q,"amount":100,"currency":"XYZ"}`, accID), http.StatusBadRequest},
+		{"other currency", "POST", "/accounts/deposit", fmt.Sprintf(`{"account_id":%q,"amount":100,"currency":"USD"}`, accID), http.StatusBadRequest},
+		{"deposit", "POST", "/accounts/deposit", fmt.Sprintf(`{"account_id":%q,"amount":100,"currency":"TWD"}`, accID), http.StatusOK},
+		{"negative withdrawal", "POST", "/accounts/withdraw", deposit("-100"), http.StatusBadRequest},
+		{"zero transfer", "POST", "/accounts/transfer", fmt.Sprintf(`{"from_account_id":%q,"to_account_id":%q,"amount":0}`, accID, otherID), http.StatusBadRequest},
+		{"transfer", "POST", "/accounts/transfer", fmt.Sprintf(`{"from_account_id":%q,"to_account_id":%q,"amount":40}`, accID, otherID), http.StatusOK},
+		{"negative reversal", "POST", "/transactions/2/reverse", `{"amount":-10}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.method, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+	if acc, _ := repo.GetAccount(context.Background(), accID); acc.Balance != 60 {
+		t.Errorf("balance got %v, want 60", acc.Balance)
+	}
+}
+
+func TestHoldsAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	buyerID, _ := repo.CreateAccount(context.Background())
+	shopID, _ := repo.CreateAccount(context.Background())
+	if _, err := repo.DepositAccount(context.Background(), buyerID, repository.Money{Amount: 1000}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	place := func(amount int) string {
+		return fmt.Sprintf(`{"account_id":%q,"to_account_id":%q,"amount":%d,"reference":"order-1"}`, buyerID, shopID, amount)
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"zero hold", "POST", "/holds", place(0), http.StatusBadRequest},
+		{"past expiry", "POST", "/holds", fmt.Sprintf(`{"account_id":%q,"to_account_id":%q,"amount":100,"expires_at":"2020-01-01T00:00:00Z"}`, buyerID, shopID), http.StatusBadRequest},
+		{"more than balance", "POST", "/holds", place(1001), http.StatusUnprocessableEntity},
+		{"place", "POST", "/holds", place(600), http.StatusOK},
+		{"place second", "POST", "/holds", place(300), http.StatusOK},
+		{"withdraw held funds", "POST", "/accounts/withdraw", fmt.Sprintf(`{"account_id":%q,"amount":200}`, buyerID), http.StatusUnprocessableEntity},
+		{"capture too much", "POST", "/holds/1/capture", `{"amount":700}`, http.StatusUnprocessableEntity},
+		{"capture part", "POST", "/holds/1/capture", `{"amount":450}`, http.StatusOK},
+		{"capture twice", "POST", "/holds/1/capture", ``, http.StatusConflict},
+		{"release", "POST", "/holds/2/release", ``, http.StatusOK},
+		{"release twice", "POST", "/holds/2/release", ``, http.StatusConflict},
+		{"unknown hold", "GET", "/holds/9", ``, http.StatusNotFound},
+		{"release unknown hold", "POST", "/holds/9/release", ``, http.StatusNotFound},
+		{"withdraw", "POST", "/accounts/withdraw", fmt.Sprintf(`{"account_id":%q,"amount":200}`, buyerID), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.method, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+
+	var hold repository.Hold
+	if rr := send("GET", "/holds/1", ``); json.Unmarshal(rr.Body.Bytes(), &hold) != nil ||
+		hold.Status != repository.HoldCaptured || hold.Captured != 450 || hold.TransactionID == 0 {
+		t.Errorf("get hold got %v", rr.Body.String())
+	}
+	var holds []repository.Hold
+	if rr := send("GET", "/accounts/"+string(buyerID)+"/holds", ``); json.Unmarshal(rr.Body.Bytes(), &holds) != nil ||
+		len(holds) != 2 || holds[1].Status != repository.HoldReleased {
+		t.Errorf("account holds got %v", rr.Body.String())
+	}
+	if rr := send("POST", "/holds", place(100)); rr.Code != http.StatusOK {
+		t.Fatalf("place got %v %v", rr.Code, rr.Body.String())
+	}
+	// 1000 less 450 captured and 200 withdrawn, of which 100 is held
+	var account repository.Account
+	if rr := send("GET", "/accounts/"+string(buyerID), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil ||
+		account.Balance != 350 || account.Held != 100 || account.Available != 250 {
+		t.Errorf("get account got %v", rr.Body.String())
+	}
+	if rr := send("GET", "/accounts/"+string(shopID), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil || account.Balance != 450 {
+		t.Errorf("get shop account got %v", rr.Body.String())
+	}
+}
+
+func TestHoldOwnershipAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	aliceID, _ := repo.CreateAccount(context.Background())
+	bobID, _ := repo.CreateAccount(context.Background())
+	if _, err := repo.DepositAccount(context.Background(), aliceID, repository.Money{Amount: 1000}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.PlaceHold(context.Background(), aliceID, bobID, repository.Money{Amount: 100}, time.Time{}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := auth.New(&auth.Config{JWT: auth.JWTConfig{HS256Secret: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// customers may manage the holds on their own accounts only
+	policy, err := auth.NewPolicy(auth.PolicyConfig{Roles: map[string][]string{
+		auth.RoleCustomer: {auth.PermAccountsRead + auth.OwnSuffix, auth.PermHoldsManage + auth.OwnSuffix},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Auth: authenticator, Policy: policy})
+
+	customer := func(account repository.AccountID) string {
+		return "Bearer " + hs256(t, "secret", map[string]interface{}{"sub": "c-" + string(account), "accounts": []repository.AccountID{account}})
+	}
+	send := func(bearer, method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(``))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", bearer)
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name         string
+		bearer       string
+		method, path string
+		want         int
+	}{
+		{"payee captures", customer(bobID), "POST", "/holds/1/capture", http.StatusForbidden},
+		{"payee releases", customer(bobID), "POST", "/holds/1/release", http.StatusForbidden},
+		{"payee reads", customer(bobID), "GET", "/holds/1", http.StatusForbidden},
+		{"owner releases", customer(aliceID), "POST", "/holds/1/release", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.bearer, tt.method, tt.path); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestIdempotentCaptureAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	buyerID, _ := repo.CreateAccount(context.Background())
+	shopID, _ := repo.CreateAccount(context.Background())
+	if _, err := repo.DepositAccount(context.Background(), buyerID, repository.Money{Amount: 1000}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	send := func(method, path, body, key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	place := fmt.Sprintf(`{"account_id":%q,"to_account_id":%q,"amount":100}`, buyerID, shopID)
+	send("POST", "/holds", place, "")
+	send("POST", "/holds", place, "")
+
+	first := send("POST", "/holds/1/capture", ``, "capture-1")
+	if retry := send("POST", "/holds/1/capture", ``, "capture-1"); first.Code != http.StatusOK || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("capture and retry got %v %v, %v %q", first.Code, first.Body.String(), retry.Code, retry.Header().Get("Idempotent-Replayed"))
+	}
+	// the key of hold 1 does not capture hold 2
+	if rr := send("POST", "/holds/2/capture", ``, "capture-1"); rr.Code != http.StatusUnprocessableEntity || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("key reused on another hold got %v %v, want %v", rr.Code, rr.Body.String(), http.StatusUnprocessableEntity)
+	}
+	if rr := send("POST", "/holds/2/capture", ``, "capture-2"); rr.Code != http.StatusOK {
+		t.Errorf("capture of hold 2 got %v %v", rr.Code, rr.Body.String())
+	}
+	if shop, _ := repo.GetAccount(context.Background(), shopID); shop.Balance != 200 {
+		t.Errorf("shop balance after two captures got %v want %v", shop.Balance, 200)
+	}
+}
+
+func TestEscrowsAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	buyerID, _ := repo.CreateAccount(context.Background())
+	shopID, _ := repo.CreateAccount(context.Background())
+	if _, err := repo.DepositAccount(context.Background(), buyerID, repository.Money{Amount: 1000}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	open := func(order string, amount int) string {
+		return fmt.Sprintf(`{"order_id":%q,"buyer_account_id":%q,"merchant_account_id":%q,"amount":%d}`, order, buyerID, shopID, amount)
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"no order", "POST", "/escrows", open("", 100), http.StatusBadRequest},
+		{"zero amount", "POST", "/escrows", open("order-1", 0), http.StatusBadRequest},
+		{"past release", "POST", "/escrows", fmt.Sprintf(`{"order_id":"order-1","buyer_account_id":%q,"merchant_account_id":%q,"amount":100,"release_at":"2020-01-01T00:00:00Z"}`, buyerID, shopID), http.StatusBadRequest},
+		{"more than balance", "POST", "/escrows", open("order-1", 1001), http.StatusUnprocessableEntity},
+		{"open", "POST", "/escrows", open("order-1", 600), http.StatusOK},
+		{"open twice", "POST", "/escrows", open("order-1", 100), http.StatusConflict},
+		{"open second", "POST", "/escrows", open("order-2", 300), http.StatusOK},
+		{"release", "POST", "/escrows/order-1/release", ``, http.StatusOK},
+		{"refund released", "POST", "/escrows/order-1/refund", ``, http.StatusConflict},
+		{"release released", "POST", "/escrows/order-1/release", ``, http.StatusConflict},
+		{"refund", "POST", "/escrows/order-2/refund", ``, http.StatusOK},
+		{"unknown order", "GET", "/escrows/order-9", ``, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.method, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+
+	var escrow repository.Escrow
+	if rr := send("GET", "/escrows/order-1", ``); json.Unmarshal(rr.Body.Bytes(), &escrow) != nil ||
+		escrow.Status != repository.EscrowReleased || escrow.Amount != 600 || escrow.SettlementID == 0 {
+		t.Errorf("get escrow got %v", rr.Body.String())
+	}
+	var escrows []repository.Escrow
+	if rr := send("GET", "/accounts/"+string(shopID)+"/escrows", ``); json.Unmarshal(rr.Body.Bytes(), &escrows) != nil ||
+		len(escrows) != 2 || escrows[1].Status != repository.EscrowRefunded {
+		t.Errorf("account escrows got %v", rr.Body.String())
+	}
+	var account repository.Account
+	if rr := send("GET", "/accounts/"+string(buyerID), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil || account.Balance != 400 {
+		t.Errorf("get buyer account got %v", rr.Body.String())
+	}
+	if rr := send("GET", "/accounts/"+string(shopID), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil || account.Balance != 600 {
+		t.Errorf("get merchant account got %v", rr.Body.String())
+	}
+	if rr := send("GET", "/ledger/check", ``); rr.Code != http.StatusOK {
+		t.Errorf("ledger check got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestEscrowVisibilityAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	buyerID, _ := repo.CreateAccount(context.Background())
+	shopID, _ := repo.CreateAccount(context.Background())
+	otherID, _ := repo.CreateAccount(context.Background())
+	if _, err := repo.DepositAccount(context.Background(), buyerID, repository.Money{Amount: 1000}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.OpenEscrow(context.Background(), "order-1", buyerID, shopID, repository.Money{Amount: 100}, time.Time{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := auth.New(&auth.Config{JWT: auth.JWTConfig{HS256Secret: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// customers may settle the escrows they are party to
+	policy, err := auth.NewPolicy(auth.PolicyConfig{Roles: map[string][]string{
+		auth.RoleCustomer: {auth.PermAccountsRead + auth.OwnSuffix, auth.PermEscrowSettle + auth.OwnSuffix},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Auth: authenticator, Policy: policy})
+
+	customer := func(account repository.AccountID) string {
+		return "Bearer " + hs256(t, "secret", map[string]interface{}{"sub": "c-" + string(account), "accounts": []repository.AccountID{account}})
+	}
+	send := func(bearer, method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(``))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", bearer)
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send(customer(buyerID), "GET", "/escrows/order-1"); rr.Code != http.StatusOK {
+		t.Errorf("buyer got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr := send(customer(shopID), "GET", "/escrows/order-1"); rr.Code != http.StatusOK {
+		t.Errorf("merchant got %v %v", rr.Code, rr.Body.String())
+	}
+	// a stranger cannot tell the order from one that does not exist
+	stranger := send(customer(otherID), "GET", "/escrows/order-1")
+	unknown := send(customer(otherID), "GET", "/escrows/order-9")
+	if stranger.Code != http.StatusNotFound || stranger.Code != unknown.Code || stranger.Body.String() != unknown.Body.String() {
+		t.Errorf("stranger got %v %v, unknown order got %v %v", stranger.Code, stranger.Body.String(), unknown.Code, unknown.Body.String())
+	}
+	if rr := send(customer(otherID), "POST", "/escrows/order-1/refund"); rr.Code != http.StatusNotFound {
+		t.Errorf("stranger refund got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr := send(customer(shopID), "POST", "/escrows/order-1/release"); rr.Code != http.StatusOK {
+		t.Errorf("merchant release got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSplitTransferAPI(t *testing.T) {
+	logger := zap.NewNop()
+	repo := repository.NewRepository()
+	buyerID, _ := repo.CreateAccount(context.Background())
+	shopID, _ := repo.CreateAccount(context.Background())
+	platformID, _ := repo.CreateAccount(context.Background())
+	shippingID, _ := repo.CreateAccount(context.Background())
+	if _, err := repo.DepositAccount(context.Background(), buyerID, repository.Money{Amount: 1000}, repository.TransactionMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	router := build(t, logger, repo, service.Config{Insecure: true})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.Handler.ServeHTTP(rr, req)
+		return rr
+	}
+	fees := "/accounts/" + string(shopID) + "/fees"
+	split := func(shop, shipping int) string {
+		return fmt.Sprintf(`{"from_account_id":%q,"legs":[{"to_account_id":%q,"amount":%d},{"to_account_id":%q,"amount":%d}],"reference":"order-1"}`,
+			buyerID, shopID, shop, shippingID, shipping)
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		want         int
+	}{
+		{"fees without reason", "PUT", fees, fmt.Sprintf(`{"rules":[{"name":"commission","to_account_id":%q,"rate":1000}]}`, platformID), http.StatusBadRequest},
+		{"invalid fee", "PUT", fees, fmt.Sprintf(`{"rules":[{"name":"commission","to_account_id":%q,"rate":10001}],"reason":"contract"}`, platformID), http.StatusBadRequest},
+		{"set fees", "PUT", fees, fmt.Sprintf(`{"rules":[{"name":"commission","to_account_id":%q,"rate":1000,"fixed":20}],"reason":"contract"}`, platformID), http.StatusOK},
+		{"no legs", "POST", "/accounts/split-transfer", fmt.Sprintf(`{"from_account_id":%q,"legs":[]}`, buyerID), http.StatusBadRequest},
+		{"zero leg", "POST", "/accounts/split-transfer", split(0, 100), http.StatusBadRequest},
+		{"fees over the leg", "POST", "/accounts/split-transfer", split(10, 100), http.StatusBadRequest},
+		{"more than balance", "POST", "/accounts/split-transfer", split(900, 101), http.StatusUnprocessableEntity},
+		{"split", "POST", "/accounts/split-transfer", split(600, 100), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rr := send(tt.method, tt.path, tt.body); rr.Code != tt.want {
+			t.Errorf("%v: %v %v got %v %v, want %v", tt.name, tt.method, tt.path, rr.Code, rr.Body.String(), tt.want)
+		}
+	}
+
+	var schedule repository.FeeSchedule
+	if rr := send("GET", fees, ``); json.Unmarshal(rr.Body.Bytes(), &schedule) != nil ||
+		len(schedule.Rules) != 1 || schedule.Rules[0].To != platformID || schedule.Rules[0].Fixed != 20 {
+		t.Errorf("get fees got %v", rr.Body.String())
+	}
+	for id, want := range map[repository.AccountID]int64{buyerID: 300, shopID: 520, platformID: 80, shippingID: 100} {
+		var account repository.Account
+		if rr := send("GET", "/accounts/"+string(id), ``); json.Unmarshal(rr.Body.Bytes(), &account) != nil || account.Balance != want {
+			t.Errorf("get account %v got %v, want balance %v", id, rr.Body.String(), want)
+		}
+	}
+	if rr := send("GET", "/ledger/check", ``); rr.Code != http.StatusOK {
+		t.Errorf("ledger check got %v %v", rr.Code, rr.Body.String())
+	}
 }
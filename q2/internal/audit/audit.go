@@ -0,0 +1,157 @@
+// Package audit records security-relevant actions: denied requests and
+// changes made by staff.
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes of an entry.
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+)
+
+// Entry is one audited action. Actor is empty for unauthenticated requests.
+type Entry struct {
+	ID         int64
+	Time       time.Time
+	Actor      string
+	AuthMethod string   `json:",omitempty"`
+	Roles      []string `json:",omitempty"`
+	Action     string
+	Resource   string
+	Outcome    string
+	Reason     string `json:",omitempty"`
+	// Detail describes the change an allowed action made
+	Detail     string `json:",omitempty"`
+	RemoteAddr string `json:",omitempty"`
+}
+
+// Query selects entries of the log, newest first. Zero fields do not filter.
+type Query struct {
+	Actor   string
+	Action  string
+	Outcome string
+	// Limit is 100 if not positive
+	Limit int
+}
+
+// Log is an append-only audit log.
+type Log interface {
+	// Record appends e, setting its ID and, if zero, its Time.
+	Record(ctx context.Context, e Entry) error
+	List(ctx context.Context, q Query) ([]Entry, error)
+}
+
+var _ Log = (*MemoryLog)(nil)
+
+// MemoryLog keeps the audit log in memory.
+type MemoryLog struct {
+	entries []Entry
+	// file is nil for a purely in-memory log
+	file *os.File
+	rw   sync.RWMutex
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{entries: make([]Entry, 0)}
+}
+
+// OpenFileLog opens or creates the audit log at path, a file of JSON lines
+// fsync'd on every entry. A torn last line left by a crash is truncated.
+func OpenFileLog(path string) (*MemoryLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &MemoryLog{entries: make([]Entry, 0), file: f}
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				if err := f.Truncate(offset); err != nil {
+					f.Close()
+					return nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s is corrupted at offset %d", path, offset)
+		}
+		l.entries = append(l.entries, e)
+		offset += int64(len(line))
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *MemoryLog) Record(ctx context.Context, e Entry) error {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	e.ID = int64(len(l.entries) + 1)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if l.file != nil {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := l.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+func (l *MemoryLog) List(ctx context.Context, q Query) ([]Entry, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	l.rw.RLock()
+	defer l.rw.RUnlock()
+	entries := make([]Entry, 0)
+	for i := len(l.entries) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := l.entries[i]
+		if (q.Actor == "" || e.Actor == q.Actor) && (q.Action == "" || e.Action == q.Action) && (q.Outcome == "" || e.Outcome == q.Outcome) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// Close closes the file of the log, if any.
+func (l *MemoryLog) Close() error {
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
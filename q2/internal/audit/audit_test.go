@@ -0,0 +1,43 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenFileLog(path)
+	if err != nil {
+		t.Fatalf("OpenFileLog() error = %v", err)
+	}
+	_ = l.Record(ctx, Entry{Actor: "alice", Action: "accounts.read", Outcome: OutcomeDenied})
+	_ = l.Record(ctx, Entry{Actor: "bob", Action: "accounts.freeze", Outcome: OutcomeAllowed, Reason: "fraud"})
+	l.Close()
+
+	// a crash left half an entry behind
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"ID":3,"Act`)
+	f.Close()
+
+	l, err = OpenFileLog(path)
+	if err != nil {
+		t.Fatalf("OpenFileLog() reopen error = %v", err)
+	}
+	defer l.Close()
+	_ = l.Record(ctx, Entry{Actor: "alice", Action: "journal.read", Outcome: OutcomeDenied})
+
+	entries, _ := l.List(ctx, Query{})
+	if len(entries) != 3 || entries[0].ID != 3 || entries[2].Actor != "alice" || entries[1].Reason != "fraud" || entries[0].Time.IsZero() {
+		t.Errorf("List() got = %+v", entries)
+	}
+	if entries, _ := l.List(ctx, Query{Actor: "alice", Limit: 1}); len(entries) != 1 || entries[0].Action != "journal.read" {
+		t.Errorf("List() of alice got = %+v", entries)
+	}
+	if entries, _ := l.List(ctx, Query{Outcome: OutcomeAllowed}); len(entries) != 1 || entries[0].Actor != "bob" {
+		t.Errorf("List() allowed got = %+v", entries)
+	}
+}
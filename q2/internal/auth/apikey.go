@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+// APIKeys authenticates services by the X-API-Key header.
+type APIKeys struct {
+	keys []apiKey
+}
+
+type apiKey struct {
+	sum   [sha256.Size]byte
+	name  string
+	roles []string
+}
+
+// NewAPIKeys returns an authenticator of the configured keys. A key without
+// roles may do nothing.
+func NewAPIKeys(keys []APIKeyConfig) *APIKeys {
+	a := &APIKeys{keys: make([]apiKey, 0, len(keys))}
+	for _, k := range keys {
+		a.keys = append(a.keys, apiKey{sum: sha256.Sum256([]byte(k.Key)), name: k.Name, roles: k.Roles})
+	}
+	return a
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	// compare digests in constant time so timing does not leak the keys
+	sum := sha256.Sum256([]byte(key))
+	var found *apiKey
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare(sum[:], a.keys[i].sum[:]) == 1 {
+			found = &a.keys[i]
+		}
+	}
+	if found == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Subject: found.name, Method: MethodAPIKey, Roles: found.roles}, nil
+}
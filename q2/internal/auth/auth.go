@@ -0,0 +1,90 @@
+// Package auth authenticates API callers with API keys or JWTs and decides
+// which accounts and customers they may act on.
+package auth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+)
+
+var (
+	// ErrNoCredentials means the request carries no credentials an
+	// Authenticator understands, so the next one may try.
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrForbidden          = errors.New("forbidden")
+)
+
+// Roles of the default policy. API keys have the roles they are configured
+// with; JWT users are customers unless their token has roles.
+const (
+	RoleCustomer = "customer"
+	RoleAdmin    = "admin"
+)
+
+// Authentication methods of a Principal.
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// Subject is the API key name or the JWT subject, which is the customer
+	// id of customers
+	Subject string
+	Method  string
+	Roles   []string
+	// Accounts are the accounts the token of a customer names besides the
+	// ones the customer holds
+	Accounts []repository.AccountID
+}
+
+// CustomerID returns the customer p is, or "" for API keys.
+func (p *Principal) CustomerID() repository.CustomerID {
+	if p.Method != MethodJWT {
+		return ""
+	}
+	return repository.CustomerID(p.Subject)
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Owns reports whether the token of p names account id.
+func (p *Principal) Owns(id repository.AccountID) bool {
+	for _, owned := range p.Accounts {
+		if owned == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator finds the caller of a request. It returns ErrNoCredentials if
+// the request has none of the credentials it checks.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Chain tries every authenticator in turn until one finds credentials.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrNoCredentials
+}
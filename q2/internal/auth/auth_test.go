@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+// sign returns a JWT of claims with header, signed by key: a []byte HS256
+// secret or an RSA private key.
+func sign(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(header) + "." + enc(claims)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func claims(extra map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"sub": "alice",
+		"iss": "login",
+		"aud": []string{"bank"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		c[k] = v
+	}
+	return c
+}
+
+func bearer(token string) *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	pubPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	j, err := NewJWT(JWTConfig{
+		Issuer:      "login",
+		Audience:    "bank",
+		HS256Secret: testSecret,
+		RS256Keys:   map[string]string{"k1": pubPEM},
+		Leeway:      Duration(time.Second),
+	})
+	if err != nil {
+		t.Fatalf("NewJWT() error = %v", err)
+	}
+
+	hs := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rs := map[string]interface{}{"alg": "RS256", "kid": "k1"}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"hs256", sign(t, hs, claims(map[string]interface{}{"accounts": []string{"1"}}), []byte(testSecret)), true},
+		{"rs256", sign(t, rs, claims(nil), rsaKey), true},
+		{"rs256 without kid", sign(t, map[string]interface{}{"alg": "RS256"}, claims(nil), rsaKey), true},
+		{"audience string", sign(t, hs, claims(map[string]interface{}{"aud": "bank"}), []byte(testSecret)), true},
+		{"wrong secret", sign(t, hs, claims(nil), []byte("other")), false},
+		{"unknown kid", sign(t, map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims(nil), rsaKey), false},
+		// the public key must not verify an HS256 token
+		{"alg confusion", sign(t, hs, claims(nil), []byte(pubPEM)), false},
+		{"alg none", sign(t, map[string]interface{}{"alg": "none"}, claims(nil), []byte{}), false},
+		{"expired", sign(t, hs, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}), []byte(testSecret)), false},
+		{"no exp", sign(t, hs, claims(map[string]interface{}{"exp": 0}), []byte(testSecret)), false},
+		{"not yet", sign(t, hs, claims(map[string]interface{}{"nbf": time.Now().Add(time.Minute).Unix()}), []byte(testSecret)), false},
+		{"wrong issuer", sign(t, hs, claims(map[string]interface{}{"iss": "evil"}), []byte(testSecret)), false},
+		{"wrong audience", sign(t, hs, claims(map[string]interface{}{"aud": "shop"}), []byte(testSecret)), false},
+		{"no subject", sign(t, hs, claims(map[string]interface{}{"sub": ""}), []byte(testSecret)), false},
+		{"malformed", "a.b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := j.Authenticate(bearer(tt.token))
+			if tt.ok && (err != nil || p.Subject != "alice" || p.Method != MethodJWT) {
+				t.Errorf("Authenticate() got = %+v, %v", p, err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Authenticate() error = %v, want %v", err, ErrInvalidCredentials)
+			}
+		})
+	}
+
+	p, _ := j.Authenticate(bearer(tests[0].token))
+	if !p.HasRole(RoleCustomer) || !p.Owns("1") || p.Owns("2") {
+		t.Errorf("customer principal got = %+v", p)
+	}
+	p, _ = j.Authenticate(bearer(sign(t, hs, claims(map[string]interface{}{"roles": []string{"admin"}}), []byte(testSecret))))
+	if p.HasRole(RoleCustomer) || !p.HasRole(RoleAdmin) {
+		t.Errorf("admin principal got = %+v", p)
+	}
+}
+
+func TestChain(t *testing.T) {
+	a, err := New(&Config{
+		APIKeys: []APIKeyConfig{{Name: "billing", Key: "k-billing", Roles: []string{RoleAdmin}}},
+		JWT:     JWTConfig{HS256Secret: testSecret},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("Authenticate() without credentials error = %v, want %v", err, ErrNoCredentials)
+	}
+	r.Header.Set(APIKeyHeader, "k-billing")
+	if p, err := a.Authenticate(r); err != nil || p.Subject != "billing" || p.Method != MethodAPIKey || !p.HasRole(RoleAdmin) {
+		t.Errorf("Authenticate() api key got = %+v, %v", p, err)
+	}
+	r.Header.Set(APIKeyHeader, "k-wrong")
+	if _, err := a.Authenticate(r); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate() wrong api key error = %v, want %v", err, ErrInvalidCredentials)
+	}
+	if p, err := a.Authenticate(bearer(sign(t, map[string]interface{}{"alg": "HS256"}, claims(nil), []byte(testSecret)))); err != nil || p.Subject != "alice" {
+		t.Errorf("Authenticate() jwt got = %+v, %v", p, err)
+	}
+
+	if _, err := New(&Config{}); err == nil {
+		t.Errorf("New() without keys got nil error")
+	}
+	if _, err := New(&Config{APIKeys: []APIKeyConfig{{Name: "billing", Key: "k-billing"}}}); err == nil {
+		t.Errorf("New() with an api key without roles got nil error")
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is the auth configuration file, for example
+//
+//	{
+//	  "api_keys": [{"name": "billing", "key": "s3cret", "roles": ["admin"]}],
+//	  "jwt": {
+//	    "issuer": "https://login.example.com",
+//	    "audience": "bank",
+//	    "hs256_secret": "...",
+//	    "rs256_keys": {"2024-01": "-----BEGIN PUBLIC KEY-----\n..."},
+//	    "leeway": "30s"
+//	  }
+//	}
+type Config struct {
+	APIKeys []APIKeyConfig `json:"api_keys"`
+	JWT     JWTConfig      `json:"jwt"`
+}
+
+type APIKeyConfig struct {
+	Name  string   `json:"name"`
+	Key   string   `json:"key"`
+	Roles []string `json:"roles"`
+}
+
+type JWTConfig struct {
+	Issuer      string `json:"issuer"`
+	Audience    string `json:"audience"`
+	HS256Secret string `json:"hs256_secret"`
+	// RS256Keys are PEM public keys by the key id of the token header
+	RS256Keys map[string]string `json:"rs256_keys"`
+	// Leeway tolerates clock skew when checking exp and nbf
+	Leeway Duration `json:"leeway"`
+}
+
+// Duration is a time.Duration written like "30s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+// LoadConfig reads the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// New returns the authenticator of cfg: API keys first, then JWTs.
+func New(cfg *Config) (Authenticator, error) {
+	chain := Chain{}
+	if len(cfg.APIKeys) > 0 {
+		for _, k := range cfg.APIKeys {
+			if k.Name == "" || k.Key == "" {
+				return nil, errors.New("api keys need a name and a key")
+			}
+			// a forgotten role list must not grant everything
+			if len(k.Roles) == 0 {
+				return nil, fmt.Errorf("api key %s has no roles", k.Name)
+			}
+		}
+		chain = append(chain, NewAPIKeys(cfg.APIKeys))
+	}
+	if cfg.JWT.HS256Secret != "" || len(cfg.JWT.RS256Keys) > 0 {
+		j, err := NewJWT(cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, j)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("auth config has no api keys or jwt keys")
+	}
+	return chain, nil
+}
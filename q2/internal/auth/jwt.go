@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+)
+
+// JWTs are signed with one of these algorithms.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+// Claims are the JWT claims the service reads.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	Roles     []string `json:"roles"`
+	// Accounts are the accounts the subject owns
+	Accounts []repository.AccountID `json:"accounts"`
+}
+
+// audience is a JWT aud claim, a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// JWT authenticates users by a bearer token signed with HS256 or RS256.
+// Tokens must expire, and their issuer and audience are checked when
+// configured.
+type JWT struct {
+	secret []byte
+	// rsaKeys are the RS256 public keys by key id
+	rsaKeys  map[string]*rsa.PublicKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+// NewJWT returns an authenticator of the configured keys.
+func NewJWT(cfg JWTConfig) (*JWT, error) {
+	j := &JWT{
+		rsaKeys:  make(map[string]*rsa.PublicKey),
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		leeway:   time.Duration(cfg.Leeway),
+		now:      time.Now,
+	}
+	if cfg.HS256Secret != "" {
+		j.secret = []byte(cfg.HS256Secret)
+	}
+	for kid, key := range cfg.RS256Keys {
+		pub, err := parseRSAPublicKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("rs256 key %q: %w", kid, err)
+		}
+		j.rsaKeys[kid] = pub
+	}
+	return j, nil
+}
+
+func parseRSAPublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("not a PEM block")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return pub, nil
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	claims, err := j.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	roles := claims.Roles
+	if len(roles) == 0 {
+		roles = []string{RoleCustomer}
+	}
+	return &Principal{Subject: claims.Subject, Method: MethodJWT, Roles: roles, Accounts: claims.Accounts}, nil
+}
+
+// Verify checks the signature and the time, issuer and audience claims of
+// token and returns its claims. Every failure is ErrInvalidCredentials.
+func (j *JWT) Verify(token string) (*Claims, error) {
+	claims, err := j.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return claims, nil
+}
+
+func (j *JWT) verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	// the key decides the algorithm, so an RS256 public key is never used as
+	// an HS256 secret
+	switch header.Alg {
+	case AlgHS256:
+		if j.secret == nil {
+			return nil, errors.New("HS256 is not configured")
+		}
+		mac := hmac.New(sha256.New, j.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errors.New("bad signature")
+		}
+	case AlgRS256:
+		if err := j.verifyRS256(header.Kid, signed, sig); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+	now := j.now()
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("token does not expire")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(j.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(j.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	if j.audience != "" && !claims.Audience.contains(j.audience) {
+		return nil, errors.New("wrong audience")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+func (j *JWT) verifyRS256(kid string, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	if kid != "" {
+		key, ok := j.rsaKeys[kid]
+		if !ok {
+			return fmt.Errorf("unknown key id %q", kid)
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	}
+	for _, key := range j.rsaKeys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("bad signature")
+}
+
+func (a audience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Yougigun/meepshop_q2/internal/audit"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	principalKey = "auth.principal"
+	grantKey     = "auth.grant"
+)
+
+// Middleware authenticates every request with a, answering 401 to requests
+// without valid credentials and recording them in log.
+func Middleware(logger *zap.Logger, a Authenticator, log audit.Log) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p, err := a.Authenticate(ctx.Request)
+		if err != nil {
+			if !errors.Is(err, ErrNoCredentials) {
+				// the reason stays in the log
+				logger.Info("authentication failed", zap.String("path", ctx.FullPath()), zap.Error(err))
+			}
+			record(ctx, logger, log, "authenticate", ctx.Request.URL.Path, err.Error())
+			if errors.Is(err, ErrNoCredentials) {
+				ctx.AbortWithStatusJSON(401, err.Error())
+			} else {
+				ctx.AbortWithStatusJSON(401, ErrInvalidCredentials.Error())
+			}
+			return
+		}
+		ctx.Set(principalKey, p)
+		ctx.Next()
+	}
+}
+
+// FromContext returns the caller of the request, or nil when it has none.
+func FromContext(ctx *gin.Context) *Principal {
+	if v, ok := ctx.Get(principalKey); ok {
+		return v.(*Principal)
+	}
+	return nil
+}
+
+// Holders looks up the customers holding an account.
+type Holders interface {
+	GetAccountHolders(ctx context.Context, id repository.AccountID) ([]repository.AccountHolder, error)
+}
+
+// Enforcer checks the permissions of callers against a policy and records
+// denials in the audit log.
+type Enforcer struct {
+	logger  *zap.Logger
+	policy  *Policy
+	log     audit.Log
+	holders Holders
+}
+
+// NewEnforcer returns an enforcer of policy. Customers own the accounts they
+// hold in holders, which may be nil, and the accounts their token names.
+func NewEnforcer(logger *zap.Logger, policy *Policy, log audit.Log, holders Holders) *Enforcer {
+	return &Enforcer{logger: logger, policy: policy, log: log, holders: holders}
+}
+
+// grant is the permission a request was let through with.
+type grant struct {
+	perm     string
+	own      bool
+	enforcer *Enforcer
+}
+
+// Require answers 403 unless the caller has perm. A caller with perm only on
+// its own accounts gets through, and the handler checks the account with
+// AllowAccount. Requests without a caller are answered 401, so a route
+// reached without Middleware is closed rather than open.
+func (e *Enforcer) Require(perm string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p := FromContext(ctx)
+		if p == nil {
+			record(ctx, e.logger, e.log, perm, ctx.Request.URL.Path, "no caller")
+			ctx.AbortWithStatusJSON(401, ErrNoCredentials.Error())
+			return
+		}
+		s := e.policy.scope(p, perm)
+		if s == scopeNone {
+			record(ctx, e.logger, e.log, perm, ctx.Request.URL.Path, "missing permission")
+			ctx.AbortWithStatusJSON(403, ErrForbidden.Error())
+			return
+		}
+		ctx.Set(grantKey, &grant{perm: perm, own: s == scopeOwn, enforcer: e})
+		ctx.Next()
+	}
+}
+
+// AllowAccount answers 403 and returns false unless the caller may act on
+// account id, or on one of others, under the permission of the route.
+func AllowAccount(ctx *gin.Context, id repository.AccountID, others ...repository.AccountID) bool {
+	v, ok := ctx.Get(grantKey)
+	if !ok {
+		return true
+	}
+	g := v.(*grant)
+	for _, id := range append([]repository.AccountID{id}, others...) {
+		allowed, err := g.allows(ctx, id)
+		if err != nil {
+			ctx.AbortWithStatusJSON(500, err.Error())
+			return false
+		}
+		if allowed {
+			return true
+		}
+	}
+	return g.deny(ctx, "account/"+string(id), "not an owner")
+}
+
+// AllowAnyAccount answers 404 with notFound and returns false unless the
+// caller may act on one of ids under the permission of the route. It is for
+// resources of several accounts whose existence the caller must not learn
+// from a 403.
+func AllowAnyAccount(ctx *gin.Context, resource string, notFound error, ids ...repository.AccountID) bool {
+	v, ok := ctx.Get(grantKey)
+	if !ok {
+		return true
+	}
+	g := v.(*grant)
+	for _, id := range ids {
+		allowed, err := g.allows(ctx, id)
+		if err != nil {
+			ctx.AbortWithStatusJSON(500, err.Error())
+			return false
+		}
+		if allowed {
+			return true
+		}
+	}
+	record(ctx, g.enforcer.logger, g.enforcer.log, g.perm, resource, "not a party")
+	ctx.AbortWithStatusJSON(404, notFound.Error())
+	return false
+}
+
+// allows reports whether the caller may act on account id under g.
+func (g *grant) allows(ctx *gin.Context, id repository.AccountID) (bool, error) {
+	p := FromContext(ctx)
+	if !g.own || p.Owns(id) {
+		return true, nil
+	}
+	return g.enforcer.holds(ctx, p, id)
+}
+
+// holds reports whether p holds account id in the holders of e.
+func (e *Enforcer) holds(ctx *gin.Context, p *Principal, id repository.AccountID) (bool, error) {
+	customer := p.CustomerID()
+	if e.holders == nil || customer == "" {
+		return false, nil
+	}
+	holders, err := e.holders.GetAccountHolders(ctx, id)
+	if errors.Is(err, repository.ErrAccountNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, h := range holders {
+		if h.CustomerID == customer {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AllowCustomer answers 403 and returns false unless the caller may act on
+// customer id under the permission of the route. Customers may only act on
+// themselves.
+func AllowCustomer(ctx *gin.Context, id repository.CustomerID) bool {
+	v, ok := ctx.Get(grantKey)
+	if !ok {
+		return true
+	}
+	g := v.(*grant)
+	if !g.own || FromContext(ctx).CustomerID() == id {
+		return true
+	}
+	return g.deny(ctx, "customer/"+string(id), "not the customer")
+}
+
+// AllowAll answers 403 and returns false if the caller only has the
+// permission of the route on its own accounts or customer, for routes that
+// span all of them.
+func AllowAll(ctx *gin.Context) bool {
+	v, ok := ctx.Get(grantKey)
+	if !ok {
+		return true
+	}
+	g := v.(*grant)
+	if !g.own {
+		return true
+	}
+	return g.deny(ctx, ctx.Request.URL.Path, "own resources only")
+}
+
+func (g *grant) deny(ctx *gin.Context, resource, reason string) bool {
+	record(ctx, g.enforcer.logger, g.enforcer.log, g.perm, resource, reason)
+	ctx.AbortWithStatusJSON(403, ErrForbidden.Error())
+	return false
+}
+
+// Audit records e, an action of the caller of the request, in log. The
+// caller and its address are filled in, and the outcome defaults to allowed.
+func Audit(ctx *gin.Context, log audit.Log, e audit.Entry) error {
+	if p := FromContext(ctx); p != nil {
+		e.Actor, e.AuthMethod, e.Roles = p.Subject, p.Method, p.Roles
+	}
+	if e.Outcome == "" {
+		e.Outcome = audit.OutcomeAllowed
+	}
+	e.RemoteAddr = ctx.ClientIP()
+	return log.Record(ctx, e)
+}
+
+// record writes a denial to the audit log. A failing log does not change the
+// answer, the request is denied anyway.
+func record(ctx *gin.Context, logger *zap.Logger, log audit.Log, action, resource, reason string) {
+	if log == nil {
+		return
+	}
+	e := audit.Entry{
+		Action:   action,
+		Resource: resource,
+		Outcome:  audit.OutcomeDenied,
+		Reason:   reason,
+	}
+	if err := Audit(ctx, log, e); err != nil {
+		logger.Error("record audit entry", zap.Any("entry", e), zap.Error(err))
+	}
+}
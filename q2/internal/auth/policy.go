@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Permissions of the routes. A permission granted with the OwnSuffix only
+// covers the accounts the caller owns.
+const (
+	PermAccountsCreate   = "accounts.create"
+	PermAccountsRead     = "accounts.read"
+	PermDeposit          = "accounts.deposit"
+	PermWithdraw         = "accounts.withdraw"
+	PermTransfer         = "accounts.transfer"
+	PermStatementsRead   = "statements.read"
+	PermReverse          = "transactions.reverse"
+	PermTransactionsRead = "transactions.read"
+	PermJournalRead      = "journal.read"
+	PermLedgerCheck      = "ledger.check"
+	PermMetricsRead      = "metrics.read"
+	PermAuditRead        = "audit.read"
+	PermCustomersCreate  = "customers.create"
+	PermCustomersRead    = "customers.read"
+	PermCustomersUpdate  = "customers.update"
+	PermCustomersDelete  = "customers.delete"
+	PermHoldersManage    = "accounts.holders"
+	PermAccountsStatus   = "accounts.status"
+	PermOverdraftManage  = "accounts.overdraft"
+	PermRatesRead        = "rates.read"
+	PermRatesManage      = "rates.manage"
+	PermHoldsPlace       = "holds.place"
+	PermHoldsManage      = "holds.manage"
+	PermEscrowOpen       = "escrow.open"
+	PermEscrowSettle     = "escrow.settle"
+	PermFeesManage       = "fees.manage"
+
+	// AllPermissions grants every permission on every account
+	AllPermissions = "*"
+	OwnSuffix      = ":own"
+)
+
+// Roles besides RoleCustomer and RoleAdmin.
+const (
+	RoleTeller  = "teller"
+	RoleAuditor = "auditor"
+)
+
+// permissions maps every permission to whether it may be granted with the
+// OwnSuffix. Only the permissions whose handlers check the account or
+// customer they act on can be; the others cover the whole bank.
+var permissions = map[string]bool{
+	PermAccountsCreate:   false,
+	PermAccountsRead:     true,
+	PermDeposit:          true,
+	PermWithdraw:         true,
+	PermTransfer:         true,
+	PermStatementsRead:   true,
+	PermReverse:          true,
+	PermTransactionsRead: false,
+	PermJournalRead:      false,
+	PermLedgerCheck:      false,
+	PermMetricsRead:      false,
+	PermAuditRead:        false,
+	PermCustomersCreate:  false,
+	PermCustomersRead:    true,
+	PermCustomersUpdate:  true,
+	PermCustomersDelete:  true,
+	PermHoldersManage:    true,
+	PermAccountsStatus:   false,
+	PermOverdraftManage:  false,
+	PermRatesRead:        false,
+	PermRatesManage:      false,
+	PermHoldsPlace:       true,
+	PermHoldsManage:      true,
+	PermEscrowOpen:       true,
+	PermEscrowSettle:     true,
+	PermFeesManage:       false,
+}
+
+// scope is how much of a permission a principal has.
+type scope int
+
+const (
+	scopeNone scope = iota
+	scopeOwn
+	scopeAny
+)
+
+// Policy maps roles to permissions.
+type Policy struct {
+	roles map[string]map[string]scope
+}
+
+// PolicyConfig is the policy file, for example
+//
+//	{"roles": {"customer": ["accounts.read:own"], "admin": ["*"]}}
+type PolicyConfig struct {
+	Roles map[string][]string `json:"roles"`
+}
+
+// DefaultPolicyConfig lets customers use their own accounts, tellers serve
+// any account and customer, auditors read everything and admins do anything.
+// Only admins delete customers, change account statuses, set overdrafts and
+// set exchange rates.
+func DefaultPolicyConfig() PolicyConfig {
+	return PolicyConfig{Roles: map[string][]string{
+		RoleCustomer: {
+			PermAccountsRead + OwnSuffix, PermDeposit + OwnSuffix, PermWithdraw + OwnSuffix,
+			PermTransfer + OwnSuffix, PermStatementsRead + OwnSuffix, PermCustomersRead + OwnSuffix,
+			PermRatesRead, PermHoldsPlace + OwnSuffix, PermEscrowOpen + OwnSuffix,
+		},
+		RoleTeller: {
+			PermAccountsCreate, PermAccountsRead, PermDeposit, PermWithdraw, PermTransfer,
+			PermStatementsRead, PermReverse, PermCustomersCreate, PermCustomersRead,
+			PermCustomersUpdate, PermHoldersManage, PermRatesRead, PermHoldsPlace, PermHoldsManage,
+			PermEscrowOpen, PermEscrowSettle,
+		},
+		RoleAuditor: {
+			PermAccountsRead, PermStatementsRead, PermTransactionsRead, PermJournalRead,
+			PermLedgerCheck, PermMetricsRead, PermAuditRead, PermCustomersRead, PermRatesRead,
+		},
+		RoleAdmin: {AllPermissions},
+	}}
+}
+
+// NewPolicy checks cfg and returns its policy. Unknown permissions are
+// rejected so a typo does not silently deny a route, and so are permissions
+// limited to own accounts that no handler could limit.
+func NewPolicy(cfg PolicyConfig) (*Policy, error) {
+	p := &Policy{roles: make(map[string]map[string]scope)}
+	for role, perms := range cfg.Roles {
+		granted := make(map[string]scope)
+		for _, perm := range perms {
+			if perm == AllPermissions {
+				for known := range permissions {
+					granted[known] = scopeAny
+				}
+				continue
+			}
+			name, own := strings.CutSuffix(perm, OwnSuffix)
+			ownable, ok := permissions[name]
+			if !ok {
+				return nil, fmt.Errorf("role %s: unknown permission %q", role, perm)
+			}
+			if own && !ownable {
+				return nil, fmt.Errorf("role %s: permission %q cannot be limited to own accounts", role, name)
+			}
+			s := scopeAny
+			if own {
+				s = scopeOwn
+			}
+			if s > granted[name] {
+				granted[name] = s
+			}
+		}
+		p.roles[role] = granted
+	}
+	return p, nil
+}
+
+// DefaultPolicy returns the policy of DefaultPolicyConfig.
+func DefaultPolicy() *Policy {
+	p, err := NewPolicy(DefaultPolicyConfig())
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// LoadPolicy reads the policy file at path.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg PolicyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return NewPolicy(cfg)
+}
+
+// scope returns the widest scope of perm over the roles of principal.
+func (p *Policy) scope(principal *Principal, perm string) scope {
+	best := scopeNone
+	for _, role := range principal.Roles {
+		if s := p.roles[role][perm]; s > best {
+			best = s
+		}
+	}
+	return best
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Yougigun/meepshop_q2/internal/audit"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestPolicyScope(t *testing.T) {
+	p := DefaultPolicy()
+	customer := &Principal{Roles: []string{RoleCustomer}}
+	teller := &Principal{Roles: []string{RoleTeller}}
+	auditor := &Principal{Roles: []string{RoleAuditor}}
+	admin := &Principal{Roles: []string{RoleAdmin}}
+	both := &Principal{Roles: []string{RoleCustomer, RoleAuditor}}
+	tests := []struct {
+		principal *Principal
+		perm      string
+		want      scope
+	}{
+		{customer, PermDeposit, scopeOwn},
+		{customer, PermTransactionsRead, scopeNone},
+		{customer, PermAccountsCreate, scopeNone},
+		{teller, PermDeposit, scopeAny},
+		{teller, PermAuditRead, scopeNone},
+		{auditor, PermTransactionsRead, scopeAny},
+		{auditor, PermWithdraw, scopeNone},
+		{admin, PermAuditRead, scopeAny},
+		{both, PermAccountsRead, scopeAny},
+		{both, PermTransfer, scopeOwn},
+		{&Principal{Roles: []string{"intern"}}, PermAccountsRead, scopeNone},
+	}
+	for _, tt := range tests {
+		if got := p.scope(tt.principal, tt.perm); got != tt.want {
+			t.Errorf("scope(%v, %v) got = %v, want %v", tt.principal.Roles, tt.perm, got, tt.want)
+		}
+	}
+
+	if _, err := NewPolicy(PolicyConfig{Roles: map[string][]string{"teller": {"accounts.depsoit"}}}); err == nil {
+		t.Errorf("NewPolicy() with an unknown permission got nil error")
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"roles": {"teller": ["accounts.read", "accounts.read:own", "accounts.deposit:own"]}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("LoadPolicy() error = %v", err)
+	}
+	teller := &Principal{Roles: []string{RoleTeller}}
+	if p.scope(teller, PermAccountsRead) != scopeAny || p.scope(teller, PermDeposit) != scopeOwn || p.scope(teller, PermWithdraw) != scopeNone {
+		t.Errorf("LoadPolicy() got = %+v", p.roles)
+	}
+}
+
+func TestPolicyOwnScope(t *testing.T) {
+	for _, perm := range []string{PermEscrowSettle + OwnSuffix, PermHoldsManage + OwnSuffix, PermCustomersUpdate + OwnSuffix} {
+		if _, err := NewPolicy(PolicyConfig{Roles: map[string][]string{"clerk": {perm}}}); err != nil {
+			t.Errorf("NewPolicy() %v error = %v", perm, err)
+		}
+	}
+	// these routes cover the whole bank, own accounts cannot limit them
+	for _, perm := range []string{PermJournalRead + OwnSuffix, PermAuditRead + OwnSuffix, PermTransactionsRead + OwnSuffix, PermRatesManage + OwnSuffix} {
+		if _, err := NewPolicy(PolicyConfig{Roles: map[string][]string{"clerk": {perm}}}); err == nil {
+			t.Errorf("NewPolicy() %v accepted", perm)
+		}
+	}
+}
+
+func TestEnforcer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := audit.NewMemoryLog()
+	ctx := context.Background()
+	repo := repository.NewRepository()
+	alice, _ := repo.CreateCustomer(ctx, repository.Customer{Name: "Alice"})
+	bob, _ := repo.CreateCustomer(ctx, repository.Customer{Name: "Bob"})
+	repo.CreateAccount(ctx)
+	repo.CreateAccount(ctx, repository.AccountHolder{CustomerID: bob.ID, Role: repository.HolderOwner})
+	repo.CreateAccount(ctx, repository.AccountHolder{CustomerID: bob.ID, Role: repository.HolderOwner}, repository.AccountHolder{CustomerID: alice.ID, Role: repository.HolderJoint})
+	can := NewEnforcer(zap.NewNop(), DefaultPolicy(), log, repo).Require
+	r := gin.New()
+	r.Use(func(ctx *gin.Context) {
+		// account 1 is named by the token, account 3 is held jointly
+		ctx.Set(principalKey, &Principal{Subject: string(alice.ID), Method: MethodJWT, Roles: []string{RoleCustomer}, Accounts: []repository.AccountID{"1"}})
+	})
+	r.GET("/accounts/:id", can(PermAccountsRead), func(ctx *gin.Context) {
+		if AllowAccount(ctx, repository.AccountID(ctx.Param("id"))) {
+			ctx.JSON(200, "ok")
+		}
+	})
+	r.GET("/customers/:id", can(PermCustomersRead), func(ctx *gin.Context) {
+		if AllowCustomer(ctx, repository.CustomerID(ctx.Param("id"))) {
+			ctx.JSON(200, "ok")
+		}
+	})
+	r.GET("/customers", can(PermCustomersRead), func(ctx *gin.Context) {
+		if AllowAll(ctx) {
+			ctx.JSON(200, "ok")
+		}
+	})
+	r.GET("/transactions", can(PermTransactionsRead), func(ctx *gin.Context) { ctx.JSON(200, "ok") })
+
+	for path, want := range map[string]int{
+		"/accounts/1": 200, "/accounts/2": 403, "/accounts/3": 200, "/accounts/4": 403,
+		"/customers/" + string(alice.ID): 200, "/customers/" + string(bob.ID): 403, "/customers": 403,
+		"/transactions": 403,
+	} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		r.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("GET %v got %v, want %v", path, rr.Code, want)
+		}
+	}
+
+	denied, _ := log.List(ctx, audit.Query{Actor: string(alice.ID), Outcome: audit.OutcomeDenied})
+	if len(denied) != 5 {
+		t.Fatalf("audit entries got = %+v", denied)
+	}
+	resources := make(map[string]string)
+	for _, e := range denied {
+		resources[e.Resource] = e.Action
+	}
+	if resources["account/2"] != PermAccountsRead || resources["customer/"+string(bob.ID)] != PermCustomersRead || resources["/transactions"] != PermTransactionsRead {
+		t.Errorf("audit entries got = %+v", denied)
+	}
+}
+
+func TestEnforcerWithoutCaller(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := audit.NewMemoryLog()
+	can := NewEnforcer(zap.NewNop(), DefaultPolicy(), log, nil).Require
+	r := gin.New()
+	r.GET("/accounts/:id", can(PermAccountsRead), func(ctx *gin.Context) { ctx.JSON(200, "ok") })
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/accounts/1", nil)
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("GET without a caller got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+	denied, _ := log.List(context.Background(), audit.Query{Outcome: audit.OutcomeDenied})
+	if len(denied) != 1 || denied[0].Action != PermAccountsRead {
+		t.Errorf("audit entries got = %+v", denied)
+	}
+}
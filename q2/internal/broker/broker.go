@@ -0,0 +1,271 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed    = errors.New("broker is closed")
+	ErrGroupBusy = errors.New("consumer group already has a subscriber")
+)
+
+// DefaultPartitions is the number of partitions used when none is given.
+const DefaultPartitions = 16
+
+// Event is an account or transaction event. Events with the same Key go to
+// the same partition and are delivered in the order they were published.
+type Event struct {
+	Type    string
+	Key     string
+	Payload json.RawMessage
+	Time    time.Time
+	// Partition and Offset locate a delivered event; Publish ignores them
+	Partition int   `json:"-"`
+	Offset    int64 `json:"-"`
+}
+
+// EventPublisher publishes events. Publish returns once the events are stored
+// by the broker; a failed Publish may have stored some of them and should be
+// retried, so consumers must tolerate duplicates.
+type EventPublisher interface {
+	Publish(ctx context.Context, events ...Event) error
+}
+
+// Handler processes a delivered event. Returning an error makes the broker
+// deliver the same event again, holding back the rest of its partition.
+type Handler func(ctx context.Context, e Event) error
+
+// EventSubscriber delivers events to consumer groups. Every group sees every
+// event at least once and resumes after the last event it acknowledged.
+type EventSubscriber interface {
+	// Subscribe delivers events to handler until ctx is done. A group has at
+	// most one subscriber at a time.
+	Subscribe(ctx context.Context, group string, handler Handler) error
+}
+
+// Broker is an EventPublisher and EventSubscriber.
+type Broker interface {
+	EventPublisher
+	EventSubscriber
+	Close() error
+}
+
+// storage makes the partitions and group offsets of a broker durable. The
+// memory broker has none.
+type storage interface {
+	append(partition int, events []Event) error
+	commit(group string, offsets []int64) error
+	close() error
+}
+
+// retryDelay is the first wait before an event is delivered again; it doubles
+// up to maxRetryDelay.
+var (
+	retryDelay    = 100 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+var groupName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// broker keeps the partitions in memory and delivers them to consumer groups.
+type broker struct {
+	partitions [][]Event
+	// offsets is the next offset to deliver per group and partition
+	offsets map[string][]int64
+	active  map[string]bool
+	store   storage
+	// published is closed and replaced whenever events are published
+	published chan struct{}
+	closed    bool
+	mu        sync.Mutex
+}
+
+func newBroker(partitions int, store storage) *broker {
+	if partitions <= 0 {
+		partitions = DefaultPartitions
+	}
+	return &broker{
+		partitions: make([][]Event, partitions),
+		offsets:    make(map[string][]int64),
+		active:     make(map[string]bool),
+		store:      store,
+		published:  make(chan struct{}),
+	}
+}
+
+// partition maps key to a partition with fnv-1a.
+func (b *broker) partition(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(b.partitions)))
+}
+
+func (b *broker) Publish(ctx context.Context, events ...Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	byPartition := make(map[int][]Event)
+	order := make([]int, 0)
+	for _, e := range events {
+		p := b.partition(e.Key)
+		if _, ok := byPartition[p]; !ok {
+			order = append(order, p)
+		}
+		e.Partition, e.Offset = p, 0
+		byPartition[p] = append(byPartition[p], e)
+	}
+	for _, p := range order {
+		batch := byPartition[p]
+		if b.store != nil {
+			if err := b.store.append(p, batch); err != nil {
+				return err
+			}
+		}
+		for _, e := range batch {
+			e.Offset = int64(len(b.partitions[p]))
+			b.partitions[p] = append(b.partitions[p], e)
+		}
+	}
+	close(b.published)
+	b.published = make(chan struct{})
+	return nil
+}
+
+func (b *broker) Subscribe(ctx context.Context, group string, handler Handler) error {
+	if !groupName.MatchString(group) {
+		return fmt.Errorf("invalid consumer group %q", group)
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	if b.active[group] {
+		b.mu.Unlock()
+		return ErrGroupBusy
+	}
+	b.active[group] = true
+	if b.offsets[group] == nil {
+		b.offsets[group] = make([]int64, len(b.partitions))
+	}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.active, group)
+		b.mu.Unlock()
+	}()
+
+	// partitions are consumed independently so a failing event only holds
+	// back the keys of its own partition
+	errs := make(chan error, len(b.partitions))
+	var wg sync.WaitGroup
+	for p := range b.partitions {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			if err := b.consume(ctx, group, p, handler); err != nil {
+				errs <- err
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// consume delivers partition p to handler in order until ctx is done.
+func (b *broker) consume(ctx context.Context, group string, p int, handler Handler) error {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return ErrClosed
+		}
+		offset := b.offsets[group][p]
+		if offset >= int64(len(b.partitions[p])) {
+			published := b.published
+			b.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-published:
+				continue
+			}
+		}
+		e := b.partitions[p][offset]
+		b.mu.Unlock()
+
+		delay := retryDelay
+		for {
+			err := handler(ctx, e)
+			if err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+		if err := b.commit(group, p, offset+1); err != nil {
+			return err
+		}
+	}
+}
+
+// commit acknowledges every event of partition p before offset.
+func (b *broker) commit(group string, p int, offset int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.offsets[group][p] = offset
+	if b.store == nil {
+		return nil
+	}
+	return b.store.commit(group, append([]int64(nil), b.offsets[group]...))
+}
+
+func (b *broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	// wake subscribers so they see the broker is closed
+	close(b.published)
+	if b.store == nil {
+		return nil
+	}
+	return b.store.close()
+}
+
+var _ Broker = (*MemoryBroker)(nil)
+
+// MemoryBroker keeps events and group offsets in memory. It is meant for tests
+// and for consumers in the same process.
+type MemoryBroker struct {
+	*broker
+}
+
+// NewMemoryBroker returns a broker with the given number of partitions, or
+// DefaultPartitions if it is not positive.
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	return &MemoryBroker{broker: newBroker(partitions, nil)}
+}
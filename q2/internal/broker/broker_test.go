@@ -0,0 +1,205 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forEachBroker runs fn against the memory and the file broker.
+func forEachBroker(t *testing.T, fn func(t *testing.T, b Broker)) {
+	t.Run("memory", func(t *testing.T) {
+		b := NewMemoryBroker(4)
+		defer b.Close()
+		fn(t, b)
+	})
+	t.Run("file", func(t *testing.T) {
+		b, err := NewFileBroker(t.TempDir(), 4)
+		if err != nil {
+			t.Fatalf("NewFileBroker() error = %v", err)
+		}
+		defer b.Close()
+		fn(t, b)
+	})
+}
+
+// collect subscribes group until n events were handled and returns them.
+func collect(t *testing.T, b Broker, group string, n int, handler Handler) []Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	events := make([]Event, 0, n)
+	err := b.Subscribe(ctx, group, func(ctx context.Context, e Event) error {
+		if handler != nil {
+			if err := handler(ctx, e); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+		if len(events) == n {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return events
+}
+
+func publishN(t *testing.T, b Broker, keys []string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		events := make([]Event, 0, len(keys))
+		for _, key := range keys {
+			events = append(events, Event{Type: "test", Key: key, Payload: []byte(fmt.Sprint(i))})
+		}
+		if err := b.Publish(context.Background(), events...); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+}
+
+// checkOrder fails unless the events of every key carry 0, 1, 2 and so on.
+func checkOrder(t *testing.T, events []Event) {
+	t.Helper()
+	next := make(map[string]int)
+	for _, e := range events {
+		if want := fmt.Sprint(next[e.Key]); string(e.Payload) != want {
+			t.Fatalf("event of %v got payload %s, want %v", e.Key, e.Payload, want)
+		}
+		next[e.Key]++
+	}
+}
+
+func TestPublishOrderPerKey(t *testing.T) {
+	forEachBroker(t, func(t *testing.T, b Broker) {
+		keys := []string{"1", "2", "3", "4", "5", "6"}
+		publishN(t, b, keys, 20)
+		events := collect(t, b, "order", len(keys)*20, nil)
+		checkOrder(t, events)
+
+		// a second group sees every event again
+		if got := collect(t, b, "other", len(keys)*20, nil); len(got) != len(keys)*20 {
+			t.Errorf("other group got %v events, want %v", len(got), len(keys)*20)
+		}
+	})
+}
+
+func TestRedeliverOnHandlerError(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	forEachBroker(t, func(t *testing.T, b Broker) {
+		publishN(t, b, []string{"1"}, 5)
+		failures := 0
+		events := collect(t, b, "retry", 5, func(ctx context.Context, e Event) error {
+			// the third event fails twice before it is handled
+			if string(e.Payload) == "2" && failures < 2 {
+				failures++
+				return errors.New("try again")
+			}
+			return nil
+		})
+		checkOrder(t, events)
+		if failures != 2 {
+			t.Errorf("failures got %v, want %v", failures, 2)
+		}
+	})
+}
+
+func TestSubscribeResumesAfterCommit(t *testing.T) {
+	forEachBroker(t, func(t *testing.T, b Broker) {
+		publishN(t, b, []string{"1"}, 3)
+		collect(t, b, "resume", 3, nil)
+		publishN(t, b, []string{"1"}, 2)
+		events := collect(t, b, "resume", 2, nil)
+		if len(events) != 2 || events[0].Offset != 3 || events[1].Offset != 4 {
+			t.Errorf("resumed events got %+v", events)
+		}
+	})
+}
+
+func TestSubscribeGroupBusy(t *testing.T) {
+	forEachBroker(t, func(t *testing.T, b Broker) {
+		publishN(t, b, []string{"1"}, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		handled := make(chan struct{}, 1)
+		done := make(chan error)
+		go func() {
+			done <- b.Subscribe(ctx, "busy", func(context.Context, Event) error {
+				handled <- struct{}{}
+				return nil
+			})
+		}()
+		// the first subscriber holds the group once it handled an event
+		<-handled
+		if err := b.Subscribe(ctx, "busy", nil); !errors.Is(err, ErrGroupBusy) {
+			t.Errorf("Subscribe() second subscriber error = %v, want %v", err, ErrGroupBusy)
+		}
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Subscribe() error = %v", err)
+		}
+		if err := b.Subscribe(ctx, "bad group", nil); err == nil {
+			t.Errorf("Subscribe() with invalid group got nil error")
+		}
+	})
+}
+
+func TestPublishAfterClose(t *testing.T) {
+	b := NewMemoryBroker(1)
+	b.Close()
+	if err := b.Publish(context.Background(), Event{Key: "1"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Publish() error = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestFileBrokerReopen(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewFileBroker(dir, 4)
+	if err != nil {
+		t.Fatalf("NewFileBroker() error = %v", err)
+	}
+	publishN(t, b, []string{"1"}, 3)
+	collect(t, b, "reopen", 3, nil)
+	publishN(t, b, []string{"1"}, 1)
+	b.Close()
+
+	// a crash left half an event at the end of a partition
+	p := b.partition("1")
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("partition-%03d.log", p)), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Type":"test","Key":"1","Pay`)
+	f.Close()
+
+	if _, err := NewFileBroker(dir, 8); err == nil {
+		t.Errorf("NewFileBroker() with another partition count got nil error")
+	}
+	b, err = NewFileBroker(dir, 0)
+	if err != nil {
+		t.Fatalf("NewFileBroker() reopen error = %v", err)
+	}
+	defer b.Close()
+	// only the event published after the commit is delivered again
+	events := collect(t, b, "reopen", 1, nil)
+	if len(events) != 1 || events[0].Offset != 3 || string(events[0].Payload) != "0" {
+		t.Errorf("events after reopen got %+v", events)
+	}
+	publishN(t, b, []string{"1"}, 1)
+	if events := collect(t, b, "reopen", 1, nil); len(events) != 1 || events[0].Offset != 4 {
+		t.Errorf("event after torn record got %+v", events)
+	}
+}
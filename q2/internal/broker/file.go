@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	metaFile        = "broker.json"
+	partitionPrefix = "partition-"
+	partitionSuffix = ".log"
+	offsetsPrefix   = "offsets-"
+	offsetsSuffix   = ".json"
+)
+
+type brokerMeta struct {
+	Partitions int `json:"partitions"`
+}
+
+var _ Broker = (*FileBroker)(nil)
+
+// FileBroker keeps every partition in an append-only file of JSON lines in a
+// directory, fsync'd before Publish returns, and the offsets of each consumer
+// group in a file of their own. It stands in for Kafka on a single machine.
+type FileBroker struct {
+	*broker
+}
+
+// NewFileBroker opens or creates the broker in dir. partitions must match the
+// existing broker; if it is not positive the existing count, or
+// DefaultPartitions for a new broker, is used.
+func NewFileBroker(dir string, partitions int) (*FileBroker, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	meta, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		if partitions <= 0 {
+			partitions = DefaultPartitions
+		}
+		meta = &brokerMeta{Partitions: partitions}
+		if err := writeJSON(filepath.Join(dir, metaFile), meta); err != nil {
+			return nil, err
+		}
+	} else if partitions > 0 && partitions != meta.Partitions {
+		return nil, fmt.Errorf("broker in %s has %d partitions, not %d", dir, meta.Partitions, partitions)
+	}
+
+	store := &fileStorage{dir: dir, files: make([]*os.File, meta.Partitions)}
+	b := newBroker(meta.Partitions, store)
+	for p := range b.partitions {
+		f, events, err := openPartition(store.partitionPath(p))
+		if err != nil {
+			store.close()
+			return nil, err
+		}
+		store.files[p] = f
+		for i := range events {
+			events[i].Partition, events[i].Offset = p, int64(i)
+		}
+		b.partitions[p] = events
+	}
+	if err := store.loadOffsets(b); err != nil {
+		store.close()
+		return nil, err
+	}
+	return &FileBroker{broker: b}, nil
+}
+
+type fileStorage struct {
+	dir   string
+	files []*os.File
+}
+
+func (s *fileStorage) partitionPath(p int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%03d%s", partitionPrefix, p, partitionSuffix))
+}
+
+func (s *fileStorage) offsetsPath(group string) string {
+	return filepath.Join(s.dir, offsetsPrefix+group+offsetsSuffix)
+}
+
+func (s *fileStorage) append(p int, events []Event) error {
+	var buf bytes.Buffer
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	f := s.files[p]
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		// drop a partial write so the partition ends with a whole event
+		_ = f.Truncate(offset)
+		return err
+	}
+	return f.Sync()
+}
+
+// commit replaces the offsets file of group. A lost commit only makes the
+// group see some events again.
+func (s *fileStorage) commit(group string, offsets []int64) error {
+	return writeJSON(s.offsetsPath(group), offsets)
+}
+
+func (s *fileStorage) loadOffsets(b *broker) error {
+	matches, err := filepath.Glob(filepath.Join(s.dir, offsetsPrefix+"*"+offsetsSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range matches {
+		group := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), offsetsPrefix), offsetsSuffix)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var offsets []int64
+		if err := json.Unmarshal(data, &offsets); err != nil || len(offsets) != len(b.partitions) {
+			return fmt.Errorf("invalid offsets of consumer group %s", group)
+		}
+		for p, offset := range offsets {
+			if offset > int64(len(b.partitions[p])) {
+				return fmt.Errorf("consumer group %s is past the end of partition %d", group, p)
+			}
+		}
+		b.offsets[group] = offsets
+	}
+	return nil
+}
+
+func (s *fileStorage) close() error {
+	var err error
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// openPartition reads the events of a partition file, truncating a torn last
+// line left by a crash.
+func openPartition(path string) (*os.File, []Event, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make([]Event, 0)
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				if err := f.Truncate(offset); err != nil {
+					f.Close()
+					return nil, nil, err
+				}
+			}
+			return f, events, nil
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s is corrupted at offset %d", path, offset)
+		}
+		events = append(events, e)
+		offset += int64(len(line))
+	}
+}
+
+func readMeta(dir string) (*brokerMeta, error) {
+	data, err := os.ReadFile(filepath.Join(dir, metaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &brokerMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	if meta.Partitions <= 0 {
+		return nil, fmt.Errorf("invalid partition count %d", meta.Partitions)
+	}
+	return meta, nil
+}
+
+// writeJSON replaces path with v through a synced temporary file.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -2,91 +2,93 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"io"
 	"strconv"
 	"time"
 
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/broker"
 	"github.com/Yougigun/meepshop_q2/internal/repository"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
 type AccountHandler struct {
-	logger              *zap.Logger
-	repository          *repository.Repository
-	transactionLogQueue chan *TransactionLog
-}
-
-func NewAccountHandler(ctx context.Context, logger *zap.Logger, repo *repository.Repository) *AccountHandler {
-	queue := make(chan *TransactionLog, 10000)
-	batchLogs := make([]struct {
-		From   int64
-		To     int64
-		Amount int
-		When   time.Time
-	}, 0, 300)
-	// deal with transaction log, this may lose some logs if the server is down. todo: use kafka or other message queue
-	go func() {
-		for {
-			select {
-			case tl := <-queue:
-				batchLogs = append(batchLogs, struct {
-					From   int64
-					To     int64
-					Amount int
-					When   time.Time
-				}{
-					From:   tl.From,
-					To:     tl.To,
-					Amount: tl.Amount,
-					When:   tl.When,
-				},
-				)
-				// if more than 3000 logs, then add to repository
-				if len(batchLogs) > 300 {
-					repo.AddTransaction(ctx, repository.BatchTransaction(batchLogs))
-					batchLogs = make([]struct {
-						From   int64
-						To     int64
-						Amount int
-						When   time.Time
-					}, 0, 300)
-				}
-
-			case <-time.After(5 * time.Second):
-				if len(batchLogs) == 0 {
-					continue
-				}
-				repo.AddTransaction(ctx, repository.BatchTransaction(batchLogs))
-				batchLogs = make([]struct {
-					From   int64
-					To     int64
-					Amount int
-					When   time.Time
-				}, 0, 300)
-			}
-		}
-	}()
+	logger     *zap.Logger
+	repository repository.AccountStore
+	events     broker.EventPublisher
+}
 
+// NewAccountHandler returns the account handlers. Money movements commit their
+// transaction log entries to the repository outbox; see TransactionRelay.
+// Account creation is published to events, which may be nil.
+func NewAccountHandler(logger *zap.Logger, repo repository.AccountStore, events broker.EventPublisher) *AccountHandler {
 	return &AccountHandler{
-		logger:              logger,
-		repository:          repo,
-		transactionLogQueue: queue,
+		logger:     logger,
+		repository: repo,
+		events:     events,
 	}
 }
 
+type CreateAccountRequest struct {
+	// Holders are the customers of the account, at least one of them an
+	// owner. The account is anonymous without them.
+	Holders []AccountHolderRequest `json:"holders"`
+	// Currency is the ISO 4217 currency of the account, TWD by default.
+	Currency repository.Currency `json:"currency"`
+}
+
 func (h *AccountHandler) CreateAccount(gCtx *gin.Context) {
 	ctx := gCtx.Request.Context()
-	if account, err := h.repository.CreateAccount(ctx); err != nil {
-		gCtx.JSON(500, err.Error())
+	// the body is optional
+	reqBody := &CreateAccountRequest{}
+	if err := gCtx.ShouldBindJSON(reqBody); err != nil && !errors.Is(err, io.EOF) {
+		gCtx.JSON(400, err.Error())
+		return
+	}
+	holders := make([]repository.AccountHolder, 0, len(reqBody.Holders))
+	for _, holder := range reqBody.Holders {
+		holders = append(holders, repository.AccountHolder{CustomerID: holder.CustomerID, Role: holder.Role})
+	}
+	if reqBody.Currency == "" {
+		reqBody.Currency = repository.DefaultCurrency
+	}
+	if account, err := h.repository.CreateCurrencyAccount(ctx, reqBody.Currency, holders...); errors.Is(err, repository.ErrInvalidCurrency) {
+		gCtx.JSON(400, err.Error())
+	} else if err != nil {
+		gCtx.JSON(customerStatus(err), err.Error())
 	} else {
 		h.logger.Info("create account", zap.Any("account", account))
-		gCtx.JSON(200, struct{ AccountID int64 }{AccountID: int64(account)})
+		h.publishAccountCreated(ctx, account)
+		gCtx.JSON(200, struct{ AccountID repository.AccountID }{AccountID: account})
+	}
+}
+
+// publishAccountCreated publishes the new account. Accounts are not created
+// through the outbox, so the event is best effort: a failure is logged and the
+// account is still created.
+func (h *AccountHandler) publishAccountCreated(ctx context.Context, id repository.AccountID) {
+	if h.events == nil {
+		return
+	}
+	e, err := accountCreatedEvent(id)
+	if err == nil {
+		err = h.events.Publish(ctx, e)
+	}
+	if err != nil {
+		h.logger.Error("publish account created", zap.Any("account", id), zap.Error(err))
 	}
 }
 
 type DepositAccountRequest struct {
-	AccountID int64 `json:"account_id"`
-	Amount    int   `json:"amount"`
+	AccountID repository.AccountID `json:"account_id"`
+	// Amount is in minor units of Currency, the currency of the account if
+	// it is empty
+	Amount    int64               `json:"amount"`
+	Currency  repository.Currency `json:"currency"`
+	Memo      string              `json:"memo"`
+	Reference string              `json:"reference"`
 }
 
 func (h *AccountHandler) DepositAccount(ctx *gin.Context) {
@@ -96,18 +98,32 @@ func (h *AccountHandler) DepositAccount(ctx *gin.Context) {
 		return
 	}
 
+	amount, err := repository.NewMoney(reqBody.Amount, reqBody.Currency)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+
+	if !auth.AllowAccount(ctx, reqBody.AccountID) {
+		return
+	}
+
 	// deposit account
-	if err := h.repository.DepositAccount(ctx, reqBody.AccountID, reqBody.Amount); err != nil {
-		ctx.JSON(500, err.Error())
+	meta := repository.TransactionMeta{Memo: reqBody.Memo, Reference: reqBody.Reference}
+	if tl, err := h.repository.DepositAccount(ctx, reqBody.AccountID, amount, meta); err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
 	} else {
-		h.logger.Info("deposit account", zap.Any("account_id", reqBody.AccountID), zap.Any("amount", reqBody.Amount))
+		h.logger.Info("deposit account", zap.Any("account_id", reqBody.AccountID), zap.Stringer("amount", amount), zap.Any("transaction_id", tl.ID))
 		ctx.JSON(200, "success")
 	}
 }
 
 type WithdrawAccountRequest struct {
-	AccountID int64 `json:"account_id"`
-	Amount    int   `json:"amount"`
+	AccountID repository.AccountID `json:"account_id"`
+	Amount    int64                `json:"amount"`
+	Currency  repository.Currency  `json:"currency"`
+	Memo      string               `json:"memo"`
+	Reference string               `json:"reference"`
 }
 
 func (h *AccountHandler) WithdrawAccount(ctx *gin.Context) {
@@ -116,27 +132,34 @@ func (h *AccountHandler) WithdrawAccount(ctx *gin.Context) {
 		ctx.JSON(400, err.Error())
 		return
 	}
+	amount, err := repository.NewMoney(reqBody.Amount, reqBody.Currency)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if !auth.AllowAccount(ctx, reqBody.AccountID) {
+		return
+	}
+
 	// withdraw account
-	if err := h.repository.WithdrawAccount(ctx, reqBody.AccountID, reqBody.Amount); err != nil {
-		ctx.JSON(500, err.Error())
+	meta := repository.TransactionMeta{Memo: reqBody.Memo, Reference: reqBody.Reference}
+	if tl, err := h.repository.WithdrawAccount(ctx, reqBody.AccountID, amount, meta); err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
 	} else {
-		h.logger.Info("withdraw account", zap.Any("account_id", reqBody.AccountID), zap.Any("amount", reqBody.Amount))
+		h.logger.Info("withdraw account", zap.Any("account_id", reqBody.AccountID), zap.Stringer("amount", amount), zap.Any("transaction_id", tl.ID))
 		ctx.JSON(200, "success")
 	}
 
 }
 
 type TransferAccountRequest struct {
-	FromAccountID int64 `json:"from_account_id"`
-	ToAccountID   int64 `json:"to_account_id"`
-	Amount        int   `json:"amount"`
-}
-
-type TransactionLog struct {
-	From   int64     `json:"from"`
-	To     int64     `json:"to"`
-	Amount int       `json:"amount"`
-	When   time.Time `json:"when"`
+	FromAccountID repository.AccountID `json:"from_account_id"`
+	ToAccountID   repository.AccountID `json:"to_account_id"`
+	// Amount is in the currency of the sender
+	Amount    int64               `json:"amount"`
+	Currency  repository.Currency `json:"currency"`
+	Memo      string              `json:"memo"`
+	Reference string              `json:"reference"`
 }
 
 func (h *AccountHandler) TransferAccount(ctx *gin.Context) {
@@ -145,52 +168,248 @@ func (h *AccountHandler) TransferAccount(ctx *gin.Context) {
 		ctx.JSON(400, err.Error())
 		return
 	}
+	amount, err := repository.NewMoney(reqBody.Amount, reqBody.Currency)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	// customers may send from their own accounts to anyone
+	if !auth.AllowAccount(ctx, reqBody.FromAccountID) {
+		return
+	}
+
 	// transfer account
-	if err := h.repository.TransferAccount(ctx, reqBody.FromAccountID, reqBody.ToAccountID, reqBody.Amount); err != nil {
-		ctx.JSON(500, err.Error())
+	meta := repository.TransactionMeta{Memo: reqBody.Memo, Reference: reqBody.Reference}
+	if tl, err := h.repository.TransferAccount(ctx, reqBody.FromAccountID, reqBody.ToAccountID, amount, meta); err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
 		return
 	} else {
 		ctx.JSON(200, "success")
 		// log transaction
-		tl := &TransactionLog{
-			From:   reqBody.FromAccountID,
-			To:     reqBody.ToAccountID,
-			Amount: reqBody.Amount,
-			When:   time.Now(),
+		h.logger.Info("transaction log", zap.Any("log", tl))
+	}
+}
+
+type ReverseTransactionRequest struct {
+	// Amount is the amount to refund, 0 refunds whatever is left of the transfer
+	Amount    int64               `json:"amount"`
+	Currency  repository.Currency `json:"currency"`
+	Memo      string              `json:"memo"`
+	Reference string              `json:"reference"`
+}
+
+// ReverseTransaction refunds all or part of a transfer to its sender.
+func (h *AccountHandler) ReverseTransaction(ctx *gin.Context) {
+	transactionID, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	// the body is optional, an empty one reverses the whole transfer
+	reqBody := &ReverseTransactionRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil && !errors.Is(err, io.EOF) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	amount := repository.Money{Currency: reqBody.Currency}
+	if reqBody.Amount != 0 {
+		if amount, err = repository.NewMoney(reqBody.Amount, reqBody.Currency); err != nil {
+			ctx.JSON(400, err.Error())
+			return
 		}
-		h.transactionLogQueue <- tl
+	}
+	entry, err := h.repository.GetJournalEntry(ctx, transactionID)
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	// the sender or the receiver of the transfer may reverse it
+	if from, to := entry.Parties(); !auth.AllowAccount(ctx, from, to) {
+		return
+	}
+	meta := repository.TransactionMeta{Memo: reqBody.Memo, Reference: reqBody.Reference}
+	if tl, err := h.repository.ReverseTransaction(ctx, transactionID, amount, meta); err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+	} else {
+		ctx.JSON(200, "success")
 		h.logger.Info("transaction log", zap.Any("log", tl))
 	}
 }
 
 type GetAccountRequest struct {
-	ID      int64 `json:"id"`
-	Balance int   `json:"balance"`
+	ID      repository.AccountID `json:"id"`
+	Balance int64                `json:"balance"`
 }
 
 func (h *AccountHandler) GetAccount(ctx *gin.Context) {
-	// id from url
-	id := ctx.Param("id")
-
-	// convert id to int64
-	accountID, err := strconv.ParseInt(id, 10, 64)
-	if err != nil {
-		ctx.JSON(400, err.Error())
+	// id from url, account ids are opaque strings
+	accountID := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, accountID) {
 		return
 	}
 
 	// get account
 	if account, err := h.repository.GetAccount(ctx, accountID); err != nil {
-		ctx.JSON(500, err.Error())
+		ctx.JSON(movementStatus(err), err.Error())
 	} else {
 		h.logger.Info("get account", zap.Any("account_id", accountID))
 		ctx.JSON(200, account)
 	}
 }
 
+// GetOverdraftHistory returns the overdraft changes of an account, oldest
+// first.
+func (h *AccountHandler) GetOverdraftHistory(ctx *gin.Context) {
+	accountID := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, accountID) {
+		return
+	}
+	if history, err := h.repository.GetOverdraftHistory(ctx, accountID); err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+	} else {
+		ctx.JSON(200, history)
+	}
+}
+
+// GetTransactionLog returns a page of the transaction log. See
+// transactionQuery for the filters.
 func (h *AccountHandler) GetTransactionLog(ctx *gin.Context) {
-	// get transaction log
-	tl := h.repository.GetTransactions(ctx)
-	// h.logger.Info("get transaction log", zap.Any("log", tl))
-	ctx.JSON(200, tl)
+	q, err := transactionQuery(ctx)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	page, err := h.repository.ListTransactions(ctx, q)
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, err.Error())
+		return
+	}
+	ctx.JSON(200, page)
+}
+
+// GetAccountTransactions returns a page of the entries of one account with its
+// balance after each one. It takes the query parameters of GetTransactionLog
+// except account.
+func (h *AccountHandler) GetAccountTransactions(ctx *gin.Context) {
+	q, err := transactionQuery(ctx)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if !auth.AllowAccount(ctx, repository.AccountID(ctx.Param("id"))) {
+		return
+	}
+	history, err := h.repository.ListAccountTransactions(ctx, repository.AccountID(ctx.Param("id")), q)
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(200, history)
+}
+
+// transactionQuery reads the query parameters account, type, since and until
+// (RFC 3339), min_amount, max_amount, order (asc or desc), limit and cursor.
+func transactionQuery(ctx *gin.Context) (repository.TransactionQuery, error) {
+	q := repository.TransactionQuery{
+		Account: repository.AccountID(ctx.Query("account")),
+		Type:    repository.TransactionType(ctx.Query("type")),
+		Cursor:  ctx.Query("cursor"),
+	}
+	var err error
+	if v := ctx.Query("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, err
+		}
+	}
+	if v := ctx.Query("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, err
+		}
+	}
+	if v := ctx.Query("min_amount"); v != "" {
+		if q.MinAmount, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return q, err
+		}
+	}
+	if v := ctx.Query("max_amount"); v != "" {
+		if q.MaxAmount, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return q, err
+		}
+	}
+	if v := ctx.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return q, err
+		}
+	}
+	switch ctx.Query("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+	return q, nil
+}
+
+func (h *AccountHandler) GetJournal(ctx *gin.Context) {
+	journal, err := h.repository.GetJournal(ctx)
+	if err != nil {
+		ctx.JSON(500, err.Error())
+		return
+	}
+	ctx.JSON(200, journal)
+}
+
+// movementStatus answers 400 for invalid amounts, amounts in the wrong
+// currency and transfers to the same account, 404 for unknown accounts and
+// transactions, 409 for accounts and transactions whose state or type does
+// not allow the change, 422 for debits the funds do not cover, balances that
+// would overflow and conversions without a rate, and 500 for every other
+// error of a money movement or account change.
+func movementStatus(err error) int {
+	switch {
+	case errors.Is(err, repository.ErrInvalidAmount), errors.Is(err, repository.ErrCurrencyMismatch),
+		errors.Is(err, repository.ErrSameAccount):
+		return 400
+	case errors.Is(err, repository.ErrAccountNotFound), errors.Is(err, repository.ErrTransactionNotFound):
+		return 404
+	case errors.Is(err, repository.ErrAccountFrozen), errors.Is(err, repository.ErrAccountClosed),
+		errors.Is(err, repository.ErrBalanceNotZero), errors.Is(err, repository.ErrFundsHeld),
+		errors.Is(err, repository.ErrInterestOwed), errors.Is(err, repository.ErrStatusUnchanged),
+		errors.Is(err, repository.ErrAlreadyReversed), errors.Is(err, repository.ErrCrossCurrencyReversal),
+		errors.Is(err, repository.ErrNotReversible):
+		return 409
+	case errors.Is(err, repository.ErrInsufficientFunds), errors.Is(err, repository.ErrReversalExceedsAmount),
+		errors.Is(err, repository.ErrAmountOverflow), errors.Is(err, repository.ErrNoExchangeRate):
+		return 422
+	}
+	return 500
+}
+
+// ListExchangeRates returns the rates cross-currency transfers convert at.
+func (h *AccountHandler) ListExchangeRates(ctx *gin.Context) {
+	rates, err := h.repository.ListExchangeRates(ctx)
+	if err != nil {
+		ctx.JSON(500, err.Error())
+		return
+	}
+	ctx.JSON(200, rates)
+}
+
+// CheckLedger reports whether the journal balances and matches every account balance.
+func (h *AccountHandler) CheckLedger(ctx *gin.Context) {
+	if err := h.repository.CheckLedger(ctx); err != nil {
+		h.logger.Error("check ledger", zap.Error(err))
+		ctx.JSON(500, err.Error())
+		return
+	}
+	ctx.JSON(200, "balanced")
 }
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Yougigun/meepshop_q2/internal/audit"
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// AdminHandler serves the changes staff make to accounts. Every change is
+// recorded in the audit log with who made it and why.
+type AdminHandler struct {
+	logger     *zap.Logger
+	repository repository.AccountStore
+	log        audit.Log
+}
+
+func NewAdminHandler(logger *zap.Logger, repo repository.AccountStore, log audit.Log) *AdminHandler {
+	return &AdminHandler{logger: logger, repository: repo, log: log}
+}
+
+type SetAccountStatusRequest struct {
+	Status repository.AccountStatus `json:"status"`
+	// Reason is why the status changes, it is required
+	Reason string `json:"reason"`
+}
+
+// SetAccountStatus activates, freezes or closes an account.
+func (h *AdminHandler) SetAccountStatus(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	reqBody := &SetAccountStatusRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if strings.TrimSpace(reqBody.Reason) == "" {
+		ctx.JSON(400, "reason is required")
+		return
+	}
+	previous, err := h.repository.SetAccountStatus(ctx, id, reqBody.Status)
+	if errors.Is(err, repository.ErrInvalidStatus) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	h.audit(ctx, audit.Entry{
+		Action:   auth.PermAccountsStatus,
+		Resource: "account/" + string(id),
+		Reason:   reqBody.Reason,
+		Detail:   fmt.Sprintf("%s -> %s", previous, reqBody.Status),
+	})
+	h.logger.Info("set account status", zap.Any("account_id", id), zap.Any("from", previous), zap.Any("to", reqBody.Status))
+	ctx.JSON(200, "success")
+}
+
+type SetOverdraftRequest struct {
+	Limit int64 `json:"limit"`
+	// InterestRate is the yearly interest on overdrawn balances in basis points
+	InterestRate int `json:"interest_rate"`
+	// Reason is why the overdraft changes, it is required
+	Reason string `json:"reason"`
+}
+
+// SetOverdraft changes the overdraft limit and interest rate of an account.
+// The change is kept in the overdraft history of the account.
+func (h *AdminHandler) SetOverdraft(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	reqBody := &SetOverdraftRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if strings.TrimSpace(reqBody.Reason) == "" {
+		ctx.JSON(400, "reason is required")
+		return
+	}
+	c := repository.OverdraftChange{
+		AccountID: id,
+		Overdraft: repository.Overdraft{Limit: reqBody.Limit, InterestRate: reqBody.InterestRate},
+		Reason:    reqBody.Reason,
+	}
+	if p := auth.FromContext(ctx); p != nil {
+		c.ChangedBy = p.Subject
+	}
+	change, err := h.repository.SetOverdraft(ctx, c)
+	if errors.Is(err, repository.ErrInvalidOverdraft) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	h.audit(ctx, audit.Entry{
+		Action:   auth.PermOverdraftManage,
+		Resource: "account/" + string(id),
+		Reason:   reqBody.Reason,
+		Detail:   fmt.Sprintf("limit %d, interest rate %d bps", change.Limit, change.InterestRate),
+	})
+	h.logger.Info("set overdraft", zap.Any("account_id", id), zap.Any("overdraft", change.Overdraft))
+	ctx.JSON(200, change)
+}
+
+type SetExchangeRateRequest struct {
+	From repository.Currency `json:"from"`
+	To   repository.Currency `json:"to"`
+	// Rate is how many units of To one unit of From buys, a decimal string
+	Rate string `json:"rate"`
+	// Spread is the part of the converted amount the bank keeps in basis points
+	Spread int `json:"spread"`
+	// Reason is why the rate changes, it is required
+	Reason string `json:"reason"`
+}
+
+// SetExchangeRate sets the rate cross-currency transfers from one currency to
+// another convert at.
+func (h *AdminHandler) SetExchangeRate(ctx *gin.Context) {
+	reqBody := &SetExchangeRateRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if strings.TrimSpace(reqBody.Reason) == "" {
+		ctx.JSON(400, "reason is required")
+		return
+	}
+	rate, err := h.repository.SetExchangeRate(ctx, repository.ExchangeRate{
+		From: reqBody.From, To: reqBody.To, Rate: reqBody.Rate, Spread: reqBody.Spread,
+	})
+	if errors.Is(err, repository.ErrInvalidExchangeRate) || errors.Is(err, repository.ErrInvalidCurrency) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if err != nil {
+		ctx.JSON(500, err.Error())
+		return
+	}
+	h.audit(ctx, audit.Entry{
+		Action:   auth.PermRatesManage,
+		Resource: fmt.Sprintf("exchange-rate/%s-%s", rate.From, rate.To),
+		Reason:   reqBody.Reason,
+		Detail:   fmt.Sprintf("%s, spread %d bps", rate.Rate, rate.Spread),
+	})
+	h.logger.Info("set exchange rate", zap.Any("rate", rate))
+	ctx.JSON(200, rate)
+}
+
+type FeeRuleRequest struct {
+	Name        string               `json:"name"`
+	ToAccountID repository.AccountID `json:"to_account_id"`
+	// Rate is the part of every leg the fee takes in basis points
+	Rate  int   `json:"rate"`
+	Fixed int64 `json:"fixed"`
+}
+
+type SetFeeScheduleRequest struct {
+	// Rules are applied in order, none removes the fees of the merchant
+	Rules []FeeRuleRequest `json:"rules"`
+	// Reason is why the fees change, it is required
+	Reason string `json:"reason"`
+}
+
+// SetFeeSchedule replaces the fee rules taken out of the split payments to a
+// merchant account.
+func (h *AdminHandler) SetFeeSchedule(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	reqBody := &SetFeeScheduleRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if strings.TrimSpace(reqBody.Reason) == "" {
+		ctx.JSON(400, "reason is required")
+		return
+	}
+	s := repository.FeeSchedule{Merchant: id, Rules: make([]repository.FeeRule, 0, len(reqBody.Rules))}
+	for _, f := range reqBody.Rules {
+		s.Rules = append(s.Rules, repository.FeeRule{Name: f.Name, To: f.ToAccountID, Rate: f.Rate, Fixed: f.Fixed})
+	}
+	schedule, err := h.repository.SetFeeSchedule(ctx, s)
+	if errors.Is(err, repository.ErrInvalidFeeRule) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	h.audit(ctx, audit.Entry{
+		Action:   auth.PermFeesManage,
+		Resource: "account/" + string(id),
+		Reason:   reqBody.Reason,
+		Detail:   fmt.Sprintf("%d fee rules", len(schedule.Rules)),
+	})
+	h.logger.Info("set fee schedule", zap.Any("account_id", id), zap.Any("rules", schedule.Rules))
+	ctx.JSON(200, schedule)
+}
+
+// audit records a change that is already made, so a failing log only shows
+// in the logs.
+func (h *AdminHandler) audit(ctx *gin.Context, e audit.Entry) {
+	if err := auth.Audit(ctx, h.log, e); err != nil {
+		h.logger.Error("record audit entry", zap.Any("entry", e), zap.Error(err))
+	}
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"strconv"
+
+	"github.com/Yougigun/meepshop_q2/internal/audit"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type AuditHandler struct {
+	logger *zap.Logger
+	log    audit.Log
+}
+
+func NewAuditHandler(logger *zap.Logger, log audit.Log) *AuditHandler {
+	return &AuditHandler{logger: logger, log: log}
+}
+
+// GetAuditLog returns audit entries newest first, filtered by the query
+// parameters actor, action and outcome, at most limit of them.
+func (h *AuditHandler) GetAuditLog(ctx *gin.Context) {
+	q := audit.Query{
+		Actor:   ctx.Query("actor"),
+		Action:  ctx.Query("action"),
+		Outcome: ctx.Query("outcome"),
+	}
+	if v := ctx.Query("limit"); v != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			ctx.JSON(400, err.Error())
+			return
+		}
+	}
+	entries, err := h.log.List(ctx, q)
+	if err != nil {
+		ctx.JSON(500, err.Error())
+		return
+	}
+	ctx.JSON(200, entries)
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+type CustomerHandler struct {
+	logger     *zap.Logger
+	repository repository.CustomerStore
+}
+
+func NewCustomerHandler(logger *zap.Logger, repo repository.CustomerStore) *CustomerHandler {
+	return &CustomerHandler{logger: logger, repository: repo}
+}
+
+type CustomerRequest struct {
+	Name              string `json:"name"`
+	Email             string `json:"email"`
+	ExternalReference string `json:"external_reference"`
+}
+
+func (r *CustomerRequest) customer(id repository.CustomerID) repository.Customer {
+	return repository.Customer{ID: id, Name: r.Name, Email: r.Email, ExternalReference: r.ExternalReference}
+}
+
+// customerStatus is 400 for invalid input, 404 for unknown customers and
+// holders, 409 for customers still holding accounts and accounts that would
+// lose their last owner, and movementStatus for the other errors of the
+// customer store.
+func customerStatus(err error) int {
+	switch {
+	case errors.Is(err, repository.ErrInvalidCustomer), errors.Is(err, repository.ErrInvalidHolder):
+		return 400
+	case errors.Is(err, repository.ErrCustomerNotFound), errors.Is(err, repository.ErrHolderNotFound):
+		return 404
+	case errors.Is(err, repository.ErrCustomerHasAccounts), errors.Is(err, repository.ErrNoOwner):
+		return 409
+	}
+	return movementStatus(err)
+}
+
+func (h *CustomerHandler) CreateCustomer(ctx *gin.Context) {
+	reqBody := &CustomerRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	c, err := h.repository.CreateCustomer(ctx, reqBody.customer(""))
+	if err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("create customer", zap.Any("customer_id", c.ID))
+	ctx.JSON(200, c)
+}
+
+// ListCustomers returns the customers, filtered by the query parameters email
+// and external_reference.
+func (h *CustomerHandler) ListCustomers(ctx *gin.Context) {
+	if !auth.AllowAll(ctx) {
+		return
+	}
+	q := repository.CustomerQuery{Email: ctx.Query("email"), ExternalReference: ctx.Query("external_reference")}
+	list, err := h.repository.ListCustomers(ctx, q)
+	if err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(200, list)
+}
+
+func (h *CustomerHandler) GetCustomer(ctx *gin.Context) {
+	id := repository.CustomerID(ctx.Param("id"))
+	if !auth.AllowCustomer(ctx, id) {
+		return
+	}
+	if c, err := h.repository.GetCustomer(ctx, id); err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+	} else {
+		ctx.JSON(200, c)
+	}
+}
+
+// UpdateCustomer replaces the name, email and external reference of a
+// customer.
+func (h *CustomerHandler) UpdateCustomer(ctx *gin.Context) {
+	id := repository.CustomerID(ctx.Param("id"))
+	if !auth.AllowCustomer(ctx, id) {
+		return
+	}
+	reqBody := &CustomerRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	c, err := h.repository.UpdateCustomer(ctx, reqBody.customer(id))
+	if err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("update customer", zap.Any("customer_id", id))
+	ctx.JSON(200, c)
+}
+
+// DeleteCustomer deletes a customer that holds no accounts.
+func (h *CustomerHandler) DeleteCustomer(ctx *gin.Context) {
+	id := repository.CustomerID(ctx.Param("id"))
+	if !auth.AllowCustomer(ctx, id) {
+		return
+	}
+	if err := h.repository.DeleteCustomer(ctx, id); err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("delete customer", zap.Any("customer_id", id))
+	ctx.JSON(200, "success")
+}
+
+// GetCustomerAccounts returns the accounts a customer holds with its role on
+// each.
+func (h *CustomerHandler) GetCustomerAccounts(ctx *gin.Context) {
+	id := repository.CustomerID(ctx.Param("id"))
+	if !auth.AllowCustomer(ctx, id) {
+		return
+	}
+	if accounts, err := h.repository.ListCustomerAccounts(ctx, id); err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+	} else {
+		ctx.JSON(200, accounts)
+	}
+}
+
+func (h *CustomerHandler) GetAccountHolders(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, id) {
+		return
+	}
+	if holders, err := h.repository.GetAccountHolders(ctx, id); err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+	} else {
+		ctx.JSON(200, holders)
+	}
+}
+
+type AccountHolderRequest struct {
+	CustomerID repository.CustomerID `json:"customer_id"`
+	Role       repository.HolderRole `json:"role"`
+}
+
+// SetAccountHolder links a customer to an account, or changes its role.
+func (h *CustomerHandler) SetAccountHolder(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, id) {
+		return
+	}
+	reqBody := &AccountHolderRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	holder := repository.AccountHolder{AccountID: id, CustomerID: reqBody.CustomerID, Role: reqBody.Role}
+	if err := h.repository.SetAccountHolder(ctx, holder); err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("set account holder", zap.Any("holder", holder))
+	ctx.JSON(200, "success")
+}
+
+func (h *CustomerHandler) RemoveAccountHolder(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, id) {
+		return
+	}
+	customer := repository.CustomerID(ctx.Param("customer_id"))
+	if err := h.repository.RemoveAccountHolder(ctx, id, customer); err != nil {
+		ctx.JSON(customerStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("remove account holder", zap.Any("account_id", id), zap.Any("customer_id", customer))
+	ctx.JSON(200, "success")
+}
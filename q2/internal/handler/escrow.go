@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// EscrowHandler serves the escrow of marketplace orders: the buyer pays into
+// escrow at checkout and the payment goes to the merchant on delivery, or
+// back to the buyer if the order is cancelled.
+type EscrowHandler struct {
+	logger     *zap.Logger
+	repository repository.AccountStore
+}
+
+func NewEscrowHandler(logger *zap.Logger, repo repository.AccountStore) *EscrowHandler {
+	return &EscrowHandler{logger: logger, repository: repo}
+}
+
+type OpenEscrowRequest struct {
+	OrderID           string               `json:"order_id"`
+	BuyerAccountID    repository.AccountID `json:"buyer_account_id"`
+	MerchantAccountID repository.AccountID `json:"merchant_account_id"`
+	Amount            int64                `json:"amount"`
+	Currency          repository.Currency  `json:"currency"`
+	// ReleaseAt is when the payment goes to the merchant if delivery is not
+	// confirmed before, in two weeks if it is empty
+	ReleaseAt time.Time `json:"release_at"`
+	Memo      string    `json:"memo"`
+}
+
+// escrowStatus is 400 for invalid escrows and amounts, 404 for unknown
+// orders, 409 for orders already in escrow, already settled or not yet due
+// and movementStatus for the other errors of the store.
+func escrowStatus(err error) int {
+	switch {
+	case errors.Is(err, repository.ErrInvalidEscrow):
+		return 400
+	case errors.Is(err, repository.ErrEscrowNotFound):
+		return 404
+	case errors.Is(err, repository.ErrEscrowExists), errors.Is(err, repository.ErrEscrowSettled),
+		errors.Is(err, repository.ErrEscrowNotDue):
+		return 409
+	}
+	return movementStatus(err)
+}
+
+func (h *EscrowHandler) OpenEscrow(ctx *gin.Context) {
+	reqBody := &OpenEscrowRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	amount, err := repository.NewMoney(reqBody.Amount, reqBody.Currency)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	// customers pay into escrow from their own accounts
+	if !auth.AllowAccount(ctx, reqBody.BuyerAccountID) {
+		return
+	}
+	escrow, err := h.repository.OpenEscrow(ctx, reqBody.OrderID, reqBody.BuyerAccountID, reqBody.MerchantAccountID, amount, reqBody.ReleaseAt, reqBody.Memo)
+	if err != nil {
+		ctx.JSON(escrowStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("open escrow", zap.Any("escrow", escrow))
+	ctx.JSON(200, escrow)
+}
+
+// allowEscrow answers and returns false unless the escrow of order exists
+// and the caller is its buyer or merchant. Others get the 404 of an unknown
+// order.
+func (h *EscrowHandler) allowEscrow(ctx *gin.Context, order string) (*repository.Escrow, bool) {
+	escrow, err := h.repository.GetEscrow(ctx, order)
+	if err != nil {
+		ctx.JSON(escrowStatus(err), err.Error())
+		return nil, false
+	}
+	if !auth.AllowAnyAccount(ctx, "escrow/"+order, repository.ErrEscrowNotFound, escrow.Buyer, escrow.Merchant) {
+		return nil, false
+	}
+	return escrow, true
+}
+
+// ReleaseEscrow pays the escrow of an order to the merchant on delivery.
+func (h *EscrowHandler) ReleaseEscrow(ctx *gin.Context) {
+	if _, ok := h.allowEscrow(ctx, ctx.Param("order_id")); !ok {
+		return
+	}
+	escrow, err := h.repository.ReleaseEscrow(ctx, ctx.Param("order_id"))
+	if err != nil {
+		ctx.JSON(escrowStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("release escrow", zap.Any("escrow", escrow))
+	ctx.JSON(200, escrow)
+}
+
+// RefundEscrow gives the escrow of a cancelled order back to the buyer.
+func (h *EscrowHandler) RefundEscrow(ctx *gin.Context) {
+	if _, ok := h.allowEscrow(ctx, ctx.Param("order_id")); !ok {
+		return
+	}
+	escrow, err := h.repository.RefundEscrow(ctx, ctx.Param("order_id"))
+	if err != nil {
+		ctx.JSON(escrowStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("refund escrow", zap.Any("escrow", escrow))
+	ctx.JSON(200, escrow)
+}
+
+// GetEscrow returns the escrow of an order to its buyer or merchant. Others
+// get the same 404 as for an unknown order.
+func (h *EscrowHandler) GetEscrow(ctx *gin.Context) {
+	escrow, ok := h.allowEscrow(ctx, ctx.Param("order_id"))
+	if !ok {
+		return
+	}
+	ctx.JSON(200, escrow)
+}
+
+// GetAccountEscrows lists the escrows an account pays or is paid by, oldest
+// first.
+func (h *EscrowHandler) GetAccountEscrows(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, id) {
+		return
+	}
+	escrows, err := h.repository.ListEscrows(ctx, id)
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(200, escrows)
+}
+
+// EscrowReleaser periodically releases the escrows whose delivery was not
+// confirmed or cancelled in time to their merchants.
+type EscrowReleaser struct {
+	logger     *zap.Logger
+	repository repository.AccountStore
+}
+
+func NewEscrowReleaser(logger *zap.Logger, repo repository.AccountStore) *EscrowReleaser {
+	return &EscrowReleaser{logger: logger, repository: repo}
+}
+
+// Run releases due escrows every interval until ctx is done.
+func (e *EscrowReleaser) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := e.repository.ReleaseDueEscrows(ctx, now)
+			if err != nil && ctx.Err() == nil {
+				e.logger.Error("release escrows", zap.Error(err))
+			}
+			if n > 0 {
+				e.logger.Info("release escrows", zap.Int("escrows", n))
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/broker"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+)
+
+// Event types published to the broker. Transaction events are named after the
+// transaction type, e.g. transaction.transfer.
+const (
+	EventAccountCreated    = "account.created"
+	EventTransactionPrefix = "transaction."
+)
+
+// transactionEvents returns one event per customer account that a log entry
+// moved money of, keyed by the account so each account sees its entries in
+// order. A transfer is published to both of its accounts.
+func transactionEvents(batch repository.BatchTransaction) ([]broker.Event, error) {
+	events := make([]broker.Event, 0, len(batch))
+	for _, tl := range batch {
+		payload, err := json.Marshal(tl)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range []repository.AccountID{tl.From, tl.To} {
+			if repository.IsSystemAccount(id) {
+				continue
+			}
+			events = append(events, broker.Event{
+				Type:    EventTransactionPrefix + string(tl.Type),
+				Key:     string(id),
+				Payload: payload,
+				Time:    tl.When,
+			})
+		}
+	}
+	return events, nil
+}
+
+func accountCreatedEvent(id repository.AccountID) (broker.Event, error) {
+	payload, err := json.Marshal(struct{ AccountID repository.AccountID }{AccountID: id})
+	if err != nil {
+		return broker.Event{}, err
+	}
+	return broker.Event{Type: EventAccountCreated, Key: string(id), Payload: payload, Time: time.Now()}, nil
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// HoldHandler serves authorization holds: funds reserved at checkout and
+// captured to the shop on fulfilment.
+type HoldHandler struct {
+	logger     *zap.Logger
+	repository repository.AccountStore
+}
+
+func NewHoldHandler(logger *zap.Logger, repo repository.AccountStore) *HoldHandler {
+	return &HoldHandler{logger: logger, repository: repo}
+}
+
+type PlaceHoldRequest struct {
+	AccountID repository.AccountID `json:"account_id"`
+	// ToAccountID is the account captured funds go to
+	ToAccountID repository.AccountID `json:"to_account_id"`
+	Amount      int64                `json:"amount"`
+	Currency    repository.Currency  `json:"currency"`
+	// ExpiresAt is when the hold is released if it is not captured, a week
+	// from now if it is empty
+	ExpiresAt time.Time `json:"expires_at"`
+	Memo      string    `json:"memo"`
+	Reference string    `json:"reference"`
+}
+
+// holdStatus is 400 for invalid holds and amounts, 404 for unknown holds,
+// 409 for holds no longer active, 422 for captures over the held amount and
+// movementStatus for the other errors of the store.
+func holdStatus(err error) int {
+	switch {
+	case errors.Is(err, repository.ErrInvalidHold):
+		return 400
+	case errors.Is(err, repository.ErrHoldNotFound):
+		return 404
+	case errors.Is(err, repository.ErrHoldNotActive), errors.Is(err, repository.ErrHoldExpired):
+		return 409
+	case errors.Is(err, repository.ErrCaptureExceedsHold):
+		return 422
+	}
+	return movementStatus(err)
+}
+
+// allowHold answers and returns false unless hold id exists and the caller
+// may act on the account it reserves funds of.
+func (h *HoldHandler) allowHold(ctx *gin.Context, id int64) (*repository.Hold, bool) {
+	hold, err := h.repository.GetHold(ctx, id)
+	if err != nil {
+		ctx.JSON(holdStatus(err), err.Error())
+		return nil, false
+	}
+	if !auth.AllowAccount(ctx, hold.AccountID) {
+		return nil, false
+	}
+	return hold, true
+}
+
+func (h *HoldHandler) PlaceHold(ctx *gin.Context) {
+	reqBody := &PlaceHoldRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	amount, err := repository.NewMoney(reqBody.Amount, reqBody.Currency)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	// customers may reserve their own funds for anyone
+	if !auth.AllowAccount(ctx, reqBody.AccountID) {
+		return
+	}
+	meta := repository.TransactionMeta{Memo: reqBody.Memo, Reference: reqBody.Reference}
+	hold, err := h.repository.PlaceHold(ctx, reqBody.AccountID, reqBody.ToAccountID, amount, reqBody.ExpiresAt, meta)
+	if err != nil {
+		ctx.JSON(holdStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("place hold", zap.Any("hold", hold))
+	ctx.JSON(200, hold)
+}
+
+type CaptureHoldRequest struct {
+	// Amount is the amount to capture, 0 captures the whole hold
+	Amount   int64               `json:"amount"`
+	Currency repository.Currency `json:"currency"`
+}
+
+// CaptureHold moves all or part of a hold to its payee and releases the rest.
+func (h *HoldHandler) CaptureHold(ctx *gin.Context) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	// the body is optional, an empty one captures the whole hold
+	reqBody := &CaptureHoldRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil && !errors.Is(err, io.EOF) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	amount := repository.Money{Currency: reqBody.Currency}
+	if reqBody.Amount != 0 {
+		if amount, err = repository.NewMoney(reqBody.Amount, reqBody.Currency); err != nil {
+			ctx.JSON(400, err.Error())
+			return
+		}
+	}
+	if _, ok := h.allowHold(ctx, id); !ok {
+		return
+	}
+	hold, err := h.repository.CaptureHold(ctx, id, amount)
+	if err != nil {
+		ctx.JSON(holdStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("capture hold", zap.Any("hold", hold))
+	ctx.JSON(200, hold)
+}
+
+func (h *HoldHandler) ReleaseHold(ctx *gin.Context) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if _, ok := h.allowHold(ctx, id); !ok {
+		return
+	}
+	hold, err := h.repository.ReleaseHold(ctx, id)
+	if err != nil {
+		ctx.JSON(holdStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("release hold", zap.Any("hold", hold))
+	ctx.JSON(200, hold)
+}
+
+func (h *HoldHandler) GetHold(ctx *gin.Context) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	hold, ok := h.allowHold(ctx, id)
+	if !ok {
+		return
+	}
+	ctx.JSON(200, hold)
+}
+
+// GetAccountHolds lists the holds of an account, oldest first.
+func (h *HoldHandler) GetAccountHolds(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, id) {
+		return
+	}
+	holds, err := h.repository.ListHolds(ctx, id)
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(200, holds)
+}
+
+// HoldExpirer periodically releases the holds that expired uncaptured.
+type HoldExpirer struct {
+	logger     *zap.Logger
+	repository repository.AccountStore
+}
+
+func NewHoldExpirer(logger *zap.Logger, repo repository.AccountStore) *HoldExpirer {
+	return &HoldExpirer{logger: logger, repository: repo}
+}
+
+// Run expires holds every interval until ctx is done.
+func (e *HoldExpirer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := e.repository.ExpireHolds(ctx, now)
+			if err != nil && ctx.Err() == nil {
+				e.logger.Error("expire holds", zap.Error(err))
+			}
+			if n > 0 {
+				e.logger.Info("expire holds", zap.Int("holds", n))
+			}
+		}
+	}
+}
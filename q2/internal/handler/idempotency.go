@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// recordingWriter keeps a copy of the response body for the idempotency store.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency makes requests carrying an Idempotency-Key header safe to retry.
+// The first response for a key is stored and replayed for every retry with the
+// same method, path and body. A key reused for a different request is rejected.
+// Keys are scoped to the authenticated caller, so callers cannot see each
+// other's responses.
+func Idempotency(logger *zap.Logger, store repository.IdempotencyStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			ctx.Next()
+			return
+		}
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			ctx.AbortWithStatusJSON(400, err.Error())
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		if p := auth.FromContext(ctx); p != nil {
+			key = p.Method + ":" + p.Subject + ":" + key
+		}
+		// the actual path, not the route, so a key reused on another :id is rejected
+		sum := sha256.Sum256(append([]byte(ctx.Request.Method+" "+ctx.Request.URL.Path+"\n"), body...))
+		resp, err := store.Begin(ctx, key, hex.EncodeToString(sum[:]))
+		if errors.Is(err, repository.ErrIdempotencyKeyReused) {
+			ctx.AbortWithStatusJSON(422, err.Error())
+			return
+		}
+		if errors.Is(err, repository.ErrIdempotencyKeyInFlight) {
+			ctx.AbortWithStatusJSON(409, err.Error())
+			return
+		}
+		if err != nil {
+			ctx.AbortWithStatusJSON(500, err.Error())
+			return
+		}
+		if resp != nil {
+			ctx.Header("Idempotent-Replayed", "true")
+			ctx.Data(resp.Status, resp.ContentType, resp.Body)
+			ctx.Abort()
+			return
+		}
+
+		// a panicking handler must not leave the key reserved until it expires
+		defer func() {
+			if p := recover(); p != nil {
+				_ = store.Release(ctx, key)
+				panic(p)
+			}
+		}()
+		writer := &recordingWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = writer
+		ctx.Next()
+
+		if !writer.Written() {
+			if err := store.Release(ctx, key); err != nil {
+				logger.Error("release idempotency key", zap.String("key", key), zap.Error(err))
+			}
+			return
+		}
+		err = store.Complete(ctx, key, repository.IdempotentResponse{
+			Status:      writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+		})
+		if err != nil {
+			logger.Error("store idempotent response", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"go.uber.org/zap"
+)
+
+// InterestCharger periodically charges the overdraft interest that accounts
+// accrued. Interest accrues by the second, so how often it is charged only
+// changes when it shows up on the accounts, not how much it is.
+type InterestCharger struct {
+	logger     *zap.Logger
+	repository repository.AccountStore
+}
+
+func NewInterestCharger(logger *zap.Logger, repo repository.AccountStore) *InterestCharger {
+	return &InterestCharger{logger: logger, repository: repo}
+}
+
+// Run charges interest every interval until ctx is done.
+func (c *InterestCharger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := c.repository.ChargeInterest(ctx, now)
+			if err != nil && ctx.Err() == nil {
+				c.logger.Error("charge overdraft interest", zap.Error(err))
+			}
+			if n > 0 {
+				c.logger.Info("charge overdraft interest", zap.Int("accounts", n))
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/broker"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const relayBatchSize = 300
+
+// TransactionRelay moves the log entries that money movements commit to the
+// repository outbox into the transaction log. Entries stay in the outbox until
+// they are relayed, so none are lost when the server stops. With an event
+// publisher every entry is published before it leaves the outbox, so a
+// broker outage delays the log instead of dropping events.
+type TransactionRelay struct {
+	logger     *zap.Logger
+	repository repository.AccountStore
+	events     broker.EventPublisher
+	relayed    int64
+	failures   int64
+}
+
+// NewTransactionRelay returns a relay of the outbox of repo. events may be nil.
+func NewTransactionRelay(logger *zap.Logger, repo repository.AccountStore, events broker.EventPublisher) *TransactionRelay {
+	return &TransactionRelay{
+		logger:     logger,
+		repository: repo,
+		events:     events,
+	}
+}
+
+// Run relays the outbox every interval until ctx is done.
+func (r *TransactionRelay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Flush(ctx); err != nil && ctx.Err() == nil {
+				r.logger.Error("relay transaction log", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush relays batches until the outbox is empty.
+func (r *TransactionRelay) Flush(ctx context.Context) error {
+	var publish func(repository.BatchTransaction) error
+	if r.events != nil {
+		publish = func(batch repository.BatchTransaction) error {
+			events, err := transactionEvents(batch)
+			if err != nil {
+				return err
+			}
+			return r.events.Publish(ctx, events...)
+		}
+	}
+	for {
+		n, err := r.repository.RelayTransactions(ctx, relayBatchSize, publish)
+		atomic.AddInt64(&r.relayed, int64(n))
+		if err != nil {
+			atomic.AddInt64(&r.failures, 1)
+			return err
+		}
+		if n < relayBatchSize {
+			return nil
+		}
+	}
+}
+
+// Metrics reports the outbox depth and relay counters in the Prometheus text format.
+func (r *TransactionRelay) Metrics(ctx *gin.Context) {
+	depth, err := r.repository.OutboxDepth(ctx)
+	if err != nil {
+		ctx.JSON(500, err.Error())
+		return
+	}
+	body := fmt.Sprintf(`# HELP transaction_outbox_depth Transaction log entries committed but not yet relayed.
+# TYPE transaction_outbox_depth gauge
+transaction_outbox_depth %d
+# HELP transaction_log_relayed_total Transaction log entries relayed from the outbox.
+# TYPE transaction_log_relayed_total counter
+transaction_log_relayed_total %d
+# HELP transaction_log_relay_failures_total Failed relays of the outbox.
+# TYPE transaction_log_relay_failures_total counter
+transaction_log_relay_failures_total %d
+`, depth, atomic.LoadInt64(&r.relayed), atomic.LoadInt64(&r.failures))
+	ctx.Data(200, "text/plain; version=0.0.4; charset=utf-8", []byte(body))
+}
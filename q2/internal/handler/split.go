@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// SplitHandler serves split payments: one checkout payment shared among the
+// merchant, the platform and the shipping partner, with the fees of every
+// merchant taken out of its share.
+type SplitHandler struct {
+	logger     *zap.Logger
+	repository repository.AccountStore
+}
+
+func NewSplitHandler(logger *zap.Logger, repo repository.AccountStore) *SplitHandler {
+	return &SplitHandler{logger: logger, repository: repo}
+}
+
+type SplitLegRequest struct {
+	ToAccountID repository.AccountID `json:"to_account_id"`
+	// Amount is before the fees of the receiver
+	Amount int64 `json:"amount"`
+}
+
+type SplitTransferRequest struct {
+	FromAccountID repository.AccountID `json:"from_account_id"`
+	Legs          []SplitLegRequest    `json:"legs"`
+	// Currency is the currency of every leg, that of the payer
+	Currency  repository.Currency `json:"currency"`
+	Memo      string              `json:"memo"`
+	Reference string              `json:"reference"`
+}
+
+// splitStatus is 400 for invalid splits, fees and amounts and 500 for the
+// other errors of the store.
+func splitStatus(err error) int {
+	if errors.Is(err, repository.ErrInvalidSplit) || errors.Is(err, repository.ErrFeesExceedAmount) {
+		return 400
+	}
+	return movementStatus(err)
+}
+
+// SplitTransfer debits the payer once and credits every leg, less fees, in one
+// atomic operation. It returns the log entries of the payment, which share one
+// transaction id.
+func (h *SplitHandler) SplitTransfer(ctx *gin.Context) {
+	reqBody := &SplitTransferRequest{}
+	if err := ctx.ShouldBindJSON(reqBody); err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	legs := make([]repository.Leg, 0, len(reqBody.Legs))
+	for _, leg := range reqBody.Legs {
+		amount, err := repository.NewMoney(leg.Amount, reqBody.Currency)
+		if err != nil {
+			ctx.JSON(400, err.Error())
+			return
+		}
+		legs = append(legs, repository.Leg{To: leg.ToAccountID, Amount: amount})
+	}
+	// customers may split payments from their own accounts
+	if !auth.AllowAccount(ctx, reqBody.FromAccountID) {
+		return
+	}
+	meta := repository.TransactionMeta{Memo: reqBody.Memo, Reference: reqBody.Reference}
+	log, err := h.repository.SplitTransfer(ctx, reqBody.FromAccountID, legs, meta)
+	if err != nil {
+		ctx.JSON(splitStatus(err), err.Error())
+		return
+	}
+	h.logger.Info("split transfer", zap.Any("log", log))
+	ctx.JSON(200, log)
+}
+
+// GetFeeSchedule returns the fee rules of a merchant account.
+func (h *SplitHandler) GetFeeSchedule(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, id) {
+		return
+	}
+	s, err := h.repository.GetFeeSchedule(ctx, id)
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	ctx.JSON(200, s)
+}
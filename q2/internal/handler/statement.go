@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+	"github.com/Yougigun/meepshop_q2/internal/statement"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const statementDate = "2006-01-02"
+
+// GetStatement returns the statement of an account for the period from-to in
+// format json (default), csv or pdf. from and to are dates, to inclusive, or
+// RFC 3339 times, to exclusive. The period defaults to the current month
+// and to one month after from.
+func (h *AccountHandler) GetStatement(ctx *gin.Context) {
+	id := repository.AccountID(ctx.Param("id"))
+	if !auth.AllowAccount(ctx, id) {
+		return
+	}
+	format := ctx.DefaultQuery("format", statement.FormatJSON)
+	contentType, err := statement.ContentType(format)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	from, err := statementTime(ctx.Query("from"), false)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if from.IsZero() {
+		from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	to, err := statementTime(ctx.Query("to"), true)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if to.IsZero() {
+		to = from.AddDate(0, 1, 0)
+	}
+
+	s, err := statement.Build(ctx, h.repository, id, from, to)
+	if errors.Is(err, statement.ErrInvalidPeriod) {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	if err != nil {
+		ctx.JSON(movementStatus(err), err.Error())
+		return
+	}
+	var buf bytes.Buffer
+	if err := s.Write(&buf, format); err != nil {
+		ctx.JSON(500, err.Error())
+		return
+	}
+	h.logger.Info("statement", zap.Any("account_id", id), zap.String("format", format), zap.Int("lines", len(s.Lines)))
+	filename := fmt.Sprintf("statement-%s-%s.%s", id, from.Format(statementDate), format)
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	ctx.Data(200, contentType, buf.Bytes())
+}
+
+// statementTime parses a date or an RFC 3339 time. A date ending a period
+// includes the whole day. An empty value is the zero time.
+func statementTime(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(statementDate, v); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,86 @@
+package repository
+
+import "sync"
+
+// accountShards is the number of shards of an accountMap, a power of two.
+const accountShards = 64
+
+// accountMap is the concurrency-safe account index of Repository. Accounts
+// are spread over shards by id, so creating an account only blocks lookups of
+// the accounts in its shard. The zero value is ready to use.
+type accountMap struct {
+	shards [accountShards]accountShard
+}
+
+type accountShard struct {
+	accounts map[AccountID]*account
+	rw       sync.RWMutex
+}
+
+func (m *accountMap) shard(id AccountID) *accountShard {
+	// fnv-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return &m.shards[h&(accountShards-1)]
+}
+
+// get returns the account with id, or nil if there is none.
+func (m *accountMap) get(id AccountID) *account {
+	s := m.shard(id)
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return s.accounts[id]
+}
+
+// put adds acc to the index, replacing any account with the same id.
+func (m *accountMap) put(acc *account) {
+	s := m.shard(acc.ID)
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	if s.accounts == nil {
+		s.accounts = make(map[AccountID]*account)
+	}
+	s.accounts[acc.ID] = acc
+}
+
+// len returns the number of accounts.
+func (m *accountMap) len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.rw.RLock()
+		n += len(s.accounts)
+		s.rw.RUnlock()
+	}
+	return n
+}
+
+// each calls fn for every account, one shard at a time. Accounts added while
+// it runs may or may not be visited.
+func (m *accountMap) each(fn func(acc *account)) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.rw.RLock()
+		for _, acc := range s.accounts {
+			fn(acc)
+		}
+		s.rw.RUnlock()
+	}
+}
+
+// lockAccounts locks a and b in id order, so that two operations on the same
+// pair of accounts cannot deadlock, and returns the function unlocking them.
+func lockAccounts(a, b *account) func() {
+	if a.ID > b.ID {
+		a, b = b, a
+	}
+	a.rw.Lock()
+	b.rw.Lock()
+	return func() {
+		b.rw.Unlock()
+		a.rw.Unlock()
+	}
+}
@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestRepositoryConcurrentOperations mixes every operation from thousands of
+// goroutines. Run it with -race to check the account index and locking.
+func TestRepositoryConcurrentOperations(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		stressRepository(t, NewRepository(), nil)
+	})
+	t.Run("durable", func(t *testing.T) {
+		repo, err := NewDurableRepository(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewDurableRepository() error = %v", err)
+		}
+		defer repo.Close()
+		stressRepository(t, repo, repo.Snapshot)
+	})
+}
+
+func stressRepository(t *testing.T, repo *Repository, snapshot func() error) {
+	const (
+		goroutines = 4000
+		seeded     = 16
+	)
+	ctx := context.Background()
+
+	ids := make([]AccountID, 0, seeded)
+	for i := 0; i < seeded; i++ {
+		id, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, id, Money{Amount: 1000}, TransactionMeta{})
+		ids = append(ids, id)
+	}
+
+	var mu sync.Mutex
+	var deposited, withdrawn int64
+	var transfers []int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, b := ids[i%seeded], ids[(i*7+1)%seeded]
+			switch i % 9 {
+			case 0:
+				if _, err := repo.CreateAccount(ctx); err != nil {
+					t.Errorf("CreateAccount() error = %v", err)
+				}
+			case 1:
+				if _, err := repo.DepositAccount(ctx, a, Money{Amount: 10}, TransactionMeta{}); err == nil {
+					mu.Lock()
+					deposited += 10
+					mu.Unlock()
+				}
+			case 2:
+				if _, err := repo.WithdrawAccount(ctx, a, Money{Amount: 15}, TransactionMeta{}); err == nil {
+					mu.Lock()
+					withdrawn += 15
+					mu.Unlock()
+				}
+			case 3:
+				if tl, err := repo.TransferAccount(ctx, a, b, Money{Amount: 20}, TransactionMeta{}); err == nil {
+					mu.Lock()
+					transfers = append(transfers, tl.ID)
+					mu.Unlock()
+				}
+			case 4:
+				mu.Lock()
+				var id int64
+				if len(transfers) > 0 {
+					id = transfers[i%len(transfers)]
+				}
+				mu.Unlock()
+				if id != 0 {
+					_, _ = repo.ReverseTransaction(ctx, id, Money{Amount: 5}, TransactionMeta{})
+				}
+			case 5:
+				_, _ = repo.GetAccount(ctx, a)
+				// accounts created concurrently are looked up too
+				_, _ = repo.GetAccount(ctx, AccountID(strconv.Itoa(seeded+i%50)))
+			case 6:
+				_ = repo.AddTransaction(ctx, BatchTransaction{{Type: TransactionDeposit, To: a, Amount: 1}})
+				if _, err := repo.RelayTransactions(ctx, 50, nil); err != nil {
+					t.Errorf("RelayTransactions() error = %v", err)
+				}
+				_, _ = repo.GetTransactions(ctx)
+			case 7:
+				_, _ = repo.GetJournal(ctx)
+				if err := repo.CheckLedger(ctx); err != nil {
+					t.Errorf("CheckLedger() error = %v", err)
+				}
+			case 8:
+				if snapshot != nil && i%90 == 8 {
+					if err := snapshot(); err != nil {
+						t.Errorf("Snapshot() error = %v", err)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() error = %v", err)
+	}
+	var total int64
+	repo.Accounts.each(func(acc *account) {
+		total += int64(acc.Balance)
+	})
+	if want := seeded*1000 + deposited - withdrawn; total != want {
+		t.Errorf("total balance got = %v, want %v", total, want)
+	}
+	if got, want := repo.Accounts.len(), seeded+goroutines/9+1; got != want {
+		t.Errorf("account count got = %v, want %v", got, want)
+	}
+}
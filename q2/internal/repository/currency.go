@@ -0,0 +1,209 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidCurrency       = errors.New("invalid currency")
+	ErrInvalidExchangeRate   = errors.New("invalid exchange rate")
+	ErrNoExchangeRate        = errors.New("no exchange rate between the currencies")
+	ErrCrossCurrencyReversal = errors.New("cross-currency transfers cannot be reversed")
+)
+
+// Currency is an ISO 4217 currency code. Amounts in a currency are in its
+// minor units, cents for USD.
+type Currency string
+
+// DefaultCurrency is the currency of accounts opened without one, and of the
+// accounts, postings and log entries from before accounts had currencies.
+const DefaultCurrency Currency = "TWD"
+
+// currencies are the supported ISO 4217 currencies with the number of digits
+// of their minor unit.
+var currencies = map[Currency]int{
+	"AED": 2, "AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CLP": 0, "CNY": 2,
+	"CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2,
+	"INR": 2, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2, "MYR": 2,
+	"NOK": 2, "NZD": 2, "OMR": 3, "PHP": 2, "PLN": 2, "SAR": 2, "SEK": 2, "SGD": 2,
+	"THB": 2, "TND": 3, "TRY": 2, "TWD": 2, "USD": 2, "VND": 0, "ZAR": 2,
+}
+
+func (c Currency) check() error {
+	if _, ok := currencies[c]; !ok {
+		return fmt.Errorf("%w %q, want an ISO 4217 code such as USD", ErrInvalidCurrency, c)
+	}
+	return nil
+}
+
+// orDefault returns c, or DefaultCurrency for data from before currencies.
+func (c Currency) orDefault() Currency {
+	if c == "" {
+		return DefaultCurrency
+	}
+	return c
+}
+
+// MinorUnits returns the number of digits of the minor unit of c.
+func (c Currency) MinorUnits() int {
+	return currencies[c]
+}
+
+// decimalRate is the format of exchange rates, a positive decimal number.
+var decimalRate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// ExchangeRate converts From into To: one unit of From buys Rate units of To,
+// less Spread basis points kept by the bank. Rates are quoted per direction,
+// USD to TWD and TWD to USD are two rates.
+type ExchangeRate struct {
+	From      Currency
+	To        Currency
+	Rate      string
+	Spread    int
+	UpdatedAt time.Time
+}
+
+func (e *ExchangeRate) check() error {
+	if err := e.From.check(); err != nil {
+		return err
+	}
+	if err := e.To.check(); err != nil {
+		return err
+	}
+	if e.From == e.To {
+		return fmt.Errorf("%w: %s to itself", ErrInvalidExchangeRate, e.From)
+	}
+	if !decimalRate.MatchString(e.Rate) {
+		return fmt.Errorf("%w: rate %q is not a decimal number", ErrInvalidExchangeRate, e.Rate)
+	}
+	if rate, _ := new(big.Rat).SetString(e.Rate); rate.Sign() <= 0 {
+		return fmt.Errorf("%w: rate %q is not positive", ErrInvalidExchangeRate, e.Rate)
+	}
+	if e.Spread < 0 || e.Spread >= 10000 {
+		return fmt.Errorf("%w: spread %d is not between 0 and 9999 basis points", ErrInvalidExchangeRate, e.Spread)
+	}
+	return nil
+}
+
+// Conversion is how a cross-currency transfer converted its amount: the
+// receiver got ToAmount of ToCurrency at Rate, less Spread basis points.
+type Conversion struct {
+	Rate       string
+	Spread     int
+	ToCurrency Currency
+	ToAmount   int64
+}
+
+// convert converts amount minor units of e.From into e.To, rounding down.
+func (e *ExchangeRate) convert(amount int64) (*Conversion, error) {
+	rate, _ := new(big.Rat).SetString(e.Rate)
+	n := new(big.Int).Mul(big.NewInt(amount), rate.Num())
+	n.Mul(n, big.NewInt(int64(10000-e.Spread)))
+	n.Mul(n, pow10(e.To.MinorUnits()))
+	d := new(big.Int).Mul(rate.Denom(), big.NewInt(10000))
+	d.Mul(d, pow10(e.From.MinorUnits()))
+	n.Quo(n, d)
+	if !n.IsInt64() {
+		return nil, fmt.Errorf("%w: %d %s does not fit in %s", ErrInvalidExchangeRate, amount, e.From, e.To)
+	}
+	if n.Sign() == 0 {
+		return nil, fmt.Errorf("%w: %d %s converts to nothing", ErrInvalidExchangeRate, amount, e.From)
+	}
+	return &Conversion{Rate: e.Rate, Spread: e.Spread, ToCurrency: e.To, ToAmount: n.Int64()}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// sortRates orders rates by From and To.
+func sortRates(rates []ExchangeRate) {
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].From != rates[j].From {
+			return rates[i].From < rates[j].From
+		}
+		return rates[i].To < rates[j].To
+	})
+}
+
+// LoadExchangeRates reads a rate table from a JSON file such as
+//
+//	{"rates": [{"from": "USD", "to": "TWD", "rate": "31.52", "spread": 50}]}
+func LoadExchangeRates(path string) ([]ExchangeRate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rates []ExchangeRate
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("exchange rates %s: %w", path, err)
+	}
+	for i := range file.Rates {
+		if err := file.Rates[i].check(); err != nil {
+			return nil, fmt.Errorf("exchange rates %s: %w", path, err)
+		}
+	}
+	return file.Rates, nil
+}
+
+// rates is the exchange rate table of Repository, keyed by From and To.
+type rates struct {
+	rates map[[2]Currency]ExchangeRate
+	rw    sync.RWMutex
+}
+
+func (t *rates) get(from, to Currency) (ExchangeRate, bool) {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	rate, ok := t.rates[[2]Currency{from, to}]
+	return rate, ok
+}
+
+func (t *rates) list() []ExchangeRate {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	list := make([]ExchangeRate, 0, len(t.rates))
+	for _, rate := range t.rates {
+		list = append(list, rate)
+	}
+	sortRates(list)
+	return list
+}
+
+func (r *Repository) SetExchangeRate(ctx context.Context, rate ExchangeRate) (*ExchangeRate, error) {
+	if err := rate.check(); err != nil {
+		return nil, err
+	}
+	rate.UpdatedAt = time.Now()
+	if err := r.setRate(walRecord{Op: opSetExchangeRate, Rate: &rate}); err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+func (r *Repository) setRate(rec walRecord) error {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	r.Rates.rw.Lock()
+	defer r.Rates.rw.Unlock()
+	if err := r.writeAhead(rec); err != nil {
+		return err
+	}
+	r.Rates.rates[[2]Currency{rec.Rate.From, rec.Rate.To}] = *rec.Rate
+	return nil
+}
+
+func (r *Repository) ListExchangeRates(ctx context.Context) ([]ExchangeRate, error) {
+	return r.Rates.list(), nil
+}
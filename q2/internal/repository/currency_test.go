@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExchangeRateConvert(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   ExchangeRate
+		amount int64
+		want   int64
+	}{
+		{"cents to cents", ExchangeRate{From: "USD", To: "TWD", Rate: "31.5"}, 10000, 315000},
+		{"with spread", ExchangeRate{From: "USD", To: "TWD", Rate: "31.5", Spread: 100}, 10000, 311850},
+		{"cents to yen", ExchangeRate{From: "USD", To: "JPY", Rate: "149.8"}, 1001, 1499},
+		{"yen to cents", ExchangeRate{From: "JPY", To: "USD", Rate: "0.0066"}, 1000, 660},
+		{"rounds down", ExchangeRate{From: "TWD", To: "USD", Rate: "0.0317", Spread: 25}, 999, 31},
+		{"to fils", ExchangeRate{From: "USD", To: "KWD", Rate: "0.307"}, 100, 307},
+	}
+	for _, tt := range tests {
+		if err := tt.rate.check(); err != nil {
+			t.Fatalf("%v: check() error = %v", tt.name, err)
+		}
+		got, err := tt.rate.convert(tt.amount)
+		if err != nil || got.ToAmount != tt.want || got.ToCurrency != tt.rate.To || got.Rate != tt.rate.Rate {
+			t.Errorf("%v: convert(%v) got = %+v, %v, want %v", tt.name, tt.amount, got, err, tt.want)
+		}
+	}
+	if _, err := (&ExchangeRate{From: "TWD", To: "USD", Rate: "0.0317"}).convert(1); !errors.Is(err, ErrInvalidExchangeRate) {
+		t.Errorf("convert() to nothing error = %v, want %v", err, ErrInvalidExchangeRate)
+	}
+
+	invalid := []ExchangeRate{
+		{From: "usd", To: "TWD", Rate: "31"},
+		{From: "USD", To: "XXX", Rate: "31"},
+		{From: "USD", To: "USD", Rate: "1"},
+		{From: "USD", To: "TWD", Rate: "1/3"},
+		{From: "USD", To: "TWD", Rate: "0.0"},
+		{From: "USD", To: "TWD", Rate: "31", Spread: -1},
+		{From: "USD", To: "TWD", Rate: "31", Spread: 10000},
+	}
+	for _, rate := range invalid {
+		if err := rate.check(); err == nil {
+			t.Errorf("check() %+v error = nil", rate)
+		}
+	}
+}
+
+func TestCrossCurrencyTransfer(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		if _, err := repo.CreateCurrencyAccount(ctx, "XYZ"); !errors.Is(err, ErrInvalidCurrency) {
+			t.Errorf("CreateCurrencyAccount() unknown currency error = %v, want %v", err, ErrInvalidCurrency)
+		}
+		usdID, _ := repo.CreateCurrencyAccount(ctx, "USD")
+		twdID, _ := repo.CreateAccount(ctx)
+		otherUSD, _ := repo.CreateCurrencyAccount(ctx, "USD")
+		if acc, _ := repo.GetAccount(ctx, twdID); acc.Currency != DefaultCurrency {
+			t.Errorf("GetAccount() currency got = %v, want %v", acc.Currency, DefaultCurrency)
+		}
+		_, _ = repo.DepositAccount(ctx, usdID, Money{Amount: 10000}, TransactionMeta{})
+
+		if _, err := repo.TransferAccount(ctx, usdID, twdID, Money{Amount: 1000}, TransactionMeta{}); !errors.Is(err, ErrNoExchangeRate) {
+			t.Errorf("TransferAccount() without rate error = %v, want %v", err, ErrNoExchangeRate)
+		}
+		if _, err := repo.SetExchangeRate(ctx, ExchangeRate{From: "USD", To: "TWD", Rate: "32", Spread: 50}); err != nil {
+			t.Fatalf("SetExchangeRate() error = %v", err)
+		}
+		if _, err := repo.SetExchangeRate(ctx, ExchangeRate{From: "USD", To: "TWD", Rate: "31.5", Spread: 100}); err != nil {
+			t.Fatalf("SetExchangeRate() replace error = %v", err)
+		}
+		if _, err := repo.SetExchangeRate(ctx, ExchangeRate{From: "USD", To: "TWD", Rate: "abc"}); !errors.Is(err, ErrInvalidExchangeRate) {
+			t.Errorf("SetExchangeRate() invalid error = %v, want %v", err, ErrInvalidExchangeRate)
+		}
+		rates, err := repo.ListExchangeRates(ctx)
+		if err != nil || len(rates) != 1 || rates[0].Rate != "31.5" || rates[0].UpdatedAt.IsZero() {
+			t.Errorf("ListExchangeRates() got = %+v, %v", rates, err)
+		}
+
+		tl, err := repo.TransferAccount(ctx, usdID, twdID, Money{Amount: 1000}, TransactionMeta{})
+		want := Conversion{Rate: "31.5", Spread: 100, ToCurrency: "TWD", ToAmount: 31185}
+		if err != nil || tl.Currency != "USD" || tl.Conversion == nil || *tl.Conversion != want || tl.FromBalance != 9000 || tl.ToBalance != 31185 {
+			t.Fatalf("TransferAccount() cross-currency got = %+v, %v", tl, err)
+		}
+		if _, err := repo.ReverseTransaction(ctx, tl.ID, Money{}, TransactionMeta{}); !errors.Is(err, ErrCrossCurrencyReversal) {
+			t.Errorf("ReverseTransaction() cross-currency error = %v, want %v", err, ErrCrossCurrencyReversal)
+		}
+		// same currency transfers are not converted
+		if tl, err := repo.TransferAccount(ctx, usdID, otherUSD, Money{Amount: 500}, TransactionMeta{}); err != nil || tl.Conversion != nil || tl.Credited() != 500 {
+			t.Errorf("TransferAccount() same currency got = %+v, %v", tl, err)
+		}
+
+		journal, _ := repo.GetJournal(ctx)
+		exchange := map[Currency]int64{}
+		for _, entry := range journal {
+			for _, p := range entry.Postings {
+				if p.Account == ExchangeAccount {
+					exchange[p.Currency] += p.Amount
+				}
+			}
+		}
+		if exchange["USD"] != 1000 || exchange["TWD"] != -31185 {
+			t.Errorf("exchange account position got = %v", exchange)
+		}
+
+		_, _ = repo.RelayTransactions(ctx, 100, nil)
+		page, _ := repo.ListTransactions(ctx, TransactionQuery{Account: twdID})
+		if len(page.Transactions) != 1 || page.Transactions[0].Conversion == nil || page.Transactions[0].Credited() != 31185 {
+			t.Errorf("relayed cross-currency entry got = %+v", page.Transactions)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+	})
+}
+
+func TestCurrencyDurable(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	eurID, _ := repo.CreateCurrencyAccount(ctx, "EUR")
+	twdID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, eurID, Money{Amount: 5000}, TransactionMeta{})
+	_, _ = repo.SetExchangeRate(ctx, ExchangeRate{From: "EUR", To: "TWD", Rate: "34.2"})
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	// replayed from the log after the snapshot, at the rate it was made at
+	_, _ = repo.TransferAccount(ctx, eurID, twdID, Money{Amount: 1000}, TransactionMeta{})
+	_, _ = repo.SetExchangeRate(ctx, ExchangeRate{From: "EUR", To: "TWD", Rate: "40"})
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	eur, _ := repo.GetAccount(ctx, eurID)
+	twd, _ := repo.GetAccount(ctx, twdID)
+	if eur.Currency != "EUR" || eur.Balance != 4000 || twd.Balance != 34200 {
+		t.Errorf("accounts after reopen got = %+v, %+v", eur, twd)
+	}
+	if rates, _ := repo.ListExchangeRates(ctx); len(rates) != 1 || rates[0].Rate != "40" {
+		t.Errorf("ListExchangeRates() after reopen got = %+v", rates)
+	}
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() after reopen error = %v", err)
+	}
+}
+
+func TestLoadExchangeRates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	_ = os.WriteFile(path, []byte(`{"rates": [{"from": "USD", "to": "TWD", "rate": "31.52", "spread": 50}]}`), 0o600)
+	rates, err := LoadExchangeRates(path)
+	if err != nil || len(rates) != 1 || rates[0].From != "USD" || rates[0].Spread != 50 {
+		t.Errorf("LoadExchangeRates() got = %+v, %v", rates, err)
+	}
+	_ = os.WriteFile(path, []byte(`{"rates": [{"from": "USD", "to": "TWD", "rate": "-1"}]}`), 0o600)
+	if _, err := LoadExchangeRates(path); !errors.Is(err, ErrInvalidExchangeRate) {
+		t.Errorf("LoadExchangeRates() invalid error = %v, want %v", err, ErrInvalidExchangeRate)
+	}
+}
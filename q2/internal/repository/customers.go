@@ -0,0 +1,405 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCustomerNotFound    = errors.New("customer not found")
+	ErrInvalidCustomer     = errors.New("invalid customer")
+	ErrCustomerHasAccounts = errors.New("customer still holds accounts")
+	ErrInvalidHolder       = errors.New("invalid account holder")
+	ErrHolderNotFound      = errors.New("customer does not hold the account")
+	ErrNoOwner             = errors.New("account must keep an owner")
+)
+
+// CustomerStore keeps customers and the accounts they hold. Every account
+// with holders has at least one owner; accounts created without holders stay
+// anonymous.
+type CustomerStore interface {
+	// CreateCustomer stores c under a new id. c.ID is ignored.
+	CreateCustomer(ctx context.Context, c Customer) (*Customer, error)
+	GetCustomer(ctx context.Context, id CustomerID) (*Customer, error)
+	// UpdateCustomer replaces the name, email and external reference of the
+	// customer with id c.ID.
+	UpdateCustomer(ctx context.Context, c Customer) (*Customer, error)
+	// DeleteCustomer deletes a customer that holds no accounts.
+	DeleteCustomer(ctx context.Context, id CustomerID) error
+	ListCustomers(ctx context.Context, q CustomerQuery) ([]Customer, error)
+	// SetAccountHolder links a customer to an account, or changes the role of
+	// an existing link.
+	SetAccountHolder(ctx context.Context, h AccountHolder) error
+	RemoveAccountHolder(ctx context.Context, account AccountID, customer CustomerID) error
+	// GetAccountHolders returns the holders of an account in the order they
+	// were linked.
+	GetAccountHolders(ctx context.Context, id AccountID) ([]AccountHolder, error)
+	// ListCustomerAccounts returns the links of a customer in the order they
+	// were made.
+	ListCustomerAccounts(ctx context.Context, id CustomerID) ([]AccountHolder, error)
+}
+
+// CustomerID is an opaque customer id, a UUIDv7.
+type CustomerID string
+
+// Customer is a person or business holding accounts.
+type Customer struct {
+	ID    CustomerID
+	Name  string
+	Email string
+	// ExternalReference is the id of the customer in another system
+	ExternalReference string
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// CustomerQuery selects customers. Zero fields do not filter.
+type CustomerQuery struct {
+	Email             string
+	ExternalReference string
+}
+
+func (q CustomerQuery) match(c *Customer) bool {
+	return (q.Email == "" || strings.EqualFold(c.Email, q.Email)) &&
+		(q.ExternalReference == "" || c.ExternalReference == q.ExternalReference)
+}
+
+type HolderRole string
+
+// Roles of account holders. Owners and holders may both use the account;
+// every account with holders needs an owner.
+const (
+	HolderOwner HolderRole = "owner"
+	HolderJoint HolderRole = "holder"
+)
+
+// AccountHolder links a customer to an account.
+type AccountHolder struct {
+	AccountID  AccountID
+	CustomerID CustomerID
+	Role       HolderRole
+	// Since is when the customer was linked to the account
+	Since time.Time
+}
+
+// normalize trims the fields of c and checks them.
+func (c *Customer) normalize() error {
+	c.Name = strings.TrimSpace(c.Name)
+	c.Email = strings.TrimSpace(c.Email)
+	c.ExternalReference = strings.TrimSpace(c.ExternalReference)
+	if c.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidCustomer)
+	}
+	if c.Email != "" {
+		if addr, err := mail.ParseAddress(c.Email); err != nil || addr.Address != c.Email {
+			return fmt.Errorf("%w: email %q is not an address", ErrInvalidCustomer, c.Email)
+		}
+	}
+	return nil
+}
+
+// checkHolders checks the holders an account is created with.
+func checkHolders(holders []AccountHolder) error {
+	if len(holders) == 0 {
+		return nil
+	}
+	seen := make(map[CustomerID]bool)
+	owned := false
+	for _, h := range holders {
+		if err := h.Role.check(); err != nil {
+			return err
+		}
+		if seen[h.CustomerID] {
+			return fmt.Errorf("%w: customer %s is listed twice", ErrInvalidHolder, h.CustomerID)
+		}
+		seen[h.CustomerID] = true
+		owned = owned || h.Role == HolderOwner
+	}
+	if !owned {
+		return ErrNoOwner
+	}
+	return nil
+}
+
+func (role HolderRole) check() error {
+	if role != HolderOwner && role != HolderJoint {
+		return fmt.Errorf("%w: role must be %s or %s", ErrInvalidHolder, HolderOwner, HolderJoint)
+	}
+	return nil
+}
+
+// customerIDs makes customer ids; random UUIDs never collide with the ids
+// of reopened stores.
+var customerIDs = NewUUIDv7IDs()
+
+func newCustomerID() CustomerID {
+	return CustomerID(customerIDs.NewID())
+}
+
+// customers is the customer index of Repository.
+type customers struct {
+	customers map[CustomerID]*Customer
+	// holders and accounts are the links of every account and customer, in
+	// the order they were made
+	holders  map[AccountID][]AccountHolder
+	accounts map[CustomerID][]AccountHolder
+	rw       sync.RWMutex
+}
+
+func newCustomers() customers {
+	return customers{
+		customers: make(map[CustomerID]*Customer),
+		holders:   make(map[AccountID][]AccountHolder),
+		accounts:  make(map[CustomerID][]AccountHolder),
+	}
+}
+
+// link adds h or changes the role of its existing link, which keeps its
+// Since.
+func (c *customers) link(h AccountHolder) {
+	for i := range c.holders[h.AccountID] {
+		if c.holders[h.AccountID][i].CustomerID == h.CustomerID {
+			c.holders[h.AccountID][i].Role = h.Role
+			for j := range c.accounts[h.CustomerID] {
+				if c.accounts[h.CustomerID][j].AccountID == h.AccountID {
+					c.accounts[h.CustomerID][j].Role = h.Role
+				}
+			}
+			return
+		}
+	}
+	c.holders[h.AccountID] = append(c.holders[h.AccountID], h)
+	c.accounts[h.CustomerID] = append(c.accounts[h.CustomerID], h)
+}
+
+func (c *customers) unlink(account AccountID, customer CustomerID) {
+	c.holders[account] = removeHolder(c.holders[account], func(h AccountHolder) bool { return h.CustomerID == customer })
+	c.accounts[customer] = removeHolder(c.accounts[customer], func(h AccountHolder) bool { return h.AccountID == account })
+	if len(c.holders[account]) == 0 {
+		delete(c.holders, account)
+	}
+	if len(c.accounts[customer]) == 0 {
+		delete(c.accounts, customer)
+	}
+}
+
+func removeHolder(holders []AccountHolder, match func(AccountHolder) bool) []AccountHolder {
+	kept := make([]AccountHolder, 0, len(holders))
+	for _, h := range holders {
+		if !match(h) {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// role returns the role of customer on account, or "" if there is no link.
+func (c *customers) role(account AccountID, customer CustomerID) HolderRole {
+	for _, h := range c.holders[account] {
+		if h.CustomerID == customer {
+			return h.Role
+		}
+	}
+	return ""
+}
+
+// ownedAfter reports whether account still has an owner once customer has
+// role, "" meaning the link is gone.
+func (c *customers) ownedAfter(account AccountID, customer CustomerID, role HolderRole) bool {
+	if role == HolderOwner {
+		return true
+	}
+	for _, h := range c.holders[account] {
+		if h.CustomerID != customer && h.Role == HolderOwner {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repository) CreateCustomer(ctx context.Context, c Customer) (*Customer, error) {
+	if err := c.normalize(); err != nil {
+		return nil, err
+	}
+	c.ID = newCustomerID()
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	return r.putCustomer(walRecord{Op: opCreateCustomer, Customer: &c})
+}
+
+func (r *Repository) UpdateCustomer(ctx context.Context, c Customer) (*Customer, error) {
+	if err := c.normalize(); err != nil {
+		return nil, err
+	}
+	c.UpdatedAt = time.Now()
+	return r.putCustomer(walRecord{Op: opUpdateCustomer, Customer: &c})
+}
+
+// putCustomer applies a create or update record. An update keeps the
+// creation time of the customer.
+func (r *Repository) putCustomer(rec walRecord) (*Customer, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	r.Customers.rw.Lock()
+	defer r.Customers.rw.Unlock()
+	c := *rec.Customer
+	if rec.Op == opUpdateCustomer {
+		existing, ok := r.Customers.customers[c.ID]
+		if !ok {
+			return nil, ErrCustomerNotFound
+		}
+		c.CreatedAt = existing.CreatedAt
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+	r.Customers.customers[c.ID] = &c
+	copied := c
+	return &copied, nil
+}
+
+func (r *Repository) GetCustomer(ctx context.Context, id CustomerID) (*Customer, error) {
+	r.Customers.rw.RLock()
+	defer r.Customers.rw.RUnlock()
+	c, ok := r.Customers.customers[id]
+	if !ok {
+		return nil, ErrCustomerNotFound
+	}
+	copied := *c
+	return &copied, nil
+}
+
+func (r *Repository) DeleteCustomer(ctx context.Context, id CustomerID) error {
+	return r.deleteCustomer(walRecord{Op: opDeleteCustomer, Customer: &Customer{ID: id}})
+}
+
+func (r *Repository) deleteCustomer(rec walRecord) error {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	r.Customers.rw.Lock()
+	defer r.Customers.rw.Unlock()
+	id := rec.Customer.ID
+	if _, ok := r.Customers.customers[id]; !ok {
+		return ErrCustomerNotFound
+	}
+	if len(r.Customers.accounts[id]) > 0 {
+		return ErrCustomerHasAccounts
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return err
+	}
+	delete(r.Customers.customers, id)
+	return nil
+}
+
+// ListCustomers returns the customers matching q in the order they were
+// created.
+func (r *Repository) ListCustomers(ctx context.Context, q CustomerQuery) ([]Customer, error) {
+	r.Customers.rw.RLock()
+	defer r.Customers.rw.RUnlock()
+	list := make([]Customer, 0)
+	for _, c := range r.Customers.customers {
+		if q.match(c) {
+			list = append(list, *c)
+		}
+	}
+	sortCustomers(list)
+	return list, nil
+}
+
+func (r *Repository) SetAccountHolder(ctx context.Context, h AccountHolder) error {
+	h.Since = time.Now()
+	return r.setHolder(walRecord{Op: opSetAccountHolder, Holders: []AccountHolder{h}})
+}
+
+func (r *Repository) setHolder(rec walRecord) error {
+	h := rec.Holders[0]
+	if err := h.Role.check(); err != nil {
+		return err
+	}
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	if r.Accounts.get(h.AccountID) == nil {
+		return ErrAccountNotFound
+	}
+	r.Customers.rw.Lock()
+	defer r.Customers.rw.Unlock()
+	if _, ok := r.Customers.customers[h.CustomerID]; !ok {
+		return ErrCustomerNotFound
+	}
+	if !r.Customers.ownedAfter(h.AccountID, h.CustomerID, h.Role) {
+		return ErrNoOwner
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return err
+	}
+	r.Customers.link(h)
+	return nil
+}
+
+func (r *Repository) RemoveAccountHolder(ctx context.Context, account AccountID, customer CustomerID) error {
+	return r.removeHolder(walRecord{Op: opRemoveAccountHolder, Holders: []AccountHolder{{AccountID: account, CustomerID: customer}}})
+}
+
+func (r *Repository) removeHolder(rec walRecord) error {
+	h := rec.Holders[0]
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	r.Customers.rw.Lock()
+	defer r.Customers.rw.Unlock()
+	if r.Customers.role(h.AccountID, h.CustomerID) == "" {
+		return ErrHolderNotFound
+	}
+	if !r.Customers.ownedAfter(h.AccountID, h.CustomerID, "") {
+		return ErrNoOwner
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return err
+	}
+	r.Customers.unlink(h.AccountID, h.CustomerID)
+	return nil
+}
+
+func (r *Repository) GetAccountHolders(ctx context.Context, id AccountID) ([]AccountHolder, error) {
+	if r.Accounts.get(id) == nil {
+		return nil, ErrAccountNotFound
+	}
+	r.Customers.rw.RLock()
+	defer r.Customers.rw.RUnlock()
+	return append(make([]AccountHolder, 0), r.Customers.holders[id]...), nil
+}
+
+func (r *Repository) ListCustomerAccounts(ctx context.Context, id CustomerID) ([]AccountHolder, error) {
+	r.Customers.rw.RLock()
+	defer r.Customers.rw.RUnlock()
+	if _, ok := r.Customers.customers[id]; !ok {
+		return nil, ErrCustomerNotFound
+	}
+	return append(make([]AccountHolder, 0), r.Customers.accounts[id]...), nil
+}
+
+// sortLinks orders the links of every account and customer by Since, the
+// order they were made in.
+func (c *customers) sortLinks() {
+	for _, links := range c.holders {
+		sortHolders(links)
+	}
+	for _, links := range c.accounts {
+		sortHolders(links)
+	}
+}
+
+func sortHolders(links []AccountHolder) {
+	sort.SliceStable(links, func(i, j int) bool { return links[i].Since.Before(links[j].Since) })
+}
+
+// sortCustomers orders customers by creation, UUIDv7 ids sort that way.
+func sortCustomers(list []Customer) {
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+}
@@ -0,0 +1,190 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCustomers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		if _, err := repo.CreateCustomer(ctx, Customer{Name: " ", Email: "a@example.com"}); !errors.Is(err, ErrInvalidCustomer) {
+			t.Errorf("CreateCustomer() without name error = %v, want %v", err, ErrInvalidCustomer)
+		}
+		if _, err := repo.CreateCustomer(ctx, Customer{Name: "Alice", Email: "Alice <a@example.com>"}); !errors.Is(err, ErrInvalidCustomer) {
+			t.Errorf("CreateCustomer() with display name error = %v, want %v", err, ErrInvalidCustomer)
+		}
+		alice, err := repo.CreateCustomer(ctx, Customer{Name: " Alice ", Email: "alice@example.com", ExternalReference: "crm-1"})
+		if err != nil || alice.ID == "" || alice.Name != "Alice" || alice.CreatedAt.IsZero() {
+			t.Fatalf("CreateCustomer() got = %+v, %v", alice, err)
+		}
+		bob, _ := repo.CreateCustomer(ctx, Customer{Name: "Bob"})
+
+		got, err := repo.GetCustomer(ctx, alice.ID)
+		if err != nil || got.Email != alice.Email || got.ExternalReference != "crm-1" {
+			t.Errorf("GetCustomer() got = %+v, %v", got, err)
+		}
+		if _, err := repo.GetCustomer(ctx, "nope"); !errors.Is(err, ErrCustomerNotFound) {
+			t.Errorf("GetCustomer() unknown error = %v, want %v", err, ErrCustomerNotFound)
+		}
+
+		updated, err := repo.UpdateCustomer(ctx, Customer{ID: alice.ID, Name: "Alice Liddell", Email: "alice@example.org"})
+		if err != nil || updated.Name != "Alice Liddell" || updated.ExternalReference != "" || !updated.CreatedAt.Equal(alice.CreatedAt) {
+			t.Errorf("UpdateCustomer() got = %+v, %v", updated, err)
+		}
+		if _, err := repo.UpdateCustomer(ctx, Customer{ID: "nope", Name: "X"}); !errors.Is(err, ErrCustomerNotFound) {
+			t.Errorf("UpdateCustomer() unknown error = %v, want %v", err, ErrCustomerNotFound)
+		}
+
+		all, _ := repo.ListCustomers(ctx, CustomerQuery{})
+		if len(all) != 2 || all[0].ID != alice.ID || all[1].ID != bob.ID {
+			t.Errorf("ListCustomers() got = %+v", all)
+		}
+		if byEmail, _ := repo.ListCustomers(ctx, CustomerQuery{Email: "ALICE@example.org"}); len(byEmail) != 1 || byEmail[0].ID != alice.ID {
+			t.Errorf("ListCustomers() by email got = %+v", byEmail)
+		}
+
+		if err := repo.DeleteCustomer(ctx, bob.ID); err != nil {
+			t.Errorf("DeleteCustomer() error = %v", err)
+		}
+		if err := repo.DeleteCustomer(ctx, bob.ID); !errors.Is(err, ErrCustomerNotFound) {
+			t.Errorf("DeleteCustomer() twice error = %v, want %v", err, ErrCustomerNotFound)
+		}
+	})
+}
+
+func TestAccountHolders(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		alice, _ := repo.CreateCustomer(ctx, Customer{Name: "Alice"})
+		bob, _ := repo.CreateCustomer(ctx, Customer{Name: "Bob"})
+
+		tests := []struct {
+			name    string
+			holders []AccountHolder
+			wantErr error
+		}{
+			{"no owner", []AccountHolder{{CustomerID: alice.ID, Role: HolderJoint}}, ErrNoOwner},
+			{"bad role", []AccountHolder{{CustomerID: alice.ID, Role: "boss"}}, ErrInvalidHolder},
+			{"twice", []AccountHolder{{CustomerID: alice.ID, Role: HolderOwner}, {CustomerID: alice.ID, Role: HolderJoint}}, ErrInvalidHolder},
+			{"unknown customer", []AccountHolder{{CustomerID: "nope", Role: HolderOwner}}, ErrCustomerNotFound},
+		}
+		for _, tt := range tests {
+			if _, err := repo.CreateAccount(ctx, tt.holders...); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CreateAccount() %v error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+
+		joint, err := repo.CreateAccount(ctx, AccountHolder{CustomerID: alice.ID, Role: HolderOwner}, AccountHolder{CustomerID: bob.ID, Role: HolderJoint})
+		if err != nil {
+			t.Fatalf("CreateAccount() joint error = %v", err)
+		}
+		anonymous, _ := repo.CreateAccount(ctx)
+		holders, err := repo.GetAccountHolders(ctx, joint)
+		if err != nil || len(holders) != 2 || holders[0].CustomerID != alice.ID || holders[1].Role != HolderJoint || holders[1].AccountID != joint {
+			t.Errorf("GetAccountHolders() got = %+v, %v", holders, err)
+		}
+		if holders, err := repo.GetAccountHolders(ctx, anonymous); err != nil || len(holders) != 0 {
+			t.Errorf("GetAccountHolders() anonymous got = %+v, %v", holders, err)
+		}
+		if _, err := repo.GetAccountHolders(ctx, "nope"); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("GetAccountHolders() unknown error = %v, want %v", err, ErrAccountNotFound)
+		}
+
+		// an account without holders only takes an owner
+		if err := repo.SetAccountHolder(ctx, AccountHolder{AccountID: anonymous, CustomerID: bob.ID, Role: HolderJoint}); !errors.Is(err, ErrNoOwner) {
+			t.Errorf("SetAccountHolder() holder of anonymous error = %v, want %v", err, ErrNoOwner)
+		}
+		if err := repo.SetAccountHolder(ctx, AccountHolder{AccountID: anonymous, CustomerID: bob.ID, Role: HolderOwner}); err != nil {
+			t.Errorf("SetAccountHolder() error = %v", err)
+		}
+		if err := repo.SetAccountHolder(ctx, AccountHolder{AccountID: "nope", CustomerID: bob.ID, Role: HolderOwner}); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("SetAccountHolder() unknown account error = %v, want %v", err, ErrAccountNotFound)
+		}
+
+		accounts, err := repo.ListCustomerAccounts(ctx, bob.ID)
+		want := []AccountHolder{{AccountID: joint, CustomerID: bob.ID, Role: HolderJoint}, {AccountID: anonymous, CustomerID: bob.ID, Role: HolderOwner}}
+		if err != nil || !reflect.DeepEqual(withoutSince(accounts), want) {
+			t.Errorf("ListCustomerAccounts() got = %+v, %v, want %+v", accounts, err, want)
+		}
+		if _, err := repo.ListCustomerAccounts(ctx, "nope"); !errors.Is(err, ErrCustomerNotFound) {
+			t.Errorf("ListCustomerAccounts() unknown error = %v, want %v", err, ErrCustomerNotFound)
+		}
+
+		// the last owner cannot leave or step down
+		if err := repo.RemoveAccountHolder(ctx, joint, alice.ID); !errors.Is(err, ErrNoOwner) {
+			t.Errorf("RemoveAccountHolder() last owner error = %v, want %v", err, ErrNoOwner)
+		}
+		if err := repo.SetAccountHolder(ctx, AccountHolder{AccountID: joint, CustomerID: alice.ID, Role: HolderJoint}); !errors.Is(err, ErrNoOwner) {
+			t.Errorf("SetAccountHolder() demote last owner error = %v, want %v", err, ErrNoOwner)
+		}
+		if err := repo.SetAccountHolder(ctx, AccountHolder{AccountID: joint, CustomerID: bob.ID, Role: HolderOwner}); err != nil {
+			t.Errorf("SetAccountHolder() promote error = %v", err)
+		}
+		if err := repo.RemoveAccountHolder(ctx, joint, alice.ID); err != nil {
+			t.Errorf("RemoveAccountHolder() error = %v", err)
+		}
+		if err := repo.RemoveAccountHolder(ctx, joint, alice.ID); !errors.Is(err, ErrHolderNotFound) {
+			t.Errorf("RemoveAccountHolder() twice error = %v, want %v", err, ErrHolderNotFound)
+		}
+		if holders, _ := repo.GetAccountHolders(ctx, joint); len(holders) != 1 || holders[0].CustomerID != bob.ID || holders[0].Role != HolderOwner {
+			t.Errorf("GetAccountHolders() after changes got = %+v", holders)
+		}
+
+		if err := repo.DeleteCustomer(ctx, bob.ID); !errors.Is(err, ErrCustomerHasAccounts) {
+			t.Errorf("DeleteCustomer() holding accounts error = %v, want %v", err, ErrCustomerHasAccounts)
+		}
+		if err := repo.DeleteCustomer(ctx, alice.ID); err != nil {
+			t.Errorf("DeleteCustomer() after leaving error = %v", err)
+		}
+	})
+}
+
+func TestCustomersDurable(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	alice, _ := repo.CreateCustomer(ctx, Customer{Name: "Alice"})
+	bob, _ := repo.CreateCustomer(ctx, Customer{Name: "Bob"})
+	carol, _ := repo.CreateCustomer(ctx, Customer{Name: "Carol"})
+	joint, _ := repo.CreateAccount(ctx, AccountHolder{CustomerID: bob.ID, Role: HolderOwner}, AccountHolder{CustomerID: alice.ID, Role: HolderJoint})
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	// replayed from the log after the snapshot
+	_ = repo.SetAccountHolder(ctx, AccountHolder{AccountID: joint, CustomerID: carol.ID, Role: HolderJoint})
+	_, _ = repo.UpdateCustomer(ctx, Customer{ID: alice.ID, Name: "Alice Liddell"})
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	if c, err := repo.GetCustomer(ctx, alice.ID); err != nil || c.Name != "Alice Liddell" {
+		t.Errorf("GetCustomer() after reopen got = %+v, %v", c, err)
+	}
+	holders, _ := repo.GetAccountHolders(ctx, joint)
+	want := []AccountHolder{
+		{AccountID: joint, CustomerID: bob.ID, Role: HolderOwner},
+		{AccountID: joint, CustomerID: alice.ID, Role: HolderJoint},
+		{AccountID: joint, CustomerID: carol.ID, Role: HolderJoint},
+	}
+	if !reflect.DeepEqual(withoutSince(holders), want) {
+		t.Errorf("GetAccountHolders() after reopen got = %+v, want %+v", holders, want)
+	}
+}
+
+func withoutSince(holders []AccountHolder) []AccountHolder {
+	stripped := make([]AccountHolder, 0, len(holders))
+	for _, h := range holders {
+		stripped = append(stripped, AccountHolder{AccountID: h.AccountID, CustomerID: h.CustomerID, Role: h.Role})
+	}
+	return stripped
+}
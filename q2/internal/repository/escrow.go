@@ -0,0 +1,378 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrEscrowNotFound = errors.New("escrow not found")
+	ErrEscrowExists   = errors.New("order is already in escrow")
+	ErrEscrowSettled  = errors.New("escrow is already settled")
+	ErrEscrowNotDue   = errors.New("escrow is not due for release")
+	ErrInvalidEscrow  = errors.New("invalid escrow")
+)
+
+const (
+	// DefaultEscrowTimeout is how long an escrow opened without a release
+	// time waits for delivery before it is released to the merchant
+	DefaultEscrowTimeout = 14 * 24 * time.Hour
+	// MaxEscrowTimeout is the longest an escrow may wait
+	MaxEscrowTimeout = 90 * 24 * time.Hour
+	// maxOrderID is the longest order id, in bytes
+	maxOrderID = 128
+)
+
+// EscrowStatus is where an escrow is in its life: held until it is released
+// to the merchant or refunded to the buyer.
+type EscrowStatus string
+
+const (
+	EscrowHeld     EscrowStatus = "held"
+	EscrowReleased EscrowStatus = "released"
+	EscrowRefunded EscrowStatus = "refunded"
+)
+
+// The transactions moving money in and out of escrow.
+const (
+	TransactionEscrow        TransactionType = "escrow"
+	TransactionEscrowRelease TransactionType = "escrow_release"
+	TransactionEscrowRefund  TransactionType = "escrow_refund"
+)
+
+// Escrow is the payment of Buyer for order OrderID, kept in EscrowAccount
+// until delivery is confirmed and it is released to Merchant, or the order is
+// cancelled and it is refunded. It is released to Merchant at ReleaseAt if
+// neither happened by then. TransactionID is the payment into escrow and
+// SettlementID the release or refund.
+type Escrow struct {
+	OrderID       string
+	Buyer         AccountID
+	Merchant      AccountID
+	Amount        int64
+	Currency      Currency
+	Status        EscrowStatus
+	Memo          string
+	OpenedAt      time.Time
+	ReleaseAt     time.Time
+	ClosedAt      time.Time
+	TransactionID int64
+	SettlementID  int64 `json:",omitempty"`
+}
+
+func checkOrderID(order string) error {
+	if order == "" {
+		return fmt.Errorf("%w: order id is required", ErrInvalidEscrow)
+	}
+	if len(order) > maxOrderID {
+		return fmt.Errorf("%w: order id is longer than %d bytes", ErrInvalidEscrow, maxOrderID)
+	}
+	return nil
+}
+
+// escrowRelease returns when an escrow opened at now with releaseAt is
+// released, or why it cannot be.
+func escrowRelease(now, releaseAt time.Time) (time.Time, error) {
+	if releaseAt.IsZero() {
+		return now.Add(DefaultEscrowTimeout), nil
+	}
+	if !releaseAt.After(now) {
+		return time.Time{}, fmt.Errorf("%w: release time %s is in the past", ErrInvalidEscrow, releaseAt.Format(time.RFC3339))
+	}
+	if releaseAt.Sub(now) > MaxEscrowTimeout {
+		return time.Time{}, fmt.Errorf("%w: release time %s is more than %s away", ErrInvalidEscrow, releaseAt.Format(time.RFC3339), MaxEscrowTimeout)
+	}
+	return releaseAt, nil
+}
+
+// settlement returns the transaction, the status and the receiver of the
+// settlement of a held escrow by a settle record of op at when, and the memo
+// of its log entry.
+func (e *Escrow) settlement(op string, when time.Time) (TransactionType, EscrowStatus, AccountID, string, error) {
+	if e.Status != EscrowHeld {
+		return "", "", "", "", fmt.Errorf("%w: it is %s", ErrEscrowSettled, e.Status)
+	}
+	switch op {
+	case opRefundEscrow:
+		return TransactionEscrowRefund, EscrowRefunded, e.Buyer, "order cancelled", nil
+	case opAutoReleaseEscrow:
+		if when.Before(e.ReleaseAt) {
+			return "", "", "", "", fmt.Errorf("%w: it releases at %s", ErrEscrowNotDue, e.ReleaseAt.Format(time.RFC3339))
+		}
+		return TransactionEscrowRelease, EscrowReleased, e.Merchant, "released after timeout", nil
+	default:
+		return TransactionEscrowRelease, EscrowReleased, e.Merchant, "delivery confirmed", nil
+	}
+}
+
+// escrows are the escrows of Repository by order id.
+type escrows struct {
+	escrows map[string]*Escrow
+	// byAccount are the order ids of the escrows of every buyer and merchant
+	byAccount map[AccountID][]string
+	// opening serializes the opening of escrows so an order is escrowed once
+	opening sync.Mutex
+	rw      sync.RWMutex
+}
+
+func newEscrows() escrows {
+	return escrows{
+		escrows:   make(map[string]*Escrow),
+		byAccount: make(map[AccountID][]string),
+	}
+}
+
+// get returns a copy of the escrow of order, or nil.
+func (t *escrows) get(order string) *Escrow {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	e, ok := t.escrows[order]
+	if !ok {
+		return nil
+	}
+	c := *e
+	return &c
+}
+
+// put adds or replaces e.
+func (t *escrows) put(e Escrow) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	if _, ok := t.escrows[e.OrderID]; !ok {
+		t.byAccount[e.Buyer] = append(t.byAccount[e.Buyer], e.OrderID)
+		t.byAccount[e.Merchant] = append(t.byAccount[e.Merchant], e.OrderID)
+	}
+	t.escrows[e.OrderID] = &e
+}
+
+// list returns the escrows account id pays or is paid by, oldest first.
+func (t *escrows) list(id AccountID) []Escrow {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	list := make([]Escrow, 0, len(t.byAccount[id]))
+	for _, order := range t.byAccount[id] {
+		list = append(list, *t.escrows[order])
+	}
+	return list
+}
+
+// all returns every escrow, oldest first.
+func (t *escrows) all() []Escrow {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	list := make([]Escrow, 0, len(t.escrows))
+	for _, e := range t.escrows {
+		list = append(list, *e)
+	}
+	sortEscrows(list)
+	return list
+}
+
+// sortEscrows orders escrows by when they were opened, then by order id.
+func sortEscrows(list []Escrow) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].OpenedAt.Equal(list[j].OpenedAt) {
+			return list[i].OpenedAt.Before(list[j].OpenedAt)
+		}
+		return list[i].OrderID < list[j].OrderID
+	})
+}
+
+// OpenEscrow moves amount from buyer into escrow for order, to be released to
+// merchant at releaseAt, DefaultEscrowTimeout from now if it is zero.
+func (r *Repository) OpenEscrow(ctx context.Context, order string, buyer, merchant AccountID, amount Money, releaseAt time.Time, memo string) (*Escrow, error) {
+	if err := checkOrderID(order); err != nil {
+		return nil, err
+	}
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	if buyer == merchant {
+		return nil, ErrSameAccount
+	}
+	rec := r.movement(opOpenEscrow, TransactionMeta{Memo: memo, Reference: order})
+	releaseAt, err := escrowRelease(rec.When, releaseAt)
+	if err != nil {
+		return nil, err
+	}
+	rec.Escrow = &Escrow{
+		OrderID:       order,
+		Buyer:         buyer,
+		Merchant:      merchant,
+		Amount:        amount.Amount,
+		Currency:      amount.Currency,
+		Status:        EscrowHeld,
+		Memo:          memo,
+		OpenedAt:      rec.When,
+		ReleaseAt:     releaseAt,
+		TransactionID: rec.Entry,
+	}
+	return r.openEscrow(rec)
+}
+
+func (r *Repository) openEscrow(rec walRecord) (*Escrow, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	e := *rec.Escrow
+	buyerAcc, merchantAcc := r.Accounts.get(e.Buyer), r.Accounts.get(e.Merchant)
+	if buyerAcc == nil || merchantAcc == nil {
+		return nil, ErrAccountNotFound
+	}
+	r.Escrows.opening.Lock()
+	defer r.Escrows.opening.Unlock()
+	if r.Escrows.get(e.OrderID) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrEscrowExists, e.OrderID)
+	}
+	defer lockAccounts(buyerAcc, merchantAcc)()
+
+	if err := checkMovement(buyerAcc, merchantAcc); err != nil {
+		return nil, err
+	}
+	if err := (Money{Currency: e.Currency}).in(buyerAcc.Currency); err != nil {
+		return nil, err
+	}
+	if merchantAcc.Currency != buyerAcc.Currency {
+		return nil, fmt.Errorf("%w: merchant in %s, buyer in %s", ErrCurrencyMismatch, merchantAcc.Currency, buyerAcc.Currency)
+	}
+	if err := buyerAcc.covers(e.Amount); err != nil {
+		return nil, err
+	}
+	balance, err := subAmounts(buyerAcc.Balance, e.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+
+	buyerAcc.accrue(rec.When)
+	buyerAcc.Balance = balance
+	e.Currency = buyerAcc.Currency
+	r.post(JournalEntry{ID: rec.Entry, Type: TransactionEscrow, Postings: transferPostings(e.Buyer, EscrowAccount, e.Currency, e.Amount), When: rec.When})
+	r.commitLog(rec, &TransactionLog{
+		ID:          rec.Entry,
+		Type:        TransactionEscrow,
+		From:        e.Buyer,
+		To:          EscrowAccount,
+		Amount:      e.Amount,
+		Currency:    e.Currency,
+		FromBalance: buyerAcc.Balance,
+	})
+	r.Escrows.put(e)
+	return &e, nil
+}
+
+// ReleaseEscrow pays the escrow of order to its merchant on delivery.
+func (r *Repository) ReleaseEscrow(ctx context.Context, order string) (*Escrow, error) {
+	return r.settleEscrow(walRecord{Op: opReleaseEscrow, Order: order, Outbox: true, When: time.Now()})
+}
+
+// RefundEscrow gives the escrow of order back to its buyer on cancellation.
+func (r *Repository) RefundEscrow(ctx context.Context, order string) (*Escrow, error) {
+	return r.settleEscrow(walRecord{Op: opRefundEscrow, Order: order, Outbox: true, When: time.Now()})
+}
+
+// settleEscrow applies a release, refund or automatic release record. An
+// automatic release of an escrow that is not due by rec.When returns
+// ErrEscrowNotDue. The journal entry id is taken once the escrow is sure to
+// settle, so the escrows the release job skips use up no ids.
+func (r *Repository) settleEscrow(rec walRecord) (*Escrow, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	e := r.Escrows.get(rec.Order)
+	if e == nil {
+		return nil, ErrEscrowNotFound
+	}
+	buyerAcc, merchantAcc := r.Accounts.get(e.Buyer), r.Accounts.get(e.Merchant)
+	if buyerAcc == nil || merchantAcc == nil {
+		return nil, ErrAccountNotFound
+	}
+	defer lockAccounts(buyerAcc, merchantAcc)()
+
+	// the escrow may have been settled before the accounts were locked
+	e = r.Escrows.get(rec.Order)
+	typ, status, to, memo, err := e.settlement(rec.Op, rec.When)
+	if err != nil {
+		return nil, err
+	}
+	toAcc := merchantAcc
+	if to == e.Buyer {
+		toAcc = buyerAcc
+	}
+	if err := toAcc.Status.canCredit(); err != nil {
+		return nil, err
+	}
+	balance, err := addAmounts(toAcc.Balance, e.Amount)
+	if err != nil {
+		return nil, err
+	}
+	rec.Memo, rec.Reference = memo, e.OrderID
+	if rec.Entry == 0 {
+		rec.Entry = r.nextEntryID()
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+
+	toAcc.accrue(rec.When)
+	toAcc.Balance = balance
+	r.post(JournalEntry{ID: rec.Entry, Type: typ, Postings: transferPostings(EscrowAccount, to, e.Currency, e.Amount), When: rec.When})
+	r.commitLog(rec, &TransactionLog{
+		ID:        rec.Entry,
+		Type:      typ,
+		From:      EscrowAccount,
+		To:        to,
+		Amount:    e.Amount,
+		Currency:  e.Currency,
+		ToBalance: toAcc.Balance,
+	})
+	e.Status, e.ClosedAt, e.SettlementID = status, rec.When, rec.Entry
+	r.Escrows.put(*e)
+	return e, nil
+}
+
+// ReleaseDueEscrows releases every held escrow due by asOf to its merchant
+// and returns how many it released. Escrows whose merchant account is closed
+// are left for a refund, and the errors of the others are joined once every
+// due escrow was tried.
+func (r *Repository) ReleaseDueEscrows(ctx context.Context, asOf time.Time) (int, error) {
+	released := 0
+	var errs []error
+	for _, e := range r.Escrows.all() {
+		if e.Status != EscrowHeld || asOf.Before(e.ReleaseAt) {
+			continue
+		}
+		_, err := r.settleEscrow(walRecord{Op: opAutoReleaseEscrow, Order: e.OrderID, Outbox: true, When: asOf})
+		// settled since it was listed, or waiting for a refund
+		if errors.Is(err, ErrEscrowSettled) || errors.Is(err, ErrAccountClosed) {
+			continue
+		}
+		// one escrow that cannot be released does not hold up the others
+		if err != nil {
+			errs = append(errs, fmt.Errorf("escrow %s: %w", e.OrderID, err))
+			continue
+		}
+		released++
+	}
+	return released, errors.Join(errs...)
+}
+
+func (r *Repository) GetEscrow(ctx context.Context, order string) (*Escrow, error) {
+	e := r.Escrows.get(order)
+	if e == nil {
+		return nil, ErrEscrowNotFound
+	}
+	return e, nil
+}
+
+// ListEscrows returns the escrows account id pays or is paid by, oldest first.
+func (r *Repository) ListEscrows(ctx context.Context, id AccountID) ([]Escrow, error) {
+	if r.Accounts.get(id) == nil {
+		return nil, ErrAccountNotFound
+	}
+	return r.Escrows.list(id), nil
+}
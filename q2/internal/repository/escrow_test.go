@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscrows(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 1000}, TransactionMeta{})
+
+		e, err := repo.OpenEscrow(ctx, "order-1", buyerID, shopID, Money{Amount: 600}, time.Time{}, "2 mugs")
+		if err != nil || e.Status != EscrowHeld || e.Currency != DefaultCurrency || e.TransactionID == 0 ||
+			e.ReleaseAt.Sub(e.OpenedAt) != DefaultEscrowTimeout {
+			t.Fatalf("OpenEscrow() got = %+v, %v", e, err)
+		}
+		if _, err := repo.OpenEscrow(ctx, "order-1", buyerID, shopID, Money{Amount: 100}, time.Time{}, ""); !errors.Is(err, ErrEscrowExists) {
+			t.Errorf("OpenEscrow() of the same order error = %v, want %v", err, ErrEscrowExists)
+		}
+		// the payment left the buyer but has not reached the merchant
+		if acc, _ := repo.GetAccount(ctx, buyerID); acc.Balance != 400 {
+			t.Errorf("buyer balance in escrow got = %v, want 400", acc.Balance)
+		}
+		if acc, _ := repo.GetAccount(ctx, shopID); acc.Balance != 0 {
+			t.Errorf("merchant balance in escrow got = %v, want 0", acc.Balance)
+		}
+
+		released, err := repo.ReleaseEscrow(ctx, "order-1")
+		if err != nil || released.Status != EscrowReleased || released.SettlementID == 0 || released.ClosedAt.IsZero() {
+			t.Fatalf("ReleaseEscrow() got = %+v, %v", released, err)
+		}
+		if acc, _ := repo.GetAccount(ctx, shopID); acc.Balance != 600 {
+			t.Errorf("merchant balance after release got = %v, want 600", acc.Balance)
+		}
+		if _, err := repo.RefundEscrow(ctx, "order-1"); !errors.Is(err, ErrEscrowSettled) {
+			t.Errorf("RefundEscrow() of a released escrow error = %v, want %v", err, ErrEscrowSettled)
+		}
+
+		_, _ = repo.OpenEscrow(ctx, "order-2", buyerID, shopID, Money{Amount: 300}, time.Time{}, "")
+		refunded, err := repo.RefundEscrow(ctx, "order-2")
+		if err != nil || refunded.Status != EscrowRefunded {
+			t.Fatalf("RefundEscrow() got = %+v, %v", refunded, err)
+		}
+		if acc, _ := repo.GetAccount(ctx, buyerID); acc.Balance != 400 {
+			t.Errorf("buyer balance after refund got = %v, want 400", acc.Balance)
+		}
+		if _, err := repo.ReleaseEscrow(ctx, "order-2"); !errors.Is(err, ErrEscrowSettled) {
+			t.Errorf("ReleaseEscrow() of a refunded escrow error = %v, want %v", err, ErrEscrowSettled)
+		}
+
+		_, _ = repo.RelayTransactions(ctx, 100, nil)
+		page, _ := repo.ListTransactions(ctx, TransactionQuery{Account: EscrowAccount})
+		if len(page.Transactions) != 4 {
+			t.Fatalf("escrow log entries got = %+v", page.Transactions)
+		}
+		opened, settled, refund := page.Transactions[0], page.Transactions[1], page.Transactions[3]
+		if opened.Type != TransactionEscrow || opened.From != buyerID || opened.Reference != "order-1" || opened.Memo != "2 mugs" ||
+			opened.ID != e.TransactionID || opened.FromBalance != 400 {
+			t.Errorf("escrow log entry got = %+v", opened)
+		}
+		if settled.Type != TransactionEscrowRelease || settled.To != shopID || settled.Reference != "order-1" ||
+			settled.ID != released.SettlementID || settled.ToBalance != 600 {
+			t.Errorf("release log entry got = %+v", settled)
+		}
+		if refund.Type != TransactionEscrowRefund || refund.To != buyerID || refund.Reference != "order-2" || refund.Memo != "order cancelled" {
+			t.Errorf("refund log entry got = %+v", refund)
+		}
+		for _, id := range []AccountID{buyerID, shopID} {
+			if escrows, err := repo.ListEscrows(ctx, id); err != nil || len(escrows) != 2 || escrows[0].OrderID != "order-1" {
+				t.Errorf("ListEscrows(%v) got = %+v, %v", id, escrows, err)
+			}
+		}
+		if got, err := repo.GetEscrow(ctx, "order-2"); err != nil || got.Status != EscrowRefunded {
+			t.Errorf("GetEscrow() got = %+v, %v", got, err)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+	})
+}
+
+func TestEscrowErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		usdID, _ := repo.CreateCurrencyAccount(ctx, "USD")
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 100}, TransactionMeta{})
+		now := time.Now()
+
+		tests := []struct {
+			name      string
+			order     string
+			merchant  AccountID
+			amount    Money
+			releaseAt time.Time
+			wantErr   error
+		}{
+			{"no order", "", shopID, Money{Amount: 10}, time.Time{}, ErrInvalidEscrow},
+			{"zero amount", "o", shopID, Money{}, time.Time{}, ErrInvalidAmount},
+			{"same account", "o", buyerID, Money{Amount: 10}, time.Time{}, ErrSameAccount},
+			{"past release", "o", shopID, Money{Amount: 10}, now.Add(-time.Minute), ErrInvalidEscrow},
+			{"too long", "o", shopID, Money{Amount: 10}, now.Add(MaxEscrowTimeout + time.Hour), ErrInvalidEscrow},
+			{"unknown merchant", "o", "nope", Money{Amount: 10}, time.Time{}, ErrAccountNotFound},
+			{"merchant in another currency", "o", usdID, Money{Amount: 10}, time.Time{}, ErrCurrencyMismatch},
+			{"more than the balance", "o", shopID, Money{Amount: 101}, time.Time{}, ErrInsufficientFunds},
+		}
+		for _, tt := range tests {
+			if _, err := repo.OpenEscrow(ctx, tt.order, buyerID, tt.merchant, tt.amount, tt.releaseAt, ""); !errors.Is(err, tt.wantErr) {
+				t.Errorf("OpenEscrow() %v error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if _, err := repo.ReleaseEscrow(ctx, "nope"); !errors.Is(err, ErrEscrowNotFound) {
+			t.Errorf("ReleaseEscrow() unknown error = %v, want %v", err, ErrEscrowNotFound)
+		}
+		if _, err := repo.ListEscrows(ctx, "nope"); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("ListEscrows() unknown error = %v, want %v", err, ErrAccountNotFound)
+		}
+		// failed openings leave the order free
+		if _, err := repo.OpenEscrow(ctx, "o", buyerID, shopID, Money{Amount: 100}, time.Time{}, ""); err != nil {
+			t.Errorf("OpenEscrow() after failures error = %v", err)
+		}
+
+		// an escrow whose merchant closed can only be refunded
+		closingID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, shopID, Money{Amount: 50}, TransactionMeta{})
+		_, _ = repo.OpenEscrow(ctx, "closing", shopID, closingID, Money{Amount: 50}, time.Time{}, "")
+		if _, err := repo.SetAccountStatus(ctx, closingID, StatusClosed); err != nil {
+			t.Fatalf("SetAccountStatus() error = %v", err)
+		}
+		if _, err := repo.ReleaseEscrow(ctx, "closing"); !errors.Is(err, ErrAccountClosed) {
+			t.Errorf("ReleaseEscrow() to a closed merchant error = %v, want %v", err, ErrAccountClosed)
+		}
+		if n, err := repo.ReleaseDueEscrows(ctx, now.Add(DefaultEscrowTimeout+time.Hour)); err != nil || n != 1 {
+			t.Errorf("ReleaseDueEscrows() past a closed merchant got = %v, %v, want 1", n, err)
+		}
+		if e, err := repo.RefundEscrow(ctx, "closing"); err != nil || e.Status != EscrowRefunded {
+			t.Errorf("RefundEscrow() from a closed merchant got = %+v, %v", e, err)
+		}
+	})
+}
+
+func TestReleaseDueEscrows(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 100}, TransactionMeta{})
+		_, _ = repo.OpenEscrow(ctx, "soon", buyerID, shopID, Money{Amount: 30}, time.Now().Add(time.Hour), "")
+		_, _ = repo.OpenEscrow(ctx, "later", buyerID, shopID, Money{Amount: 40}, time.Now().Add(48*time.Hour), "")
+
+		if n, err := repo.ReleaseDueEscrows(ctx, time.Now()); err != nil || n != 0 {
+			t.Errorf("ReleaseDueEscrows() before release got = %v, %v", n, err)
+		}
+		if n, err := repo.ReleaseDueEscrows(ctx, time.Now().Add(2*time.Hour)); err != nil || n != 1 {
+			t.Errorf("ReleaseDueEscrows() got = %v, %v, want 1", n, err)
+		}
+		if e, _ := repo.GetEscrow(ctx, "soon"); e.Status != EscrowReleased {
+			t.Errorf("due escrow got = %+v", e)
+		}
+		if e, _ := repo.GetEscrow(ctx, "later"); e.Status != EscrowHeld {
+			t.Errorf("escrow released later got = %+v", e)
+		}
+		if acc, _ := repo.GetAccount(ctx, shopID); acc.Balance != 30 {
+			t.Errorf("merchant balance after release got = %v, want 30", acc.Balance)
+		}
+		if n, _ := repo.ReleaseDueEscrows(ctx, time.Now().Add(2*time.Hour)); n != 0 {
+			t.Errorf("ReleaseDueEscrows() twice got = %v, want 0", n)
+		}
+		_, _ = repo.RelayTransactions(ctx, 100, nil)
+		page, _ := repo.ListTransactions(ctx, TransactionQuery{Type: TransactionEscrowRelease})
+		if len(page.Transactions) != 1 || page.Transactions[0].Memo != "released after timeout" {
+			t.Errorf("release log entries got = %+v", page.Transactions)
+		}
+	})
+}
+
+func TestReleaseDueEscrowsPastFailure(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		fullID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 100}, TransactionMeta{})
+		// a release to the first merchant overflows its balance
+		seedBalance(t, repo, fullID, math.MaxInt64-50)
+		_, _ = repo.OpenEscrow(ctx, "overflows", buyerID, fullID, Money{Amount: 60}, time.Now().Add(time.Hour), "")
+		_, _ = repo.OpenEscrow(ctx, "fine", buyerID, shopID, Money{Amount: 40}, time.Now().Add(time.Hour), "")
+
+		n, err := repo.ReleaseDueEscrows(ctx, time.Now().Add(2*time.Hour))
+		if n != 1 || !errors.Is(err, ErrAmountOverflow) || !strings.Contains(err.Error(), "overflows") {
+			t.Errorf("ReleaseDueEscrows() past a failure got = %v, %v, want 1 and %v", n, err, ErrAmountOverflow)
+		}
+		if e, _ := repo.GetEscrow(ctx, "overflows"); e.Status != EscrowHeld {
+			t.Errorf("failed escrow got = %+v", e)
+		}
+		if e, _ := repo.GetEscrow(ctx, "fine"); e.Status != EscrowReleased {
+			t.Errorf("escrow after the failed one got = %+v", e)
+		}
+	})
+}
+
+func TestEscrowsDurable(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	buyerID, _ := repo.CreateAccount(ctx)
+	shopID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 1000}, TransactionMeta{})
+	_, _ = repo.OpenEscrow(ctx, "released", buyerID, shopID, Money{Amount: 300}, time.Time{}, "")
+	_, _ = repo.OpenEscrow(ctx, "held", buyerID, shopID, Money{Amount: 200}, time.Time{}, "")
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	// replayed from the log after the snapshot
+	_, _ = repo.ReleaseEscrow(ctx, "released")
+	_, _ = repo.OpenEscrow(ctx, "due", buyerID, shopID, Money{Amount: 100}, time.Now().Add(time.Hour), "")
+	_, _ = repo.ReleaseDueEscrows(ctx, time.Now().Add(2*time.Hour))
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	for order, want := range map[string]EscrowStatus{"released": EscrowReleased, "held": EscrowHeld, "due": EscrowReleased} {
+		if e, err := repo.GetEscrow(ctx, order); err != nil || e.Status != want {
+			t.Errorf("GetEscrow(%v) after reopen got = %+v, %v, want %v", order, e, err, want)
+		}
+	}
+	if acc, _ := repo.GetAccount(ctx, shopID); acc.Balance != 400 {
+		t.Errorf("merchant balance after reopen got = %v, want 400", acc.Balance)
+	}
+	if _, err := repo.OpenEscrow(ctx, "held", buyerID, shopID, Money{Amount: 10}, time.Time{}, ""); !errors.Is(err, ErrEscrowExists) {
+		t.Errorf("OpenEscrow() of a restored order error = %v, want %v", err, ErrEscrowExists)
+	}
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() after reopen error = %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package repository
+
+import "context"
+
+// AccountEntry is a transaction log entry of one account with the balance of
+// that account right after it.
+type AccountEntry struct {
+	TransactionLog
+	Balance int64
+}
+
+// AccountHistory is a page of the entries of one account.
+type AccountHistory struct {
+	AccountID  AccountID
+	Entries    []AccountEntry
+	NextCursor string `json:",omitempty"`
+}
+
+// accountHistory adds the running balance of id to the entries of page.
+func accountHistory(id AccountID, page *TransactionPage) *AccountHistory {
+	history := &AccountHistory{
+		AccountID:  id,
+		Entries:    make([]AccountEntry, 0, len(page.Transactions)),
+		NextCursor: page.NextCursor,
+	}
+	for _, tl := range page.Transactions {
+		balance := tl.ToBalance
+		if tl.From == id {
+			balance = tl.FromBalance
+		}
+		history.Entries = append(history.Entries, AccountEntry{TransactionLog: tl, Balance: balance})
+	}
+	return history
+}
+
+// ListAccountTransactions returns a page of the entries of account id from
+// its index, with the balance after each one. q.Account is ignored.
+func (r *Repository) ListAccountTransactions(ctx context.Context, id AccountID, q TransactionQuery) (*AccountHistory, error) {
+	if r.Accounts.get(id) == nil {
+		return nil, ErrAccountNotFound
+	}
+	q.Account = id
+	page, err := r.ListTransactions(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return accountHistory(id, page), nil
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestListAccountTransactions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		a, _ := repo.CreateAccount(ctx)
+		b, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, a, Money{Amount: 500}, TransactionMeta{})
+		_, _ = repo.DepositAccount(ctx, b, Money{Amount: 70}, TransactionMeta{})
+		transfer, _ := repo.TransferAccount(ctx, a, b, Money{Amount: 200}, TransactionMeta{})
+		_, _ = repo.WithdrawAccount(ctx, a, Money{Amount: 50}, TransactionMeta{})
+		_, _ = repo.ReverseTransaction(ctx, transfer.ID, Money{Amount: 30}, TransactionMeta{})
+		if _, err := repo.RelayTransactions(ctx, 100, nil); err != nil {
+			t.Fatalf("RelayTransactions() error = %v", err)
+		}
+
+		balances := func(id AccountID, q TransactionQuery) []int64 {
+			t.Helper()
+			history, err := repo.ListAccountTransactions(ctx, id, q)
+			if err != nil {
+				t.Fatalf("ListAccountTransactions(%v) error = %v", id, err)
+			}
+			got := make([]int64, 0, len(history.Entries))
+			for _, e := range history.Entries {
+				got = append(got, e.Balance)
+			}
+			return got
+		}
+		if got := balances(a, TransactionQuery{}); fmt.Sprint(got) != "[500 300 250 280]" {
+			t.Errorf("balances of %v got = %v", a, got)
+		}
+		if got := balances(b, TransactionQuery{Descending: true}); fmt.Sprint(got) != "[240 270 70]" {
+			t.Errorf("balances of %v newest first got = %v", b, got)
+		}
+		// the account filter of the query does not widen the history
+		if got := balances(b, TransactionQuery{Account: a}); len(got) != 3 {
+			t.Errorf("balances of %v with another account got = %v", b, got)
+		}
+		if got := balances(a, TransactionQuery{Until: time.Now().Add(-time.Hour)}); len(got) != 0 {
+			t.Errorf("balances of %v an hour ago got = %v", a, got)
+		}
+
+		history, _ := repo.ListAccountTransactions(ctx, a, TransactionQuery{Limit: 3})
+		if len(history.Entries) != 3 || history.NextCursor == "" {
+			t.Fatalf("ListAccountTransactions() first page got = %+v", history)
+		}
+		history, _ = repo.ListAccountTransactions(ctx, a, TransactionQuery{Limit: 3, Cursor: history.NextCursor})
+		if len(history.Entries) != 1 || history.Entries[0].Type != TransactionReversal || history.NextCursor != "" {
+			t.Errorf("ListAccountTransactions() last page got = %+v", history)
+		}
+
+		if _, err := repo.ListAccountTransactions(ctx, "999", TransactionQuery{}); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("ListAccountTransactions() unknown account error = %v, want %v", err, ErrAccountNotFound)
+		}
+	})
+}
@@ -0,0 +1,381 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrHoldNotFound       = errors.New("hold not found")
+	ErrHoldNotActive      = errors.New("hold is not active")
+	ErrHoldExpired        = errors.New("hold has expired")
+	ErrCaptureExceedsHold = errors.New("capture exceeds the held amount")
+	ErrInvalidHold        = errors.New("invalid hold")
+)
+
+const (
+	// DefaultHoldDuration is how long a hold placed without an expiry lasts
+	DefaultHoldDuration = 7 * 24 * time.Hour
+	// MaxHoldDuration is the longest a hold may last
+	MaxHoldDuration = 30 * 24 * time.Hour
+)
+
+// HoldStatus is where a hold is in its life: active until it is captured,
+// released or expires.
+type HoldStatus string
+
+const (
+	HoldActive   HoldStatus = "active"
+	HoldCaptured HoldStatus = "captured"
+	HoldReleased HoldStatus = "released"
+	HoldExpired  HoldStatus = "expired"
+)
+
+// TransactionCapture is the transaction moving captured funds to the payee.
+const TransactionCapture TransactionType = "capture"
+
+// Hold reserves Amount of AccountID for a payment to To. While it is active
+// the amount counts against the available balance of the account but stays
+// in its ledger balance. Capturing moves up to Amount to To and releases the
+// rest; TransactionID is the capture transaction.
+type Hold struct {
+	ID            int64
+	AccountID     AccountID
+	To            AccountID
+	Amount        int64
+	Currency      Currency
+	Captured      int64
+	Status        HoldStatus
+	Memo          string
+	Reference     string
+	PlacedAt      time.Time
+	ExpiresAt     time.Time
+	ClosedAt      time.Time
+	TransactionID int64 `json:",omitempty"`
+}
+
+// holdExpiry returns when a hold placed at now with expiresAt expires, or why
+// it cannot.
+func holdExpiry(now, expiresAt time.Time) (time.Time, error) {
+	if expiresAt.IsZero() {
+		return now.Add(DefaultHoldDuration), nil
+	}
+	if !expiresAt.After(now) {
+		return time.Time{}, fmt.Errorf("%w: expiry %s is in the past", ErrInvalidHold, expiresAt.Format(time.RFC3339))
+	}
+	if expiresAt.Sub(now) > MaxHoldDuration {
+		return time.Time{}, fmt.Errorf("%w: expiry %s is more than %s away", ErrInvalidHold, expiresAt.Format(time.RFC3339), MaxHoldDuration)
+	}
+	return expiresAt, nil
+}
+
+// captureAmount returns how much of an active hold a capture of amount
+// moves, all of it for a zero amount, as of now.
+func (h *Hold) captureAmount(amount Money, now time.Time) (int64, error) {
+	if h.Status != HoldActive {
+		return 0, fmt.Errorf("%w: it is %s", ErrHoldNotActive, h.Status)
+	}
+	if now.After(h.ExpiresAt) {
+		return 0, ErrHoldExpired
+	}
+	if err := amount.in(h.Currency); err != nil {
+		return 0, err
+	}
+	if amount.Amount == 0 {
+		return h.Amount, nil
+	}
+	if amount.Amount > h.Amount {
+		return 0, ErrCaptureExceedsHold
+	}
+	return amount.Amount, nil
+}
+
+// holds are the holds of Repository. Holds only change while their account
+// is locked.
+type holds struct {
+	holds     map[int64]*Hold
+	byAccount map[AccountID][]int64
+	seq       int64
+	rw        sync.RWMutex
+}
+
+func newHolds() holds {
+	return holds{holds: make(map[int64]*Hold), byAccount: make(map[AccountID][]int64)}
+}
+
+func (t *holds) nextID() int64 {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	t.seq++
+	return t.seq
+}
+
+// get returns a copy of hold id, or nil.
+func (t *holds) get(id int64) *Hold {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	h, ok := t.holds[id]
+	if !ok {
+		return nil
+	}
+	c := *h
+	return &c
+}
+
+// put adds or replaces h.
+func (t *holds) put(h Hold) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+	if _, ok := t.holds[h.ID]; !ok {
+		t.byAccount[h.AccountID] = append(t.byAccount[h.AccountID], h.ID)
+	}
+	t.holds[h.ID] = &h
+	if h.ID > t.seq {
+		t.seq = h.ID
+	}
+}
+
+// list returns the holds of account id in the order they were placed.
+func (t *holds) list(id AccountID) []Hold {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	list := make([]Hold, 0, len(t.byAccount[id]))
+	for _, hid := range t.byAccount[id] {
+		list = append(list, *t.holds[hid])
+	}
+	return list
+}
+
+// all returns every hold ordered by id.
+func (t *holds) all() []Hold {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	list := make([]Hold, 0, len(t.holds))
+	for _, h := range t.holds {
+		list = append(list, *h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// PlaceHold reserves amount of account for a payment to to until expiresAt,
+// DefaultHoldDuration from now if it is zero.
+func (r *Repository) PlaceHold(ctx context.Context, account AccountID, to AccountID, amount Money, expiresAt time.Time, meta TransactionMeta) (*Hold, error) {
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	if account == to {
+		return nil, ErrSameAccount
+	}
+	now := time.Now()
+	expiresAt, err := holdExpiry(now, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	h := &Hold{
+		AccountID: account,
+		To:        to,
+		Amount:    amount.Amount,
+		Currency:  amount.Currency,
+		Status:    HoldActive,
+		Memo:      meta.Memo,
+		Reference: meta.Reference,
+		PlacedAt:  now,
+		ExpiresAt: expiresAt,
+	}
+	return r.placeHold(walRecord{Op: opPlaceHold, Hold: h, When: now})
+}
+
+func (r *Repository) placeHold(rec walRecord) (*Hold, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	h := *rec.Hold
+	fromAcc, toAcc := r.Accounts.get(h.AccountID), r.Accounts.get(h.To)
+	if fromAcc == nil || toAcc == nil {
+		return nil, ErrAccountNotFound
+	}
+	defer lockAccounts(fromAcc, toAcc)()
+
+	if err := checkMovement(fromAcc, toAcc); err != nil {
+		return nil, err
+	}
+	if err := (Money{Currency: h.Currency}).in(fromAcc.Currency); err != nil {
+		return nil, err
+	}
+	if toAcc.Currency != fromAcc.Currency {
+		return nil, fmt.Errorf("%w: payee in %s, account in %s", ErrCurrencyMismatch, toAcc.Currency, fromAcc.Currency)
+	}
+	if err := fromAcc.covers(h.Amount); err != nil {
+		return nil, err
+	}
+	// the id is taken once the hold is sure to be placed, replayed holds have theirs
+	if h.ID == 0 {
+		h.ID = r.Holds.nextID()
+		rec.Hold = &h
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+	h.Currency = fromAcc.Currency
+	fromAcc.Held += h.Amount
+	r.Holds.put(h)
+	return &h, nil
+}
+
+// CaptureHold moves amount of hold id to its payee and releases the rest. A
+// zero amount captures all of it.
+func (r *Repository) CaptureHold(ctx context.Context, id int64, amount Money) (*Hold, error) {
+	if amount.Amount != 0 {
+		if err := amount.check(); err != nil {
+			return nil, err
+		}
+	}
+	rec := r.movement(opCaptureHold, TransactionMeta{})
+	rec.ID, rec.Amount, rec.Currency = id, amount.Amount, amount.Currency
+	return r.capture(rec)
+}
+
+// capture applies a capture record. A zero amount is resolved to the whole
+// hold before the record is written ahead.
+func (r *Repository) capture(rec walRecord) (*Hold, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	h := r.Holds.get(rec.ID)
+	if h == nil {
+		return nil, ErrHoldNotFound
+	}
+	fromAcc, toAcc := r.Accounts.get(h.AccountID), r.Accounts.get(h.To)
+	if fromAcc == nil || toAcc == nil {
+		return nil, ErrAccountNotFound
+	}
+	defer lockAccounts(fromAcc, toAcc)()
+
+	// the hold may have changed before the accounts were locked
+	h = r.Holds.get(rec.ID)
+	amount, err := h.captureAmount(Money{Amount: rec.Amount, Currency: rec.Currency}, rec.When)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMovement(fromAcc, toAcc); err != nil {
+		return nil, err
+	}
+	// the held funds are spent, not held on top of the capture
+	if err := fromAcc.coversHeld(fromAcc.Held-h.Amount, amount); err != nil {
+		return nil, err
+	}
+	fromBalance, err := subAmounts(fromAcc.Balance, amount)
+	if err != nil {
+		return nil, err
+	}
+	toBalance, err := addAmounts(toAcc.Balance, amount)
+	if err != nil {
+		return nil, err
+	}
+	rec.Amount, rec.Memo, rec.Reference = amount, h.Memo, h.Reference
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+
+	fromAcc.accrue(rec.When)
+	toAcc.accrue(rec.When)
+	fromAcc.Held -= h.Amount
+	fromAcc.Balance = fromBalance
+	toAcc.Balance = toBalance
+	r.post(JournalEntry{ID: rec.Entry, Type: TransactionCapture, Postings: transferPostings(h.AccountID, h.To, h.Currency, amount), When: rec.When})
+	r.commitLog(rec, &TransactionLog{
+		ID:          rec.Entry,
+		Type:        TransactionCapture,
+		From:        h.AccountID,
+		To:          h.To,
+		Amount:      amount,
+		Currency:    h.Currency,
+		FromBalance: fromAcc.Balance,
+		ToBalance:   toAcc.Balance,
+	})
+	h.Status, h.Captured, h.ClosedAt, h.TransactionID = HoldCaptured, amount, rec.When, rec.Entry
+	r.Holds.put(*h)
+	return h, nil
+}
+
+// ReleaseHold gives the funds of hold id back to the available balance of
+// its account.
+func (r *Repository) ReleaseHold(ctx context.Context, id int64) (*Hold, error) {
+	return r.release(walRecord{Op: opReleaseHold, ID: id, When: time.Now()})
+}
+
+// release applies a release or expiry record. An expiry of a hold that has
+// not expired by rec.When returns ErrHoldNotActive.
+func (r *Repository) release(rec walRecord) (*Hold, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	h := r.Holds.get(rec.ID)
+	if h == nil {
+		return nil, ErrHoldNotFound
+	}
+	account := r.Accounts.get(h.AccountID)
+	if account == nil {
+		return nil, ErrAccountNotFound
+	}
+	account.rw.Lock()
+	defer account.rw.Unlock()
+
+	h = r.Holds.get(rec.ID)
+	if h.Status != HoldActive {
+		return nil, fmt.Errorf("%w: it is %s", ErrHoldNotActive, h.Status)
+	}
+	status := HoldReleased
+	if rec.Op == opExpireHold {
+		if rec.When.Before(h.ExpiresAt) {
+			return nil, fmt.Errorf("%w: it expires at %s", ErrHoldNotActive, h.ExpiresAt.Format(time.RFC3339))
+		}
+		status = HoldExpired
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+	account.Held -= h.Amount
+	h.Status, h.ClosedAt = status, rec.When
+	r.Holds.put(*h)
+	return h, nil
+}
+
+// ExpireHolds releases every active hold that expired by asOf and returns
+// how many it released.
+func (r *Repository) ExpireHolds(ctx context.Context, asOf time.Time) (int, error) {
+	expired := 0
+	for _, h := range r.Holds.all() {
+		if h.Status != HoldActive || asOf.Before(h.ExpiresAt) {
+			continue
+		}
+		_, err := r.release(walRecord{Op: opExpireHold, ID: h.ID, When: asOf})
+		// captured or released since it was listed
+		if errors.Is(err, ErrHoldNotActive) {
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+func (r *Repository) GetHold(ctx context.Context, id int64) (*Hold, error) {
+	h := r.Holds.get(id)
+	if h == nil {
+		return nil, ErrHoldNotFound
+	}
+	return h, nil
+}
+
+// ListHolds returns the holds of account id, oldest first.
+func (r *Repository) ListHolds(ctx context.Context, id AccountID) ([]Hold, error) {
+	if r.Accounts.get(id) == nil {
+		return nil, ErrAccountNotFound
+	}
+	return r.Holds.list(id), nil
+}
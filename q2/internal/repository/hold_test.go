@@ -0,0 +1,217 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHolds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 1000}, TransactionMeta{})
+
+		h, err := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 700}, time.Time{}, TransactionMeta{Reference: "order-1"})
+		if err != nil || h.Status != HoldActive || h.Currency != DefaultCurrency || h.ExpiresAt.Sub(h.PlacedAt) != DefaultHoldDuration {
+			t.Fatalf("PlaceHold() got = %+v, %v", h, err)
+		}
+		if acc, _ := repo.GetAccount(ctx, buyerID); acc.Balance != 1000 || acc.Held != 700 || acc.Available != 300 {
+			t.Errorf("GetAccount() with a hold got = %+v", acc)
+		}
+		// held funds are not available to debits or other holds
+		if _, err := repo.WithdrawAccount(ctx, buyerID, Money{Amount: 400}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("WithdrawAccount() of held funds error = %v, want %v", err, ErrInsufficientFunds)
+		}
+		if _, err := repo.TransferAccount(ctx, buyerID, shopID, Money{Amount: 400}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("TransferAccount() of held funds error = %v, want %v", err, ErrInsufficientFunds)
+		}
+		if _, err := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 400}, time.Time{}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("PlaceHold() of held funds error = %v, want %v", err, ErrInsufficientFunds)
+		}
+		if _, err := repo.WithdrawAccount(ctx, buyerID, Money{Amount: 300}, TransactionMeta{}); err != nil {
+			t.Errorf("WithdrawAccount() of available funds error = %v", err)
+		}
+
+		if _, err := repo.CaptureHold(ctx, h.ID, Money{Amount: 701}); !errors.Is(err, ErrCaptureExceedsHold) {
+			t.Errorf("CaptureHold() over the hold error = %v, want %v", err, ErrCaptureExceedsHold)
+		}
+		captured, err := repo.CaptureHold(ctx, h.ID, Money{Amount: 500})
+		if err != nil || captured.Status != HoldCaptured || captured.Captured != 500 || captured.TransactionID == 0 {
+			t.Fatalf("CaptureHold() partial got = %+v, %v", captured, err)
+		}
+		// the rest of a partial capture is released
+		if acc, _ := repo.GetAccount(ctx, buyerID); acc.Balance != 200 || acc.Held != 0 || acc.Available != 200 {
+			t.Errorf("GetAccount() after capture got = %+v", acc)
+		}
+		if acc, _ := repo.GetAccount(ctx, shopID); acc.Balance != 500 {
+			t.Errorf("payee balance after capture got = %v, want 500", acc.Balance)
+		}
+		if _, err := repo.CaptureHold(ctx, h.ID, Money{}); !errors.Is(err, ErrHoldNotActive) {
+			t.Errorf("CaptureHold() twice error = %v, want %v", err, ErrHoldNotActive)
+		}
+		if _, err := repo.ReleaseHold(ctx, h.ID); !errors.Is(err, ErrHoldNotActive) {
+			t.Errorf("ReleaseHold() of a captured hold error = %v, want %v", err, ErrHoldNotActive)
+		}
+
+		released, _ := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 150}, time.Time{}, TransactionMeta{})
+		if h, err := repo.ReleaseHold(ctx, released.ID); err != nil || h.Status != HoldReleased || h.ClosedAt.IsZero() {
+			t.Errorf("ReleaseHold() got = %+v, %v", h, err)
+		}
+		full, _ := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 50}, time.Time{}, TransactionMeta{})
+		if h, err := repo.CaptureHold(ctx, full.ID, Money{}); err != nil || h.Captured != 50 {
+			t.Errorf("CaptureHold() full got = %+v, %v", h, err)
+		}
+
+		_, _ = repo.RelayTransactions(ctx, 100, nil)
+		page, _ := repo.ListTransactions(ctx, TransactionQuery{Type: TransactionCapture})
+		if len(page.Transactions) != 2 || page.Transactions[0].Amount != 500 || page.Transactions[0].Reference != "order-1" ||
+			page.Transactions[0].ID != captured.TransactionID || page.Transactions[0].FromBalance != 200 {
+			t.Errorf("capture log entries got = %+v", page.Transactions)
+		}
+		holds, err := repo.ListHolds(ctx, buyerID)
+		if err != nil || len(holds) != 3 || holds[0].ID != h.ID || holds[1].Status != HoldReleased {
+			t.Errorf("ListHolds() got = %+v, %v", holds, err)
+		}
+		if got, err := repo.GetHold(ctx, released.ID); err != nil || got.Status != HoldReleased {
+			t.Errorf("GetHold() got = %+v, %v", got, err)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+	})
+}
+
+func TestHoldErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		usdID, _ := repo.CreateCurrencyAccount(ctx, "USD")
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 100}, TransactionMeta{})
+		now := time.Now()
+
+		tests := []struct {
+			name      string
+			to        AccountID
+			amount    Money
+			expiresAt time.Time
+			wantErr   error
+		}{
+			{"zero amount", shopID, Money{}, time.Time{}, ErrInvalidAmount},
+			{"same account", buyerID, Money{Amount: 10}, time.Time{}, ErrSameAccount},
+			{"expired", shopID, Money{Amount: 10}, now.Add(-time.Minute), ErrInvalidHold},
+			{"too long", shopID, Money{Amount: 10}, now.Add(MaxHoldDuration + time.Hour), ErrInvalidHold},
+			{"unknown payee", "nope", Money{Amount: 10}, time.Time{}, ErrAccountNotFound},
+			{"payee in another currency", usdID, Money{Amount: 10}, time.Time{}, ErrCurrencyMismatch},
+			{"amount in another currency", shopID, Money{Amount: 10, Currency: "USD"}, time.Time{}, ErrCurrencyMismatch},
+			{"more than the balance", shopID, Money{Amount: 101}, time.Time{}, ErrInsufficientFunds},
+		}
+		for _, tt := range tests {
+			if _, err := repo.PlaceHold(ctx, buyerID, tt.to, tt.amount, tt.expiresAt, TransactionMeta{}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("PlaceHold() %v error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if _, err := repo.CaptureHold(ctx, 999, Money{}); !errors.Is(err, ErrHoldNotFound) {
+			t.Errorf("CaptureHold() unknown error = %v, want %v", err, ErrHoldNotFound)
+		}
+		if _, err := repo.ReleaseHold(ctx, 999); !errors.Is(err, ErrHoldNotFound) {
+			t.Errorf("ReleaseHold() unknown error = %v, want %v", err, ErrHoldNotFound)
+		}
+		if _, err := repo.ListHolds(ctx, "nope"); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("ListHolds() unknown error = %v, want %v", err, ErrAccountNotFound)
+		}
+
+		// a frozen account keeps its holds, which can still be released
+		h, _ := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 60}, time.Time{}, TransactionMeta{})
+		_, _ = repo.SetAccountStatus(ctx, buyerID, StatusFrozen)
+		if _, err := repo.CaptureHold(ctx, h.ID, Money{}); !errors.Is(err, ErrAccountFrozen) {
+			t.Errorf("CaptureHold() from a frozen account error = %v, want %v", err, ErrAccountFrozen)
+		}
+		if _, err := repo.ReleaseHold(ctx, h.ID); err != nil {
+			t.Errorf("ReleaseHold() on a frozen account error = %v", err)
+		}
+		if acc, _ := repo.GetAccount(ctx, buyerID); acc.Held != 0 || acc.Available != 100 {
+			t.Errorf("GetAccount() after release got = %+v", acc)
+		}
+	})
+}
+
+func TestExpireHolds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 100}, TransactionMeta{})
+		soon, _ := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 30}, time.Now().Add(time.Hour), TransactionMeta{})
+		later, _ := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 40}, time.Now().Add(48*time.Hour), TransactionMeta{})
+
+		if n, err := repo.ExpireHolds(ctx, time.Now()); err != nil || n != 0 {
+			t.Errorf("ExpireHolds() before expiry got = %v, %v", n, err)
+		}
+		if n, err := repo.ExpireHolds(ctx, time.Now().Add(2*time.Hour)); err != nil || n != 1 {
+			t.Errorf("ExpireHolds() got = %v, %v, want 1", n, err)
+		}
+		if h, _ := repo.GetHold(ctx, soon.ID); h.Status != HoldExpired {
+			t.Errorf("expired hold got = %+v", h)
+		}
+		if h, _ := repo.GetHold(ctx, later.ID); h.Status != HoldActive {
+			t.Errorf("hold expiring later got = %+v", h)
+		}
+		if acc, _ := repo.GetAccount(ctx, buyerID); acc.Held != 40 || acc.Available != 60 {
+			t.Errorf("GetAccount() after expiry got = %+v", acc)
+		}
+		if n, _ := repo.ExpireHolds(ctx, time.Now().Add(2*time.Hour)); n != 0 {
+			t.Errorf("ExpireHolds() twice got = %v, want 0", n)
+		}
+	})
+}
+
+func TestHoldsDurable(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	buyerID, _ := repo.CreateAccount(ctx)
+	shopID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 1000}, TransactionMeta{})
+	captured, _ := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 300}, time.Time{}, TransactionMeta{})
+	active, _ := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 200}, time.Time{}, TransactionMeta{})
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	// replayed from the log after the snapshot
+	_, _ = repo.CaptureHold(ctx, captured.ID, Money{Amount: 250})
+	expiring, _ := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 100}, time.Now().Add(time.Hour), TransactionMeta{})
+	_, _ = repo.ExpireHolds(ctx, time.Now().Add(2*time.Hour))
+	want, _ := repo.GetAccount(ctx, buyerID)
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	got, _ := repo.GetAccount(ctx, buyerID)
+	if got.Balance != want.Balance || got.Held != 200 || got.Available != want.Available {
+		t.Errorf("GetAccount() after reopen got = %+v, want %+v", got, want)
+	}
+	if h, _ := repo.GetHold(ctx, captured.ID); h.Status != HoldCaptured || h.Captured != 250 {
+		t.Errorf("captured hold after reopen got = %+v", h)
+	}
+	if h, _ := repo.GetHold(ctx, expiring.ID); h.Status != HoldExpired {
+		t.Errorf("expired hold after reopen got = %+v", h)
+	}
+	// new holds do not reuse ids
+	h, err := repo.PlaceHold(ctx, buyerID, shopID, Money{Amount: 10}, time.Time{}, TransactionMeta{})
+	if err != nil || h.ID <= expiring.ID || h.ID == active.ID {
+		t.Errorf("PlaceHold() after reopen got = %+v, %v", h, err)
+	}
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() after reopen error = %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrIdempotencyKeyReused   = errors.New("idempotency key was already used for a different request")
+	ErrIdempotencyKeyInFlight = errors.New("a request with this idempotency key is still in progress")
+)
+
+// IdempotentResponse is the response recorded for an idempotency key.
+type IdempotentResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore remembers the response to each idempotency key until it
+// expires, so that retried requests are answered instead of applied again.
+type IdempotencyStore interface {
+	// Begin reserves key for a request identified by fingerprint. It returns
+	// the recorded response if the key has already completed, and
+	// ErrIdempotencyKeyReused if the key was used with another fingerprint.
+	Begin(ctx context.Context, key string, fingerprint string) (*IdempotentResponse, error)
+	// Complete records the response for a key reserved by Begin.
+	Complete(ctx context.Context, key string, resp IdempotentResponse) error
+	// Release drops a reservation whose request produced no response.
+	Release(ctx context.Context, key string) error
+}
+
+var _ IdempotencyStore = (*MemoryIdempotencyStore)(nil)
+
+type idempotencyEntry struct {
+	fingerprint string
+	response    *IdempotentResponse
+	expires     time.Time
+}
+
+// MemoryIdempotencyStore keeps idempotency keys in memory for ttl after they
+// are first used.
+type MemoryIdempotencyStore struct {
+	ttl       time.Duration
+	entries   map[string]*idempotencyEntry
+	lastPurge time.Time
+	mu        sync.Mutex
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:       ttl,
+		entries:   make(map[string]*idempotencyEntry),
+		lastPurge: time.Now(),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Begin(ctx context.Context, key string, fingerprint string) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.purgeExpired(now)
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expires) {
+		if entry.fingerprint != fingerprint {
+			return nil, ErrIdempotencyKeyReused
+		}
+		if entry.response == nil {
+			return nil, ErrIdempotencyKeyInFlight
+		}
+		return entry.response, nil
+	}
+	s.entries[key] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(s.ttl)}
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, resp IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok {
+		entry.response = &resp
+	}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok && entry.response == nil {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// purgeExpired drops expired keys, at most once per minute.
+func (s *MemoryIdempotencyStore) purgeExpired(now time.Time) {
+	if now.Sub(s.lastPurge) < time.Minute {
+		return
+	}
+	s.lastPurge = now
+	for key, entry := range s.entries {
+		if !now.Before(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
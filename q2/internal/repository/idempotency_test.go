@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Hour)
+	ctx := context.Background()
+
+	if resp, err := store.Begin(ctx, "key-1", "request-a"); resp != nil || err != nil {
+		t.Fatalf("Begin() first use got = %v, %v, want nil, nil", resp, err)
+	}
+	if _, err := store.Begin(ctx, "key-1", "request-a"); !errors.Is(err, ErrIdempotencyKeyInFlight) {
+		t.Errorf("Begin() while in flight error = %v, want %v", err, ErrIdempotencyKeyInFlight)
+	}
+
+	_ = store.Complete(ctx, "key-1", IdempotentResponse{Status: 200, Body: []byte(`"success"`)})
+	resp, err := store.Begin(ctx, "key-1", "request-a")
+	if err != nil || resp == nil || resp.Status != 200 || string(resp.Body) != `"success"` {
+		t.Errorf("Begin() replay got = %+v, %v, want the stored response", resp, err)
+	}
+	if _, err := store.Begin(ctx, "key-1", "request-b"); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("Begin() with another request error = %v, want %v", err, ErrIdempotencyKeyReused)
+	}
+
+	// a released key can be used again
+	_, _ = store.Begin(ctx, "key-2", "request-a")
+	_ = store.Release(ctx, "key-2")
+	if resp, err := store.Begin(ctx, "key-2", "request-b"); resp != nil || err != nil {
+		t.Errorf("Begin() after release got = %v, %v, want nil, nil", resp, err)
+	}
+}
+
+func TestMemoryIdempotencyStoreExpiry(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Millisecond)
+	ctx := context.Background()
+
+	_, _ = store.Begin(ctx, "key-1", "request-a")
+	_ = store.Complete(ctx, "key-1", IdempotentResponse{Status: 200})
+	time.Sleep(5 * time.Millisecond)
+
+	if resp, err := store.Begin(ctx, "key-1", "request-b"); resp != nil || err != nil {
+		t.Errorf("Begin() after expiry got = %v, %v, want nil, nil", resp, err)
+	}
+}
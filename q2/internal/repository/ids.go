@@ -0,0 +1,195 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IDGenerator hands out account ids. Every repository owns its generator.
+type IDGenerator interface {
+	// NewID returns an id the generator has not returned or observed before.
+	NewID() AccountID
+	// Observe tells the generator about an id that already exists, so that a
+	// reopened repository does not hand it out again.
+	Observe(id AccountID)
+}
+
+// ID generation strategies accepted by NewIDGenerator.
+const (
+	IDSequential = "sequential"
+	IDUUIDv7     = "uuidv7"
+	IDSnowflake  = "snowflake"
+)
+
+// NewIDGenerator returns a generator for strategy. node is the worker id of
+// Snowflake ids and is ignored by the other strategies.
+func NewIDGenerator(strategy string, node int64) (IDGenerator, error) {
+	switch strategy {
+	case IDSequential, "":
+		return NewSequentialIDs(), nil
+	case IDUUIDv7:
+		return NewUUIDv7IDs(), nil
+	case IDSnowflake:
+		return NewSnowflakeIDs(node)
+	default:
+		return nil, fmt.Errorf("unknown id strategy %q", strategy)
+	}
+}
+
+var _ IDGenerator = (*SequentialIDs)(nil)
+
+// SequentialIDs numbers accounts 1, 2, 3 and so on.
+type SequentialIDs struct {
+	last int64
+}
+
+func NewSequentialIDs() *SequentialIDs {
+	return &SequentialIDs{}
+}
+
+func (g *SequentialIDs) NewID() AccountID {
+	return AccountID(strconv.FormatInt(atomic.AddInt64(&g.last, 1), 10))
+}
+
+// Observe continues numbering after id. Ids that are not numbers are ignored.
+func (g *SequentialIDs) Observe(id AccountID) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		last := atomic.LoadInt64(&g.last)
+		if n <= last || atomic.CompareAndSwapInt64(&g.last, last, n) {
+			return
+		}
+	}
+}
+
+var _ IDGenerator = (*UUIDv7IDs)(nil)
+
+// UUIDv7IDs returns RFC 9562 version 7 UUIDs. The 12 bits after the
+// millisecond timestamp count up within a millisecond, so ids from one
+// generator sort in creation order.
+type UUIDv7IDs struct {
+	lastMillis int64
+	seq        uint16
+	mu         sync.Mutex
+}
+
+func NewUUIDv7IDs() *UUIDv7IDs {
+	return &UUIDv7IDs{}
+}
+
+func (g *UUIDv7IDs) NewID() AccountID {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	g.mu.Lock()
+	millis := time.Now().UnixMilli()
+	if millis <= g.lastMillis {
+		// same millisecond or the clock went back: count up from the last id
+		millis = g.lastMillis
+		g.seq++
+		if g.seq > 0xfff {
+			millis++
+			g.seq = 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMillis = millis
+	seq := g.seq
+	g.mu.Unlock()
+
+	b[0], b[1], b[2] = byte(millis>>40), byte(millis>>32), byte(millis>>24)
+	b[3], b[4], b[5] = byte(millis>>16), byte(millis>>8), byte(millis)
+	b[6] = 0x70 | byte(seq>>8)
+	b[7] = byte(seq)
+	b[8] = 0x80 | b[8]&0x3f
+
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return AccountID(s[:])
+}
+
+// Observe does nothing, random bits keep UUIDs unique.
+func (g *UUIDv7IDs) Observe(id AccountID) {}
+
+var _ IDGenerator = (*SnowflakeIDs)(nil)
+
+// snowflakeEpoch is the start of Snowflake timestamps, 2024-01-01 UTC.
+const snowflakeEpoch = 1704067200000
+
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeMaxNode  = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSeq   = 1<<snowflakeSeqBits - 1
+)
+
+// SnowflakeIDs returns 63-bit ids made of a millisecond timestamp, the node
+// id and a per-millisecond sequence, written in decimal. Nodes with different
+// ids never return the same id.
+type SnowflakeIDs struct {
+	node       int64
+	lastMillis int64
+	seq        int64
+	mu         sync.Mutex
+}
+
+func NewSnowflakeIDs(node int64) (*SnowflakeIDs, error) {
+	if node < 0 || node > snowflakeMaxNode {
+		return nil, fmt.Errorf("snowflake node %d is outside 0-%d", node, snowflakeMaxNode)
+	}
+	return &SnowflakeIDs{node: node}, nil
+}
+
+func (g *SnowflakeIDs) NewID() AccountID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	millis := time.Now().UnixMilli() - snowflakeEpoch
+	if millis <= g.lastMillis {
+		// same millisecond or the clock went back: count up from the last id
+		millis = g.lastMillis
+		g.seq++
+		if g.seq > snowflakeMaxSeq {
+			millis++
+			g.seq = 0
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMillis = millis
+	id := millis<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq
+	return AccountID(strconv.FormatInt(id, 10))
+}
+
+// Observe makes later ids of this node sort after id, even if the clock went
+// back since id was made.
+func (g *SnowflakeIDs) Observe(id AccountID) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil || n < 0 || (n>>snowflakeSeqBits)&snowflakeMaxNode != g.node {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	millis, seq := n>>(snowflakeNodeBits+snowflakeSeqBits), n&snowflakeMaxSeq
+	if millis > g.lastMillis || millis == g.lastMillis && seq > g.seq {
+		g.lastMillis, g.seq = millis, seq
+	}
+}
@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIDGenerators(t *testing.T) {
+	for _, strategy := range []string{IDSequential, IDUUIDv7, IDSnowflake} {
+		t.Run(strategy, func(t *testing.T) {
+			ids, err := NewIDGenerator(strategy, 1)
+			if err != nil {
+				t.Fatalf("NewIDGenerator() error = %v", err)
+			}
+			var mu sync.Mutex
+			seen := make(map[AccountID]bool)
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 2000; j++ {
+						id := ids.NewID()
+						mu.Lock()
+						if seen[id] {
+							t.Errorf("NewID() returned %v twice", id)
+						}
+						seen[id] = true
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+	if _, err := NewIDGenerator("random", 0); err == nil {
+		t.Errorf("NewIDGenerator() unknown strategy error = %v, wantErr %v", err, true)
+	}
+	if _, err := NewSnowflakeIDs(1024); err == nil {
+		t.Errorf("NewSnowflakeIDs() node out of range error = %v, wantErr %v", err, true)
+	}
+}
+
+func TestSequentialIDsObserve(t *testing.T) {
+	ids := NewSequentialIDs()
+	ids.Observe("41")
+	ids.Observe("7")
+	ids.Observe("0190a4b2-not-a-number")
+	if id := ids.NewID(); id != "42" {
+		t.Errorf("NewID() got = %v, want %v", id, "42")
+	}
+}
+
+func TestUUIDv7IDs(t *testing.T) {
+	ids := NewUUIDv7IDs()
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	prev := ids.NewID()
+	for i := 0; i < 10000; i++ {
+		id := ids.NewID()
+		if !format.MatchString(string(id)) {
+			t.Fatalf("NewID() got = %v, not a version 7 UUID", id)
+		}
+		if id <= prev {
+			t.Fatalf("NewID() got = %v after %v, want increasing ids", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestSnowflakeIDsObserve(t *testing.T) {
+	ids, _ := NewSnowflakeIDs(3)
+
+	// an id from far in the future, as if the clock went back since
+	other, _ := NewSnowflakeIDs(3)
+	other.lastMillis = 1 << 40
+	future := other.NewID()
+	ids.Observe(future)
+	id := ids.NewID()
+	got, _ := strconv.ParseInt(string(id), 10, 64)
+	want, _ := strconv.ParseInt(string(future), 10, 64)
+	if got <= want {
+		t.Errorf("NewID() after Observe(%v) got = %v, want a later id", future, id)
+	}
+	// ids of other nodes do not move this one
+	ids.Observe(AccountID(strconv.FormatInt(want+1<<snowflakeSeqBits, 10)))
+	if next := ids.NewID(); next == id {
+		t.Errorf("NewID() got = %v twice", id)
+	}
+}
+
+func TestRepositoriesHaveSeparateIDs(t *testing.T) {
+	ctx := context.Background()
+	a := NewRepository()
+	b := NewRepository()
+	for i := 0; i < 3; i++ {
+		_, _ = a.CreateAccount(ctx)
+	}
+	if id, _ := b.CreateAccount(ctx); id != "1" {
+		t.Errorf("CreateAccount() on a second repository got = %v, want %v", id, "1")
+	}
+
+	uuids := NewRepository(WithIDGenerator(NewUUIDv7IDs()))
+	id, _ := uuids.CreateAccount(ctx)
+	if _, err := uuids.DepositAccount(ctx, id, Money{Amount: 10}, TransactionMeta{}); err != nil {
+		t.Errorf("DepositAccount() on a UUID account error = %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// System accounts hold the other side of money entering and leaving the bank,
+// so that every journal entry balances. Their balances are derived from the
+// journal only.
+const (
+	CashInAccount  AccountID = "-1"
+	CashOutAccount AccountID = "-2"
+	// InterestIncomeAccount receives the interest charged on overdrafts
+	InterestIncomeAccount AccountID = "-3"
+	// ExchangeAccount buys the currency a cross-currency transfer sends and
+	// sells the currency it receives; its balance in every currency is the
+	// position of the bank
+	ExchangeAccount AccountID = "-4"
+	// EscrowAccount keeps the payments of marketplace orders until they are
+	// released to the merchant or refunded to the buyer
+	EscrowAccount AccountID = "-5"
+)
+
+var ErrLedgerImbalance = errors.New("ledger is out of balance")
+
+// Posting changes the balance of Account by Amount of Currency. Positive
+// amounts are credits and negative amounts are debits.
+type Posting struct {
+	Account  AccountID
+	Amount   int64
+	Currency Currency
+}
+
+// JournalEntry is one balanced money movement: its postings in every currency
+// sum to zero.
+// Reverses is the id of the entry a reversal compensates.
+type JournalEntry struct {
+	ID       int64
+	Type     TransactionType
+	Reverses int64 `json:",omitempty"`
+	Postings []Posting
+	When     time.Time
+}
+
+type journal struct {
+	entries []JournalEntry
+	// byID is the position of every entry in entries
+	byID map[int64]int
+	// reversed is the amount reversed so far of every reversed entry
+	reversed map[int64]int64
+	rw       sync.RWMutex
+}
+
+func newJournal() journal {
+	return journal{
+		entries:  make([]JournalEntry, 0),
+		byID:     make(map[int64]int),
+		reversed: make(map[int64]int64),
+	}
+}
+
+// add appends entry and indexes it. The caller holds the write lock.
+func (j *journal) add(entry JournalEntry) {
+	j.byID[entry.ID] = len(j.entries)
+	j.entries = append(j.entries, entry)
+	if entry.Reverses != 0 {
+		// the first posting of a reversal credits the original sender
+		j.reversed[entry.Reverses] += entry.Postings[0].Amount
+	}
+}
+
+// reversalPostings give amount of a transfer back from its receiver to its sender.
+func reversalPostings(original JournalEntry, amount int64) []Posting {
+	from, to := original.Postings[0], original.Postings[1]
+	return []Posting{
+		{Account: from.Account, Amount: amount, Currency: from.Currency.orDefault()},
+		{Account: to.Account, Amount: -amount, Currency: to.Currency.orDefault()},
+	}
+}
+
+// depositPostings moves amount from cash-in into the account.
+func depositPostings(id AccountID, currency Currency, amount int64) []Posting {
+	return []Posting{{Account: CashInAccount, Amount: -amount, Currency: currency}, {Account: id, Amount: amount, Currency: currency}}
+}
+
+// withdrawPostings moves amount from the account out through cash-out.
+func withdrawPostings(id AccountID, currency Currency, amount int64) []Posting {
+	return []Posting{{Account: id, Amount: -amount, Currency: currency}, {Account: CashOutAccount, Amount: amount, Currency: currency}}
+}
+
+func transferPostings(from AccountID, to AccountID, currency Currency, amount int64) []Posting {
+	return []Posting{{Account: from, Amount: -amount, Currency: currency}, {Account: to, Amount: amount, Currency: currency}}
+}
+
+// exchangePostings move amount of currency from one account to the exchange
+// account, and the converted amount from the exchange account to the other.
+func exchangePostings(from AccountID, to AccountID, currency Currency, amount int64, c *Conversion) []Posting {
+	return []Posting{
+		{Account: from, Amount: -amount, Currency: currency},
+		{Account: ExchangeAccount, Amount: amount, Currency: currency},
+		{Account: ExchangeAccount, Amount: -c.ToAmount, Currency: c.ToCurrency},
+		{Account: to, Amount: c.ToAmount, Currency: c.ToCurrency},
+	}
+}
+
+// post appends an entry to the journal.
+func (r *Repository) post(entry JournalEntry) {
+	r.Journal.rw.Lock()
+	defer r.Journal.rw.Unlock()
+	r.Journal.add(entry)
+}
+
+// GetJournal returns a copy of the journal
+func (r *Repository) GetJournal(ctx context.Context) ([]JournalEntry, error) {
+	r.Journal.rw.RLock()
+	defer r.Journal.rw.RUnlock()
+	return append([]JournalEntry(nil), r.Journal.entries...), nil
+}
+
+func (r *Repository) GetJournalEntry(ctx context.Context, id int64) (*JournalEntry, error) {
+	r.Journal.rw.RLock()
+	defer r.Journal.rw.RUnlock()
+	pos, ok := r.Journal.byID[id]
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+	entry := r.Journal.entries[pos]
+	return &entry, nil
+}
+
+// Parties returns the first account that e debits and the last it credits,
+// skipping the system accounts, or "" for a side only they are on.
+func (e *JournalEntry) Parties() (from, to AccountID) {
+	for _, p := range e.Postings {
+		if IsSystemAccount(p.Account) {
+			continue
+		}
+		if p.Amount < 0 && from == "" {
+			from = p.Account
+		}
+		if p.Amount > 0 {
+			to = p.Account
+		}
+	}
+	return from, to
+}
+
+// CheckLedger verifies that every journal entry balances and that the
+// balance of every account equals the sum of its postings.
+func (r *Repository) CheckLedger(ctx context.Context) error {
+	// block writers so balances and journal are read at the same point
+	r.cut.Lock()
+	defer r.cut.Unlock()
+	balances := make(map[AccountID]int64, r.Accounts.len())
+	r.Accounts.each(func(account *account) {
+		balances[account.ID] = account.Balance
+	})
+	return checkJournal(r.Journal.entries, balances)
+}
+
+// checkJournal verifies entries against the cached balances of customer accounts.
+func checkJournal(entries []JournalEntry, balances map[AccountID]int64) error {
+	sums := make(map[AccountID]int64, len(balances))
+	for _, entry := range entries {
+		totals := make(map[Currency]int64, 1)
+		for _, p := range entry.Postings {
+			totals[p.Currency.orDefault()] += p.Amount
+			sums[p.Account] += p.Amount
+		}
+		for currency, total := range totals {
+			if total != 0 {
+				return fmt.Errorf("%w: entry %d sums to %d %s", ErrLedgerImbalance, entry.ID, total, currency)
+			}
+		}
+	}
+	for id, balance := range balances {
+		if sums[id] != balance {
+			return fmt.Errorf("%w: account %s has balance %d but postings sum to %d", ErrLedgerImbalance, id, balance, sums[id])
+		}
+	}
+	for id := range sums {
+		if _, ok := balances[id]; !ok && !IsSystemAccount(id) {
+			return fmt.Errorf("%w: postings to unknown account %s", ErrLedgerImbalance, id)
+		}
+	}
+	return nil
+}
+
+// IsSystemAccount reports whether id is one of the system accounts.
+func IsSystemAccount(id AccountID) bool {
+	return id == CashInAccount || id == CashOutAccount || id == InterestIncomeAccount || id == ExchangeAccount || id == EscrowAccount
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLedgerPostsBalancedEntries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		fromAccID, _ := repo.CreateAccount(ctx)
+		toAccID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, fromAccID, Money{Amount: 300}, TransactionMeta{})
+		_, _ = repo.WithdrawAccount(ctx, fromAccID, Money{Amount: 100}, TransactionMeta{})
+		_, _ = repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 50}, TransactionMeta{})
+		// rejected operations post nothing
+		_, _ = repo.WithdrawAccount(ctx, toAccID, Money{Amount: 1000}, TransactionMeta{})
+
+		journal, err := repo.GetJournal(ctx)
+		if err != nil {
+			t.Fatalf("GetJournal() error = %v", err)
+		}
+		if len(journal) != 3 {
+			t.Fatalf("GetJournal() got = %v entries, want %v", len(journal), 3)
+		}
+		sums := make(map[AccountID]int64)
+		for _, entry := range journal {
+			for _, p := range entry.Postings {
+				sums[p.Account] += p.Amount
+			}
+		}
+		if sums[CashInAccount] != -300 || sums[CashOutAccount] != 100 || sums[fromAccID] != 150 || sums[toAccID] != 50 {
+			t.Errorf("GetJournal() got account sums %v", sums)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v, wantErr %v", err, false)
+		}
+	})
+}
+
+func TestCheckLedgerDetectsDrift(t *testing.T) {
+	repo := NewRepository()
+	ctx := context.Background()
+
+	accID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{})
+
+	// a balance changed without a journal entry
+	repo.Accounts.get(accID).Balance += 10
+	if err := repo.CheckLedger(ctx); !errors.Is(err, ErrLedgerImbalance) {
+		t.Errorf("CheckLedger() error = %v, want %v", err, ErrLedgerImbalance)
+	}
+}
+
+func TestReverseTransaction(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		fromAccID, _ := repo.CreateAccount(ctx)
+		toAccID, _ := repo.CreateAccount(ctx)
+		deposit, _ := repo.DepositAccount(ctx, fromAccID, Money{Amount: 100}, TransactionMeta{})
+		transfer, _ := repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 60}, TransactionMeta{})
+
+		// partial refund
+		tl, err := repo.ReverseTransaction(ctx, transfer.ID, Money{Amount: 20}, TransactionMeta{Memo: "damaged item"})
+		if err != nil {
+			t.Fatalf("ReverseTransaction() error = %v", err)
+		}
+		if tl.Type != TransactionReversal || tl.Reverses != transfer.ID || tl.From != toAccID || tl.To != fromAccID ||
+			tl.Amount != 20 || tl.FromBalance != 40 || tl.ToBalance != 60 || tl.Memo != "damaged item" {
+			t.Errorf("ReverseTransaction() got = %+v", tl)
+		}
+		if _, err := repo.ReverseTransaction(ctx, transfer.ID, Money{Amount: 50}, TransactionMeta{}); !errors.Is(err, ErrReversalExceedsAmount) {
+			t.Errorf("ReverseTransaction() over the remaining amount error = %v, want %v", err, ErrReversalExceedsAmount)
+		}
+
+		// the receiver spent the money
+		_, _ = repo.WithdrawAccount(ctx, toAccID, Money{Amount: 30}, TransactionMeta{})
+		if _, err := repo.ReverseTransaction(ctx, transfer.ID, Money{}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("ReverseTransaction() error = %v, want %v", err, ErrInsufficientFunds)
+		}
+
+		// 0 reverses the rest
+		_, _ = repo.DepositAccount(ctx, toAccID, Money{Amount: 30}, TransactionMeta{})
+		if tl, err := repo.ReverseTransaction(ctx, transfer.ID, Money{}, TransactionMeta{}); err != nil || tl.Amount != 40 {
+			t.Errorf("ReverseTransaction() rest got = %v, %v, want amount %v", tl, err, 40)
+		}
+		if _, err := repo.ReverseTransaction(ctx, transfer.ID, Money{}, TransactionMeta{}); !errors.Is(err, ErrAlreadyReversed) {
+			t.Errorf("ReverseTransaction() twice error = %v, want %v", err, ErrAlreadyReversed)
+		}
+		if _, err := repo.ReverseTransaction(ctx, deposit.ID, Money{}, TransactionMeta{}); !errors.Is(err, ErrNotReversible) {
+			t.Errorf("ReverseTransaction() deposit error = %v, want %v", err, ErrNotReversible)
+		}
+		if _, err := repo.ReverseTransaction(ctx, 999, Money{}, TransactionMeta{}); !errors.Is(err, ErrTransactionNotFound) {
+			t.Errorf("ReverseTransaction() unknown error = %v, want %v", err, ErrTransactionNotFound)
+		}
+
+		fromAcc, _ := repo.GetAccount(ctx, fromAccID)
+		toAcc, _ := repo.GetAccount(ctx, toAccID)
+		if fromAcc.Balance != 100 || toAcc.Balance != 0 {
+			t.Errorf("ReverseTransaction() gotFrom = %v, want %v; gotTo = %v, want %v", fromAcc.Balance, 100, toAcc.Balance, 0)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v, wantErr %v", err, false)
+		}
+	})
+}
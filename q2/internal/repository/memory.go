@@ -3,167 +3,610 @@ package repository
 import (
 	"context"
 	"errors"
-	"sort"
+	"fmt"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// type RepositoryI interface {
-// 	CreateAccount(account *account) error
-// 	GetAccount(id accountID) (*account, error)
-// 	DepositAccount(account *account, amount int) error
-// 	WithdrawAccount(id accountID) (*account, error)
-// 	TransferAccount(id accountID) (*account, error)
-// }
-
-type accountID int64
-
-var idCounter int64
+var _ AccountStore = (*Repository)(nil)
 
 type account struct {
-	ID      accountID
-	Balance int
-	rw      sync.RWMutex
-}
-
-type TransactionLog struct {
-	From   accountID
-	To     accountID
-	Amount int64
-	When   time.Time
+	ID       AccountID
+	Currency Currency
+	Balance  int64
+	// Held is the sum of the active holds on the account
+	Held   int64
+	Status AccountStatus
+	Overdraft
+	interest interest
+	rw       sync.RWMutex
 }
 
 type transactions struct {
 	transactions []TransactionLog
-	rw           sync.RWMutex
+	// byAccount and byType are the ascending positions in transactions of the
+	// entries of every account and type
+	byAccount map[AccountID][]int
+	byType    map[TransactionType][]int
+	// unordered is set once an entry is older than the one before it, as
+	// entries of a charge or release as of a later time make it
+	unordered bool
+	rw        sync.RWMutex
 }
 
+// Repository is the in-memory AccountStore.
 type Repository struct {
-	Accounts     map[accountID]*account
+	Accounts     accountMap
 	Transactions transactions
+	// Outbox holds the transaction log entries of money movements until they
+	// are relayed to Transactions
+	Outbox     outbox
+	Journal    journal
+	Customers  customers
+	Overdrafts overdrafts
+	Rates      rates
+	Holds      holds
+	Escrows    escrows
+	Fees       fees
+	journalSeq int64
+	ids        IDGenerator
+	// wal is nil for a purely in-memory repository
+	wal *wal
+	// cut is held for reading by every mutation and for writing while a
+	// snapshot copies the state or the ledger is checked
+	cut        sync.RWMutex
+	snapshotMu sync.Mutex
+	// relayMu is taken before cut
+	relayMu sync.Mutex
 }
 
-func NewRepository() *Repository {
-	idCounter = 0
+func NewRepository(opts ...Option) *Repository {
+	o := newOptions(opts)
 	return &Repository{
-		Accounts: make(map[accountID]*account),
 		Transactions: transactions{
 			transactions: make([]TransactionLog, 0),
+			byAccount:    make(map[AccountID][]int),
+			byType:       make(map[TransactionType][]int),
+		},
+		Outbox: outbox{
+			entries: make([]TransactionLog, 0),
 		},
+		Journal:    newJournal(),
+		Customers:  newCustomers(),
+		Overdrafts: overdrafts{changes: make(map[AccountID][]OverdraftChange)},
+		Rates:      rates{rates: make(map[[2]Currency]ExchangeRate)},
+		Holds:      newHolds(),
+		Escrows:    newEscrows(),
+		Fees:       fees{schedules: make(map[AccountID]FeeSchedule)},
+		ids:        o.ids,
+	}
+}
+
+// NewDurableRepository returns a repository backed by the write-ahead log and
+// snapshots in dir. The newest valid snapshot is loaded and the log written
+// after it is replayed before the repository is returned.
+func NewDurableRepository(dir string, opts ...Option) (*Repository, error) {
+	r := NewRepository(opts...)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	snap, err := loadLatestSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	first := uint64(1)
+	if snap != nil {
+		r.restore(snap)
+		first = snap.Segment
+	}
+	w, records, err := openWAL(dir, first)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		if err := r.replay(rec); err != nil {
+			w.close()
+			return nil, err
+		}
 	}
+	r.wal = w
+	return r, nil
 }
 
-func (r *Repository) CreateAccount(ctx context.Context) (accountID, error) {
-	// use uuid to generate account id
-	id := atomic.AddInt64(&idCounter, 1)
-	r.Accounts[accountID(id)] = &account{
-		ID:      accountID(id),
-		Balance: 0,
+// Close closes the write-ahead log, if any.
+func (r *Repository) Close() error {
+	if r.wal == nil {
+		return nil
+	}
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+	return r.wal.close()
+}
+
+// writeAhead makes rec durable before the caller applies it.
+func (r *Repository) writeAhead(rec walRecord) error {
+	if r.wal == nil {
+		return nil
+	}
+	return r.wal.append(rec)
+}
+
+// replay applies a record read back from the write-ahead log.
+func (r *Repository) replay(rec walRecord) error {
+	switch rec.Op {
+	case opCreateAccount:
+		rec.Account = rec.account()
+		_, err := r.createAccount(rec)
+		r.ids.Observe(rec.Account)
+		return err
+	case opDepositAccount:
+		rec.Account, rec.Entry = rec.account(), r.replayEntryID(rec.Entry)
+		_, err := r.deposit(rec)
+		return err
+	case opWithdrawAccount:
+		rec.Account, rec.Entry = rec.account(), r.replayEntryID(rec.Entry)
+		_, err := r.withdraw(rec)
+		return err
+	case opTransferAccount:
+		rec.Entry = r.replayEntryID(rec.Entry)
+		_, err := r.transfer(rec)
+		return err
+	case opReverseTransaction:
+		rec.Entry = r.replayEntryID(rec.Entry)
+		_, err := r.reverse(rec)
+		return err
+	case opRelayTransactions:
+		_, err := r.relay(rec.Relayed)
+		return err
+	case opAddTransaction:
+		return r.AddTransaction(context.Background(), rec.Batch)
+	case opCreateCustomer, opUpdateCustomer:
+		_, err := r.putCustomer(rec)
+		return err
+	case opDeleteCustomer:
+		return r.deleteCustomer(rec)
+	case opSetAccountHolder:
+		return r.setHolder(rec)
+	case opRemoveAccountHolder:
+		return r.removeHolder(rec)
+	case opSetAccountStatus:
+		_, err := r.setStatus(rec)
+		return err
+	case opSetOverdraft:
+		_, err := r.setOverdraft(rec)
+		return err
+	case opChargeInterest:
+		rec.Entry = r.replayEntryID(rec.Entry)
+		_, err := r.charge(rec)
+		return err
+	case opSetExchangeRate:
+		return r.setRate(rec)
+	case opPlaceHold:
+		_, err := r.placeHold(rec)
+		return err
+	case opCaptureHold:
+		_, err := r.capture(rec)
+		return err
+	case opReleaseHold, opExpireHold:
+		_, err := r.release(rec)
+		return err
+	case opOpenEscrow:
+		rec.Entry = r.replayEntryID(rec.Entry)
+		_, err := r.openEscrow(rec)
+		return err
+	case opReleaseEscrow, opRefundEscrow, opAutoReleaseEscrow:
+		rec.Entry = r.replayEntryID(rec.Entry)
+		_, err := r.settleEscrow(rec)
+		return err
+	case opSetFeeSchedule:
+		_, err := r.setFees(rec)
+		return err
+	case opSplitTransfer:
+		rec.Entry = r.replayEntryID(rec.Entry)
+		_, err := r.split(rec)
+		return err
+	default:
+		return errors.New("unknown wal operation: " + rec.Op)
 	}
-	return accountID(id), nil
 }
 
-func (r *Repository) GetAccount(ctx context.Context, id int64) (*account, error) {
+// nextEntryID returns the id of the next journal entry.
+func (r *Repository) nextEntryID() int64 {
+	return atomic.AddInt64(&r.journalSeq, 1)
+}
+
+// replayEntryID keeps the journal entry id recorded in the log, or assigns one
+// to records written before the journal existed.
+func (r *Repository) replayEntryID(id int64) int64 {
+	if id == 0 {
+		return r.nextEntryID()
+	}
+	if id > r.journalSeq {
+		r.journalSeq = id
+	}
+	return id
+}
+
+func (r *Repository) CreateAccount(ctx context.Context, holders ...AccountHolder) (AccountID, error) {
+	return r.CreateCurrencyAccount(ctx, DefaultCurrency, holders...)
+}
+
+func (r *Repository) CreateCurrencyAccount(ctx context.Context, currency Currency, holders ...AccountHolder) (AccountID, error) {
+	if err := currency.check(); err != nil {
+		return "", err
+	}
+	if err := checkHolders(holders); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	holders = append([]AccountHolder(nil), holders...)
+	for i := range holders {
+		holders[i].Since = now
+	}
+	return r.createAccount(walRecord{Op: opCreateAccount, Account: r.ids.NewID(), Currency: currency, Holders: holders})
+}
+
+func (r *Repository) createAccount(rec walRecord) (AccountID, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	id := rec.Account
+	// the account is not visible before it is linked to its holders
+	r.Customers.rw.Lock()
+	defer r.Customers.rw.Unlock()
+	for i := range rec.Holders {
+		if _, ok := r.Customers.customers[rec.Holders[i].CustomerID]; !ok {
+			return "", ErrCustomerNotFound
+		}
+		rec.Holders[i].AccountID = id
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return "", err
+	}
+	for _, h := range rec.Holders {
+		r.Customers.link(h)
+	}
+	r.Accounts.put(&account{
+		ID:       id,
+		Currency: rec.Currency.orDefault(),
+		Balance:  0,
+		Status:   StatusActive,
+	})
+	return id, nil
+}
+
+func (r *Repository) GetAccount(ctx context.Context, id AccountID) (*Account, error) {
 	// check if account exists
-	if r.Accounts[accountID(id)] == nil {
-		return nil, errors.New("account not found")
+	account := r.Accounts.get(id)
+	if account == nil {
+		return nil, ErrAccountNotFound
 	}
-	r.Accounts[accountID(id)].rw.RLock()
-	defer r.Accounts[accountID(id)].rw.RUnlock()
-	readAccount := &account{
-		ID:      r.Accounts[accountID(id)].ID,
-		Balance: r.Accounts[accountID(id)].Balance,
+	account.rw.RLock()
+	defer account.rw.RUnlock()
+	// what is owed up to now, without changing the account
+	accrued := account.interest
+	accrued.accrue(account.Balance, account.InterestRate, time.Now())
+	readAccount := &Account{
+		ID:           account.ID,
+		Currency:     account.Currency,
+		Balance:      account.Balance,
+		Held:         account.Held,
+		Available:    account.Balance - account.Held,
+		Status:       account.Status,
+		Overdraft:    account.Overdraft,
+		InterestOwed: accrued.Owed,
 	}
 	return readAccount, nil
 }
 
-func (r *Repository) DepositAccount(ctx context.Context, aid int64, amount int) error {
-	if account := r.Accounts[accountID(aid)]; account == nil {
-		return errors.New("account not found")
+func (r *Repository) DepositAccount(ctx context.Context, aid AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error) {
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	rec := r.movement(opDepositAccount, meta)
+	rec.Account, rec.Amount, rec.Currency = aid, amount.Amount, amount.Currency
+	return r.deposit(rec)
+}
+
+// deposit applies a deposit record. The same record is written ahead, so
+// replaying it posts the same journal entry and outbox entry.
+func (r *Repository) deposit(rec walRecord) (*TransactionLog, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	if account := r.Accounts.get(rec.Account); account == nil {
+		return nil, ErrAccountNotFound
 	} else {
 		account.rw.Lock()
 		defer account.rw.Unlock()
-		account.Balance += amount
-		return nil
+		if err := account.Status.canCredit(); err != nil {
+			return nil, err
+		}
+		if err := (Money{Currency: rec.Currency}).in(account.Currency); err != nil {
+			return nil, err
+		}
+		balance, err := addAmounts(account.Balance, rec.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.writeAhead(rec); err != nil {
+			return nil, err
+		}
+		account.accrue(rec.When)
+		account.Balance = balance
+		r.post(JournalEntry{ID: rec.Entry, Type: TransactionDeposit, Postings: depositPostings(account.ID, account.Currency, rec.Amount), When: rec.When})
+		return r.commitLog(rec, &TransactionLog{
+			ID:        rec.Entry,
+			Type:      TransactionDeposit,
+			From:      CashInAccount,
+			To:        account.ID,
+			Amount:    rec.Amount,
+			Currency:  account.Currency,
+			ToBalance: account.Balance,
+		}), nil
 	}
 }
 
-func (r *Repository) WithdrawAccount(ctx context.Context, id int64, amount int) error {
+func (r *Repository) WithdrawAccount(ctx context.Context, id AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error) {
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	rec := r.movement(opWithdrawAccount, meta)
+	rec.Account, rec.Amount, rec.Currency = id, amount.Amount, amount.Currency
+	return r.withdraw(rec)
+}
+
+func (r *Repository) withdraw(rec walRecord) (*TransactionLog, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
 
 	// check if account exists
-	if r.Accounts[accountID(id)] == nil {
-		return errors.New("account not found")
+	account := r.Accounts.get(rec.Account)
+	if account == nil {
+		return nil, ErrAccountNotFound
 	}
-	r.Accounts[accountID(id)].rw.Lock()
-	defer r.Accounts[accountID(id)].rw.Unlock()
-	r.Accounts[accountID(id)].Balance -= amount
-	if r.Accounts[accountID(id)].Balance < 0 {
-		r.Accounts[accountID(id)].Balance += amount
-		return errors.New("insufficient funds")
+	account.rw.Lock()
+	defer account.rw.Unlock()
+	if err := account.Status.canDebit(); err != nil {
+		return nil, err
 	}
-	return nil
+	if err := (Money{Currency: rec.Currency}).in(account.Currency); err != nil {
+		return nil, err
+	}
+	if err := account.covers(rec.Amount); err != nil {
+		return nil, err
+	}
+	balance, err := subAmounts(account.Balance, rec.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+	account.accrue(rec.When)
+	account.Balance = balance
+	r.post(JournalEntry{ID: rec.Entry, Type: TransactionWithdrawal, Postings: withdrawPostings(account.ID, account.Currency, rec.Amount), When: rec.When})
+	return r.commitLog(rec, &TransactionLog{
+		ID:          rec.Entry,
+		Type:        TransactionWithdrawal,
+		From:        account.ID,
+		To:          CashOutAccount,
+		Amount:      rec.Amount,
+		Currency:    account.Currency,
+		FromBalance: account.Balance,
+	}), nil
+}
+
+func (r *Repository) TransferAccount(ctx context.Context, from AccountID, to AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error) {
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	rec := r.movement(opTransferAccount, meta)
+	rec.From, rec.To, rec.Amount, rec.Currency = from, to, amount.Amount, amount.Currency
+	return r.transfer(rec)
 }
 
-func (r *Repository) TransferAccount(ctx context.Context, from int64, to int64, amount int) error {
-	fromID := accountID(from)
-	toID := accountID(to)
+func (r *Repository) transfer(rec walRecord) (*TransactionLog, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	fromID, toID, amount := rec.From, rec.To, rec.Amount
 	// check if account exists
-	if r.Accounts[fromID] == nil || r.Accounts[toID] == nil {
-		return errors.New("account not found")
+	fromAcc, toAcc := r.Accounts.get(fromID), r.Accounts.get(toID)
+	if fromAcc == nil || toAcc == nil {
+		return nil, ErrAccountNotFound
 	}
 
 	if fromID == toID {
 		// Handle the case where from and to are the same, which could be a no-op or an error
-		return errors.New("cannot transfer to the same account")
+		return nil, ErrSameAccount
 	}
 
 	// Ensure consistent locking order
-	ids := []int{int(from), int(to)}
-	sort.Ints(ids)
-	first, second := accountID(ids[0]), accountID(ids[1])
+	defer lockAccounts(fromAcc, toAcc)()
 
-	r.Accounts[first].rw.Lock()
-	defer r.Accounts[first].rw.Unlock()
-
-	r.Accounts[second].rw.Lock()
-	defer r.Accounts[second].rw.Unlock()
+	if err := checkMovement(fromAcc, toAcc); err != nil {
+		return nil, err
+	}
+	if err := (Money{Currency: rec.Currency}).in(fromAcc.Currency); err != nil {
+		return nil, err
+	}
+	if err := fromAcc.covers(amount); err != nil {
+		return nil, err
+	}
+	// the conversion is resolved once and replayed from the log
+	if fromAcc.Currency != toAcc.Currency && rec.Conversion == nil {
+		rate, ok := r.Rates.get(fromAcc.Currency, toAcc.Currency)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s to %s", ErrNoExchangeRate, fromAcc.Currency, toAcc.Currency)
+		}
+		conversion, err := rate.convert(amount)
+		if err != nil {
+			return nil, err
+		}
+		rec.Conversion = conversion
+	}
+	postings := transferPostings(fromID, toID, fromAcc.Currency, amount)
+	credited := amount
+	if rec.Conversion != nil {
+		postings = exchangePostings(fromID, toID, fromAcc.Currency, amount, rec.Conversion)
+		credited = rec.Conversion.ToAmount
+	}
+	fromBalance, err := subAmounts(fromAcc.Balance, amount)
+	if err != nil {
+		return nil, err
+	}
+	toBalance, err := addAmounts(toAcc.Balance, credited)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
 
 	// Perform the transfer
-	r.Accounts[fromID].Balance -= amount
-	if r.Accounts[fromID].Balance < 0 {
-		r.Accounts[fromID].Balance += amount // Roll back the change
-		return errors.New("insufficient funds")
+	fromAcc.accrue(rec.When)
+	toAcc.accrue(rec.When)
+	fromAcc.Balance = fromBalance
+	toAcc.Balance = toBalance
+	r.post(JournalEntry{ID: rec.Entry, Type: TransactionTransfer, Postings: postings, When: rec.When})
+
+	return r.commitLog(rec, &TransactionLog{
+		ID:          rec.Entry,
+		Type:        TransactionTransfer,
+		From:        fromID,
+		To:          toID,
+		Amount:      amount,
+		Currency:    fromAcc.Currency,
+		Conversion:  rec.Conversion,
+		FromBalance: fromAcc.Balance,
+		ToBalance:   toAcc.Balance,
+	}), nil
+}
+
+func (r *Repository) ReverseTransaction(ctx context.Context, id int64, amount Money, meta TransactionMeta) (*TransactionLog, error) {
+	// a zero amount is the rest of the transfer
+	if amount.Amount != 0 {
+		if err := amount.check(); err != nil {
+			return nil, err
+		}
 	}
-	r.Accounts[toID].Balance += amount
+	rec := r.movement(opReverseTransaction, meta)
+	rec.ID, rec.Amount, rec.Currency = id, amount.Amount, amount.Currency
+	return r.reverse(rec)
+}
 
-	return nil
+// reverse applies a reversal record. An amount of 0 is resolved to the rest of
+// the transfer before the record is written ahead.
+func (r *Repository) reverse(rec walRecord) (*TransactionLog, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	originalID := rec.ID
+
+	r.Journal.rw.RLock()
+	pos, ok := r.Journal.byID[originalID]
+	var original JournalEntry
+	if ok {
+		original = r.Journal.entries[pos]
+	}
+	r.Journal.rw.RUnlock()
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+	if original.Type != TransactionTransfer {
+		return nil, ErrNotReversible
+	}
+	if len(original.Postings) != 2 {
+		return nil, ErrCrossCurrencyReversal
+	}
+	// money goes back from the original receiver to the original sender
+	fromID, toID := original.Postings[1].Account, original.Postings[0].Account
+	fromAcc, toAcc := r.Accounts.get(fromID), r.Accounts.get(toID)
+	if fromAcc == nil || toAcc == nil {
+		return nil, ErrAccountNotFound
+	}
+
+	// Ensure consistent locking order
+	defer lockAccounts(fromAcc, toAcc)()
+
+	if err := checkMovement(fromAcc, toAcc); err != nil {
+		return nil, err
+	}
+	// reversals of the same transfer are serialized by the account locks
+	r.Journal.rw.RLock()
+	remaining := original.Postings[1].Amount - r.Journal.reversed[originalID]
+	r.Journal.rw.RUnlock()
+	if remaining <= 0 {
+		return nil, ErrAlreadyReversed
+	}
+	if err := (Money{Currency: rec.Currency}).in(fromAcc.Currency); err != nil {
+		return nil, err
+	}
+	if rec.Amount == 0 {
+		rec.Amount = remaining
+	}
+	amount := rec.Amount
+	if amount > remaining {
+		return nil, ErrReversalExceedsAmount
+	}
+	if err := fromAcc.covers(amount); err != nil {
+		return nil, err
+	}
+	fromBalance, err := subAmounts(fromAcc.Balance, amount)
+	if err != nil {
+		return nil, err
+	}
+	toBalance, err := addAmounts(toAcc.Balance, amount)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+
+	fromAcc.accrue(rec.When)
+	toAcc.accrue(rec.When)
+	fromAcc.Balance = fromBalance
+	toAcc.Balance = toBalance
+	r.post(JournalEntry{ID: rec.Entry, Type: TransactionReversal, Reverses: originalID, Postings: reversalPostings(original, amount), When: rec.When})
+
+	return r.commitLog(rec, &TransactionLog{
+		ID:          rec.Entry,
+		Type:        TransactionReversal,
+		Reverses:    originalID,
+		From:        fromID,
+		To:          toID,
+		Amount:      amount,
+		Currency:    fromAcc.Currency,
+		FromBalance: fromAcc.Balance,
+		ToBalance:   toAcc.Balance,
+	}), nil
+}
+
+// checkMovement returns why money cannot move from one locked account to
+// another, if it cannot.
+func checkMovement(from, to *account) error {
+	if err := from.Status.canDebit(); err != nil {
+		return err
+	}
+	return to.Status.canCredit()
 }
 
 // GetTransactions returns a copy of the transaction log
-func (r *Repository) GetTransactions(ctx context.Context) []TransactionLog {
+func (r *Repository) GetTransactions(ctx context.Context) ([]TransactionLog, error) {
 	r.Transactions.rw.RLock()
 	defer r.Transactions.rw.RUnlock()
-	return append([]TransactionLog(nil), r.Transactions.transactions...)
-}
-
-type BatchTransaction []struct {
-	From   int64
-	To     int64
-	Amount int
-	When   time.Time
+	return append([]TransactionLog(nil), r.Transactions.transactions...), nil
 }
 
 // AddTransaction adds a new transaction to the log
-func (r *Repository) AddTransaction(ctx context.Context, batch BatchTransaction) {
+func (r *Repository) AddTransaction(ctx context.Context, batch BatchTransaction) error {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
 	r.Transactions.rw.Lock()
 	defer r.Transactions.rw.Unlock()
-	for _, transaction := range batch {
-		r.Transactions.transactions = append(r.Transactions.transactions, TransactionLog{
-			From:   accountID(transaction.From),
-			To:     accountID(transaction.To),
-			Amount: int64(transaction.Amount),
-			When:   transaction.When,
-		})
+	if err := r.writeAhead(walRecord{Op: opAddTransaction, Batch: batch}); err != nil {
+		return err
 	}
+	r.Transactions.add(batch...)
+	return nil
 }
@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidAmount    = errors.New("invalid amount")
+	ErrAmountOverflow   = errors.New("amount overflows")
+	ErrCurrencyMismatch = errors.New("currencies do not match")
+)
+
+// MaxAmount is the largest amount one movement may move, in minor units. It
+// keeps balances, which add up many amounts, far from the limits of int64.
+const MaxAmount int64 = 1_000_000_000_000_000
+
+// Money is an amount in the minor units of a currency. Money without a
+// currency is in the currency of the account it moves in or out of.
+type Money struct {
+	Amount   int64
+	Currency Currency
+}
+
+// NewMoney returns amount minor units of currency, or why it is not an
+// amount that can be moved.
+func NewMoney(amount int64, currency Currency) (Money, error) {
+	m := Money{Amount: amount, Currency: currency}
+	if err := m.check(); err != nil {
+		return Money{}, err
+	}
+	return m, nil
+}
+
+// check returns why m cannot be moved, if it cannot.
+func (m Money) check() error {
+	if m.Currency != "" {
+		if err := m.Currency.check(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case m.Amount < 0:
+		return fmt.Errorf("%w: %d is negative", ErrInvalidAmount, m.Amount)
+	case m.Amount == 0:
+		return fmt.Errorf("%w: amount must be positive", ErrInvalidAmount)
+	case m.Amount > MaxAmount:
+		return fmt.Errorf("%w: %d is more than the maximum of %d", ErrInvalidAmount, m.Amount, MaxAmount)
+	}
+	return nil
+}
+
+// in returns why m cannot move in or out of an account in currency, if it cannot.
+func (m Money) in(currency Currency) error {
+	if m.Currency != "" && m.Currency != currency {
+		return fmt.Errorf("%w: amount in %s, account in %s", ErrCurrencyMismatch, m.Currency, currency)
+	}
+	return nil
+}
+
+// Add returns m plus o. Both must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	sum, err := addAmounts(m.Amount, o.Amount)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+// Sub returns m minus o. Both must be in the same currency.
+func (m Money) Sub(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	diff, err := subAmounts(m.Amount, o.Amount)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: diff, Currency: m.Currency}, nil
+}
+
+// String formats m in major units, 1234 USD cents is "12.34 USD".
+func (m Money) String() string {
+	digits := m.Currency.MinorUnits()
+	s := strconv.FormatInt(m.Amount, 10)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	if digits > 0 {
+		if len(s) <= digits {
+			s = strings.Repeat("0", digits-len(s)+1) + s
+		}
+		s = s[:len(s)-digits] + "." + s[len(s)-digits:]
+	}
+	if m.Currency == "" {
+		return sign + s
+	}
+	return sign + s + " " + string(m.Currency)
+}
+
+// subAmounts returns a minus b, or ErrAmountOverflow if it does not fit in an int64.
+func subAmounts(a, b int64) (int64, error) {
+	if (b > 0 && a < math.MinInt64+b) || (b < 0 && a > math.MaxInt64+b) {
+		return 0, fmt.Errorf("%w: %d minus %d", ErrAmountOverflow, a, b)
+	}
+	return a - b, nil
+}
+
+// addAmounts returns a plus b, or ErrAmountOverflow if it does not fit in an int64.
+func addAmounts(a, b int64) (int64, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, fmt.Errorf("%w: %d plus %d", ErrAmountOverflow, a, b)
+	}
+	return a + b, nil
+}
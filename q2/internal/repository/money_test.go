@@ -0,0 +1,160 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestNewMoney(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   int64
+		currency Currency
+		wantErr  error
+	}{
+		{"valid", 100, "USD", nil},
+		{"account currency", 100, "", nil},
+		{"maximum", MaxAmount, "TWD", nil},
+		{"zero", 0, "USD", ErrInvalidAmount},
+		{"negative", -1, "USD", ErrInvalidAmount},
+		{"too large", MaxAmount + 1, "USD", ErrInvalidAmount},
+		{"unknown currency", 100, "XYZ", ErrInvalidCurrency},
+	}
+	for _, tt := range tests {
+		m, err := NewMoney(tt.amount, tt.currency)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("NewMoney() %v error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && (m.Amount != tt.amount || m.Currency != tt.currency) {
+			t.Errorf("NewMoney() %v got = %+v", tt.name, m)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	usd := func(amount int64) Money { return Money{Amount: amount, Currency: "USD"} }
+	if sum, err := usd(150).Add(usd(250)); err != nil || sum != usd(400) {
+		t.Errorf("Add() got = %v, %v", sum, err)
+	}
+	if diff, err := usd(150).Sub(usd(250)); err != nil || diff != usd(-100) {
+		t.Errorf("Sub() got = %v, %v", diff, err)
+	}
+	if _, err := usd(1).Add(Money{Amount: 1, Currency: "TWD"}); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Add() across currencies error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+	if _, err := usd(math.MaxInt64).Add(usd(1)); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("Add() past the maximum error = %v, want %v", err, ErrAmountOverflow)
+	}
+	if _, err := usd(-2).Sub(usd(math.MaxInt64)); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("Sub() past the minimum error = %v, want %v", err, ErrAmountOverflow)
+	}
+	if _, err := usd(0).Sub(usd(math.MinInt64)); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("Sub() of the minimum error = %v, want %v", err, ErrAmountOverflow)
+	}
+	// every debit of a balance goes through subAmounts
+	if _, err := subAmounts(math.MinInt64+MaxAmount-1, MaxAmount); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("subAmounts() past the minimum error = %v, want %v", err, ErrAmountOverflow)
+	}
+	if diff, err := subAmounts(-MaxAmount, MaxAmount); err != nil || diff != -2*MaxAmount {
+		t.Errorf("subAmounts() got = %v, %v", diff, err)
+	}
+
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{usd(1234), "12.34 USD"},
+		{usd(5), "0.05 USD"},
+		{usd(-5), "-0.05 USD"},
+		{Money{Amount: 1234, Currency: "JPY"}, "1234 JPY"},
+		{Money{Amount: 1234, Currency: "KWD"}, "1.234 KWD"},
+		{Money{Amount: 1234}, "1234"},
+	}
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("String() of %+v got = %v, want %v", tt.money, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidAmounts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		accID, _ := repo.CreateAccount(ctx)
+		otherID, _ := repo.CreateAccount(ctx)
+		if _, err := repo.DepositAccount(ctx, accID, Money{Amount: 100, Currency: DefaultCurrency}, TransactionMeta{}); err != nil {
+			t.Fatalf("DepositAccount() error = %v", err)
+		}
+		transfer, _ := repo.TransferAccount(ctx, accID, otherID, Money{Amount: 50}, TransactionMeta{})
+
+		tests := []struct {
+			name    string
+			move    func() (*TransactionLog, error)
+			wantErr error
+		}{
+			{"negative deposit", func() (*TransactionLog, error) {
+				return repo.DepositAccount(ctx, accID, Money{Amount: -100}, TransactionMeta{})
+			}, ErrInvalidAmount},
+			{"zero withdrawal", func() (*TransactionLog, error) {
+				return repo.WithdrawAccount(ctx, accID, Money{}, TransactionMeta{})
+			}, ErrInvalidAmount},
+			{"too large transfer", func() (*TransactionLog, error) {
+				return repo.TransferAccount(ctx, accID, otherID, Money{Amount: MaxAmount + 1}, TransactionMeta{})
+			}, ErrInvalidAmount},
+			{"negative reversal", func() (*TransactionLog, error) {
+				return repo.ReverseTransaction(ctx, transfer.ID, Money{Amount: -1}, TransactionMeta{})
+			}, ErrInvalidAmount},
+			{"deposit in another currency", func() (*TransactionLog, error) {
+				return repo.DepositAccount(ctx, accID, Money{Amount: 100, Currency: "USD"}, TransactionMeta{})
+			}, ErrCurrencyMismatch},
+			{"withdrawal in another currency", func() (*TransactionLog, error) {
+				return repo.WithdrawAccount(ctx, accID, Money{Amount: 10, Currency: "USD"}, TransactionMeta{})
+			}, ErrCurrencyMismatch},
+			{"transfer in another currency", func() (*TransactionLog, error) {
+				return repo.TransferAccount(ctx, accID, otherID, Money{Amount: 10, Currency: "USD"}, TransactionMeta{})
+			}, ErrCurrencyMismatch},
+		}
+		for _, tt := range tests {
+			if _, err := tt.move(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("%v error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if acc, _ := repo.GetAccount(ctx, accID); acc.Balance != 50 {
+			t.Errorf("balance after rejected movements got = %v, want 50", acc.Balance)
+		}
+
+		// balances cannot overflow, however many deposits add up
+		seedBalance(t, repo, otherID, math.MaxInt64-50)
+		if _, err := repo.DepositAccount(ctx, otherID, Money{Amount: MaxAmount}, TransactionMeta{}); !errors.Is(err, ErrAmountOverflow) {
+			t.Errorf("DepositAccount() past the int64 limit error = %v, want %v", err, ErrAmountOverflow)
+		}
+		if _, err := repo.TransferAccount(ctx, accID, otherID, Money{Amount: 50}, TransactionMeta{}); err != nil {
+			t.Errorf("TransferAccount() up to the int64 limit error = %v", err)
+		}
+		if acc, _ := repo.GetAccount(ctx, otherID); acc.Balance != math.MaxInt64 {
+			t.Errorf("balance near the limit got = %v", acc.Balance)
+		}
+	})
+}
+
+// seedBalance sets the balance of account id directly, to reach the limits
+// of int64 without the many deposits MaxAmount would take. The ledger no
+// longer balances afterwards.
+func seedBalance(t *testing.T, repo AccountStore, id AccountID, balance int64) {
+	t.Helper()
+	switch repo := repo.(type) {
+	case *Repository:
+		acc := repo.Accounts.get(id)
+		acc.rw.Lock()
+		acc.Balance = balance
+		acc.rw.Unlock()
+	case *SQLiteRepository:
+		if _, err := repo.db.Exec(`UPDATE accounts SET balance = ? WHERE id = ?`, balance, id); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("seedBalance() of %T", repo)
+	}
+}
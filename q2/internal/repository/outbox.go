@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// outbox holds transaction log entries committed together with their money
+// movement, in commit order, until they are relayed to the transaction log.
+type outbox struct {
+	entries []TransactionLog
+	rw      sync.RWMutex
+}
+
+// movement returns the record of a new money movement of type op. Its log
+// entry goes to the outbox.
+func (r *Repository) movement(op string, meta TransactionMeta) walRecord {
+	return walRecord{
+		Op:        op,
+		Memo:      meta.Memo,
+		Reference: meta.Reference,
+		Outbox:    true,
+		Entry:     r.nextEntryID(),
+		When:      time.Now(),
+	}
+}
+
+// commitLog completes tl from rec and adds it to the outbox. It is called
+// while the movement still holds its locks, so a snapshot sees both or
+// neither. Records written before the outbox existed logged their entries
+// through add_transaction records instead.
+func (r *Repository) commitLog(rec walRecord, tl *TransactionLog) *TransactionLog {
+	tl.Memo, tl.Reference, tl.When = rec.Memo, rec.Reference, rec.When
+	if rec.Outbox {
+		r.Outbox.rw.Lock()
+		r.Outbox.entries = append(r.Outbox.entries, *tl)
+		r.Outbox.rw.Unlock()
+	}
+	return tl
+}
+
+// RelayTransactions moves up to limit of the oldest outbox entries to the
+// transaction log and returns how many it moved. publish, if not nil, is
+// called with the entries first; nothing moves if it fails.
+func (r *Repository) RelayTransactions(ctx context.Context, limit int, publish func(BatchTransaction) error) (int, error) {
+	// relays run one at a time so two of them never pick the same entries,
+	// and only relays take entries out of the outbox, so the batch is still
+	// there once published
+	r.relayMu.Lock()
+	defer r.relayMu.Unlock()
+	r.Outbox.rw.RLock()
+	n := len(r.Outbox.entries)
+	if n > limit {
+		n = limit
+	}
+	batch := append(BatchTransaction(nil), r.Outbox.entries[:n]...)
+	r.Outbox.rw.RUnlock()
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	// a slow broker holds up relays only, not snapshots
+	if publish != nil {
+		if err := publish(batch); err != nil {
+			return 0, err
+		}
+	}
+	ids := make([]int64, 0, n)
+	for _, tl := range batch {
+		ids = append(ids, tl.ID)
+	}
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	if err := r.writeAhead(walRecord{Op: opRelayTransactions, Relayed: ids}); err != nil {
+		return 0, err
+	}
+	return r.relay(ids)
+}
+
+// relay moves the outbox entries with ids to the transaction log in that order.
+// The legs of a split payment share an id, which ids repeats once per leg.
+func (r *Repository) relay(ids []int64) (int, error) {
+	moving := make(map[int64]int, len(ids))
+	for _, id := range ids {
+		moving[id]++
+	}
+	r.Outbox.rw.Lock()
+	defer r.Outbox.rw.Unlock()
+	byID := make(map[int64][]TransactionLog, len(moving))
+	// a new slice, snapshots may share the old one
+	kept := make([]TransactionLog, 0, len(r.Outbox.entries))
+	for _, tl := range r.Outbox.entries {
+		if moving[tl.ID] > 0 {
+			moving[tl.ID]--
+			byID[tl.ID] = append(byID[tl.ID], tl)
+		} else {
+			kept = append(kept, tl)
+		}
+	}
+	batch := make(BatchTransaction, 0, len(ids))
+	for _, id := range ids {
+		if entries := byID[id]; len(entries) > 0 {
+			batch = append(batch, entries[0])
+			byID[id] = entries[1:]
+		}
+	}
+	r.Outbox.entries = kept
+	r.Transactions.rw.Lock()
+	r.Transactions.add(batch...)
+	r.Transactions.rw.Unlock()
+	return len(batch), nil
+}
+
+// OutboxDepth returns the number of entries waiting to be relayed.
+func (r *Repository) OutboxDepth(ctx context.Context) (int, error) {
+	r.Outbox.rw.RLock()
+	defer r.Outbox.rw.RUnlock()
+	return len(r.Outbox.entries), nil
+}
@@ -0,0 +1,241 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var ErrInvalidOverdraft = errors.New("invalid overdraft")
+
+// MaxInterestRate is the highest yearly overdraft interest rate in basis
+// points, 100%.
+const MaxInterestRate = 10000
+
+// interestBasis divides balance × rate in basis points × seconds into minor
+// units of interest: 10000 basis points over a 365 day year.
+const interestBasis = 10000 * 365 * 24 * 60 * 60
+
+// Overdraft is the credit line of an account: its balance may go down to
+// -Limit, and while it is negative it accrues InterestRate basis points of
+// interest a year. Interest accrues by the second and is charged to the
+// account by ChargeInterest.
+type Overdraft struct {
+	Limit        int64
+	InterestRate int
+}
+
+func (o Overdraft) check() error {
+	if o.Limit < 0 || o.Limit > MaxAmount {
+		return fmt.Errorf("%w: limit %d is not between 0 and %d", ErrInvalidOverdraft, o.Limit, MaxAmount)
+	}
+	if o.InterestRate < 0 || o.InterestRate > MaxInterestRate {
+		return fmt.Errorf("%w: interest rate %d is not between 0 and %d basis points", ErrInvalidOverdraft, o.InterestRate, MaxInterestRate)
+	}
+	return nil
+}
+
+// OverdraftChange is one change of the overdraft of an account, with who made
+// it and why.
+type OverdraftChange struct {
+	AccountID AccountID
+	Overdraft
+	ChangedBy string
+	Reason    string
+	When      time.Time
+}
+
+// interest is the interest an account accrued and has not been charged yet.
+// Owed is in minor units and Remainder is the fraction of a minor unit left
+// over, in 1/interestBasis.
+type interest struct {
+	AccruedAt time.Time
+	Owed      int64
+	Remainder int64
+}
+
+// accrue adds the interest on balance at rate from AccruedAt until now.
+// Accruing twice over a period adds up to accruing once, so accruals that are
+// not logged do not change what a replay of the log computes.
+func (i *interest) accrue(balance int64, rate int, now time.Time) {
+	elapsed := now.Unix() - i.AccruedAt.Unix()
+	if elapsed <= 0 {
+		return
+	}
+	i.AccruedAt = now
+	if balance >= 0 || rate == 0 {
+		return
+	}
+	n := big.NewInt(-balance)
+	n.Mul(n, big.NewInt(int64(rate)))
+	n.Mul(n, big.NewInt(elapsed))
+	n.Add(n, big.NewInt(i.Remainder))
+	owed, remainder := n.QuoRem(n, big.NewInt(interestBasis), new(big.Int))
+	i.Owed += owed.Int64()
+	i.Remainder = remainder.Int64()
+}
+
+// overdrafts keeps the overdraft history of every account.
+type overdrafts struct {
+	changes map[AccountID][]OverdraftChange
+	rw      sync.RWMutex
+}
+
+// accrue brings the interest of a locked account up to now. Movements call it
+// after they are written ahead and before they change the balance.
+func (a *account) accrue(now time.Time) {
+	a.interest.accrue(a.Balance, a.InterestRate, now)
+}
+
+// covers returns why the available balance of a locked account cannot pay
+// amount within its overdraft, if it cannot.
+func (a *account) covers(amount int64) error {
+	return a.coversHeld(a.Held, amount)
+}
+
+// coversHeld is covers with held of the balance held instead of a.Held.
+func (a *account) coversHeld(held, amount int64) error {
+	available, err := subAmounts(a.Balance, held)
+	if err != nil {
+		return err
+	}
+	after, err := subAmounts(available, amount)
+	if err != nil {
+		return err
+	}
+	if after < -a.Limit {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
+
+// SetOverdraft changes the overdraft of account c.AccountID. c.When is set
+// to now. Lowering the limit below the current debt is allowed; the account
+// then takes no debits until it is back within the limit.
+func (r *Repository) SetOverdraft(ctx context.Context, c OverdraftChange) (*OverdraftChange, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.When = time.Now()
+	return r.setOverdraft(walRecord{Op: opSetOverdraft, Account: c.AccountID, Overdraft: &c})
+}
+
+func (r *Repository) setOverdraft(rec walRecord) (*OverdraftChange, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	c := *rec.Overdraft
+	account := r.Accounts.get(c.AccountID)
+	if account == nil {
+		return nil, ErrAccountNotFound
+	}
+	account.rw.Lock()
+	defer account.rw.Unlock()
+	if account.Status == StatusClosed {
+		return nil, ErrAccountClosed
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+	// interest so far accrues at the old rate
+	account.accrue(c.When)
+	account.interest.AccruedAt = c.When
+	account.Overdraft = c.Overdraft
+	r.Overdrafts.rw.Lock()
+	r.Overdrafts.changes[c.AccountID] = append(r.Overdrafts.changes[c.AccountID], c)
+	r.Overdrafts.rw.Unlock()
+	return &c, nil
+}
+
+// GetOverdraftHistory returns the overdraft changes of account id, oldest
+// first.
+func (r *Repository) GetOverdraftHistory(ctx context.Context, id AccountID) ([]OverdraftChange, error) {
+	if r.Accounts.get(id) == nil {
+		return nil, ErrAccountNotFound
+	}
+	r.Overdrafts.rw.RLock()
+	defer r.Overdrafts.rw.RUnlock()
+	return append(make([]OverdraftChange, 0), r.Overdrafts.changes[id]...), nil
+}
+
+// ChargeInterest charges every account that is not closed the whole minor
+// units of interest it accrued until asOf, moving them to
+// InterestIncomeAccount, and returns how many accounts it charged. An account
+// that cannot be charged is skipped and its error joined to the one returned.
+func (r *Repository) ChargeInterest(ctx context.Context, asOf time.Time) (int, error) {
+	ids := make([]AccountID, 0)
+	r.Accounts.each(func(account *account) {
+		ids = append(ids, account.ID)
+	})
+	charged := 0
+	var errs []error
+	for _, id := range ids {
+		// the entry id is taken once there is something to charge
+		rec := walRecord{Op: opChargeInterest, Account: id, Memo: "overdraft interest", Outbox: true, When: asOf}
+		tl, err := r.charge(rec)
+		// one account that cannot be charged does not hold up the others
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", id, err))
+			continue
+		}
+		if tl != nil {
+			charged++
+		}
+	}
+	return charged, errors.Join(errs...)
+}
+
+// charge applies an interest charge record. An amount of 0 is resolved to the
+// interest owed before the record is written ahead; nothing is written and nil
+// is returned if the account owes no whole minor unit.
+func (r *Repository) charge(rec walRecord) (*TransactionLog, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	account := r.Accounts.get(rec.Account)
+	if account == nil {
+		return nil, ErrAccountNotFound
+	}
+	account.rw.Lock()
+	defer account.rw.Unlock()
+	if account.Status == StatusClosed {
+		return nil, nil
+	}
+	// accrue on a copy, the record is only written if there is a charge
+	accrued := account.interest
+	accrued.accrue(account.Balance, account.InterestRate, rec.When)
+	if rec.Amount == 0 {
+		if accrued.Owed == 0 {
+			return nil, nil
+		}
+		rec.Amount = accrued.Owed
+		rec.Entry = r.nextEntryID()
+	}
+	balance, err := subAmounts(account.Balance, rec.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+	account.interest = accrued
+	account.interest.Owed -= rec.Amount
+	account.Balance = balance
+	r.post(JournalEntry{ID: rec.Entry, Type: TransactionInterest, Postings: interestPostings(account.ID, account.Currency, rec.Amount), When: rec.When})
+	return r.commitLog(rec, &TransactionLog{
+		ID:          rec.Entry,
+		Type:        TransactionInterest,
+		From:        account.ID,
+		To:          InterestIncomeAccount,
+		Amount:      rec.Amount,
+		Currency:    account.Currency,
+		FromBalance: account.Balance,
+	}), nil
+}
+
+// interestPostings move amount of interest from the account to the income of
+// the bank.
+func interestPostings(id AccountID, currency Currency, amount int64) []Posting {
+	return []Posting{{Account: id, Amount: -amount, Currency: currency}, {Account: InterestIncomeAccount, Amount: amount, Currency: currency}}
+}
@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterestAccrue(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	year := 365 * 24 * time.Hour
+
+	once := interest{AccruedAt: start}
+	once.accrue(-10000, 1000, start.Add(year))
+	if once.Owed != 1000 || once.Remainder != 0 {
+		t.Errorf("accrue() a year at 10%% got = %+v, want 1000 owed", once)
+	}
+
+	// accruing in steps adds up to the same interest
+	steps := interest{AccruedAt: start}
+	for when := start.Add(time.Hour); !when.After(start.Add(year)); when = when.Add(7 * time.Hour) {
+		steps.accrue(-10000, 1000, when)
+	}
+	steps.accrue(-10000, 1000, start.Add(year))
+	if steps != once {
+		t.Errorf("accrue() in steps got = %+v, want %+v", steps, once)
+	}
+
+	positive := interest{AccruedAt: start}
+	positive.accrue(500, 1000, start.Add(year))
+	if positive.Owed != 0 || !positive.AccruedAt.Equal(start.Add(year)) {
+		t.Errorf("accrue() on a positive balance got = %+v", positive)
+	}
+}
+
+func TestOverdraft(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		accID, _ := repo.CreateAccount(ctx)
+		otherID, _ := repo.CreateAccount(ctx)
+
+		if _, err := repo.WithdrawAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("WithdrawAccount() without overdraft error = %v, want %v", err, ErrInsufficientFunds)
+		}
+		change, err := repo.SetOverdraft(ctx, OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: 1000}, ChangedBy: "admin", Reason: "credit line"})
+		if err != nil || change.When.IsZero() {
+			t.Fatalf("SetOverdraft() got = %+v, %v", change, err)
+		}
+		if tl, err := repo.WithdrawAccount(ctx, accID, Money{Amount: 800}, TransactionMeta{}); err != nil || tl.FromBalance != -800 {
+			t.Errorf("WithdrawAccount() into overdraft got = %+v, %v", tl, err)
+		}
+		if _, err := repo.TransferAccount(ctx, accID, otherID, Money{Amount: 300}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("TransferAccount() past the limit error = %v, want %v", err, ErrInsufficientFunds)
+		}
+		if _, err := repo.TransferAccount(ctx, accID, otherID, Money{Amount: 200}, TransactionMeta{}); err != nil {
+			t.Errorf("TransferAccount() up to the limit error = %v", err)
+		}
+		if acc, _ := repo.GetAccount(ctx, accID); acc.Balance != -1000 || acc.Overdraft.Limit != 1000 {
+			t.Errorf("GetAccount() got = %+v", acc)
+		}
+
+		// lowering the limit below the debt blocks debits but not credits
+		if _, err := repo.SetOverdraft(ctx, OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: 500, InterestRate: 1200}, ChangedBy: "admin"}); err != nil {
+			t.Fatalf("SetOverdraft() lower error = %v", err)
+		}
+		if _, err := repo.WithdrawAccount(ctx, accID, Money{Amount: 1}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("WithdrawAccount() over the lowered limit error = %v, want %v", err, ErrInsufficientFunds)
+		}
+		if _, err := repo.DepositAccount(ctx, accID, Money{Amount: 600}, TransactionMeta{}); err != nil {
+			t.Errorf("DepositAccount() into overdraft error = %v", err)
+		}
+
+		history, err := repo.GetOverdraftHistory(ctx, accID)
+		if err != nil || len(history) != 2 || history[0].Limit != 1000 || history[1].InterestRate != 1200 || history[0].Reason != "credit line" {
+			t.Errorf("GetOverdraftHistory() got = %+v, %v", history, err)
+		}
+		if history, err := repo.GetOverdraftHistory(ctx, otherID); err != nil || len(history) != 0 {
+			t.Errorf("GetOverdraftHistory() without changes got = %+v, %v", history, err)
+		}
+
+		tests := []struct {
+			name    string
+			change  OverdraftChange
+			wantErr error
+		}{
+			{"negative limit", OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: -1}}, ErrInvalidOverdraft},
+			{"limit too high", OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: MaxAmount + 1}}, ErrInvalidOverdraft},
+			{"negative rate", OverdraftChange{AccountID: accID, Overdraft: Overdraft{InterestRate: -1}}, ErrInvalidOverdraft},
+			{"rate too high", OverdraftChange{AccountID: accID, Overdraft: Overdraft{InterestRate: MaxInterestRate + 1}}, ErrInvalidOverdraft},
+			{"unknown account", OverdraftChange{AccountID: "nope"}, ErrAccountNotFound},
+		}
+		for _, tt := range tests {
+			if _, err := repo.SetOverdraft(ctx, tt.change); !errors.Is(err, tt.wantErr) {
+				t.Errorf("SetOverdraft() %v error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if _, err := repo.GetOverdraftHistory(ctx, "nope"); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("GetOverdraftHistory() unknown error = %v, want %v", err, ErrAccountNotFound)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+	})
+}
+
+func TestOverdraftBounds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		accID, _ := repo.CreateAccount(ctx)
+		if _, err := repo.SetOverdraft(ctx, OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: MaxAmount}}); err != nil {
+			t.Fatalf("SetOverdraft() to the maximum error = %v", err)
+		}
+		if tl, err := repo.WithdrawAccount(ctx, accID, Money{Amount: MaxAmount}, TransactionMeta{}); err != nil || tl.FromBalance != -MaxAmount {
+			t.Fatalf("WithdrawAccount() up to the limit got = %+v, %v", tl, err)
+		}
+		// further debits stop at the limit instead of wrapping the balance around
+		for i := 0; i < 10; i++ {
+			if _, err := repo.WithdrawAccount(ctx, accID, Money{Amount: MaxAmount}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+				t.Fatalf("WithdrawAccount() past the limit error = %v, want %v", err, ErrInsufficientFunds)
+			}
+		}
+		if acc, _ := repo.GetAccount(ctx, accID); acc.Balance != -MaxAmount {
+			t.Errorf("balance at the limit got = %v, want %v", acc.Balance, -MaxAmount)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+	})
+}
+
+func TestChargeInterest(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		accID, _ := repo.CreateAccount(ctx)
+		savingsID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, savingsID, Money{Amount: 10000}, TransactionMeta{})
+		_, _ = repo.SetOverdraft(ctx, OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: 10000, InterestRate: 1000}})
+		_, _ = repo.SetOverdraft(ctx, OverdraftChange{AccountID: savingsID, Overdraft: Overdraft{InterestRate: 1000}})
+		_, _ = repo.WithdrawAccount(ctx, accID, Money{Amount: 10000}, TransactionMeta{})
+
+		// a year at 10%, give or take the second the withdrawal started in
+		asOf := time.Now().Add(365 * 24 * time.Hour)
+		if acc, _ := repo.GetAccount(ctx, accID); acc.InterestOwed != 0 {
+			t.Errorf("GetAccount() interest owed right away got = %v", acc.InterestOwed)
+		}
+		charged, err := repo.ChargeInterest(ctx, asOf)
+		if err != nil || charged != 1 {
+			t.Fatalf("ChargeInterest() got = %v, %v, want 1", charged, err)
+		}
+		acc, _ := repo.GetAccount(ctx, accID)
+		if acc.Balance != -11000 && acc.Balance != -10999 {
+			t.Errorf("balance after interest got = %v, want about %v", acc.Balance, -11000)
+		}
+		if charged, err := repo.ChargeInterest(ctx, asOf); err != nil || charged != 0 {
+			t.Errorf("ChargeInterest() twice got = %v, %v, want 0", charged, err)
+		}
+		if savings, _ := repo.GetAccount(ctx, savingsID); savings.Balance != 10000 {
+			t.Errorf("positive balance was charged, got = %v", savings.Balance)
+		}
+
+		_, _ = repo.RelayTransactions(ctx, 100, nil)
+		page, _ := repo.ListTransactions(ctx, TransactionQuery{Type: TransactionInterest})
+		if len(page.Transactions) != 1 || page.Transactions[0].From != accID || page.Transactions[0].To != InterestIncomeAccount ||
+			page.Transactions[0].FromBalance != int64(acc.Balance) {
+			t.Errorf("interest log entries got = %+v", page.Transactions)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+	})
+}
+
+func TestChargeInterestPastFailure(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		deepID, _ := repo.CreateAccount(ctx)
+		accID, _ := repo.CreateAccount(ctx)
+		// charging the first account overflows its balance
+		seedBalance(t, repo, deepID, math.MinInt64+50)
+		owe(t, repo, deepID, 100)
+		owe(t, repo, accID, 100)
+
+		charged, err := repo.ChargeInterest(ctx, time.Now())
+		if charged != 1 || !errors.Is(err, ErrAmountOverflow) || !strings.Contains(err.Error(), "account "+string(deepID)) {
+			t.Errorf("ChargeInterest() past a failure got = %v, %v, want 1 and %v", charged, err, ErrAmountOverflow)
+		}
+		if acc, _ := repo.GetAccount(ctx, deepID); acc.Balance != math.MinInt64+50 || acc.InterestOwed != 100 {
+			t.Errorf("failed account got = %+v", acc)
+		}
+		if acc, _ := repo.GetAccount(ctx, accID); acc.Balance != -100 || acc.InterestOwed != 0 {
+			t.Errorf("account after the failed one got = %+v", acc)
+		}
+	})
+}
+
+func TestOverdraftDurable(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	accID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.SetOverdraft(ctx, OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: 5000, InterestRate: 2000}, Reason: "opened"})
+	_, _ = repo.WithdrawAccount(ctx, accID, Money{Amount: 3000}, TransactionMeta{})
+	asOf := time.Now().Add(90 * 24 * time.Hour)
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	// replayed from the log after the snapshot
+	_, _ = repo.ChargeInterest(ctx, asOf)
+	_, _ = repo.SetOverdraft(ctx, OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: 6000, InterestRate: 2000}, Reason: "raised"})
+	want, _ := repo.GetAccount(ctx, accID)
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	got, _ := repo.GetAccount(ctx, accID)
+	if got.Balance != want.Balance || got.Overdraft != want.Overdraft || got.Balance >= -3000 {
+		t.Errorf("GetAccount() after reopen got = %+v, want %+v", got, want)
+	}
+	if history, _ := repo.GetOverdraftHistory(ctx, accID); len(history) != 2 || history[1].Reason != "raised" {
+		t.Errorf("GetOverdraftHistory() after reopen got = %+v", history)
+	}
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() after reopen error = %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page sizes of ListTransactions.
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// TransactionQuery selects a page of the transaction log. Zero fields do not
+// filter.
+type TransactionQuery struct {
+	// Account matches entries it sent or received
+	Account AccountID
+	Type    TransactionType
+	// Since and Until bound When, Since inclusive and Until exclusive
+	Since, Until time.Time
+	// MinAmount and MaxAmount bound Amount inclusively
+	MinAmount, MaxAmount int64
+	// Descending lists the newest entries first
+	Descending bool
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	// Limit is the page size, DefaultPageSize if not positive and at most
+	// MaxPageSize
+	Limit int
+}
+
+// TransactionPage is a page of the transaction log in relay order.
+// NextCursor is empty on the last page.
+type TransactionPage struct {
+	Transactions []TransactionLog
+	NextCursor   string `json:",omitempty"`
+}
+
+func (q *TransactionQuery) limit() int {
+	if q.Limit <= 0 {
+		return DefaultPageSize
+	}
+	if q.Limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return q.Limit
+}
+
+func (q *TransactionQuery) match(tl *TransactionLog) bool {
+	if q.Account != "" && tl.From != q.Account && tl.To != q.Account {
+		return false
+	}
+	if q.Type != "" && tl.Type != q.Type {
+		return false
+	}
+	if !q.Since.IsZero() && tl.When.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !tl.When.Before(q.Until) {
+		return false
+	}
+	if q.MinAmount != 0 && tl.Amount < q.MinAmount {
+		return false
+	}
+	if q.MaxAmount != 0 && tl.Amount > q.MaxAmount {
+		return false
+	}
+	return true
+}
+
+// encodeCursor makes the opaque cursor of the entry at position seq of the log.
+func encodeCursor(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+// decodeCursor returns the position of cursor, or ok false if there is none.
+func decodeCursor(cursor string) (seq int64, ok bool, err error) {
+	if cursor == "" {
+		return 0, false, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, false, ErrInvalidCursor
+	}
+	seq, err = strconv.ParseInt(string(b), 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false, ErrInvalidCursor
+	}
+	return seq, true, nil
+}
+
+// add appends batch to the log and indexes it. The caller holds the write lock.
+func (t *transactions) add(batch ...TransactionLog) {
+	if t.byAccount == nil {
+		t.byAccount = make(map[AccountID][]int)
+		t.byType = make(map[TransactionType][]int)
+	}
+	for _, tl := range batch {
+		p := len(t.transactions)
+		if p > 0 && tl.When.Before(t.transactions[p-1].When) {
+			t.unordered = true
+		}
+		t.transactions = append(t.transactions, tl)
+		t.byAccount[tl.From] = append(t.byAccount[tl.From], p)
+		if tl.To != tl.From {
+			t.byAccount[tl.To] = append(t.byAccount[tl.To], p)
+		}
+		t.byType[tl.Type] = append(t.byType[tl.Type], p)
+	}
+}
+
+// positions returns the ascending positions of the entries that may match q,
+// the shorter of its account and type index, or nil to scan the whole log.
+// The caller holds the read lock.
+func (t *transactions) positions(q *TransactionQuery) []int {
+	var best []int
+	found := false
+	if q.Account != "" {
+		best, found = t.byAccount[q.Account], true
+	}
+	if q.Type != "" {
+		if byType := t.byType[q.Type]; !found || len(byType) < len(best) {
+			best, found = byType, true
+		}
+	}
+	if found && best == nil {
+		return []int{}
+	}
+	return best
+}
+
+// bounds returns the range [lo, hi) of the size candidates at gives the
+// positions of that may fall within the time bounds of q. While the log is
+// in time order they are found by binary search, otherwise every candidate
+// is kept. The caller holds the read lock.
+func (t *transactions) bounds(q *TransactionQuery, size int, at func(int) int) (lo, hi int) {
+	lo, hi = 0, size
+	if t.unordered {
+		return lo, hi
+	}
+	when := func(i int) time.Time { return t.transactions[at(i)].When }
+	if !q.Since.IsZero() {
+		lo = sort.Search(size, func(i int) bool { return !when(i).Before(q.Since) })
+	}
+	if !q.Until.IsZero() {
+		hi = sort.Search(size, func(i int) bool { return !when(i).Before(q.Until) })
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return lo, hi
+}
+
+// ListTransactions returns a page of the transaction log matching q. The
+// account and type filters use indexes and the time bounds a binary search
+// while the log is in time order; the amount bounds are checked on every
+// entry those leave.
+func (r *Repository) ListTransactions(ctx context.Context, q TransactionQuery) (*TransactionPage, error) {
+	cursor, hasCursor, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit := q.limit()
+
+	t := &r.Transactions
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	size, at := len(t.transactions), func(i int) int { return i }
+	if list := t.positions(&q); list != nil {
+		size, at = len(list), func(i int) int { return list[i] }
+	}
+
+	lo, hi := t.bounds(&q, size, at)
+
+	// i walks the candidates from the one after the cursor
+	i, step := lo, 1
+	if q.Descending {
+		i, step = hi-1, -1
+		if hasCursor {
+			if c := sort.Search(size, func(i int) bool { return int64(at(i)) >= cursor }) - 1; c < i {
+				i = c
+			}
+		}
+	} else if hasCursor {
+		if c := sort.Search(size, func(i int) bool { return int64(at(i)) > cursor }); c > i {
+			i = c
+		}
+	}
+
+	page := &TransactionPage{Transactions: make([]TransactionLog, 0)}
+	last := 0
+	for ; i >= lo && i < hi; i += step {
+		p := at(i)
+		tl := &t.transactions[p]
+		if !q.match(tl) {
+			continue
+		}
+		if len(page.Transactions) == limit {
+			// there is at least one more entry after this page
+			page.NextCursor = encodeCursor(int64(last))
+			break
+		}
+		page.Transactions = append(page.Transactions, *tl)
+		last = p
+	}
+	return page, nil
+}
@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// queryLog is a transaction log with every combination the filters look at.
+func queryLog() BatchTransaction {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	types := []TransactionType{TransactionDeposit, TransactionWithdrawal, TransactionTransfer}
+	accounts := []AccountID{"1", "2", "3", CashInAccount}
+	batch := make(BatchTransaction, 0, 200)
+	for i := 0; i < 200; i++ {
+		batch = append(batch, TransactionLog{
+			ID:     int64(i + 1),
+			Type:   types[i%len(types)],
+			From:   accounts[i%len(accounts)],
+			To:     accounts[(i*7+1)%len(accounts)],
+			Amount: int64(i*37%500 + 1),
+			// relay order is not quite time order
+			When: start.Add(time.Duration(i*60+(i%5)*45) * time.Second),
+		})
+	}
+	return batch
+}
+
+func TestListTransactions(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+	queries := []TransactionQuery{
+		{},
+		{Descending: true},
+		{Account: "1"},
+		{Account: "2", Type: TransactionTransfer, Descending: true},
+		{Type: TransactionWithdrawal, MinAmount: 100, MaxAmount: 300},
+		{Account: "3", Since: since, Until: since.Add(90 * time.Minute)},
+		{Since: since, Descending: true, MaxAmount: 250},
+		{Account: "nobody"},
+	}
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		log := queryLog()
+		if err := repo.AddTransaction(ctx, log); err != nil {
+			t.Fatalf("AddTransaction() error = %v", err)
+		}
+		checkQueries(t, repo, log, queries)
+
+		if _, err := repo.ListTransactions(ctx, TransactionQuery{Cursor: "not a cursor"}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ListTransactions() invalid cursor error = %v, want %v", err, ErrInvalidCursor)
+		}
+		page, _ := repo.ListTransactions(ctx, TransactionQuery{Limit: MaxPageSize + 1})
+		if len(page.Transactions) != len(log) {
+			t.Errorf("ListTransactions() over the page size got %v entries", len(page.Transactions))
+		}
+	})
+}
+
+// checkQueries pages through every query of queries 7 entries at a time and
+// compares the entries of log that match it with what repo lists.
+func checkQueries(t *testing.T, repo AccountStore, log BatchTransaction, queries []TransactionQuery) {
+	t.Helper()
+	ctx := context.Background()
+	for _, q := range queries {
+		want := make([]int64, 0)
+		for i := range log {
+			tl := log[i]
+			if q.Descending {
+				tl = log[len(log)-1-i]
+			}
+			if q.match(&tl) {
+				want = append(want, tl.ID)
+			}
+		}
+
+		got := make([]int64, 0)
+		q.Limit = 7
+		for pages := 0; pages <= len(log); pages++ {
+			page, err := repo.ListTransactions(ctx, q)
+			if err != nil {
+				t.Fatalf("ListTransactions(%+v) error = %v", q, err)
+			}
+			for _, tl := range page.Transactions {
+				got = append(got, tl.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			if len(page.Transactions) != q.Limit {
+				t.Errorf("ListTransactions(%+v) got a page of %v with a next cursor", q, len(page.Transactions))
+			}
+			q.Cursor = page.NextCursor
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("ListTransactions(%+v) got = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestListTransactionsInTimeOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := NewRepository()
+	log := queryLog()
+	for i := range log {
+		log[i].When = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Minute)
+	}
+	if err := repo.AddTransaction(ctx, log); err != nil {
+		t.Fatalf("AddTransaction() error = %v", err)
+	}
+	since := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+	queries := []TransactionQuery{
+		{Since: since, Until: since.Add(90 * time.Minute)},
+		{Since: since, Until: since.Add(90 * time.Minute), Descending: true, MinAmount: 100},
+		{Account: "3", Since: since, Until: since.Add(time.Hour)},
+		{Type: TransactionTransfer, Until: since, Descending: true},
+		{Since: since.Add(time.Hour), Until: since},
+	}
+	checkQueries(t, repo, log, queries)
+
+	// the time bounds leave only the entries in range to scan
+	q := TransactionQuery{Since: since, Until: since.Add(90 * time.Minute)}
+	if lo, hi := repo.Transactions.bounds(&q, len(log), func(i int) int { return i }); lo != 30 || hi != 120 {
+		t.Errorf("bounds() got = %v, %v, want 30, 120", lo, hi)
+	}
+
+	// an entry older than the last one turns the binary search off
+	late := log[0]
+	late.ID = int64(len(log) + 1)
+	if err := repo.AddTransaction(ctx, BatchTransaction{late}); err != nil {
+		t.Fatalf("AddTransaction() error = %v", err)
+	}
+	if !repo.Transactions.unordered {
+		t.Fatalf("log with an older entry last is not unordered")
+	}
+	checkQueries(t, repo, append(log, late), append(queries, TransactionQuery{Until: since}))
+}
+
+func TestListTransactionsAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	if err := repo.AddTransaction(ctx, queryLog()[:100]); err != nil {
+		t.Fatalf("AddTransaction() error = %v", err)
+	}
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	_ = repo.AddTransaction(ctx, queryLog()[100:])
+	repo.Close()
+
+	// the indexes are rebuilt from the snapshot and the replayed log
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	page, err := repo.ListTransactions(ctx, TransactionQuery{Account: "1", Limit: MaxPageSize})
+	want := 0
+	for _, tl := range queryLog() {
+		if tl.From == "1" || tl.To == "1" {
+			want++
+		}
+	}
+	if err != nil || len(page.Transactions) != want {
+		t.Errorf("ListTransactions() after restart got %v entries, %v, want %v", len(page.Transactions), err, want)
+	}
+}
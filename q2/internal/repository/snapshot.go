@@ -0,0 +1,318 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+)
+
+// snapshotHeaderSize is the 64-bit length prefix plus the crc32 of the payload.
+const snapshotHeaderSize = 12
+
+var errInvalidSnapshot = errors.New("invalid snapshot")
+
+// snapshot is the repository state before the first record of Segment.
+type snapshot struct {
+	Segment      uint64            `json:"segment"`
+	Accounts     []Account         `json:"accounts"`
+	Transactions []TransactionLog  `json:"transactions"`
+	Outbox       []TransactionLog  `json:"outbox,omitempty"`
+	JournalSeq   int64             `json:"journal_seq"`
+	Journal      []JournalEntry    `json:"journal"`
+	Customers    []Customer        `json:"customers,omitempty"`
+	Holders      []AccountHolder   `json:"holders,omitempty"`
+	Interest     []accountInterest `json:"interest,omitempty"`
+	Overdrafts   []OverdraftChange `json:"overdrafts,omitempty"`
+	Rates        []ExchangeRate    `json:"rates,omitempty"`
+	Holds        []Hold            `json:"holds,omitempty"`
+	HoldSeq      int64             `json:"hold_seq,omitempty"`
+	Escrows      []Escrow          `json:"escrows,omitempty"`
+	Fees         []FeeSchedule     `json:"fees,omitempty"`
+}
+
+// accountInterest is the accrued interest of an account with an overdraft.
+type accountInterest struct {
+	Account AccountID `json:"account"`
+	interest
+}
+
+// Snapshot writes the current state of a durable repository to disk and
+// removes the log segments and snapshots it supersedes, so that startup only
+// replays the log written after it. Operations are paused only while the state
+// is copied in memory, not while it is written out.
+func (r *Repository) Snapshot() error {
+	if r.wal == nil {
+		return errors.New("repository is not durable")
+	}
+	// only one snapshot at a time, the removals below assume it is the newest
+	r.snapshotMu.Lock()
+	defer r.snapshotMu.Unlock()
+
+	snap, err := r.cutSnapshot()
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(r.wal.dir, snap); err != nil {
+		return err
+	}
+	if err := r.wal.removeBefore(snap.Segment); err != nil {
+		return err
+	}
+	if err := removeSnapshotsBefore(r.wal.dir, snap.Segment); err != nil {
+		return err
+	}
+	return syncDir(r.wal.dir)
+}
+
+// cutSnapshot blocks writers, starts a new log segment and copies the state
+// that the segments before it add up to.
+func (r *Repository) cutSnapshot() (*snapshot, error) {
+	r.cut.Lock()
+	defer r.cut.Unlock()
+
+	segment, err := r.wal.rotate()
+	if err != nil {
+		return nil, err
+	}
+	// the transaction log, outbox and journal are only appended to or
+	// replaced, so sharing their backing arrays is safe. Entry ids are taken
+	// before the cut lock, so the sequence is read atomically.
+	transactions := r.Transactions.transactions
+	pending := r.Outbox.entries
+	entries := r.Journal.entries
+	snap := &snapshot{
+		Segment:      segment,
+		Accounts:     make([]Account, 0, r.Accounts.len()),
+		Transactions: transactions[:len(transactions):len(transactions)],
+		Outbox:       pending[:len(pending):len(pending)],
+		JournalSeq:   atomic.LoadInt64(&r.journalSeq),
+		Journal:      entries[:len(entries):len(entries)],
+	}
+	r.Accounts.each(func(account *account) {
+		snap.Accounts = append(snap.Accounts, Account{ID: account.ID, Currency: account.Currency, Balance: account.Balance, Status: account.Status, Overdraft: account.Overdraft})
+		if account.interest != (interest{}) {
+			snap.Interest = append(snap.Interest, accountInterest{Account: account.ID, interest: account.interest})
+		}
+	})
+	r.Overdrafts.rw.RLock()
+	for _, changes := range r.Overdrafts.changes {
+		snap.Overdrafts = append(snap.Overdrafts, changes...)
+	}
+	r.Overdrafts.rw.RUnlock()
+	snap.Rates = r.Rates.list()
+	snap.Holds = r.Holds.all()
+	r.Holds.rw.RLock()
+	snap.HoldSeq = r.Holds.seq
+	r.Holds.rw.RUnlock()
+	snap.Escrows = r.Escrows.all()
+	snap.Fees = r.Fees.all()
+	r.Customers.rw.RLock()
+	defer r.Customers.rw.RUnlock()
+	for _, c := range r.Customers.customers {
+		snap.Customers = append(snap.Customers, *c)
+	}
+	sortCustomers(snap.Customers)
+	// holders of one account keep their order, which restore sorts by Since
+	for _, links := range r.Customers.holders {
+		snap.Holders = append(snap.Holders, links...)
+	}
+	return snap, nil
+}
+
+// restore loads snap into an empty repository.
+func (r *Repository) restore(snap *snapshot) {
+	for _, acc := range snap.Accounts {
+		// snapshots from before account statuses only have active accounts
+		if acc.Status == "" {
+			acc.Status = StatusActive
+		}
+		r.Accounts.put(&account{ID: acc.ID, Currency: acc.Currency.orDefault(), Balance: acc.Balance, Status: acc.Status, Overdraft: acc.Overdraft})
+		r.ids.Observe(acc.ID)
+	}
+	for _, i := range snap.Interest {
+		if account := r.Accounts.get(i.Account); account != nil {
+			account.interest = i.interest
+		}
+	}
+	// the held balances are those of the active holds
+	for _, h := range snap.Holds {
+		r.Holds.put(h)
+		if account := r.Accounts.get(h.AccountID); account != nil && h.Status == HoldActive {
+			account.Held += h.Amount
+		}
+	}
+	if snap.HoldSeq > r.Holds.seq {
+		r.Holds.seq = snap.HoldSeq
+	}
+	for _, e := range snap.Escrows {
+		r.Escrows.put(e)
+	}
+	for _, s := range snap.Fees {
+		r.Fees.schedules[s.Merchant] = s
+	}
+	for _, rate := range snap.Rates {
+		r.Rates.rates[[2]Currency{rate.From, rate.To}] = rate
+	}
+	// the changes of one account keep their order
+	for _, c := range snap.Overdrafts {
+		r.Overdrafts.changes[c.AccountID] = append(r.Overdrafts.changes[c.AccountID], c)
+	}
+	for i := range snap.Customers {
+		r.Customers.customers[snap.Customers[i].ID] = &snap.Customers[i]
+	}
+	for _, h := range snap.Holders {
+		r.Customers.link(h)
+	}
+	r.Customers.sortLinks()
+	r.Transactions.add(snap.Transactions...)
+	r.Outbox.entries = append(r.Outbox.entries, snap.Outbox...)
+	r.journalSeq = snap.JournalSeq
+	for _, entry := range snap.Journal {
+		r.Journal.add(entry)
+	}
+	if len(snap.Journal) == 0 {
+		r.postOpeningBalances()
+	}
+}
+
+// postOpeningBalances funds the balances of a snapshot taken before the
+// journal existed from cash-in, so the ledger balances again.
+func (r *Repository) postOpeningBalances() {
+	entry := JournalEntry{ID: r.nextEntryID(), Type: TransactionDeposit, When: time.Now()}
+	var total int64
+	r.Accounts.each(func(account *account) {
+		if account.Balance == 0 {
+			return
+		}
+		entry.Postings = append(entry.Postings, Posting{Account: account.ID, Amount: account.Balance})
+		total += account.Balance
+	})
+	if len(entry.Postings) == 0 {
+		return
+	}
+	entry.Postings = append(entry.Postings, Posting{Account: CashInAccount, Amount: -total})
+	r.post(entry)
+}
+
+func writeSnapshot(dir string, snap *snapshot) error {
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, snapshotHeaderSize)
+	binary.BigEndian.PutUint64(header[0:8], uint64(len(payload)))
+	binary.BigEndian.PutUint32(header[8:12], crc32.ChecksumIEEE(payload))
+
+	// write to a temporary file first so a crash never leaves a partial snapshot
+	path := snapshotPath(dir, snap.Segment)
+	tmp, err := os.CreateTemp(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(header); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// loadLatestSnapshot returns the newest snapshot in dir that can be read back
+// intact, or nil if there is none.
+func loadLatestSnapshot(dir string) (*snapshot, error) {
+	segments, err := listFiles(dir, snapshotPrefix, snapshotSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		snap, err := readSnapshot(snapshotPath(dir, segments[i]))
+		if errors.Is(err, errInvalidSnapshot) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return snap, nil
+	}
+	return nil, nil
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errInvalidSnapshot
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint64(header[0:8])
+	if size != uint64(info.Size())-snapshotHeaderSize {
+		return nil, errInvalidSnapshot
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errInvalidSnapshot
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[8:12]) {
+		return nil, errInvalidSnapshot
+	}
+	snap := &snapshot{}
+	if err := json.Unmarshal(payload, snap); err != nil {
+		return nil, errInvalidSnapshot
+	}
+	return snap, nil
+}
+
+func removeSnapshotsBefore(dir string, segment uint64) error {
+	segments, err := listFiles(dir, snapshotPrefix, snapshotSuffix)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= segment {
+			continue
+		}
+		if err := os.Remove(snapshotPath(dir, s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func snapshotPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, segment, snapshotSuffix))
+}
@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotCompactsLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	fromAccID, _ := repo.CreateAccount(ctx)
+	toAccID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, fromAccID, Money{Amount: 300}, TransactionMeta{})
+	_ = repo.AddTransaction(ctx, BatchTransaction{{From: fromAccID, To: toAccID, Amount: 100, When: time.Now()}})
+
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+
+	// the first segment is covered by the snapshot and removed
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) != 1 || filepath.Base(segments[0]) != "wal-00000000000000000002.log" {
+		t.Errorf("Snapshot() left segments %v, want only the second one", segments)
+	}
+
+	// written to the log tail after the snapshot
+	_, _ = repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 100}, TransactionMeta{})
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+
+	fromAcc, _ := repo.GetAccount(ctx, fromAccID)
+	toAcc, _ := repo.GetAccount(ctx, toAccID)
+	if fromAcc.Balance != 200 || toAcc.Balance != 100 {
+		t.Errorf("restore gotFrom = %v, want %v; gotTo = %v, want %v", fromAcc.Balance, 200, toAcc.Balance, 100)
+	}
+	if trans, _ := repo.GetTransactions(ctx); len(trans) != 1 {
+		t.Errorf("restore got = %v transactions, want %v", len(trans), 1)
+	}
+	nextID, _ := repo.CreateAccount(ctx)
+	if nextID != AccountID("3") {
+		t.Errorf("CreateAccount() after restore got = %v, want %v", nextID, AccountID("3"))
+	}
+}
+
+func TestSnapshotSkipsInvalid(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	accID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{})
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 50}, TransactionMeta{})
+	repo.Close()
+
+	// a newer snapshot that was never completely written is ignored
+	bad := filepath.Join(dir, "snapshot-00000000000000000003.snap")
+	if err := os.WriteFile(bad, []byte{0, 0, 0, 0, 0, 0, 1, 0, 9, 9}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	acc, _ := repo.GetAccount(ctx, accID)
+	if acc.Balance != 150 {
+		t.Errorf("restore got = %v, want %v", acc.Balance, 150)
+	}
+}
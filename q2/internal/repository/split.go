@@ -0,0 +1,393 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidFeeRule   = errors.New("invalid fee rule")
+	ErrInvalidSplit     = errors.New("invalid split payment")
+	ErrFeesExceedAmount = errors.New("fees exceed the amount of the leg")
+)
+
+const (
+	// MaxFeeRate is the highest fee rate in basis points, 100%
+	MaxFeeRate = 10000
+	// MaxFeeRules is the most fee rules a merchant may have
+	MaxFeeRules = 10
+	// MaxLegs is the most legs a split payment may have
+	MaxLegs = 20
+)
+
+// The transactions of a split payment: a split for every leg and a fee for
+// every fee taken out of one.
+const (
+	TransactionSplit TransactionType = "split"
+	TransactionFee   TransactionType = "fee"
+)
+
+// FeeRule takes a fee for To out of every split payment leg to a merchant:
+// Rate basis points of the leg, rounded down, plus Fixed minor units. Name
+// describes the fee, such as "platform commission".
+type FeeRule struct {
+	Name  string
+	To    AccountID
+	Rate  int
+	Fixed int64
+}
+
+func (f FeeRule) check(merchant AccountID) error {
+	switch {
+	case strings.TrimSpace(f.Name) == "":
+		return fmt.Errorf("%w: name is required", ErrInvalidFeeRule)
+	case f.To == merchant:
+		return fmt.Errorf("%w: %s pays its fee to itself", ErrInvalidFeeRule, f.Name)
+	case f.Rate < 0 || f.Rate > MaxFeeRate:
+		return fmt.Errorf("%w: rate %d of %s is not between 0 and %d basis points", ErrInvalidFeeRule, f.Rate, f.Name, MaxFeeRate)
+	case f.Fixed < 0 || f.Fixed > MaxAmount:
+		return fmt.Errorf("%w: fixed fee %d of %s is not between 0 and %d", ErrInvalidFeeRule, f.Fixed, f.Name, MaxAmount)
+	case f.Rate == 0 && f.Fixed == 0:
+		return fmt.Errorf("%w: %s takes no fee", ErrInvalidFeeRule, f.Name)
+	}
+	return nil
+}
+
+// fee returns the fee of the rule on amount. Amounts are at most MaxAmount,
+// so amount/10000 × rate and the rest never overflow.
+func (f FeeRule) fee(amount int64) int64 {
+	rate := int64(f.Rate)
+	return amount/MaxFeeRate*rate + amount%MaxFeeRate*rate/MaxFeeRate + f.Fixed
+}
+
+// FeeSchedule is the fee rules of merchant account Merchant, applied in order.
+type FeeSchedule struct {
+	Merchant  AccountID
+	Rules     []FeeRule
+	UpdatedAt time.Time
+}
+
+func (s *FeeSchedule) check() error {
+	if len(s.Rules) > MaxFeeRules {
+		return fmt.Errorf("%w: %d rules, at most %d", ErrInvalidFeeRule, len(s.Rules), MaxFeeRules)
+	}
+	for _, f := range s.Rules {
+		if err := f.check(s.Merchant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Leg is one credit of a split payment, Amount to To before the fees of To.
+type Leg struct {
+	To     AccountID
+	Amount Money
+}
+
+// checkLegs returns the total of legs paid by from, or why they cannot be
+// paid.
+func checkLegs(from AccountID, legs []Leg) (int64, error) {
+	if len(legs) == 0 || len(legs) > MaxLegs {
+		return 0, fmt.Errorf("%w: %d legs, want 1 to %d", ErrInvalidSplit, len(legs), MaxLegs)
+	}
+	var total int64
+	for _, leg := range legs {
+		if err := leg.Amount.check(); err != nil {
+			return 0, err
+		}
+		if leg.To == from {
+			return 0, ErrSameAccount
+		}
+		total += leg.Amount.Amount
+	}
+	if total > MaxAmount {
+		return 0, fmt.Errorf("%w: legs total %d, more than the maximum of %d", ErrInvalidAmount, total, MaxAmount)
+	}
+	return total, nil
+}
+
+// Payout is a credit of a split payment after fees: Amount to To, for the leg
+// or for the fee rule Fee.
+type Payout struct {
+	To     AccountID
+	Amount int64
+	Fee    string `json:",omitempty"`
+}
+
+// payouts takes the fees of the rules of every leg's receiver out of the leg.
+// A leg or fee of nothing pays out nothing.
+func payouts(legs []Leg, rules func(AccountID) []FeeRule) ([]Payout, error) {
+	payouts := make([]Payout, 0, len(legs))
+	for _, leg := range legs {
+		rest := leg.Amount.Amount
+		var fees []Payout
+		for _, f := range rules(leg.To) {
+			fee := f.fee(leg.Amount.Amount)
+			if fee > rest {
+				return nil, fmt.Errorf("%w: %s of %d to %s", ErrFeesExceedAmount, f.Name, leg.Amount.Amount, leg.To)
+			}
+			rest -= fee
+			if fee > 0 {
+				fees = append(fees, Payout{To: f.To, Amount: fee, Fee: f.Name})
+			}
+		}
+		if rest > 0 {
+			payouts = append(payouts, Payout{To: leg.To, Amount: rest})
+		}
+		payouts = append(payouts, fees...)
+	}
+	return payouts, nil
+}
+
+// splitPostings debit total from the payer and credit every payout.
+func splitPostings(from AccountID, currency Currency, total int64, payouts []Payout) []Posting {
+	postings := []Posting{{Account: from, Amount: -total, Currency: currency}}
+	for _, p := range payouts {
+		postings = append(postings, Posting{Account: p.To, Amount: p.Amount, Currency: currency})
+	}
+	return postings
+}
+
+// splitLog returns the log entries of the payouts of split payment id from
+// from, with the balances of the payer and the receivers after each payout
+// counted on from the balances before the payment.
+func splitLog(id int64, from AccountID, currency Currency, payouts []Payout, before map[AccountID]int64) []TransactionLog {
+	balances := make(map[AccountID]int64, len(before))
+	for id, balance := range before {
+		balances[id] = balance
+	}
+	log := make([]TransactionLog, 0, len(payouts))
+	for _, p := range payouts {
+		balances[from] -= p.Amount
+		balances[p.To] += p.Amount
+		tl := TransactionLog{ID: id, Type: TransactionSplit, From: from, To: p.To, Amount: p.Amount, Currency: currency,
+			FromBalance: balances[from], ToBalance: balances[p.To]}
+		// fees are described by their rule
+		if p.Fee != "" {
+			tl.Type, tl.Memo = TransactionFee, p.Fee
+		}
+		log = append(log, tl)
+	}
+	return log
+}
+
+// fees are the fee schedules of Repository by merchant.
+type fees struct {
+	schedules map[AccountID]FeeSchedule
+	rw        sync.RWMutex
+}
+
+// rules returns the fee rules of merchant id.
+func (t *fees) rules(id AccountID) []FeeRule {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	return t.schedules[id].Rules
+}
+
+// all returns every fee schedule ordered by merchant.
+func (t *fees) all() []FeeSchedule {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	list := make([]FeeSchedule, 0, len(t.schedules))
+	for _, s := range t.schedules {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Merchant < list[j].Merchant })
+	return list
+}
+
+// lockAll locks accounts in id order, each once, and returns the function
+// unlocking them.
+func lockAll(accounts []*account) func() {
+	sorted := append([]*account(nil), accounts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	locked := make([]*account, 0, len(sorted))
+	for _, acc := range sorted {
+		if len(locked) > 0 && locked[len(locked)-1] == acc {
+			continue
+		}
+		acc.rw.Lock()
+		locked = append(locked, acc)
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].rw.Unlock()
+		}
+	}
+}
+
+// SetFeeSchedule replaces the fee rules of merchant s.Merchant. A schedule
+// without rules removes them.
+func (r *Repository) SetFeeSchedule(ctx context.Context, s FeeSchedule) (*FeeSchedule, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	s.Rules = append([]FeeRule(nil), s.Rules...)
+	s.UpdatedAt = time.Now()
+	return r.setFees(walRecord{Op: opSetFeeSchedule, Fees: &s})
+}
+
+func (r *Repository) setFees(rec walRecord) (*FeeSchedule, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	s := *rec.Fees
+	merchant := r.Accounts.get(s.Merchant)
+	if merchant == nil {
+		return nil, ErrAccountNotFound
+	}
+	accounts := []*account{merchant}
+	for _, f := range s.Rules {
+		acc := r.Accounts.get(f.To)
+		if acc == nil {
+			return nil, ErrAccountNotFound
+		}
+		accounts = append(accounts, acc)
+	}
+	defer lockAll(accounts)()
+
+	for _, acc := range accounts {
+		if acc.Status == StatusClosed {
+			return nil, ErrAccountClosed
+		}
+		if acc.Currency != merchant.Currency {
+			return nil, fmt.Errorf("%w: fee account %s in %s, merchant in %s", ErrCurrencyMismatch, acc.ID, acc.Currency, merchant.Currency)
+		}
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+	r.Fees.rw.Lock()
+	defer r.Fees.rw.Unlock()
+	if len(s.Rules) == 0 {
+		delete(r.Fees.schedules, s.Merchant)
+	} else {
+		r.Fees.schedules[s.Merchant] = s
+	}
+	return &s, nil
+}
+
+// GetFeeSchedule returns the fee rules of merchant id, none if it has none.
+func (r *Repository) GetFeeSchedule(ctx context.Context, id AccountID) (*FeeSchedule, error) {
+	if r.Accounts.get(id) == nil {
+		return nil, ErrAccountNotFound
+	}
+	r.Fees.rw.RLock()
+	defer r.Fees.rw.RUnlock()
+	s, ok := r.Fees.schedules[id]
+	if !ok {
+		return &FeeSchedule{Merchant: id, Rules: make([]FeeRule, 0)}, nil
+	}
+	s.Rules = append([]FeeRule(nil), s.Rules...)
+	return &s, nil
+}
+
+// SplitTransfer debits the total of legs from from and credits every leg,
+// less the fees of its receiver which go to the fee accounts, in one journal
+// entry. Every credit is logged under the id of the entry.
+func (r *Repository) SplitTransfer(ctx context.Context, from AccountID, legs []Leg, meta TransactionMeta) ([]TransactionLog, error) {
+	total, err := checkLegs(from, legs)
+	if err != nil {
+		return nil, err
+	}
+	rec := r.movement(opSplitTransfer, meta)
+	rec.From, rec.Amount, rec.Legs = from, total, append([]Leg(nil), legs...)
+	return r.split(rec)
+}
+
+// split applies a split record. The fees are resolved once, before the record
+// is written ahead, and replayed from the log.
+func (r *Repository) split(rec walRecord) ([]TransactionLog, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	if rec.Payouts == nil {
+		payouts, err := payouts(rec.Legs, r.Fees.rules)
+		if err != nil {
+			return nil, err
+		}
+		rec.Payouts = payouts
+	}
+	fromAcc := r.Accounts.get(rec.From)
+	if fromAcc == nil {
+		return nil, ErrAccountNotFound
+	}
+	accounts := []*account{fromAcc}
+	receivers := make(map[AccountID]*account, len(rec.Payouts))
+	for _, p := range rec.Payouts {
+		// a fee may not go back to the payer
+		if p.To == rec.From {
+			return nil, ErrSameAccount
+		}
+		acc := r.Accounts.get(p.To)
+		if acc == nil {
+			return nil, ErrAccountNotFound
+		}
+		accounts = append(accounts, acc)
+		receivers[p.To] = acc
+	}
+	defer lockAll(accounts)()
+
+	if err := fromAcc.Status.canDebit(); err != nil {
+		return nil, err
+	}
+	for _, leg := range rec.Legs {
+		if err := leg.Amount.in(fromAcc.Currency); err != nil {
+			return nil, err
+		}
+	}
+	balances := make(map[AccountID]int64, len(receivers))
+	for _, p := range rec.Payouts {
+		acc := receivers[p.To]
+		if err := acc.Status.canCredit(); err != nil {
+			return nil, err
+		}
+		if acc.Currency != fromAcc.Currency {
+			return nil, fmt.Errorf("%w: %s in %s, payer in %s", ErrCurrencyMismatch, acc.ID, acc.Currency, fromAcc.Currency)
+		}
+		if _, ok := balances[p.To]; !ok {
+			balances[p.To] = acc.Balance
+		}
+		balance, err := addAmounts(balances[p.To], p.Amount)
+		if err != nil {
+			return nil, err
+		}
+		balances[p.To] = balance
+	}
+	before := make(map[AccountID]int64, len(receivers)+1)
+	for id, acc := range receivers {
+		before[id] = acc.Balance
+	}
+	before[rec.From] = fromAcc.Balance
+	if err := fromAcc.covers(rec.Amount); err != nil {
+		return nil, err
+	}
+	fromBalance, err := subAmounts(fromAcc.Balance, rec.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return nil, err
+	}
+
+	fromAcc.accrue(rec.When)
+	fromAcc.Balance = fromBalance
+	for id, balance := range balances {
+		receivers[id].accrue(rec.When)
+		receivers[id].Balance = balance
+	}
+	r.post(JournalEntry{ID: rec.Entry, Type: TransactionSplit, Postings: splitPostings(rec.From, fromAcc.Currency, rec.Amount, rec.Payouts), When: rec.When})
+	log := splitLog(rec.Entry, rec.From, fromAcc.Currency, rec.Payouts, before)
+	for i := range log {
+		legRec := rec
+		if log[i].Type == TransactionFee {
+			legRec.Memo = log[i].Memo
+		}
+		r.commitLog(legRec, &log[i])
+	}
+	return log, nil
+}
@@ -0,0 +1,231 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFeeRuleFee(t *testing.T) {
+	tests := []struct {
+		rule   FeeRule
+		amount int64
+		want   int64
+	}{
+		{FeeRule{Rate: 250}, 1000, 25},
+		{FeeRule{Rate: 250}, 999, 24},
+		{FeeRule{Rate: 100, Fixed: 30}, 8000, 110},
+		{FeeRule{Fixed: 30}, 8000, 30},
+		{FeeRule{Rate: MaxFeeRate}, MaxAmount, MaxAmount},
+		{FeeRule{Rate: 9999}, MaxAmount, MaxAmount / 10000 * 9999},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.fee(tt.amount); got != tt.want {
+			t.Errorf("%+v.fee(%v) got = %v, want %v", tt.rule, tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestSplitTransfer(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		platformID, _ := repo.CreateAccount(ctx)
+		shippingID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 10000}, TransactionMeta{})
+
+		s, err := repo.SetFeeSchedule(ctx, FeeSchedule{Merchant: shopID, Rules: []FeeRule{
+			{Name: "platform commission", To: platformID, Rate: 500},
+			{Name: "payment processing", To: platformID, Rate: 100, Fixed: 30},
+		}})
+		if err != nil || len(s.Rules) != 2 || s.UpdatedAt.IsZero() {
+			t.Fatalf("SetFeeSchedule() got = %+v, %v", s, err)
+		}
+		if got, err := repo.GetFeeSchedule(ctx, shopID); err != nil || len(got.Rules) != 2 || got.Rules[1].Fixed != 30 {
+			t.Errorf("GetFeeSchedule() got = %+v, %v", got, err)
+		}
+		if got, err := repo.GetFeeSchedule(ctx, shippingID); err != nil || got.Rules == nil || len(got.Rules) != 0 {
+			t.Errorf("GetFeeSchedule() without rules got = %+v, %v", got, err)
+		}
+
+		legs := []Leg{{To: shopID, Amount: Money{Amount: 8000}}, {To: shippingID, Amount: Money{Amount: 1200}}}
+		log, err := repo.SplitTransfer(ctx, buyerID, legs, TransactionMeta{Memo: "checkout", Reference: "order-1"})
+		if err != nil || len(log) != 4 {
+			t.Fatalf("SplitTransfer() got = %+v, %v", log, err)
+		}
+		want := []TransactionLog{
+			{Type: TransactionSplit, To: shopID, Amount: 7490, Memo: "checkout", FromBalance: 2510, ToBalance: 7490},
+			{Type: TransactionFee, To: platformID, Amount: 400, Memo: "platform commission", FromBalance: 2110, ToBalance: 400},
+			{Type: TransactionFee, To: platformID, Amount: 110, Memo: "payment processing", FromBalance: 2000, ToBalance: 510},
+			{Type: TransactionSplit, To: shippingID, Amount: 1200, Memo: "checkout", FromBalance: 800, ToBalance: 1200},
+		}
+		for i, tl := range log {
+			w := want[i]
+			if tl.ID != log[0].ID || tl.ID == 0 || tl.From != buyerID || tl.Reference != "order-1" || tl.Type != w.Type || tl.To != w.To ||
+				tl.Amount != w.Amount || tl.Memo != w.Memo || tl.FromBalance != w.FromBalance || tl.ToBalance != w.ToBalance {
+				t.Errorf("SplitTransfer() leg %d got = %+v, want %+v", i, tl, w)
+			}
+		}
+		for id, want := range map[AccountID]int64{buyerID: 800, shopID: 7490, platformID: 510, shippingID: 1200} {
+			if acc, _ := repo.GetAccount(ctx, id); acc.Balance != want {
+				t.Errorf("balance of %v got = %v, want %v", id, acc.Balance, want)
+			}
+		}
+
+		// the legs are relayed one by one but stay under one id
+		if n, err := repo.RelayTransactions(ctx, 2, nil); err != nil || n != 2 {
+			t.Fatalf("RelayTransactions() got = %v, %v", n, err)
+		}
+		_, _ = repo.RelayTransactions(ctx, 100, nil)
+		page, _ := repo.ListTransactions(ctx, TransactionQuery{Account: buyerID})
+		var legCount int
+		for _, tl := range page.Transactions {
+			if tl.ID == log[0].ID {
+				if tl.Amount != want[legCount].Amount {
+					t.Errorf("relayed leg %d got = %+v", legCount, tl)
+				}
+				legCount++
+			}
+		}
+		if legCount != 4 {
+			t.Errorf("relayed legs got = %v, want 4", legCount)
+		}
+
+		journal, _ := repo.GetJournal(ctx)
+		last := journal[len(journal)-1]
+		if last.ID != log[0].ID || last.Type != TransactionSplit || len(last.Postings) != 5 || last.Postings[0].Amount != -9200 {
+			t.Errorf("split journal entry got = %+v", last)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+
+		// an empty schedule removes the fees
+		if _, err := repo.SetFeeSchedule(ctx, FeeSchedule{Merchant: shopID}); err != nil {
+			t.Fatalf("SetFeeSchedule() empty error = %v", err)
+		}
+		log, err = repo.SplitTransfer(ctx, buyerID, []Leg{{To: shopID, Amount: Money{Amount: 100}}}, TransactionMeta{})
+		if err != nil || len(log) != 1 || log[0].Amount != 100 {
+			t.Errorf("SplitTransfer() without fees got = %+v, %v", log, err)
+		}
+	})
+}
+
+func TestSplitTransferErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		buyerID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		platformID, _ := repo.CreateAccount(ctx)
+		usdID, _ := repo.CreateCurrencyAccount(ctx, "USD")
+		otherID, _ := repo.CreateAccount(ctx)
+		closedID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.SetAccountStatus(ctx, closedID, StatusClosed)
+		_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 1000}, TransactionMeta{})
+
+		schedules := []struct {
+			name    string
+			rules   []FeeRule
+			wantErr error
+		}{
+			{"no name", []FeeRule{{To: platformID, Rate: 100}}, ErrInvalidFeeRule},
+			{"no fee", []FeeRule{{Name: "f", To: platformID}}, ErrInvalidFeeRule},
+			{"rate over 100%", []FeeRule{{Name: "f", To: platformID, Rate: MaxFeeRate + 1}}, ErrInvalidFeeRule},
+			{"negative fixed", []FeeRule{{Name: "f", To: platformID, Fixed: -1}}, ErrInvalidFeeRule},
+			{"to the merchant", []FeeRule{{Name: "f", To: shopID, Rate: 100}}, ErrInvalidFeeRule},
+			{"unknown fee account", []FeeRule{{Name: "f", To: "nope", Rate: 100}}, ErrAccountNotFound},
+			{"closed fee account", []FeeRule{{Name: "f", To: closedID, Rate: 100}}, ErrAccountClosed},
+			{"fee account in another currency", []FeeRule{{Name: "f", To: usdID, Rate: 100}}, ErrCurrencyMismatch},
+		}
+		for _, tt := range schedules {
+			if _, err := repo.SetFeeSchedule(ctx, FeeSchedule{Merchant: shopID, Rules: tt.rules}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("SetFeeSchedule() %v error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		if _, err := repo.SetFeeSchedule(ctx, FeeSchedule{Merchant: "nope"}); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("SetFeeSchedule() unknown merchant error = %v, want %v", err, ErrAccountNotFound)
+		}
+		if _, err := repo.GetFeeSchedule(ctx, "nope"); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("GetFeeSchedule() unknown error = %v, want %v", err, ErrAccountNotFound)
+		}
+
+		_, _ = repo.SetFeeSchedule(ctx, FeeSchedule{Merchant: shopID, Rules: []FeeRule{{Name: "listing", To: platformID, Fixed: 50}}})
+		_, _ = repo.SetFeeSchedule(ctx, FeeSchedule{Merchant: platformID, Rules: []FeeRule{{Name: "rebate", To: buyerID, Rate: 100}}})
+		leg := func(to AccountID, amount int64) Leg { return Leg{To: to, Amount: Money{Amount: amount}} }
+		splits := []struct {
+			name    string
+			legs    []Leg
+			wantErr error
+		}{
+			{"no legs", nil, ErrInvalidSplit},
+			{"too many legs", make([]Leg, MaxLegs+1), ErrInvalidSplit},
+			{"zero leg", []Leg{leg(shopID, 0)}, ErrInvalidAmount},
+			{"leg in another currency", []Leg{{To: shopID, Amount: Money{Amount: 100, Currency: "USD"}}}, ErrCurrencyMismatch},
+			{"leg to the payer", []Leg{leg(buyerID, 10)}, ErrSameAccount},
+			{"fee back to the payer", []Leg{leg(platformID, 100)}, ErrSameAccount},
+			{"fees over the leg", []Leg{leg(shopID, 40)}, ErrFeesExceedAmount},
+			{"unknown receiver", []Leg{leg(shopID, 100), leg("nope", 10)}, ErrAccountNotFound},
+			{"closed receiver", []Leg{leg(shopID, 100), leg(closedID, 10)}, ErrAccountClosed},
+			{"receiver in another currency", []Leg{leg(usdID, 10)}, ErrCurrencyMismatch},
+			{"more than the balance", []Leg{leg(shopID, 600), leg(otherID, 401)}, ErrInsufficientFunds},
+		}
+		for _, tt := range splits {
+			if _, err := repo.SplitTransfer(ctx, buyerID, tt.legs, TransactionMeta{}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("SplitTransfer() %v error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+		// failed splits move nothing
+		for id, want := range map[AccountID]int64{buyerID: 1000, shopID: 0, platformID: 0} {
+			if acc, _ := repo.GetAccount(ctx, id); acc.Balance != want {
+				t.Errorf("balance of %v after failures got = %v, want %v", id, acc.Balance, want)
+			}
+		}
+		if n, _ := repo.OutboxDepth(ctx); n != 1 {
+			t.Errorf("OutboxDepth() after failures got = %v, want 1", n)
+		}
+	})
+}
+
+func TestSplitTransferDurable(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	buyerID, _ := repo.CreateAccount(ctx)
+	shopID, _ := repo.CreateAccount(ctx)
+	platformID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, buyerID, Money{Amount: 1000}, TransactionMeta{})
+	_, _ = repo.SetFeeSchedule(ctx, FeeSchedule{Merchant: shopID, Rules: []FeeRule{{Name: "commission", To: platformID, Rate: 1000}}})
+	_, _ = repo.SplitTransfer(ctx, buyerID, []Leg{{To: shopID, Amount: Money{Amount: 300}}}, TransactionMeta{})
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	// replayed from the log after the snapshot, with the fees it was paid with
+	_, _ = repo.SplitTransfer(ctx, buyerID, []Leg{{To: shopID, Amount: Money{Amount: 200}}}, TransactionMeta{})
+	_, _ = repo.SetFeeSchedule(ctx, FeeSchedule{Merchant: shopID, Rules: []FeeRule{{Name: "commission", To: platformID, Rate: 2000}}})
+	_, _ = repo.RelayTransactions(ctx, 3, nil)
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	for id, want := range map[AccountID]int64{buyerID: 500, shopID: 450, platformID: 50} {
+		if acc, _ := repo.GetAccount(ctx, id); acc.Balance != want {
+			t.Errorf("balance of %v after reopen got = %v, want %v", id, acc.Balance, want)
+		}
+	}
+	if s, err := repo.GetFeeSchedule(ctx, shopID); err != nil || len(s.Rules) != 1 || s.Rules[0].Rate != 2000 {
+		t.Errorf("GetFeeSchedule() after reopen got = %+v, %v", s, err)
+	}
+	if n, _ := repo.OutboxDepth(ctx); n != 2 {
+		t.Errorf("OutboxDepth() after reopen got = %v, want 2", n)
+	}
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() after reopen error = %v", err)
+	}
+}
@@ -0,0 +1,2142 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var _ AccountStore = (*SQLiteRepository)(nil)
+
+// migrations are applied in order on startup; the applied version is kept in
+// schema_migrations. Never edit a released migration, append a new one.
+var migrations = []string{
+	`CREATE TABLE accounts (
+		id      INTEGER PRIMARY KEY AUTOINCREMENT,
+		balance INTEGER NOT NULL DEFAULT 0 CHECK (balance >= 0)
+	);
+	CREATE TABLE transactions (
+		seq          INTEGER PRIMARY KEY AUTOINCREMENT,
+		from_account INTEGER NOT NULL,
+		to_account   INTEGER NOT NULL,
+		amount       INTEGER NOT NULL,
+		created_at   INTEGER NOT NULL
+	);`,
+	// double-entry journal; existing balances are opened against cash-in (-1)
+	`CREATE TABLE journal_entries (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at INTEGER NOT NULL
+	);
+	CREATE TABLE postings (
+		entry_id   INTEGER NOT NULL REFERENCES journal_entries (id),
+		account_id INTEGER NOT NULL,
+		amount     INTEGER NOT NULL
+	);
+	CREATE INDEX postings_entry ON postings (entry_id);
+	CREATE INDEX postings_account ON postings (account_id);
+	INSERT INTO journal_entries (id, created_at)
+		SELECT 1, CAST(strftime('%s', 'now') AS INTEGER) * 1000000000
+		WHERE EXISTS (SELECT 1 FROM accounts WHERE balance != 0);
+	INSERT INTO postings (entry_id, account_id, amount)
+		SELECT 1, id, balance FROM accounts WHERE balance != 0;
+	INSERT INTO postings (entry_id, account_id, amount)
+		SELECT 1, -1, -SUM(balance) FROM accounts HAVING SUM(balance) != 0;`,
+	// typed transaction log entries
+	`ALTER TABLE transactions ADD COLUMN id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE transactions ADD COLUMN type TEXT NOT NULL DEFAULT 'transfer';
+	ALTER TABLE transactions ADD COLUMN from_balance INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE transactions ADD COLUMN to_balance INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE transactions ADD COLUMN memo TEXT NOT NULL DEFAULT '';
+	ALTER TABLE transactions ADD COLUMN reference TEXT NOT NULL DEFAULT '';`,
+	// typed journal entries and transfer reversals
+	`ALTER TABLE journal_entries ADD COLUMN type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE journal_entries ADD COLUMN reverses INTEGER NOT NULL DEFAULT 0;
+	UPDATE journal_entries SET type = CASE
+		WHEN EXISTS (SELECT 1 FROM postings WHERE entry_id = journal_entries.id AND account_id = -1) THEN 'deposit'
+		WHEN EXISTS (SELECT 1 FROM postings WHERE entry_id = journal_entries.id AND account_id = -2) THEN 'withdrawal'
+		ELSE 'transfer' END;
+	CREATE INDEX journal_entries_reverses ON journal_entries (reverses) WHERE reverses != 0;
+	ALTER TABLE transactions ADD COLUMN reverses INTEGER NOT NULL DEFAULT 0;`,
+	// opaque text account ids
+	`CREATE TABLE accounts_text (
+		id      TEXT PRIMARY KEY,
+		balance INTEGER NOT NULL DEFAULT 0 CHECK (balance >= 0)
+	);
+	INSERT INTO accounts_text (id, balance) SELECT CAST(id AS TEXT), balance FROM accounts;
+	DROP TABLE accounts;
+	ALTER TABLE accounts_text RENAME TO accounts;
+	CREATE TABLE postings_text (
+		entry_id   INTEGER NOT NULL REFERENCES journal_entries (id),
+		account_id TEXT NOT NULL,
+		amount     INTEGER NOT NULL
+	);
+	INSERT INTO postings_text (rowid, entry_id, account_id, amount)
+		SELECT rowid, entry_id, CAST(account_id AS TEXT), amount FROM postings;
+	DROP TABLE postings;
+	ALTER TABLE postings_text RENAME TO postings;
+	CREATE INDEX postings_entry ON postings (entry_id);
+	CREATE INDEX postings_account ON postings (account_id);
+	CREATE TABLE transactions_text (
+		seq          INTEGER PRIMARY KEY AUTOINCREMENT,
+		id           INTEGER NOT NULL DEFAULT 0,
+		type         TEXT NOT NULL DEFAULT 'transfer',
+		reverses     INTEGER NOT NULL DEFAULT 0,
+		from_account TEXT NOT NULL,
+		to_account   TEXT NOT NULL,
+		amount       INTEGER NOT NULL,
+		from_balance INTEGER NOT NULL DEFAULT 0,
+		to_balance   INTEGER NOT NULL DEFAULT 0,
+		memo         TEXT NOT NULL DEFAULT '',
+		reference    TEXT NOT NULL DEFAULT '',
+		created_at   INTEGER NOT NULL
+	);
+	INSERT INTO transactions_text
+		SELECT seq, id, type, reverses, CAST(from_account AS TEXT), CAST(to_account AS TEXT),
+			amount, from_balance, to_balance, memo, reference, created_at
+		FROM transactions;
+	DROP TABLE transactions;
+	ALTER TABLE transactions_text RENAME TO transactions;`,
+	// transactional outbox of transaction log entries
+	`CREATE TABLE transaction_outbox (
+		seq          INTEGER PRIMARY KEY AUTOINCREMENT,
+		id           INTEGER NOT NULL,
+		type         TEXT NOT NULL,
+		reverses     INTEGER NOT NULL DEFAULT 0,
+		from_account TEXT NOT NULL,
+		to_account   TEXT NOT NULL,
+		amount       INTEGER NOT NULL,
+		from_balance INTEGER NOT NULL,
+		to_balance   INTEGER NOT NULL,
+		memo         TEXT NOT NULL,
+		reference    TEXT NOT NULL,
+		created_at   INTEGER NOT NULL
+	);`,
+	// indexes of the transaction log filters
+	`CREATE INDEX transactions_from_account ON transactions (from_account, seq);
+	CREATE INDEX transactions_to_account ON transactions (to_account, seq);
+	CREATE INDEX transactions_type ON transactions (type, seq);
+	CREATE INDEX transactions_created_at ON transactions (created_at);
+	CREATE INDEX transactions_amount ON transactions (amount);`,
+	// customers and the accounts they hold
+	`CREATE TABLE customers (
+		id                 TEXT PRIMARY KEY,
+		name               TEXT NOT NULL,
+		email              TEXT NOT NULL,
+		external_reference TEXT NOT NULL,
+		created_at         INTEGER NOT NULL,
+		updated_at         INTEGER NOT NULL
+	);
+	CREATE INDEX customers_email ON customers (email COLLATE NOCASE);
+	CREATE INDEX customers_external_reference ON customers (external_reference);
+	CREATE TABLE account_holders (
+		seq         INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id  TEXT NOT NULL REFERENCES accounts (id),
+		customer_id TEXT NOT NULL REFERENCES customers (id),
+		role        TEXT NOT NULL CHECK (role IN ('owner', 'holder')),
+		since       INTEGER NOT NULL,
+		UNIQUE (account_id, customer_id)
+	);
+	CREATE INDEX account_holders_customer ON account_holders (customer_id, seq);`,
+	// account lifecycle
+	`ALTER TABLE accounts ADD COLUMN status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'frozen', 'closed'));`,
+	// overdrafts: balances may go negative, so accounts are rebuilt without
+	// the balance check
+	`CREATE TABLE accounts_overdraft (
+		id                  TEXT PRIMARY KEY,
+		balance             INTEGER NOT NULL DEFAULT 0,
+		status              TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'frozen', 'closed')),
+		overdraft_limit     INTEGER NOT NULL DEFAULT 0 CHECK (overdraft_limit >= 0),
+		interest_rate       INTEGER NOT NULL DEFAULT 0 CHECK (interest_rate >= 0),
+		interest_accrued_at INTEGER NOT NULL DEFAULT 0,
+		interest_owed       INTEGER NOT NULL DEFAULT 0,
+		interest_remainder  INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT INTO accounts_overdraft (id, balance, status) SELECT id, balance, status FROM accounts;
+	DROP TABLE accounts;
+	ALTER TABLE accounts_overdraft RENAME TO accounts;
+	CREATE TABLE overdraft_changes (
+		seq             INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id      TEXT NOT NULL REFERENCES accounts (id),
+		overdraft_limit INTEGER NOT NULL,
+		interest_rate   INTEGER NOT NULL,
+		changed_by      TEXT NOT NULL,
+		reason          TEXT NOT NULL,
+		created_at      INTEGER NOT NULL
+	);
+	CREATE INDEX overdraft_changes_account ON overdraft_changes (account_id, seq);`,
+	// currencies; everything before them is in TWD, the DefaultCurrency
+	`ALTER TABLE accounts ADD COLUMN currency TEXT NOT NULL DEFAULT 'TWD';
+	ALTER TABLE postings ADD COLUMN currency TEXT NOT NULL DEFAULT 'TWD';
+	ALTER TABLE transactions ADD COLUMN currency TEXT NOT NULL DEFAULT 'TWD';
+	ALTER TABLE transactions ADD COLUMN to_currency TEXT NOT NULL DEFAULT '';
+	ALTER TABLE transactions ADD COLUMN to_amount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE transactions ADD COLUMN rate TEXT NOT NULL DEFAULT '';
+	ALTER TABLE transactions ADD COLUMN spread INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE transaction_outbox ADD COLUMN currency TEXT NOT NULL DEFAULT 'TWD';
+	ALTER TABLE transaction_outbox ADD COLUMN to_currency TEXT NOT NULL DEFAULT '';
+	ALTER TABLE transaction_outbox ADD COLUMN to_amount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE transaction_outbox ADD COLUMN rate TEXT NOT NULL DEFAULT '';
+	ALTER TABLE transaction_outbox ADD COLUMN spread INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE exchange_rates (
+		from_currency TEXT NOT NULL,
+		to_currency   TEXT NOT NULL,
+		rate          TEXT NOT NULL,
+		spread        INTEGER NOT NULL,
+		updated_at    INTEGER NOT NULL,
+		PRIMARY KEY (from_currency, to_currency)
+	);`,
+	// authorization holds
+	`ALTER TABLE accounts ADD COLUMN held INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE holds (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id     TEXT NOT NULL REFERENCES accounts (id),
+		to_account     TEXT NOT NULL REFERENCES accounts (id),
+		amount         INTEGER NOT NULL,
+		currency       TEXT NOT NULL,
+		captured       INTEGER NOT NULL DEFAULT 0,
+		status         TEXT NOT NULL CHECK (status IN ('active', 'captured', 'released', 'expired')),
+		memo           TEXT NOT NULL,
+		reference      TEXT NOT NULL,
+		placed_at      INTEGER NOT NULL,
+		expires_at     INTEGER NOT NULL,
+		closed_at      INTEGER NOT NULL DEFAULT 0,
+		transaction_id INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX holds_account ON holds (account_id, id);
+	CREATE INDEX holds_expiry ON holds (status, expires_at);`,
+	// escrow of marketplace orders
+	`CREATE TABLE escrows (
+		order_id       TEXT PRIMARY KEY,
+		buyer          TEXT NOT NULL REFERENCES accounts (id),
+		merchant       TEXT NOT NULL REFERENCES accounts (id),
+		amount         INTEGER NOT NULL,
+		currency       TEXT NOT NULL,
+		status         TEXT NOT NULL CHECK (status IN ('held', 'released', 'refunded')),
+		memo           TEXT NOT NULL,
+		opened_at      INTEGER NOT NULL,
+		release_at     INTEGER NOT NULL,
+		closed_at      INTEGER NOT NULL DEFAULT 0,
+		transaction_id INTEGER NOT NULL,
+		settlement_id  INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX escrows_buyer ON escrows (buyer, opened_at);
+	CREATE INDEX escrows_merchant ON escrows (merchant, opened_at);
+	CREATE INDEX escrows_due ON escrows (status, release_at);`,
+	// fee rules of merchants, taken out of split payments
+	`CREATE TABLE fee_rules (
+		merchant   TEXT NOT NULL REFERENCES accounts (id),
+		position   INTEGER NOT NULL,
+		name       TEXT NOT NULL,
+		to_account TEXT NOT NULL REFERENCES accounts (id),
+		rate       INTEGER NOT NULL,
+		fixed      INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (merchant, position)
+	);`,
+}
+
+// SQLiteRepository is an AccountStore backed by a SQLite database. Balance
+// checks are done by the database inside transactions instead of with
+// per-account locks.
+type SQLiteRepository struct {
+	db  *sql.DB
+	ids IDGenerator
+}
+
+// NewSQLiteRepository opens or creates the database at path and migrates its
+// schema to the latest version.
+func NewSQLiteRepository(path string, opts ...Option) (*SQLiteRepository, error) {
+	// immediate transactions take the write lock up front, so concurrent
+	// transfers wait on busy_timeout instead of failing to upgrade their lock
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": []string{"busy_timeout(5000)", "journal_mode(WAL)", "synchronous(FULL)", "foreign_keys(1)"},
+		"_txlock": []string{"immediate"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	r := &SQLiteRepository{db: db, ids: newOptions(opts).ids}
+	if err := r.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := r.observeIDs(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// observeIDs tells the id generator about the accounts already stored.
+func (r *SQLiteRepository) observeIDs(ctx context.Context) error {
+	rows, err := r.db.QueryContext(ctx, `SELECT id FROM accounts`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id AccountID
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		r.ids.Observe(id)
+	}
+	return rows.Err()
+}
+
+func (r *SQLiteRepository) migrate(ctx context.Context) error {
+	// migrations that rebuild a table drop it while others still reference
+	// it, which needs foreign keys off. That cannot change inside a
+	// transaction, so it is done on a connection of its own.
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return err
+	}
+	if err := migrateConn(ctx, conn); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`)
+	return err
+}
+
+func migrateConn(ctx context.Context, conn *sql.Conn) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this binary", version)
+	}
+	for i := version; i < len(migrations); i++ {
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			return err
+		}
+	}
+	// the rebuilt tables must still satisfy the foreign keys
+	rows, err := tx.QueryContext(ctx, `PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	broken := rows.Next()
+	rows.Close()
+	if broken {
+		return errors.New("migrations left broken foreign keys")
+	}
+	return tx.Commit()
+}
+
+// Close closes the database.
+func (r *SQLiteRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *SQLiteRepository) CreateAccount(ctx context.Context, holders ...AccountHolder) (AccountID, error) {
+	return r.CreateCurrencyAccount(ctx, DefaultCurrency, holders...)
+}
+
+func (r *SQLiteRepository) CreateCurrencyAccount(ctx context.Context, currency Currency, holders ...AccountHolder) (AccountID, error) {
+	if err := currency.check(); err != nil {
+		return "", err
+	}
+	if err := checkHolders(holders); err != nil {
+		return "", err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	id := r.ids.NewID()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO accounts (id, balance, currency) VALUES (?, 0, ?)`, id, currency); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	for _, h := range holders {
+		if err := customerExists(ctx, tx, h.CustomerID); err != nil {
+			return "", err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO account_holders (account_id, customer_id, role, since) VALUES (?, ?, ?, ?)`,
+			id, h.CustomerID, h.Role, now.UnixNano()); err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (r *SQLiteRepository) GetAccount(ctx context.Context, id AccountID) (*Account, error) {
+	acc := &Account{}
+	var accrued interest
+	var accruedAt int64
+	err := r.db.QueryRowContext(ctx, `SELECT id, currency, balance, held, status, overdraft_limit, interest_rate, interest_accrued_at, interest_owed, interest_remainder
+		FROM accounts WHERE id = ?`, id).Scan(&acc.ID, &acc.Currency, &acc.Balance, &acc.Held, &acc.Status, &acc.Overdraft.Limit, &acc.Overdraft.InterestRate,
+		&accruedAt, &accrued.Owed, &accrued.Remainder)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// what is owed up to now, without changing the account
+	accrued.AccruedAt = time.Unix(0, accruedAt)
+	accrued.accrue(acc.Balance, acc.Overdraft.InterestRate, time.Now())
+	acc.InterestOwed = accrued.Owed
+	acc.Available = acc.Balance - acc.Held
+	return acc, nil
+}
+
+func (r *SQLiteRepository) DepositAccount(ctx context.Context, id AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error) {
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	tl := &TransactionLog{Type: TransactionDeposit, From: CashInAccount, To: id, Amount: amount.Amount, Memo: meta.Memo, Reference: meta.Reference}
+	if tl.ToBalance, err = credit(ctx, tx, id, amount.Amount); err != nil {
+		return nil, err
+	}
+	if tl.Currency, err = accountCurrency(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	if err := amount.in(tl.Currency); err != nil {
+		return nil, err
+	}
+	if tl.ID, tl.When, err = postEntry(ctx, tx, JournalEntry{Type: TransactionDeposit, Postings: depositPostings(id, tl.Currency, amount.Amount)}); err != nil {
+		return nil, err
+	}
+	if err := enqueueLog(ctx, tx, tl); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return tl, nil
+}
+
+func (r *SQLiteRepository) WithdrawAccount(ctx context.Context, id AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error) {
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	tl := &TransactionLog{Type: TransactionWithdrawal, From: id, To: CashOutAccount, Amount: amount.Amount, Memo: meta.Memo, Reference: meta.Reference}
+	if tl.FromBalance, err = debit(ctx, tx, id, amount.Amount); err != nil {
+		return nil, err
+	}
+	if tl.Currency, err = accountCurrency(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	if err := amount.in(tl.Currency); err != nil {
+		return nil, err
+	}
+	if tl.ID, tl.When, err = postEntry(ctx, tx, JournalEntry{Type: TransactionWithdrawal, Postings: withdrawPostings(id, tl.Currency, amount.Amount)}); err != nil {
+		return nil, err
+	}
+	if err := enqueueLog(ctx, tx, tl); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return tl, nil
+}
+
+func (r *SQLiteRepository) TransferAccount(ctx context.Context, from AccountID, to AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error) {
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	if from == to {
+		return nil, ErrSameAccount
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// check the receiver first so a missing account is not reported as insufficient funds
+	if err := accountExists(ctx, tx, to); err != nil {
+		return nil, err
+	}
+	tl := &TransactionLog{Type: TransactionTransfer, From: from, To: to, Amount: amount.Amount, Memo: meta.Memo, Reference: meta.Reference}
+	if tl.FromBalance, err = debit(ctx, tx, from, amount.Amount); err != nil {
+		return nil, err
+	}
+	if tl.Currency, err = accountCurrency(ctx, tx, from); err != nil {
+		return nil, err
+	}
+	if err := amount.in(tl.Currency); err != nil {
+		return nil, err
+	}
+	toCurrency, err := accountCurrency(ctx, tx, to)
+	if err != nil {
+		return nil, err
+	}
+	postings, credited := transferPostings(from, to, tl.Currency, amount.Amount), amount.Amount
+	if toCurrency != tl.Currency {
+		rate, err := exchangeRate(ctx, tx, tl.Currency, toCurrency)
+		if err != nil {
+			return nil, err
+		}
+		if tl.Conversion, err = rate.convert(amount.Amount); err != nil {
+			return nil, err
+		}
+		postings, credited = exchangePostings(from, to, tl.Currency, amount.Amount, tl.Conversion), tl.Conversion.ToAmount
+	}
+	if tl.ToBalance, err = credit(ctx, tx, to, credited); err != nil {
+		return nil, err
+	}
+	if tl.ID, tl.When, err = postEntry(ctx, tx, JournalEntry{Type: TransactionTransfer, Postings: postings}); err != nil {
+		return nil, err
+	}
+	if err := enqueueLog(ctx, tx, tl); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return tl, nil
+}
+
+func (r *SQLiteRepository) ReverseTransaction(ctx context.Context, id int64, money Money, meta TransactionMeta) (*TransactionLog, error) {
+	// a zero amount is the rest of the transfer
+	if money.Amount != 0 {
+		if err := money.check(); err != nil {
+			return nil, err
+		}
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	original, err := journalEntry(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if original.Type != TransactionTransfer {
+		return nil, ErrNotReversible
+	}
+	if len(original.Postings) != 2 {
+		return nil, ErrCrossCurrencyReversal
+	}
+	if err := money.in(original.Postings[1].Currency.orDefault()); err != nil {
+		return nil, err
+	}
+	var reversed int64
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(SUM(p.amount), 0) FROM journal_entries e
+		JOIN postings p ON p.entry_id = e.id
+		WHERE e.reverses = ? AND p.amount > 0`, id).Scan(&reversed)
+	if err != nil {
+		return nil, err
+	}
+	remaining := original.Postings[1].Amount - reversed
+	if remaining <= 0 {
+		return nil, ErrAlreadyReversed
+	}
+	amount := money.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		return nil, ErrReversalExceedsAmount
+	}
+	// money goes back from the original receiver to the original sender
+	from, to := original.Postings[1].Account, original.Postings[0].Account
+	tl := &TransactionLog{Type: TransactionReversal, Reverses: id, From: from, To: to, Amount: amount, Currency: original.Postings[1].Currency, Memo: meta.Memo, Reference: meta.Reference}
+	if tl.FromBalance, err = debit(ctx, tx, from, amount); err != nil {
+		return nil, err
+	}
+	if tl.ToBalance, err = credit(ctx, tx, to, amount); err != nil {
+		return nil, err
+	}
+	entry := JournalEntry{Type: TransactionReversal, Reverses: id, Postings: reversalPostings(*original, amount)}
+	if tl.ID, tl.When, err = postEntry(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	if err := enqueueLog(ctx, tx, tl); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return tl, nil
+}
+
+// GetTransactions returns the transaction log in insertion order
+func (r *SQLiteRepository) GetTransactions(ctx context.Context) ([]TransactionLog, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT `+logColumns+` FROM transactions ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	return scanTransactions(rows)
+}
+
+// ListTransactions returns a page of the transaction log matching q. Cursors
+// are the seq of the last entry of a page.
+func (r *SQLiteRepository) ListTransactions(ctx context.Context, q TransactionQuery) (*TransactionPage, error) {
+	cursor, hasCursor, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit := q.limit()
+
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+	if q.Account != "" {
+		where = append(where, `(from_account = ? OR to_account = ?)`)
+		args = append(args, q.Account, q.Account)
+	}
+	if q.Type != "" {
+		where = append(where, `type = ?`)
+		args = append(args, q.Type)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, `created_at >= ?`)
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, `created_at < ?`)
+		args = append(args, q.Until.UnixNano())
+	}
+	if q.MinAmount != 0 {
+		where = append(where, `amount >= ?`)
+		args = append(args, q.MinAmount)
+	}
+	if q.MaxAmount != 0 {
+		where = append(where, `amount <= ?`)
+		args = append(args, q.MaxAmount)
+	}
+	order := `ASC`
+	if q.Descending {
+		order = `DESC`
+	}
+	if hasCursor {
+		if q.Descending {
+			where = append(where, `seq < ?`)
+		} else {
+			where = append(where, `seq > ?`)
+		}
+		args = append(args, cursor)
+	}
+	query := `SELECT seq, ` + logColumns + ` FROM transactions`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	// one more row than the page tells whether there is a next page
+	query += ` ORDER BY seq ` + order + ` LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	page := &TransactionPage{Transactions: make([]TransactionLog, 0)}
+	var last int64
+	for rows.Next() {
+		var tl TransactionLog
+		var seq int64
+		if err := scanLog(rows, &tl, &seq); err != nil {
+			return nil, err
+		}
+		if len(page.Transactions) == limit {
+			page.NextCursor = encodeCursor(last)
+			break
+		}
+		page.Transactions = append(page.Transactions, tl)
+		last = seq
+	}
+	return page, rows.Err()
+}
+
+// ListAccountTransactions returns a page of the entries of account id with
+// its balance after each one, using the account indexes of the log.
+func (r *SQLiteRepository) ListAccountTransactions(ctx context.Context, id AccountID, q TransactionQuery) (*AccountHistory, error) {
+	var exists int
+	err := r.db.QueryRowContext(ctx, `SELECT 1 FROM accounts WHERE id = ?`, id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.Account = id
+	page, err := r.ListTransactions(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return accountHistory(id, page), nil
+}
+
+// logColumns are the columns of a log entry in the transaction log and the
+// outbox, in the order of logArgs and scanLog.
+const (
+	logColumns = `id, type, reverses, from_account, to_account, amount, currency,
+		to_currency, to_amount, rate, spread, from_balance, to_balance, memo, reference, created_at`
+	logPlaceholders = `?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?`
+)
+
+// logArgs are the values of the logColumns of tl.
+func logArgs(tl *TransactionLog) []interface{} {
+	c := tl.Conversion
+	if c == nil {
+		c = &Conversion{}
+	}
+	return []interface{}{tl.ID, tl.Type, tl.Reverses, tl.From, tl.To, tl.Amount, tl.Currency.orDefault(),
+		c.ToCurrency, c.ToAmount, c.Rate, c.Spread, tl.FromBalance, tl.ToBalance, tl.Memo, tl.Reference, tl.When.UnixNano()}
+}
+
+// scanLog reads the columns before, then the logColumns of a row into tl.
+func scanLog(rows *sql.Rows, tl *TransactionLog, before ...interface{}) error {
+	var c Conversion
+	var when int64
+	dest := append(before, &tl.ID, &tl.Type, &tl.Reverses, &tl.From, &tl.To, &tl.Amount, &tl.Currency,
+		&c.ToCurrency, &c.ToAmount, &c.Rate, &c.Spread, &tl.FromBalance, &tl.ToBalance, &tl.Memo, &tl.Reference, &when)
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+	if c.ToCurrency != "" {
+		tl.Conversion = &c
+	}
+	tl.When = time.Unix(0, when)
+	return nil
+}
+
+// scanTransactions reads and closes rows of transaction log entries.
+func scanTransactions(rows *sql.Rows) (BatchTransaction, error) {
+	defer rows.Close()
+	logs := make(BatchTransaction, 0)
+	for rows.Next() {
+		var tl TransactionLog
+		if err := scanLog(rows, &tl); err != nil {
+			return nil, err
+		}
+		logs = append(logs, tl)
+	}
+	return logs, rows.Err()
+}
+
+// AddTransaction adds a new transaction to the log
+func (r *SQLiteRepository) AddTransaction(ctx context.Context, batch BatchTransaction) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO transactions (`+logColumns+`) VALUES (`+logPlaceholders+`)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, tl := range batch {
+		if _, err := stmt.ExecContext(ctx, logArgs(&tl)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RelayTransactions moves up to limit of the oldest outbox entries to the
+// transaction log in one transaction and returns how many it moved. publish,
+// if not nil, is called with the entries before the transaction commits.
+func (r *SQLiteRepository) RelayTransactions(ctx context.Context, limit int, publish func(BatchTransaction) error) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// the insert takes the write lock first, so no other relay reads the
+	// same entries before this one commits
+	res, err := tx.ExecContext(ctx, `INSERT INTO transactions (`+logColumns+`)
+		SELECT `+logColumns+` FROM transaction_outbox ORDER BY seq LIMIT ?`, limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if publish != nil {
+		rows, err := tx.QueryContext(ctx, `SELECT `+logColumns+` FROM transaction_outbox ORDER BY seq LIMIT ?`, limit)
+		if err != nil {
+			return 0, err
+		}
+		batch, err := scanTransactions(rows)
+		if err != nil {
+			return 0, err
+		}
+		if err := publish(batch); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM transaction_outbox WHERE seq IN
+		(SELECT seq FROM transaction_outbox ORDER BY seq LIMIT ?)`, limit); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// OutboxDepth returns the number of entries waiting to be relayed.
+func (r *SQLiteRepository) OutboxDepth(ctx context.Context) (int, error) {
+	var n int
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM transaction_outbox`).Scan(&n)
+	return n, err
+}
+
+// GetJournal returns the journal in entry order
+func (r *SQLiteRepository) GetJournal(ctx context.Context) ([]JournalEntry, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT e.id, e.type, e.reverses, e.created_at, p.account_id, p.amount, p.currency
+		FROM journal_entries e JOIN postings p ON p.entry_id = e.id
+		ORDER BY e.id, p.rowid`)
+	if err != nil {
+		return nil, err
+	}
+	return scanJournal(rows)
+}
+
+func (r *SQLiteRepository) GetJournalEntry(ctx context.Context, id int64) (*JournalEntry, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return journalEntry(ctx, tx, id)
+}
+
+// journalEntry returns the journal entry id read in tx.
+func journalEntry(ctx context.Context, tx *sql.Tx, id int64) (*JournalEntry, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT e.id, e.type, e.reverses, e.created_at, p.account_id, p.amount, p.currency
+		FROM journal_entries e JOIN postings p ON p.entry_id = e.id
+		WHERE e.id = ? ORDER BY p.rowid`, id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := scanJournal(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrTransactionNotFound
+	}
+	return &entries[0], nil
+}
+
+// scanJournal groups rows of entry columns and one posting into entries.
+func scanJournal(rows *sql.Rows) ([]JournalEntry, error) {
+	defer rows.Close()
+	entries := make([]JournalEntry, 0)
+	for rows.Next() {
+		var entry JournalEntry
+		var when int64
+		var p Posting
+		if err := rows.Scan(&entry.ID, &entry.Type, &entry.Reverses, &when, &p.Account, &p.Amount, &p.Currency); err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 || entries[len(entries)-1].ID != entry.ID {
+			entry.When = time.Unix(0, when)
+			entries = append(entries, entry)
+		}
+		entries[len(entries)-1].Postings = append(entries[len(entries)-1].Postings, p)
+	}
+	return entries, rows.Err()
+}
+
+// CheckLedger verifies that every journal entry balances and that the
+// balance of every account equals the sum of its postings.
+func (r *SQLiteRepository) CheckLedger(ctx context.Context) error {
+	// one transaction so balances and postings are read at the same point
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var entryID, total int64
+	var currency Currency
+	err = tx.QueryRowContext(ctx, `SELECT entry_id, SUM(amount), currency FROM postings
+		GROUP BY entry_id, currency HAVING SUM(amount) != 0 LIMIT 1`).Scan(&entryID, &total, &currency)
+	if err == nil {
+		return fmt.Errorf("%w: entry %d sums to %d %s", ErrLedgerImbalance, entryID, total, currency)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	var accountID AccountID
+	var balance, sum int64
+	err = tx.QueryRowContext(ctx, `SELECT a.id, a.balance, COALESCE(p.total, 0) FROM accounts a
+		LEFT JOIN (SELECT account_id, SUM(amount) AS total FROM postings GROUP BY account_id) p ON p.account_id = a.id
+		WHERE a.balance != COALESCE(p.total, 0) LIMIT 1`).Scan(&accountID, &balance, &sum)
+	if err == nil {
+		return fmt.Errorf("%w: account %s has balance %d but postings sum to %d", ErrLedgerImbalance, accountID, balance, sum)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `SELECT account_id FROM postings
+		WHERE account_id NOT IN (SELECT id FROM accounts) AND account_id NOT IN (?, ?, ?, ?, ?) LIMIT 1`,
+		CashInAccount, CashOutAccount, InterestIncomeAccount, ExchangeAccount, EscrowAccount).Scan(&accountID)
+	if err == nil {
+		return fmt.Errorf("%w: postings to unknown account %s", ErrLedgerImbalance, accountID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return nil
+}
+
+func (r *SQLiteRepository) CreateCustomer(ctx context.Context, c Customer) (*Customer, error) {
+	if err := c.normalize(); err != nil {
+		return nil, err
+	}
+	c.ID = newCustomerID()
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	if _, err := r.db.ExecContext(ctx, `INSERT INTO customers (id, name, email, external_reference, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		c.ID, c.Name, c.Email, c.ExternalReference, c.CreatedAt.UnixNano(), c.UpdatedAt.UnixNano()); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *SQLiteRepository) GetCustomer(ctx context.Context, id CustomerID) (*Customer, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, name, email, external_reference, created_at, updated_at FROM customers WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	list, err := scanCustomers(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrCustomerNotFound
+	}
+	return &list[0], nil
+}
+
+func (r *SQLiteRepository) UpdateCustomer(ctx context.Context, c Customer) (*Customer, error) {
+	if err := c.normalize(); err != nil {
+		return nil, err
+	}
+	c.UpdatedAt = time.Now()
+	var created int64
+	err := r.db.QueryRowContext(ctx, `UPDATE customers SET name = ?, email = ?, external_reference = ?, updated_at = ? WHERE id = ? RETURNING created_at`,
+		c.Name, c.Email, c.ExternalReference, c.UpdatedAt.UnixNano(), c.ID).Scan(&created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCustomerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.CreatedAt = time.Unix(0, created)
+	return &c, nil
+}
+
+func (r *SQLiteRepository) DeleteCustomer(ctx context.Context, id CustomerID) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var holds bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM account_holders WHERE customer_id = ?)`, id).Scan(&holds); err != nil {
+		return err
+	}
+	if holds {
+		return ErrCustomerHasAccounts
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM customers WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrCustomerNotFound
+	}
+	return tx.Commit()
+}
+
+// ListCustomers returns the customers matching q in the order they were
+// created.
+func (r *SQLiteRepository) ListCustomers(ctx context.Context, q CustomerQuery) ([]Customer, error) {
+	where, args := []string{"1 = 1"}, []interface{}{}
+	if q.Email != "" {
+		where = append(where, `email = ? COLLATE NOCASE`)
+		args = append(args, q.Email)
+	}
+	if q.ExternalReference != "" {
+		where = append(where, `external_reference = ?`)
+		args = append(args, q.ExternalReference)
+	}
+	rows, err := r.db.QueryContext(ctx, `SELECT id, name, email, external_reference, created_at, updated_at FROM customers
+		WHERE `+strings.Join(where, " AND ")+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanCustomers(rows)
+}
+
+// scanCustomers reads and closes rows of customers.
+func scanCustomers(rows *sql.Rows) ([]Customer, error) {
+	defer rows.Close()
+	list := make([]Customer, 0)
+	for rows.Next() {
+		var c Customer
+		var created, updated int64
+		if err := rows.Scan(&c.ID, &c.Name, &c.Email, &c.ExternalReference, &created, &updated); err != nil {
+			return nil, err
+		}
+		c.CreatedAt, c.UpdatedAt = time.Unix(0, created), time.Unix(0, updated)
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+func (r *SQLiteRepository) SetAccountHolder(ctx context.Context, h AccountHolder) error {
+	if err := h.Role.check(); err != nil {
+		return err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := accountExists(ctx, tx, h.AccountID); err != nil {
+		return err
+	}
+	if err := customerExists(ctx, tx, h.CustomerID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO account_holders (account_id, customer_id, role, since) VALUES (?, ?, ?, ?)
+		ON CONFLICT (account_id, customer_id) DO UPDATE SET role = excluded.role`,
+		h.AccountID, h.CustomerID, h.Role, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	if err := checkOwned(ctx, tx, h.AccountID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteRepository) RemoveAccountHolder(ctx context.Context, account AccountID, customer CustomerID) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `DELETE FROM account_holders WHERE account_id = ? AND customer_id = ?`, account, customer)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrHolderNotFound
+	}
+	if err := checkOwned(ctx, tx, account); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLiteRepository) GetAccountHolders(ctx context.Context, id AccountID) ([]AccountHolder, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := accountExists(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT account_id, customer_id, role, since FROM account_holders WHERE account_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanHolders(rows)
+}
+
+func (r *SQLiteRepository) ListCustomerAccounts(ctx context.Context, id CustomerID) ([]AccountHolder, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := customerExists(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT account_id, customer_id, role, since FROM account_holders WHERE customer_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanHolders(rows)
+}
+
+// scanHolders reads and closes rows of account holders.
+func scanHolders(rows *sql.Rows) ([]AccountHolder, error) {
+	defer rows.Close()
+	list := make([]AccountHolder, 0)
+	for rows.Next() {
+		var h AccountHolder
+		var since int64
+		if err := rows.Scan(&h.AccountID, &h.CustomerID, &h.Role, &since); err != nil {
+			return nil, err
+		}
+		h.Since = time.Unix(0, since)
+		list = append(list, h)
+	}
+	return list, rows.Err()
+}
+
+// checkOwned returns ErrNoOwner unless account still has an owner after a
+// change of its holders in tx.
+func checkOwned(ctx context.Context, tx *sql.Tx, account AccountID) error {
+	var owned bool
+	err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM account_holders WHERE account_id = ? AND role = ?)`, account, HolderOwner).Scan(&owned)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return ErrNoOwner
+	}
+	return nil
+}
+
+// SetAccountStatus moves account id to status and returns the status it had.
+func (r *SQLiteRepository) SetAccountStatus(ctx context.Context, id AccountID, status AccountStatus) (AccountStatus, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var previous AccountStatus
+	var balance, held, owed int64
+	err = tx.QueryRowContext(ctx, `SELECT status, balance, held, interest_owed FROM accounts WHERE id = ?`, id).Scan(&previous, &balance, &held, &owed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrAccountNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := previous.transition(status, balance, held, owed); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET status = ? WHERE id = ?`, status, id); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+func (r *SQLiteRepository) SetExchangeRate(ctx context.Context, rate ExchangeRate) (*ExchangeRate, error) {
+	if err := rate.check(); err != nil {
+		return nil, err
+	}
+	rate.UpdatedAt = time.Now()
+	if _, err := r.db.ExecContext(ctx, `INSERT INTO exchange_rates (from_currency, to_currency, rate, spread, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (from_currency, to_currency) DO UPDATE SET rate = excluded.rate, spread = excluded.spread, updated_at = excluded.updated_at`,
+		rate.From, rate.To, rate.Rate, rate.Spread, rate.UpdatedAt.UnixNano()); err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
+func (r *SQLiteRepository) ListExchangeRates(ctx context.Context) ([]ExchangeRate, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT from_currency, to_currency, rate, spread, updated_at FROM exchange_rates ORDER BY from_currency, to_currency`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]ExchangeRate, 0)
+	for rows.Next() {
+		var rate ExchangeRate
+		var updated int64
+		if err := rows.Scan(&rate.From, &rate.To, &rate.Rate, &rate.Spread, &updated); err != nil {
+			return nil, err
+		}
+		rate.UpdatedAt = time.Unix(0, updated)
+		list = append(list, rate)
+	}
+	return list, rows.Err()
+}
+
+// SetOverdraft changes the overdraft of account c.AccountID. c.When is set
+// to now.
+func (r *SQLiteRepository) SetOverdraft(ctx context.Context, c OverdraftChange) (*OverdraftChange, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.When = time.Now()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	status, err := accountStatus(ctx, tx, c.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	if status == StatusClosed {
+		return nil, ErrAccountClosed
+	}
+	// interest so far accrues at the old rate
+	if _, err := accrue(ctx, tx, c.AccountID, c.When); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET overdraft_limit = ?, interest_rate = ?, interest_accrued_at = ? WHERE id = ?`,
+		c.Limit, c.InterestRate, c.When.UnixNano(), c.AccountID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO overdraft_changes (account_id, overdraft_limit, interest_rate, changed_by, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, c.AccountID, c.Limit, c.InterestRate, c.ChangedBy, c.Reason, c.When.UnixNano()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetOverdraftHistory returns the overdraft changes of account id, oldest
+// first.
+func (r *SQLiteRepository) GetOverdraftHistory(ctx context.Context, id AccountID) ([]OverdraftChange, error) {
+	var exists int
+	err := r.db.QueryRowContext(ctx, `SELECT 1 FROM accounts WHERE id = ?`, id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, `SELECT account_id, overdraft_limit, interest_rate, changed_by, reason, created_at
+		FROM overdraft_changes WHERE account_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := make([]OverdraftChange, 0)
+	for rows.Next() {
+		var c OverdraftChange
+		var when int64
+		if err := rows.Scan(&c.AccountID, &c.Limit, &c.InterestRate, &c.ChangedBy, &c.Reason, &when); err != nil {
+			return nil, err
+		}
+		c.When = time.Unix(0, when)
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// ChargeInterest charges the interest accrued until asOf of every account
+// that is not closed, each in its own transaction.
+func (r *SQLiteRepository) ChargeInterest(ctx context.Context, asOf time.Time) (int, error) {
+	ids, err := r.interestAccounts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	charged := 0
+	var errs []error
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		ok, err := r.chargeInterest(ctx, id, asOf)
+		// one account that cannot be charged does not hold up the others
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", id, err))
+			continue
+		}
+		if ok {
+			charged++
+		}
+	}
+	return charged, errors.Join(errs...)
+}
+
+// interestAccounts returns the accounts that are not closed and owe or accrue
+// interest.
+func (r *SQLiteRepository) interestAccounts(ctx context.Context) ([]AccountID, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM accounts
+		WHERE status != ? AND (interest_owed > 0 OR (balance < 0 AND interest_rate > 0)) ORDER BY id`, StatusClosed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]AccountID, 0)
+	for rows.Next() {
+		var id AccountID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// chargeInterest charges account id the interest accrued until asOf and
+// reports whether there was a whole minor unit to charge.
+func (r *SQLiteRepository) chargeInterest(ctx context.Context, id AccountID, asOf time.Time) (bool, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	owed, err := accrue(ctx, tx, id, asOf)
+	if err != nil || owed == 0 {
+		return false, err
+	}
+	tl := &TransactionLog{Type: TransactionInterest, From: id, To: InterestIncomeAccount, Amount: owed, Memo: "overdraft interest"}
+	// sqlite turns integers that overflow into floats, so the difference is checked first
+	err = tx.QueryRowContext(ctx, `UPDATE accounts SET balance = balance - ?, interest_owed = 0 WHERE id = ? AND balance >= ? RETURNING balance, currency`,
+		owed, id, math.MinInt64+owed).Scan(&tl.FromBalance, &tl.Currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("%w: balance of account %s", ErrAmountOverflow, id)
+	}
+	if err != nil {
+		return false, err
+	}
+	if tl.ID, tl.When, err = postEntry(ctx, tx, JournalEntry{Type: TransactionInterest, Postings: interestPostings(id, tl.Currency, owed)}); err != nil {
+		return false, err
+	}
+	if err := enqueueLog(ctx, tx, tl); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (r *SQLiteRepository) PlaceHold(ctx context.Context, account AccountID, to AccountID, amount Money, expiresAt time.Time, meta TransactionMeta) (*Hold, error) {
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	if account == to {
+		return nil, ErrSameAccount
+	}
+	now := time.Now()
+	expiresAt, err := holdExpiry(now, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := accountExists(ctx, tx, account); err != nil {
+		return nil, err
+	}
+	toStatus, err := accountStatus(ctx, tx, to)
+	if err != nil {
+		return nil, err
+	}
+	status, err := accountStatus(ctx, tx, account)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.canDebit(); err != nil {
+		return nil, err
+	}
+	if err := toStatus.canCredit(); err != nil {
+		return nil, err
+	}
+	h := &Hold{AccountID: account, To: to, Amount: amount.Amount, Status: HoldActive, Memo: meta.Memo, Reference: meta.Reference, PlacedAt: now, ExpiresAt: expiresAt}
+	if h.Currency, err = accountCurrency(ctx, tx, account); err != nil {
+		return nil, err
+	}
+	if err := amount.in(h.Currency); err != nil {
+		return nil, err
+	}
+	toCurrency, err := accountCurrency(ctx, tx, to)
+	if err != nil {
+		return nil, err
+	}
+	if toCurrency != h.Currency {
+		return nil, fmt.Errorf("%w: payee in %s, account in %s", ErrCurrencyMismatch, toCurrency, h.Currency)
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE accounts SET held = held + ? WHERE id = ? AND balance - held - ? >= -overdraft_limit`, h.Amount, account, h.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrInsufficientFunds
+	}
+	err = tx.QueryRowContext(ctx, `INSERT INTO holds (account_id, to_account, amount, currency, status, memo, reference, placed_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		h.AccountID, h.To, h.Amount, h.Currency, h.Status, h.Memo, h.Reference, h.PlacedAt.UnixNano(), h.ExpiresAt.UnixNano()).Scan(&h.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (r *SQLiteRepository) CaptureHold(ctx context.Context, id int64, money Money) (*Hold, error) {
+	if money.Amount != 0 {
+		if err := money.check(); err != nil {
+			return nil, err
+		}
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	h, err := holdByID(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	amount, err := h.captureAmount(money, now)
+	if err != nil {
+		return nil, err
+	}
+	// the held funds are spent, not held on top of the capture
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET held = held - ? WHERE id = ?`, h.Amount, h.AccountID); err != nil {
+		return nil, err
+	}
+	tl := &TransactionLog{Type: TransactionCapture, From: h.AccountID, To: h.To, Amount: amount, Currency: h.Currency, Memo: h.Memo, Reference: h.Reference}
+	if tl.FromBalance, err = debit(ctx, tx, h.AccountID, amount); err != nil {
+		return nil, err
+	}
+	if tl.ToBalance, err = credit(ctx, tx, h.To, amount); err != nil {
+		return nil, err
+	}
+	if tl.ID, tl.When, err = postEntry(ctx, tx, JournalEntry{Type: TransactionCapture, Postings: transferPostings(h.AccountID, h.To, h.Currency, amount)}); err != nil {
+		return nil, err
+	}
+	if err := enqueueLog(ctx, tx, tl); err != nil {
+		return nil, err
+	}
+	h.Status, h.Captured, h.ClosedAt, h.TransactionID = HoldCaptured, amount, now, tl.ID
+	if _, err := tx.ExecContext(ctx, `UPDATE holds SET status = ?, captured = ?, closed_at = ?, transaction_id = ? WHERE id = ?`,
+		h.Status, h.Captured, h.ClosedAt.UnixNano(), h.TransactionID, h.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (r *SQLiteRepository) ReleaseHold(ctx context.Context, id int64) (*Hold, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	h, err := holdByID(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := releaseHold(ctx, tx, h, HoldReleased, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (r *SQLiteRepository) ExpireHolds(ctx context.Context, asOf time.Time) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE status = ? AND expires_at <= ? ORDER BY id`, HoldActive, asOf.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	expired, err := scanHolds(rows)
+	if err != nil {
+		return 0, err
+	}
+	for i := range expired {
+		if err := releaseHold(ctx, tx, &expired[i], HoldExpired, asOf); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+func (r *SQLiteRepository) GetHold(ctx context.Context, id int64) (*Hold, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return holdByID(ctx, tx, id)
+}
+
+func (r *SQLiteRepository) ListHolds(ctx context.Context, id AccountID) ([]Hold, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := accountExists(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE account_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanHolds(rows)
+}
+
+// releaseHold gives the funds of an active hold back to its account and
+// closes it with status.
+func releaseHold(ctx context.Context, tx *sql.Tx, h *Hold, status HoldStatus, when time.Time) error {
+	if h.Status != HoldActive {
+		return fmt.Errorf("%w: it is %s", ErrHoldNotActive, h.Status)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET held = held - ? WHERE id = ?`, h.Amount, h.AccountID); err != nil {
+		return err
+	}
+	h.Status, h.ClosedAt = status, when
+	_, err := tx.ExecContext(ctx, `UPDATE holds SET status = ?, closed_at = ? WHERE id = ?`, h.Status, h.ClosedAt.UnixNano(), h.ID)
+	return err
+}
+
+const holdColumns = `id, account_id, to_account, amount, currency, captured, status, memo, reference, placed_at, expires_at, closed_at, transaction_id`
+
+func holdByID(ctx context.Context, tx *sql.Tx, id int64) (*Hold, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	holds, err := scanHolds(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(holds) == 0 {
+		return nil, ErrHoldNotFound
+	}
+	return &holds[0], nil
+}
+
+func scanHolds(rows *sql.Rows) ([]Hold, error) {
+	defer rows.Close()
+	holds := make([]Hold, 0)
+	for rows.Next() {
+		var h Hold
+		var placedAt, expiresAt, closedAt int64
+		if err := rows.Scan(&h.ID, &h.AccountID, &h.To, &h.Amount, &h.Currency, &h.Captured, &h.Status, &h.Memo, &h.Reference,
+			&placedAt, &expiresAt, &closedAt, &h.TransactionID); err != nil {
+			return nil, err
+		}
+		h.PlacedAt, h.ExpiresAt = time.Unix(0, placedAt), time.Unix(0, expiresAt)
+		if closedAt != 0 {
+			h.ClosedAt = time.Unix(0, closedAt)
+		}
+		holds = append(holds, h)
+	}
+	return holds, rows.Err()
+}
+
+func (r *SQLiteRepository) OpenEscrow(ctx context.Context, order string, buyer, merchant AccountID, amount Money, releaseAt time.Time, memo string) (*Escrow, error) {
+	if err := checkOrderID(order); err != nil {
+		return nil, err
+	}
+	if err := amount.check(); err != nil {
+		return nil, err
+	}
+	if buyer == merchant {
+		return nil, ErrSameAccount
+	}
+	now := time.Now()
+	releaseAt, err := escrowRelease(now, releaseAt)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM escrows WHERE order_id = ?)`, order).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%w: %s", ErrEscrowExists, order)
+	}
+	// check the merchant first so a missing account is not reported as insufficient funds
+	merchantStatus, err := accountStatus(ctx, tx, merchant)
+	if err != nil {
+		return nil, err
+	}
+	tl := &TransactionLog{Type: TransactionEscrow, From: buyer, To: EscrowAccount, Amount: amount.Amount, Memo: memo, Reference: order}
+	if tl.FromBalance, err = debit(ctx, tx, buyer, amount.Amount); err != nil {
+		return nil, err
+	}
+	if err := merchantStatus.canCredit(); err != nil {
+		return nil, err
+	}
+	if tl.Currency, err = accountCurrency(ctx, tx, buyer); err != nil {
+		return nil, err
+	}
+	if err := amount.in(tl.Currency); err != nil {
+		return nil, err
+	}
+	merchantCurrency, err := accountCurrency(ctx, tx, merchant)
+	if err != nil {
+		return nil, err
+	}
+	if merchantCurrency != tl.Currency {
+		return nil, fmt.Errorf("%w: merchant in %s, buyer in %s", ErrCurrencyMismatch, merchantCurrency, tl.Currency)
+	}
+	if tl.ID, tl.When, err = postEntry(ctx, tx, JournalEntry{Type: TransactionEscrow, Postings: transferPostings(buyer, EscrowAccount, tl.Currency, amount.Amount)}); err != nil {
+		return nil, err
+	}
+	if err := enqueueLog(ctx, tx, tl); err != nil {
+		return nil, err
+	}
+	e := &Escrow{
+		OrderID:       order,
+		Buyer:         buyer,
+		Merchant:      merchant,
+		Amount:        amount.Amount,
+		Currency:      tl.Currency,
+		Status:        EscrowHeld,
+		Memo:          memo,
+		OpenedAt:      now,
+		ReleaseAt:     releaseAt,
+		TransactionID: tl.ID,
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO escrows (order_id, buyer, merchant, amount, currency, status, memo, opened_at, release_at, transaction_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.OrderID, e.Buyer, e.Merchant, e.Amount, e.Currency, e.Status, e.Memo, e.OpenedAt.UnixNano(), e.ReleaseAt.UnixNano(), e.TransactionID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (r *SQLiteRepository) ReleaseEscrow(ctx context.Context, order string) (*Escrow, error) {
+	return r.settleEscrow(ctx, order, opReleaseEscrow, time.Now())
+}
+
+func (r *SQLiteRepository) RefundEscrow(ctx context.Context, order string) (*Escrow, error) {
+	return r.settleEscrow(ctx, order, opRefundEscrow, time.Now())
+}
+
+func (r *SQLiteRepository) settleEscrow(ctx context.Context, order string, op string, when time.Time) (*Escrow, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	e, err := escrowByOrder(ctx, tx, order)
+	if err != nil {
+		return nil, err
+	}
+	if err := settleEscrow(ctx, tx, e, op, when); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ReleaseDueEscrows releases each due escrow in its own transaction, so one
+// that fails is rolled back alone and the others are still released.
+func (r *SQLiteRepository) ReleaseDueEscrows(ctx context.Context, asOf time.Time) (int, error) {
+	due, err := r.dueEscrows(ctx, asOf)
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	var errs []error
+	for _, e := range due {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		_, err := r.settleEscrow(ctx, e.OrderID, opAutoReleaseEscrow, asOf)
+		// settled since it was listed, or waiting for a refund
+		if errors.Is(err, ErrEscrowSettled) || errors.Is(err, ErrAccountClosed) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("escrow %s: %w", e.OrderID, err))
+			continue
+		}
+		released++
+	}
+	return released, errors.Join(errs...)
+}
+
+func (r *SQLiteRepository) dueEscrows(ctx context.Context, asOf time.Time) ([]Escrow, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT `+escrowColumns+` FROM escrows WHERE status = ? AND release_at <= ? ORDER BY opened_at, order_id`,
+		EscrowHeld, asOf.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return scanEscrows(rows)
+}
+
+func (r *SQLiteRepository) GetEscrow(ctx context.Context, order string) (*Escrow, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return escrowByOrder(ctx, tx, order)
+}
+
+func (r *SQLiteRepository) ListEscrows(ctx context.Context, id AccountID) ([]Escrow, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := accountExists(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT `+escrowColumns+` FROM escrows WHERE buyer = ? OR merchant = ? ORDER BY opened_at, order_id`, id, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanEscrows(rows)
+}
+
+// settleEscrow pays a held escrow out of EscrowAccount as a settle record of
+// op at when would, and closes it.
+func settleEscrow(ctx context.Context, tx *sql.Tx, e *Escrow, op string, when time.Time) error {
+	typ, status, to, memo, err := e.settlement(op, when)
+	if err != nil {
+		return err
+	}
+	tl := &TransactionLog{Type: typ, From: EscrowAccount, To: to, Amount: e.Amount, Currency: e.Currency, Memo: memo, Reference: e.OrderID}
+	if tl.ToBalance, err = credit(ctx, tx, to, e.Amount); err != nil {
+		return err
+	}
+	if tl.ID, tl.When, err = postEntry(ctx, tx, JournalEntry{Type: typ, Postings: transferPostings(EscrowAccount, to, e.Currency, e.Amount)}); err != nil {
+		return err
+	}
+	if err := enqueueLog(ctx, tx, tl); err != nil {
+		return err
+	}
+	e.Status, e.ClosedAt, e.SettlementID = status, when, tl.ID
+	_, err = tx.ExecContext(ctx, `UPDATE escrows SET status = ?, closed_at = ?, settlement_id = ? WHERE order_id = ?`,
+		e.Status, e.ClosedAt.UnixNano(), e.SettlementID, e.OrderID)
+	return err
+}
+
+const escrowColumns = `order_id, buyer, merchant, amount, currency, status, memo, opened_at, release_at, closed_at, transaction_id, settlement_id`
+
+func escrowByOrder(ctx context.Context, tx *sql.Tx, order string) (*Escrow, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT `+escrowColumns+` FROM escrows WHERE order_id = ?`, order)
+	if err != nil {
+		return nil, err
+	}
+	escrows, err := scanEscrows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(escrows) == 0 {
+		return nil, ErrEscrowNotFound
+	}
+	return &escrows[0], nil
+}
+
+func scanEscrows(rows *sql.Rows) ([]Escrow, error) {
+	defer rows.Close()
+	escrows := make([]Escrow, 0)
+	for rows.Next() {
+		var e Escrow
+		var openedAt, releaseAt, closedAt int64
+		if err := rows.Scan(&e.OrderID, &e.Buyer, &e.Merchant, &e.Amount, &e.Currency, &e.Status, &e.Memo,
+			&openedAt, &releaseAt, &closedAt, &e.TransactionID, &e.SettlementID); err != nil {
+			return nil, err
+		}
+		e.OpenedAt, e.ReleaseAt = time.Unix(0, openedAt), time.Unix(0, releaseAt)
+		if closedAt != 0 {
+			e.ClosedAt = time.Unix(0, closedAt)
+		}
+		escrows = append(escrows, e)
+	}
+	return escrows, rows.Err()
+}
+
+func (r *SQLiteRepository) SetFeeSchedule(ctx context.Context, s FeeSchedule) (*FeeSchedule, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	s.Rules = append([]FeeRule(nil), s.Rules...)
+	s.UpdatedAt = time.Now()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	currency, err := accountCurrency(ctx, tx, s.Merchant)
+	if err != nil {
+		return nil, err
+	}
+	accounts := []AccountID{s.Merchant}
+	for _, f := range s.Rules {
+		accounts = append(accounts, f.To)
+	}
+	for _, id := range accounts {
+		status, err := accountStatus(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if status == StatusClosed {
+			return nil, ErrAccountClosed
+		}
+		feeCurrency, err := accountCurrency(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if feeCurrency != currency {
+			return nil, fmt.Errorf("%w: fee account %s in %s, merchant in %s", ErrCurrencyMismatch, id, feeCurrency, currency)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM fee_rules WHERE merchant = ?`, s.Merchant); err != nil {
+		return nil, err
+	}
+	for i, f := range s.Rules {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO fee_rules (merchant, position, name, to_account, rate, fixed, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			s.Merchant, i, f.Name, f.To, f.Rate, f.Fixed, s.UpdatedAt.UnixNano()); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *SQLiteRepository) GetFeeSchedule(ctx context.Context, id AccountID) (*FeeSchedule, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := accountExists(ctx, tx, id); err != nil {
+		return nil, err
+	}
+	return feeSchedule(ctx, tx, id)
+}
+
+func (r *SQLiteRepository) SplitTransfer(ctx context.Context, from AccountID, legs []Leg, meta TransactionMeta) ([]TransactionLog, error) {
+	total, err := checkLegs(from, legs)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// check the receivers first so a missing account is not reported as insufficient funds
+	rules := make(map[AccountID][]FeeRule, len(legs))
+	for _, leg := range legs {
+		if _, ok := rules[leg.To]; ok {
+			continue
+		}
+		if err := accountExists(ctx, tx, leg.To); err != nil {
+			return nil, err
+		}
+		s, err := feeSchedule(ctx, tx, leg.To)
+		if err != nil {
+			return nil, err
+		}
+		rules[leg.To] = s.Rules
+	}
+	payouts, err := payouts(legs, func(id AccountID) []FeeRule { return rules[id] })
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range payouts {
+		// a fee may not go back to the payer
+		if p.To == from {
+			return nil, ErrSameAccount
+		}
+	}
+	currency, err := accountCurrency(ctx, tx, from)
+	if err != nil {
+		return nil, err
+	}
+	for _, leg := range legs {
+		if err := leg.Amount.in(currency); err != nil {
+			return nil, err
+		}
+	}
+	before := make(map[AccountID]int64, len(payouts)+1)
+	balance, err := debit(ctx, tx, from, total)
+	if err != nil {
+		return nil, err
+	}
+	before[from] = balance + total
+	for _, p := range payouts {
+		toCurrency, err := accountCurrency(ctx, tx, p.To)
+		if err != nil {
+			return nil, err
+		}
+		if toCurrency != currency {
+			return nil, fmt.Errorf("%w: %s in %s, payer in %s", ErrCurrencyMismatch, p.To, toCurrency, currency)
+		}
+		balance, err := credit(ctx, tx, p.To, p.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := before[p.To]; !ok {
+			before[p.To] = balance - p.Amount
+		}
+	}
+	id, when, err := postEntry(ctx, tx, JournalEntry{Type: TransactionSplit, Postings: splitPostings(from, currency, total, payouts)})
+	if err != nil {
+		return nil, err
+	}
+	log := splitLog(id, from, currency, payouts, before)
+	for i := range log {
+		tl := &log[i]
+		tl.Reference, tl.When = meta.Reference, when
+		if tl.Type != TransactionFee {
+			tl.Memo = meta.Memo
+		}
+		if err := enqueueLog(ctx, tx, tl); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// feeSchedule returns the fee rules of merchant id read in tx, none if it has
+// none.
+func feeSchedule(ctx context.Context, tx *sql.Tx, id AccountID) (*FeeSchedule, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT name, to_account, rate, fixed, updated_at FROM fee_rules WHERE merchant = ? ORDER BY position`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	s := &FeeSchedule{Merchant: id, Rules: make([]FeeRule, 0)}
+	for rows.Next() {
+		var f FeeRule
+		var updated int64
+		if err := rows.Scan(&f.Name, &f.To, &f.Rate, &f.Fixed, &updated); err != nil {
+			return nil, err
+		}
+		s.Rules = append(s.Rules, f)
+		s.UpdatedAt = time.Unix(0, updated)
+	}
+	return s, rows.Err()
+}
+
+// accrue brings the overdraft interest of account id up to now in tx, before
+// its balance changes, and returns the whole minor units it owes.
+func accrue(ctx context.Context, tx *sql.Tx, id AccountID, now time.Time) (int64, error) {
+	var i interest
+	var balance, accruedAt int64
+	var rate int
+	err := tx.QueryRowContext(ctx, `SELECT balance, interest_rate, interest_accrued_at, interest_owed, interest_remainder FROM accounts WHERE id = ?`,
+		id).Scan(&balance, &rate, &accruedAt, &i.Owed, &i.Remainder)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrAccountNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	i.AccruedAt = time.Unix(0, accruedAt)
+	i.accrue(balance, rate, now)
+	if i.AccruedAt.UnixNano() == accruedAt {
+		return i.Owed, nil
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET interest_accrued_at = ?, interest_owed = ?, interest_remainder = ? WHERE id = ?`,
+		i.AccruedAt.UnixNano(), i.Owed, i.Remainder, id)
+	return i.Owed, err
+}
+
+// postEntry records a balanced journal entry in tx and returns its id and time.
+// The id and time of entry are ignored.
+func postEntry(ctx context.Context, tx *sql.Tx, entry JournalEntry) (int64, time.Time, error) {
+	when := time.Now()
+	res, err := tx.ExecContext(ctx, `INSERT INTO journal_entries (type, reverses, created_at) VALUES (?, ?, ?)`, entry.Type, entry.Reverses, when.UnixNano())
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	entryID, err := res.LastInsertId()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	for _, p := range entry.Postings {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO postings (entry_id, account_id, amount, currency) VALUES (?, ?, ?, ?)`,
+			entryID, p.Account, p.Amount, p.Currency.orDefault()); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+	return entryID, when, nil
+}
+
+// enqueueLog adds the log entry of a money movement to the outbox in tx, so it
+// is committed together with the movement.
+func enqueueLog(ctx context.Context, tx *sql.Tx, tl *TransactionLog) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO transaction_outbox (`+logColumns+`) VALUES (`+logPlaceholders+`)`, logArgs(tl)...)
+	return err
+}
+
+// debit takes amount from the account only if it is active and the available
+// balance covers it within the overdraft, and returns the new balance.
+func debit(ctx context.Context, tx *sql.Tx, id AccountID, amount int64) (int64, error) {
+	if _, err := accrue(ctx, tx, id, time.Now()); err != nil {
+		return 0, err
+	}
+	var balance int64
+	// sqlite turns integers that overflow into floats, so the balance is bounded first
+	err := tx.QueryRowContext(ctx, `UPDATE accounts SET balance = balance - ? WHERE id = ? AND status = ? AND balance >= ? AND balance - held - ? >= -overdraft_limit RETURNING balance`,
+		amount, id, StatusActive, math.MinInt64+amount, amount).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		status, err := accountStatus(ctx, tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if err := status.canDebit(); err != nil {
+			return 0, err
+		}
+		return 0, ErrInsufficientFunds
+	}
+	return balance, err
+}
+
+// credit adds amount to the account unless it is closed or the balance would
+// overflow, and returns the new balance.
+func credit(ctx context.Context, tx *sql.Tx, id AccountID, amount int64) (int64, error) {
+	if _, err := accrue(ctx, tx, id, time.Now()); err != nil {
+		return 0, err
+	}
+	var balance int64
+	// sqlite turns integers that overflow into floats, so the sum is checked first
+	err := tx.QueryRowContext(ctx, `UPDATE accounts SET balance = balance + ? WHERE id = ? AND status != ? AND balance <= ? RETURNING balance`,
+		amount, id, StatusClosed, math.MaxInt64-amount).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		status, err := accountStatus(ctx, tx, id)
+		if err != nil {
+			return 0, err
+		}
+		if err := status.canCredit(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w: balance of account %s", ErrAmountOverflow, id)
+	}
+	return balance, err
+}
+
+func accountStatus(ctx context.Context, tx *sql.Tx, id AccountID) (AccountStatus, error) {
+	var status AccountStatus
+	err := tx.QueryRowContext(ctx, `SELECT status FROM accounts WHERE id = ?`, id).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrAccountNotFound
+	}
+	return status, err
+}
+
+func accountCurrency(ctx context.Context, tx *sql.Tx, id AccountID) (Currency, error) {
+	var currency Currency
+	err := tx.QueryRowContext(ctx, `SELECT currency FROM accounts WHERE id = ?`, id).Scan(&currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrAccountNotFound
+	}
+	return currency, err
+}
+
+// exchangeRate returns the rate from one currency to another read in tx.
+func exchangeRate(ctx context.Context, tx *sql.Tx, from, to Currency) (*ExchangeRate, error) {
+	rate := &ExchangeRate{From: from, To: to}
+	var updated int64
+	err := tx.QueryRowContext(ctx, `SELECT rate, spread, updated_at FROM exchange_rates WHERE from_currency = ? AND to_currency = ?`,
+		from, to).Scan(&rate.Rate, &rate.Spread, &updated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrNoExchangeRate, from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rate.UpdatedAt = time.Unix(0, updated)
+	return rate, nil
+}
+
+func accountExists(ctx context.Context, tx *sql.Tx, id AccountID) error {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM accounts WHERE id = ?)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrAccountNotFound
+	}
+	return nil
+}
+
+func customerExists(ctx context.Context, tx *sql.Tx, id CustomerID) error {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM customers WHERE id = ?)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrCustomerNotFound
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSQLiteRepositoryReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "bank.db")
+
+	repo, err := NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	accID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{})
+	repo.Close()
+
+	// migrations already applied must not run again
+	repo, err = NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	acc, err := repo.GetAccount(ctx, accID)
+	if err != nil || acc.Balance != 100 {
+		t.Errorf("GetAccount() after reopen got = %v, %v, want balance %v", acc, err, 100)
+	}
+}
+
+func TestSQLiteRepositoryErrors(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "bank.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	defer repo.Close()
+
+	accID, _ := repo.CreateAccount(ctx)
+	if _, err := repo.DepositAccount(ctx, "999", Money{Amount: 100}, TransactionMeta{}); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("DepositAccount() unknown account error = %v, want %v", err, ErrAccountNotFound)
+	}
+	if _, err := repo.WithdrawAccount(ctx, "999", Money{Amount: 100}, TransactionMeta{}); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("WithdrawAccount() unknown account error = %v, want %v", err, ErrAccountNotFound)
+	}
+	if _, err := repo.WithdrawAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("WithdrawAccount() error = %v, want %v", err, ErrInsufficientFunds)
+	}
+	if _, err := repo.TransferAccount(ctx, accID, "999", Money{Amount: 1}, TransactionMeta{}); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("TransferAccount() unknown receiver error = %v, want %v", err, ErrAccountNotFound)
+	}
+	if _, err := repo.TransferAccount(ctx, accID, accID, Money{Amount: 1}, TransactionMeta{}); !errors.Is(err, ErrSameAccount) {
+		t.Errorf("TransferAccount() same account error = %v, want %v", err, ErrSameAccount)
+	}
+}
+
+func TestSQLiteRepositoryConcurrentTransfers(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "bank.db"))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	defer repo.Close()
+
+	a, _ := repo.CreateAccount(ctx)
+	b, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, a, Money{Amount: 100}, TransactionMeta{})
+	_, _ = repo.DepositAccount(ctx, b, Money{Amount: 100}, TransactionMeta{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _ = repo.TransferAccount(ctx, a, b, Money{Amount: 7}, TransactionMeta{})
+		}()
+		go func() {
+			defer wg.Done()
+			_, _ = repo.TransferAccount(ctx, b, a, Money{Amount: 5}, TransactionMeta{})
+		}()
+	}
+	wg.Wait()
+
+	accA, _ := repo.GetAccount(ctx, a)
+	accB, _ := repo.GetAccount(ctx, b)
+	if accA.Balance < 0 || accB.Balance < 0 || accA.Balance+accB.Balance != 200 {
+		t.Errorf("concurrent transfers got balances %v and %v, want non-negative summing to %v", accA.Balance, accB.Balance, 200)
+	}
+}
+
+func TestSQLiteRepositoryMigratesNumericIDs(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "bank.db")
+
+	// a database from before account ids were text
+	all := migrations
+	migrations = all[:4]
+	repo, err := NewSQLiteRepository(path)
+	migrations = all
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	for _, stmt := range []string{
+		`INSERT INTO accounts (id, balance) VALUES (1, 70), (2, 30)`,
+		`INSERT INTO journal_entries (id, type, created_at) VALUES (1, 'deposit', 0), (2, 'transfer', 0)`,
+		`INSERT INTO postings (entry_id, account_id, amount) VALUES (1, -1, -100), (1, 1, 100), (2, 1, -30), (2, 2, 30)`,
+		`INSERT INTO transactions (id, type, from_account, to_account, amount, created_at) VALUES (2, 'transfer', 1, 2, 30, 0)`,
+	} {
+		if _, err := repo.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("ExecContext() error = %v", err)
+		}
+	}
+	repo.Close()
+
+	repo, err = NewSQLiteRepository(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() migrate error = %v", err)
+	}
+	defer repo.Close()
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() after migration error = %v", err)
+	}
+	if trans, _ := repo.GetTransactions(ctx); len(trans) != 1 || trans[0].From != "1" || trans[0].To != "2" {
+		t.Errorf("GetTransactions() after migration got = %+v", trans)
+	}
+	if _, err := repo.ReverseTransaction(ctx, 2, Money{Amount: 10}, TransactionMeta{}); err != nil {
+		t.Errorf("ReverseTransaction() after migration error = %v", err)
+	}
+	// sequential ids continue after the migrated ones
+	if id, _ := repo.CreateAccount(ctx); id != "3" {
+		t.Errorf("CreateAccount() after migration got = %v, want %v", id, "3")
+	}
+}
+
+func TestSQLiteRepositoryUUIDs(t *testing.T) {
+	ctx := context.Background()
+	repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "bank.db"), WithIDGenerator(NewUUIDv7IDs()))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository() error = %v", err)
+	}
+	defer repo.Close()
+
+	a, _ := repo.CreateAccount(ctx)
+	b, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, a, Money{Amount: 100}, TransactionMeta{})
+	if _, err := repo.TransferAccount(ctx, a, b, Money{Amount: 40}, TransactionMeta{}); err != nil {
+		t.Fatalf("TransferAccount() error = %v", err)
+	}
+	if acc, err := repo.GetAccount(ctx, b); err != nil || acc.ID != b || acc.Balance != 40 {
+		t.Errorf("GetAccount() got = %v, %v, want balance %v", acc, err, 40)
+	}
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() error = %v", err)
+	}
+}
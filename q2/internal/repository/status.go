@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrAccountFrozen   = errors.New("account is frozen")
+	ErrAccountClosed   = errors.New("account is closed")
+	ErrInvalidStatus   = errors.New("invalid account status")
+	ErrStatusUnchanged = errors.New("account already has this status")
+	ErrBalanceNotZero  = errors.New("account balance must be zero to close it")
+	ErrFundsHeld       = errors.New("account must have no held funds to close it")
+	ErrInterestOwed    = errors.New("account must owe no interest to close it")
+)
+
+// AccountStatus is the lifecycle state of an account. Frozen accounts take
+// credits but no debits; closed accounts take neither and never reopen.
+type AccountStatus string
+
+const (
+	StatusActive AccountStatus = "active"
+	StatusFrozen AccountStatus = "frozen"
+	StatusClosed AccountStatus = "closed"
+)
+
+func (s AccountStatus) check() error {
+	if s != StatusActive && s != StatusFrozen && s != StatusClosed {
+		return fmt.Errorf("%w %q, want %s, %s or %s", ErrInvalidStatus, s, StatusActive, StatusFrozen, StatusClosed)
+	}
+	return nil
+}
+
+// transition checks the move of an account with balance, held funds and
+// interest owed from s to next. Closing it would forgive the interest, which
+// is no longer charged, and strand the held funds.
+func (s AccountStatus) transition(next AccountStatus, balance, held, owed int64) error {
+	if err := next.check(); err != nil {
+		return err
+	}
+	switch {
+	case s == StatusClosed:
+		return ErrAccountClosed
+	case s == next:
+		return ErrStatusUnchanged
+	case next == StatusClosed && balance != 0:
+		return ErrBalanceNotZero
+	case next == StatusClosed && held != 0:
+		return ErrFundsHeld
+	case next == StatusClosed && owed != 0:
+		return ErrInterestOwed
+	}
+	return nil
+}
+
+// canCredit returns why an account in status s cannot receive money, if it
+// cannot.
+func (s AccountStatus) canCredit() error {
+	if s == StatusClosed {
+		return ErrAccountClosed
+	}
+	return nil
+}
+
+// canDebit returns why money cannot leave an account in status s, if it
+// cannot.
+func (s AccountStatus) canDebit() error {
+	switch s {
+	case StatusClosed:
+		return ErrAccountClosed
+	case StatusFrozen:
+		return ErrAccountFrozen
+	}
+	return nil
+}
+
+// SetAccountStatus moves account id to status and returns the status it had.
+func (r *Repository) SetAccountStatus(ctx context.Context, id AccountID, status AccountStatus) (AccountStatus, error) {
+	return r.setStatus(walRecord{Op: opSetAccountStatus, Account: id, Status: status})
+}
+
+func (r *Repository) setStatus(rec walRecord) (AccountStatus, error) {
+	r.cut.RLock()
+	defer r.cut.RUnlock()
+	account := r.Accounts.get(rec.Account)
+	if account == nil {
+		return "", ErrAccountNotFound
+	}
+	account.rw.Lock()
+	defer account.rw.Unlock()
+	previous := account.Status
+	if err := previous.transition(rec.Status, account.Balance, account.Held, account.interest.Owed); err != nil {
+		return "", err
+	}
+	if err := r.writeAhead(rec); err != nil {
+		return "", err
+	}
+	account.Status = rec.Status
+	return previous, nil
+}
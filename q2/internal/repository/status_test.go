@@ -0,0 +1,180 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAccountStatus(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		accID, _ := repo.CreateAccount(ctx)
+		otherID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 250}, TransactionMeta{})
+		_, _ = repo.DepositAccount(ctx, otherID, Money{Amount: 50}, TransactionMeta{})
+		transfer, _ := repo.TransferAccount(ctx, otherID, accID, Money{Amount: 50}, TransactionMeta{})
+
+		if acc, _ := repo.GetAccount(ctx, accID); acc.Status != StatusActive {
+			t.Errorf("GetAccount() status got = %v, want %v", acc.Status, StatusActive)
+		}
+		if previous, err := repo.SetAccountStatus(ctx, accID, StatusFrozen); err != nil || previous != StatusActive {
+			t.Fatalf("SetAccountStatus() frozen got = %v, %v", previous, err)
+		}
+
+		// frozen accounts take credits only
+		if _, err := repo.WithdrawAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{}); !errors.Is(err, ErrAccountFrozen) {
+			t.Errorf("WithdrawAccount() frozen error = %v, want %v", err, ErrAccountFrozen)
+		}
+		if _, err := repo.TransferAccount(ctx, accID, otherID, Money{Amount: 100}, TransactionMeta{}); !errors.Is(err, ErrAccountFrozen) {
+			t.Errorf("TransferAccount() from frozen error = %v, want %v", err, ErrAccountFrozen)
+		}
+		if _, err := repo.ReverseTransaction(ctx, transfer.ID, Money{}, TransactionMeta{}); !errors.Is(err, ErrAccountFrozen) {
+			t.Errorf("ReverseTransaction() from frozen error = %v, want %v", err, ErrAccountFrozen)
+		}
+		if _, err := repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{}); err != nil {
+			t.Errorf("DepositAccount() frozen error = %v", err)
+		}
+		_, _ = repo.DepositAccount(ctx, otherID, Money{Amount: 100}, TransactionMeta{})
+		if _, err := repo.TransferAccount(ctx, otherID, accID, Money{Amount: 100}, TransactionMeta{}); err != nil {
+			t.Errorf("TransferAccount() to frozen error = %v", err)
+		}
+		if _, err := repo.SetAccountStatus(ctx, accID, StatusFrozen); !errors.Is(err, ErrStatusUnchanged) {
+			t.Errorf("SetAccountStatus() frozen twice error = %v, want %v", err, ErrStatusUnchanged)
+		}
+
+		// closing needs a zero balance
+		if _, err := repo.SetAccountStatus(ctx, accID, StatusClosed); !errors.Is(err, ErrBalanceNotZero) {
+			t.Errorf("SetAccountStatus() close with balance error = %v, want %v", err, ErrBalanceNotZero)
+		}
+		if _, err := repo.SetAccountStatus(ctx, accID, StatusActive); err != nil {
+			t.Errorf("SetAccountStatus() unfreeze error = %v", err)
+		}
+		_, _ = repo.WithdrawAccount(ctx, accID, Money{Amount: 500}, TransactionMeta{})
+		if previous, err := repo.SetAccountStatus(ctx, accID, StatusClosed); err != nil || previous != StatusActive {
+			t.Fatalf("SetAccountStatus() close got = %v, %v", previous, err)
+		}
+
+		// closed accounts take nothing and stay closed
+		if _, err := repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{}); !errors.Is(err, ErrAccountClosed) {
+			t.Errorf("DepositAccount() closed error = %v, want %v", err, ErrAccountClosed)
+		}
+		_, _ = repo.DepositAccount(ctx, otherID, Money{Amount: 100}, TransactionMeta{})
+		if _, err := repo.TransferAccount(ctx, otherID, accID, Money{Amount: 100}, TransactionMeta{}); !errors.Is(err, ErrAccountClosed) {
+			t.Errorf("TransferAccount() to closed error = %v, want %v", err, ErrAccountClosed)
+		}
+		if _, err := repo.SetAccountStatus(ctx, accID, StatusActive); !errors.Is(err, ErrAccountClosed) {
+			t.Errorf("SetAccountStatus() reopen error = %v, want %v", err, ErrAccountClosed)
+		}
+		if acc, _ := repo.GetAccount(ctx, otherID); acc.Balance != 100 {
+			t.Errorf("rejected transfer moved money, balance got = %v, want %v", acc.Balance, 100)
+		}
+
+		if _, err := repo.SetAccountStatus(ctx, otherID, "dormant"); !errors.Is(err, ErrInvalidStatus) {
+			t.Errorf("SetAccountStatus() unknown status error = %v, want %v", err, ErrInvalidStatus)
+		}
+		if _, err := repo.SetAccountStatus(ctx, "nope", StatusFrozen); !errors.Is(err, ErrAccountNotFound) {
+			t.Errorf("SetAccountStatus() unknown account error = %v, want %v", err, ErrAccountNotFound)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+	})
+}
+
+// owe makes account id owe amount of accrued interest, as time in overdraft
+// would.
+func owe(t *testing.T, repo AccountStore, id AccountID, amount int64) {
+	switch repo := repo.(type) {
+	case *Repository:
+		acc := repo.Accounts.get(id)
+		acc.rw.Lock()
+		acc.interest.Owed = amount
+		acc.rw.Unlock()
+	case *SQLiteRepository:
+		if _, err := repo.db.Exec(`UPDATE accounts SET interest_owed = ? WHERE id = ?`, amount, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCloseWithInterestOwed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		accID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.SetOverdraft(ctx, OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: 5000000, InterestRate: 1000}})
+		// overdrawn, repaid to 0 and still owing the interest
+		_, _ = repo.WithdrawAccount(ctx, accID, Money{Amount: 5000000}, TransactionMeta{})
+		_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 5000000}, TransactionMeta{})
+		owe(t, repo, accID, 1000000)
+
+		if _, err := repo.SetAccountStatus(ctx, accID, StatusClosed); !errors.Is(err, ErrInterestOwed) {
+			t.Fatalf("SetAccountStatus() close owing interest error = %v, want %v", err, ErrInterestOwed)
+		}
+		if charged, err := repo.ChargeInterest(ctx, time.Now()); err != nil || charged != 1 {
+			t.Fatalf("ChargeInterest() got = %v, %v, want 1", charged, err)
+		}
+		if acc, _ := repo.GetAccount(ctx, accID); acc.Balance != -1000000 || acc.InterestOwed != 0 {
+			t.Errorf("GetAccount() after the charge got = %+v", acc)
+		}
+		_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 1000000}, TransactionMeta{})
+		if _, err := repo.SetAccountStatus(ctx, accID, StatusClosed); err != nil {
+			t.Errorf("SetAccountStatus() close after paying the interest error = %v", err)
+		}
+		if err := repo.CheckLedger(ctx); err != nil {
+			t.Errorf("CheckLedger() error = %v", err)
+		}
+	})
+}
+
+func TestCloseWithFundsHeld(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+		accID, _ := repo.CreateAccount(ctx)
+		shopID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.SetOverdraft(ctx, OverdraftChange{AccountID: accID, Overdraft: Overdraft{Limit: 500}})
+		h, err := repo.PlaceHold(ctx, accID, shopID, Money{Amount: 300}, time.Time{}, TransactionMeta{})
+		if err != nil {
+			t.Fatalf("PlaceHold() error = %v", err)
+		}
+
+		if _, err := repo.SetAccountStatus(ctx, accID, StatusClosed); !errors.Is(err, ErrFundsHeld) {
+			t.Fatalf("SetAccountStatus() close with funds held error = %v, want %v", err, ErrFundsHeld)
+		}
+		if _, err := repo.ReleaseHold(ctx, h.ID); err != nil {
+			t.Fatalf("ReleaseHold() error = %v", err)
+		}
+		if _, err := repo.SetAccountStatus(ctx, accID, StatusClosed); err != nil {
+			t.Errorf("SetAccountStatus() close after the release error = %v", err)
+		}
+	})
+}
+
+func TestAccountStatusDurable(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	frozenID, _ := repo.CreateAccount(ctx)
+	closedID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.SetAccountStatus(ctx, frozenID, StatusFrozen)
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	_, _ = repo.SetAccountStatus(ctx, closedID, StatusClosed)
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	frozen, _ := repo.GetAccount(ctx, frozenID)
+	closed, _ := repo.GetAccount(ctx, closedID)
+	if frozen.Status != StatusFrozen || closed.Status != StatusClosed {
+		t.Errorf("statuses after reopen got = %v, %v", frozen.Status, closed.Status)
+	}
+}
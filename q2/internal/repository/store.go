@@ -0,0 +1,238 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrSameAccount       = errors.New("cannot transfer to the same account")
+
+	ErrTransactionNotFound   = errors.New("transaction not found")
+	ErrNotReversible         = errors.New("only transfers can be reversed")
+	ErrAlreadyReversed       = errors.New("transaction is already fully reversed")
+	ErrReversalExceedsAmount = errors.New("reversal exceeds the amount left to reverse")
+)
+
+// AccountStore is the storage used by the handlers. Repository is the
+// in-memory implementation; other backends only need to satisfy this interface.
+type AccountStore interface {
+	CustomerStore
+	// CreateAccount opens an account in DefaultCurrency held by holders, whose
+	// AccountID is ignored. An account without holders is anonymous.
+	CreateAccount(ctx context.Context, holders ...AccountHolder) (AccountID, error)
+	// CreateCurrencyAccount opens an account in currency held by holders.
+	CreateCurrencyAccount(ctx context.Context, currency Currency, holders ...AccountHolder) (AccountID, error)
+	GetAccount(ctx context.Context, id AccountID) (*Account, error)
+	// DepositAccount and WithdrawAccount move amount in or out of account
+	// id. The amount must be in the currency of the account, or have none.
+	DepositAccount(ctx context.Context, id AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error)
+	WithdrawAccount(ctx context.Context, id AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error)
+	// TransferAccount moves amount in the currency of from to account to. If
+	// to has another currency, the amount is converted at the exchange rate
+	// between the two.
+	TransferAccount(ctx context.Context, from AccountID, to AccountID, amount Money, meta TransactionMeta) (*TransactionLog, error)
+	// ReverseTransaction moves amount of transfer id back from its receiver
+	// to its sender. A zero amount reverses whatever is left of it.
+	ReverseTransaction(ctx context.Context, id int64, amount Money, meta TransactionMeta) (*TransactionLog, error)
+	GetTransactions(ctx context.Context) ([]TransactionLog, error)
+	// ListTransactions returns a page of the transaction log matching q, in
+	// relay order or the reverse of it.
+	ListTransactions(ctx context.Context, q TransactionQuery) (*TransactionPage, error)
+	// ListAccountTransactions returns a page of the entries of account id with
+	// its balance after each one. q.Account is ignored.
+	ListAccountTransactions(ctx context.Context, id AccountID, q TransactionQuery) (*AccountHistory, error)
+	AddTransaction(ctx context.Context, batch BatchTransaction) error
+	// RelayTransactions moves up to limit of the oldest log entries that money
+	// movements committed to the outbox into the transaction log, and returns
+	// how many it moved. publish, if not nil, gets the entries before they
+	// move and nothing moves if it fails, so every entry is published at
+	// least once.
+	RelayTransactions(ctx context.Context, limit int, publish func(BatchTransaction) error) (int, error)
+	// OutboxDepth returns the number of log entries waiting in the outbox.
+	OutboxDepth(ctx context.Context) (int, error)
+	// SetAccountStatus moves account id to status and returns the status it
+	// had. Closed accounts never change again and only close at a zero
+	// balance.
+	SetAccountStatus(ctx context.Context, id AccountID, status AccountStatus) (AccountStatus, error)
+	// SetOverdraft changes the overdraft of account c.AccountID and returns
+	// the change as recorded in its history.
+	SetOverdraft(ctx context.Context, c OverdraftChange) (*OverdraftChange, error)
+	// GetOverdraftHistory returns the overdraft changes of account id, oldest
+	// first.
+	GetOverdraftHistory(ctx context.Context, id AccountID) ([]OverdraftChange, error)
+	// ChargeInterest charges every account that is not closed the interest
+	// its overdraft accrued until asOf and returns how many it charged,
+	// with the errors of the accounts it had to skip.
+	ChargeInterest(ctx context.Context, asOf time.Time) (int, error)
+	// SetExchangeRate adds or replaces the rate from rate.From to rate.To and
+	// returns it with UpdatedAt set.
+	SetExchangeRate(ctx context.Context, rate ExchangeRate) (*ExchangeRate, error)
+	// ListExchangeRates returns the rate table ordered by From and To.
+	ListExchangeRates(ctx context.Context) ([]ExchangeRate, error)
+	// PlaceHold reserves amount of account for a payment to to until
+	// expiresAt, DefaultHoldDuration from now if it is zero. Held funds are
+	// not available to withdrawals, transfers or other holds.
+	PlaceHold(ctx context.Context, account AccountID, to AccountID, amount Money, expiresAt time.Time, meta TransactionMeta) (*Hold, error)
+	// CaptureHold moves amount of hold id to its payee and releases the
+	// rest. A zero amount captures all of it.
+	CaptureHold(ctx context.Context, id int64, amount Money) (*Hold, error)
+	ReleaseHold(ctx context.Context, id int64) (*Hold, error)
+	// ExpireHolds releases every active hold that expired by asOf and
+	// returns how many it released.
+	ExpireHolds(ctx context.Context, asOf time.Time) (int, error)
+	GetHold(ctx context.Context, id int64) (*Hold, error)
+	// ListHolds returns the holds of account id, oldest first.
+	ListHolds(ctx context.Context, id AccountID) ([]Hold, error)
+	// OpenEscrow moves amount from buyer into EscrowAccount for order, to be
+	// released to merchant at releaseAt, DefaultEscrowTimeout from now if it
+	// is zero. An order is only escrowed once.
+	OpenEscrow(ctx context.Context, order string, buyer, merchant AccountID, amount Money, releaseAt time.Time, memo string) (*Escrow, error)
+	// ReleaseEscrow pays the escrow of order to its merchant and
+	// RefundEscrow gives it back to its buyer.
+	ReleaseEscrow(ctx context.Context, order string) (*Escrow, error)
+	RefundEscrow(ctx context.Context, order string) (*Escrow, error)
+	// ReleaseDueEscrows releases every held escrow due by asOf to its
+	// merchant and returns how many it released. An escrow that fails is
+	// skipped, and the errors are joined.
+	ReleaseDueEscrows(ctx context.Context, asOf time.Time) (int, error)
+	GetEscrow(ctx context.Context, order string) (*Escrow, error)
+	// ListEscrows returns the escrows account id pays or is paid by, oldest
+	// first.
+	ListEscrows(ctx context.Context, id AccountID) ([]Escrow, error)
+	// SetFeeSchedule replaces the fee rules of a merchant account, taken out
+	// of every split payment leg to it.
+	SetFeeSchedule(ctx context.Context, s FeeSchedule) (*FeeSchedule, error)
+	GetFeeSchedule(ctx context.Context, id AccountID) (*FeeSchedule, error)
+	// SplitTransfer debits the legs from from and credits each, less the
+	// fees of its receiver, in one journal entry whose id every log entry
+	// of the payment shares.
+	SplitTransfer(ctx context.Context, from AccountID, legs []Leg, meta TransactionMeta) ([]TransactionLog, error)
+	GetJournal(ctx context.Context) ([]JournalEntry, error)
+	// GetJournalEntry returns journal entry id, or ErrTransactionNotFound.
+	GetJournalEntry(ctx context.Context, id int64) (*JournalEntry, error)
+	CheckLedger(ctx context.Context) error
+	Close() error
+}
+
+// AccountID is an opaque account id made by the IDGenerator of the store.
+type AccountID string
+
+// UnmarshalJSON also accepts the numeric ids of data and clients from before
+// ids were strings.
+func (id *AccountID) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var s string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*id = AccountID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	if _, err := n.Int64(); err != nil {
+		return fmt.Errorf("invalid account id %s", b)
+	}
+	*id = AccountID(n.String())
+	return nil
+}
+
+// Option configures a store when it is created.
+type Option func(*options)
+
+type options struct {
+	ids IDGenerator
+}
+
+// WithIDGenerator makes the store create account ids with ids instead of
+// numbering them sequentially.
+func WithIDGenerator(ids IDGenerator) Option {
+	return func(o *options) {
+		o.ids = ids
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{ids: NewSequentialIDs()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Account is a point-in-time copy of an account returned by the store.
+// Balance is the ledger balance and Available is what is left of it after
+// the Held funds of active holds; it may be negative down to
+// -Overdraft.Limit. InterestOwed is the whole minor units of overdraft
+// interest accrued since it was last charged.
+type Account struct {
+	ID           AccountID
+	Currency     Currency
+	Balance      int64
+	Held         int64
+	Available    int64
+	Status       AccountStatus
+	Overdraft    Overdraft
+	InterestOwed int64
+}
+
+type TransactionType string
+
+const (
+	TransactionDeposit    TransactionType = "deposit"
+	TransactionWithdrawal TransactionType = "withdrawal"
+	TransactionTransfer   TransactionType = "transfer"
+	TransactionReversal   TransactionType = "reversal"
+	TransactionInterest   TransactionType = "interest"
+)
+
+// TransactionMeta is the optional client-supplied description of a money movement.
+type TransactionMeta struct {
+	Memo      string
+	Reference string
+}
+
+// TransactionLog records one money movement. ID is the id of its journal
+// entry. Deposits come from CashInAccount, withdrawals go to CashOutAccount
+// and overdraft interest goes to InterestIncomeAccount; FromBalance and
+// ToBalance are the balances of the customer accounts right after the
+// movement and are zero for system accounts.
+// Reverses is the id of the transfer a reversal refunds. Amount is in
+// Currency; a cross-currency transfer credits To with the amount of its
+// Conversion instead.
+type TransactionLog struct {
+	ID          int64
+	Type        TransactionType
+	Reverses    int64 `json:",omitempty"`
+	From        AccountID
+	To          AccountID
+	Amount      int64
+	Currency    Currency    `json:",omitempty"`
+	Conversion  *Conversion `json:",omitempty"`
+	FromBalance int64
+	ToBalance   int64
+	Memo        string
+	Reference   string
+	When        time.Time
+}
+
+// Credited returns the amount the entry credited to To.
+func (tl *TransactionLog) Credited() int64 {
+	if tl.Conversion != nil {
+		return tl.Conversion.ToAmount
+	}
+	return tl.Amount
+}
+
+type BatchTransaction []TransactionLog
@@ -0,0 +1,291 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		accID, err := repo.CreateAccount(ctx)
+		if err != nil {
+			t.Errorf("CreateAccount() error = %v, wantErr %v", err, false)
+		}
+		if accID == "" {
+			t.Errorf("CreateAccount() got = %v, want %v", accID, "non-empty ID")
+		}
+	})
+}
+
+func TestGetAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		// Pre-create an account to test retrieval
+		expectedID, _ := repo.CreateAccount(ctx)
+
+		acc, err := repo.GetAccount(ctx, expectedID)
+		if err != nil {
+			t.Errorf("GetAccount() error = %v, wantErr %v", err, false)
+		}
+		if acc.ID != expectedID {
+			t.Errorf("GetAccount() got = %v, want %v", acc.ID, expectedID)
+		}
+	})
+}
+
+func TestDepositAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		// Create an account for deposit testing
+		accID, _ := repo.CreateAccount(ctx)
+
+		_, err := repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{})
+		if err != nil {
+			t.Errorf("DepositAccount() error = %v, wantErr %v", err, false)
+		}
+
+		acc, _ := repo.GetAccount(ctx, accID)
+		if acc.Balance != 100 {
+			t.Errorf("DepositAccount() got = %v, want %v", acc.Balance, 100)
+		}
+	})
+}
+
+func TestWithdrawAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		// Create an account and deposit an initial amount
+		accID, _ := repo.CreateAccount(ctx)
+		_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 200}, TransactionMeta{})
+
+		// Withdraw a valid amount
+		if _, err := repo.WithdrawAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{}); err != nil {
+			t.Errorf("WithdrawAccount() error = %v, wantErr %v", err, false)
+		}
+
+		// Assert the balance is as expected
+		acc, _ := repo.GetAccount(ctx, accID)
+		if acc.Balance != 100 {
+			t.Errorf("WithdrawAccount() got = %v, want %v", acc.Balance, 100)
+		}
+
+		// Attempt to withdraw more than the balance
+		if _, err := repo.WithdrawAccount(ctx, accID, Money{Amount: 200}, TransactionMeta{}); err == nil {
+			t.Errorf("WithdrawAccount() expected error for insufficient funds, got nil")
+		}
+	})
+}
+
+func TestTransferAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		// Create two accounts
+		fromAccID, _ := repo.CreateAccount(ctx)
+		toAccID, _ := repo.CreateAccount(ctx)
+
+		// Deposit into the first account
+		_, _ = repo.DepositAccount(ctx, fromAccID, Money{Amount: 300}, TransactionMeta{})
+
+		// Transfer funds
+		if _, err := repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 150}, TransactionMeta{}); err != nil {
+			t.Errorf("TransferAccount() error = %v, wantErr %v", err, false)
+		}
+
+		// Assert balances are as expected
+		fromAcc, _ := repo.GetAccount(ctx, fromAccID)
+		toAcc, _ := repo.GetAccount(ctx, toAccID)
+		if fromAcc.Balance != 150 || toAcc.Balance != 150 {
+			t.Errorf("TransferAccount() gotFrom = %v, want %v; gotTo = %v, want %v", fromAcc.Balance, 150, toAcc.Balance, 150)
+		}
+
+		// Test transferring with insufficient funds
+		if _, err := repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 300}, TransactionMeta{}); err == nil {
+			t.Errorf("TransferAccount() expected error for insufficient funds, got nil")
+		}
+	})
+}
+
+func TestAddTransaction(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		// Create a batch of transactions
+		batch := BatchTransaction{
+			{From: "1", To: "2", Amount: 100, When: time.Now()},
+			{From: "2", To: "1", Amount: 50, When: time.Now()},
+		}
+
+		// Add transactions to the log
+		repo.AddTransaction(ctx, batch)
+
+		// Retrieve the transactions log
+		trans, _ := repo.GetTransactions(ctx)
+		if len(trans) != 2 {
+			t.Errorf("AddTransaction() got = %v transactions, want %v", len(trans), 2)
+		}
+
+		// Verify the first transaction details
+		if trans[0].From != "1" || trans[0].To != "2" || trans[0].Amount != 100 {
+			t.Errorf("AddTransaction() gotFirstTransaction = %+v, want From=1, To=2, Amount=100", trans[0])
+		}
+	})
+}
+
+// forEachStore runs test against every AccountStore implementation.
+func forEachStore(t *testing.T, test func(t *testing.T, repo AccountStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewRepository())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		repo, err := NewSQLiteRepository(filepath.Join(t.TempDir(), "bank.db"))
+		if err != nil {
+			t.Fatalf("NewSQLiteRepository() error = %v", err)
+		}
+		defer repo.Close()
+		test(t, repo)
+	})
+}
+
+func TestTransactionLogRecords(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		fromAccID, _ := repo.CreateAccount(ctx)
+		toAccID, _ := repo.CreateAccount(ctx)
+
+		deposit, err := repo.DepositAccount(ctx, fromAccID, Money{Amount: 300}, TransactionMeta{Memo: "salary"})
+		if err != nil {
+			t.Fatalf("DepositAccount() error = %v", err)
+		}
+		if deposit.Type != TransactionDeposit || deposit.From != CashInAccount || deposit.To != fromAccID || deposit.ToBalance != 300 || deposit.Memo != "salary" {
+			t.Errorf("DepositAccount() got = %+v", deposit)
+		}
+
+		withdrawal, _ := repo.WithdrawAccount(ctx, fromAccID, Money{Amount: 100}, TransactionMeta{})
+		if withdrawal.Type != TransactionWithdrawal || withdrawal.From != fromAccID || withdrawal.To != CashOutAccount || withdrawal.FromBalance != 200 {
+			t.Errorf("WithdrawAccount() got = %+v", withdrawal)
+		}
+
+		transfer, _ := repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 50}, TransactionMeta{Reference: "order-1"})
+		if transfer.Type != TransactionTransfer || transfer.FromBalance != 150 || transfer.ToBalance != 50 || transfer.Reference != "order-1" {
+			t.Errorf("TransferAccount() got = %+v", transfer)
+		}
+
+		if deposit.ID == withdrawal.ID || withdrawal.ID == transfer.ID || deposit.ID == transfer.ID {
+			t.Errorf("transaction ids are not unique: %v, %v, %v", deposit.ID, withdrawal.ID, transfer.ID)
+		}
+	})
+}
+
+func TestOutboxRelay(t *testing.T) {
+	forEachStore(t, func(t *testing.T, repo AccountStore) {
+		ctx := context.Background()
+
+		fromAccID, _ := repo.CreateAccount(ctx)
+		toAccID, _ := repo.CreateAccount(ctx)
+		deposit, _ := repo.DepositAccount(ctx, fromAccID, Money{Amount: 300}, TransactionMeta{Memo: "salary"})
+		withdrawal, _ := repo.WithdrawAccount(ctx, fromAccID, Money{Amount: 100}, TransactionMeta{})
+		transfer, _ := repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 50}, TransactionMeta{})
+		// rejected operations commit no log entry
+		_, _ = repo.WithdrawAccount(ctx, toAccID, Money{Amount: 1000}, TransactionMeta{})
+
+		if depth, err := repo.OutboxDepth(ctx); err != nil || depth != 3 {
+			t.Errorf("OutboxDepth() got = %v, %v, want %v", depth, err, 3)
+		}
+		if trans, _ := repo.GetTransactions(ctx); len(trans) != 0 {
+			t.Errorf("GetTransactions() before relay got = %v transactions, want %v", len(trans), 0)
+		}
+
+		// nothing moves when the entries cannot be published
+		failed := errors.New("broker down")
+		if n, err := repo.RelayTransactions(ctx, 2, func(BatchTransaction) error { return failed }); !errors.Is(err, failed) || n != 0 {
+			t.Errorf("RelayTransactions() failing publish got = %v, %v, want %v", n, err, failed)
+		}
+		if depth, _ := repo.OutboxDepth(ctx); depth != 3 {
+			t.Errorf("OutboxDepth() after failed publish got = %v, want %v", depth, 3)
+		}
+
+		var published BatchTransaction
+		publish := func(batch BatchTransaction) error {
+			published = append(published, batch...)
+			return nil
+		}
+		if n, err := repo.RelayTransactions(ctx, 2, publish); err != nil || n != 2 {
+			t.Errorf("RelayTransactions() got = %v, %v, want %v", n, err, 2)
+		}
+		if len(published) != 2 || published[0].ID != deposit.ID || published[1].ID != withdrawal.ID {
+			t.Errorf("RelayTransactions() published = %+v", published)
+		}
+		if n, err := repo.RelayTransactions(ctx, 2, nil); err != nil || n != 1 {
+			t.Errorf("RelayTransactions() rest got = %v, %v, want %v", n, err, 1)
+		}
+		if n, err := repo.RelayTransactions(ctx, 2, nil); err != nil || n != 0 {
+			t.Errorf("RelayTransactions() empty got = %v, %v, want %v", n, err, 0)
+		}
+		if depth, _ := repo.OutboxDepth(ctx); depth != 0 {
+			t.Errorf("OutboxDepth() after relay got = %v, want %v", depth, 0)
+		}
+
+		trans, _ := repo.GetTransactions(ctx)
+		if len(trans) != 3 || trans[0].ID != deposit.ID || trans[1].ID != withdrawal.ID || trans[2].ID != transfer.ID {
+			t.Fatalf("GetTransactions() after relay got = %+v", trans)
+		}
+		if trans[0].Memo != "salary" || trans[0].ToBalance != 300 || !trans[0].When.Equal(deposit.When) {
+			t.Errorf("GetTransactions() got first = %+v, want %+v", trans[0], deposit)
+		}
+	})
+}
+
+func TestRelayPublishesOutsideCut(t *testing.T) {
+	ctx := context.Background()
+	repo := NewRepository()
+	accID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{})
+
+	publishing, unblock := make(chan struct{}), make(chan struct{})
+	relayed := make(chan error)
+	go func() {
+		_, err := repo.RelayTransactions(ctx, 10, func(BatchTransaction) error {
+			close(publishing)
+			<-unblock
+			return nil
+		})
+		relayed <- err
+	}()
+	<-publishing
+
+	// a slow broker does not hold up the ledger check or new movements
+	done := make(chan error)
+	go func() {
+		if _, err := repo.DepositAccount(ctx, accID, Money{Amount: 50}, TransactionMeta{}); err != nil {
+			done <- err
+			return
+		}
+		done <- repo.CheckLedger(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("movement during publish error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("movement blocked by a publish in progress")
+	}
+	close(unblock)
+	if err := <-relayed; err != nil {
+		t.Fatalf("RelayTransactions() error = %v", err)
+	}
+	// only the published entry moved
+	if depth, _ := repo.OutboxDepth(ctx); depth != 1 {
+		t.Errorf("OutboxDepth() after relay got = %v, want %v", depth, 1)
+	}
+}
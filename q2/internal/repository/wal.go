@@ -0,0 +1,357 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wal operations
+const (
+	opCreateAccount      = "create_account"
+	opDepositAccount     = "deposit_account"
+	opWithdrawAccount    = "withdraw_account"
+	opTransferAccount    = "transfer_account"
+	opReverseTransaction = "reverse_transaction"
+	opRelayTransactions  = "relay_transactions"
+	opAddTransaction     = "add_transaction"
+
+	opCreateCustomer      = "create_customer"
+	opUpdateCustomer      = "update_customer"
+	opDeleteCustomer      = "delete_customer"
+	opSetAccountHolder    = "set_account_holder"
+	opRemoveAccountHolder = "remove_account_holder"
+	opSetAccountStatus    = "set_account_status"
+	opSetOverdraft        = "set_overdraft"
+	opChargeInterest      = "charge_interest"
+	opSetExchangeRate     = "set_exchange_rate"
+	opPlaceHold           = "place_hold"
+	opCaptureHold         = "capture_hold"
+	opReleaseHold         = "release_hold"
+	opExpireHold          = "expire_hold"
+	opOpenEscrow          = "open_escrow"
+	opReleaseEscrow       = "release_escrow"
+	opRefundEscrow        = "refund_escrow"
+	opAutoReleaseEscrow   = "auto_release_escrow"
+	opSetFeeSchedule      = "set_fee_schedule"
+	opSplitTransfer       = "split_transfer"
+)
+
+// walHeaderSize is the length prefix plus the crc32 of the payload.
+const walHeaderSize = 8
+
+// maxWALRecordSize guards against reading a garbage length from a torn header.
+const maxWALRecordSize = 64 << 20
+
+const (
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".log"
+)
+
+var errTornRecord = errors.New("torn wal record")
+
+type walRecord struct {
+	Op string `json:"op"`
+	// ID is the transaction a reversal refunds, and the account of records
+	// written before account ids were strings
+	ID      int64            `json:"id,omitempty"`
+	Account AccountID        `json:"account,omitempty"`
+	From    AccountID        `json:"from,omitempty"`
+	To      AccountID        `json:"to,omitempty"`
+	Amount  int64            `json:"amount,omitempty"`
+	Batch   BatchTransaction `json:"batch,omitempty"`
+	// Entry and When are the journal entry posted by a money movement
+	Entry     int64     `json:"entry,omitempty"`
+	When      time.Time `json:"when"`
+	Memo      string    `json:"memo,omitempty"`
+	Reference string    `json:"reference,omitempty"`
+	// Outbox is set on money movements whose log entry goes to the outbox
+	Outbox bool `json:"outbox,omitempty"`
+	// Relayed are the outbox entries a relay moved to the transaction log
+	Relayed []int64 `json:"relayed,omitempty"`
+	// Customer is the customer a customer record creates, updates or deletes
+	Customer *Customer `json:"customer,omitempty"`
+	// Holders are the holders an account is created with, or the link a
+	// holder record sets or removes
+	Holders []AccountHolder `json:"holders,omitempty"`
+	// Status is the status a status record moves Account to
+	Status AccountStatus `json:"status,omitempty"`
+	// Overdraft is the change an overdraft record makes
+	Overdraft *OverdraftChange `json:"overdraft,omitempty"`
+	// Currency is the currency an account is created in
+	Currency Currency `json:"currency,omitempty"`
+	// Conversion is how a cross-currency transfer converted its amount
+	Conversion *Conversion `json:"conversion,omitempty"`
+	// Rate is the exchange rate a rate record sets
+	Rate *ExchangeRate `json:"rate,omitempty"`
+	// Hold is the hold a hold record places; capture, release and expiry
+	// records name the hold by ID
+	Hold *Hold `json:"hold,omitempty"`
+	// Escrow is the escrow an open record opens; release and refund records
+	// name it by Order
+	Escrow *Escrow `json:"escrow,omitempty"`
+	Order  string  `json:"order,omitempty"`
+	// Fees is the fee schedule a fee record sets
+	Fees *FeeSchedule `json:"fees,omitempty"`
+	// Legs are the legs of a split payment, and Payouts what they pay out
+	// after fees
+	Legs    []Leg    `json:"legs,omitempty"`
+	Payouts []Payout `json:"payouts,omitempty"`
+}
+
+// account returns the account a create, deposit or withdraw record applies to.
+func (rec walRecord) account() AccountID {
+	if rec.Account == "" {
+		return AccountID(strconv.FormatInt(rec.ID, 10))
+	}
+	return rec.Account
+}
+
+// wal is an append-only log of repository mutations split into numbered
+// segments in dir. Every record is fsync'd before append returns, so a
+// mutation is durable once it is applied.
+type wal struct {
+	dir     string
+	segment uint64
+	file    *os.File
+	offset  int64
+	mu      sync.Mutex
+}
+
+// openWAL opens the segments in dir numbered from first on and returns the
+// records in them. A torn or corrupted record at the end of the last segment,
+// left by a crash in the middle of a write, is truncated away so new records
+// are appended after the last good one.
+func openWAL(dir string, first uint64) (*wal, []walRecord, error) {
+	segments, err := listFiles(dir, walSegmentPrefix, walSegmentSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	records := make([]walRecord, 0)
+	w := &wal{dir: dir, segment: first}
+	next := first
+	for i, segment := range segments {
+		if segment < first {
+			continue
+		}
+		if segment != next {
+			return nil, nil, fmt.Errorf("wal segment %d is missing", next)
+		}
+		next++
+		last := i == len(segments)-1
+		f, err := os.OpenFile(w.segmentPath(segment), os.O_RDWR, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+		segmentRecords, offset, err := readWAL(f)
+		if errors.Is(err, errTornRecord) && !last {
+			f.Close()
+			return nil, nil, fmt.Errorf("wal segment %d is corrupted", segment)
+		}
+		if err != nil && !errors.Is(err, errTornRecord) {
+			f.Close()
+			return nil, nil, err
+		}
+		records = append(records, segmentRecords...)
+		if !last {
+			f.Close()
+			continue
+		}
+		if err != nil {
+			if err := f.Truncate(offset); err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			if err := f.Sync(); err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		w.segment, w.file, w.offset = segment, f, offset
+	}
+	if w.file == nil {
+		if err := w.openSegment(first); err != nil {
+			return nil, nil, err
+		}
+	}
+	return w, records, nil
+}
+
+// readWAL reads records from the start of f. It returns the offset just past
+// the last complete record, and errTornRecord if anything follows it.
+func readWAL(f *os.File) ([]walRecord, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	reader := bufio.NewReader(f)
+	records := make([]walRecord, 0)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return records, offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return records, offset, errTornRecord
+			}
+			return nil, 0, err
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		if size > maxWALRecordSize {
+			return records, offset, errTornRecord
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, errTornRecord
+			}
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return records, offset, errTornRecord
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return records, offset, errTornRecord
+		}
+		records = append(records, rec)
+		offset += walHeaderSize + int64(size)
+	}
+}
+
+// append writes rec to the end of the current segment and fsyncs it.
+func (w *wal) append(rec walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.file.Write(buf); err != nil {
+		w.rollback()
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.rollback()
+		return err
+	}
+	w.offset += int64(len(buf))
+	return nil
+}
+
+// rollback drops a partially written record so the next append does not
+// land behind it.
+func (w *wal) rollback() {
+	if err := w.file.Truncate(w.offset); err == nil {
+		_, _ = w.file.Seek(w.offset, io.SeekStart)
+	}
+}
+
+// rotate closes the current segment and starts the next one. It returns the
+// number of the new segment; every earlier record is in older segments.
+func (w *wal) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+	if err := w.openSegment(w.segment + 1); err != nil {
+		return 0, err
+	}
+	return w.segment, nil
+}
+
+// removeBefore deletes the segments older than segment.
+func (w *wal) removeBefore(segment uint64) error {
+	segments, err := listFiles(w.dir, walSegmentPrefix, walSegmentSuffix)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= segment {
+			continue
+		}
+		if err := os.Remove(w.segmentPath(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+func (w *wal) openSegment(segment uint64) error {
+	f, err := os.OpenFile(w.segmentPath(segment), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		f.Close()
+		return err
+	}
+	w.segment, w.file, w.offset = segment, f, 0
+	return nil
+}
+
+func (w *wal) segmentPath(segment uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, segment, walSegmentSuffix))
+}
+
+// listFiles returns the numbers n of the files in dir named prefix<n>suffix,
+// in ascending order.
+func listFiles(dir string, prefix string, suffix string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]uint64, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+// syncDir makes file creations, renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,226 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDurableRepositoryReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	fromAccID, _ := repo.CreateAccount(ctx)
+	toAccID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, fromAccID, Money{Amount: 300}, TransactionMeta{})
+	_, _ = repo.WithdrawAccount(ctx, fromAccID, Money{Amount: 50}, TransactionMeta{})
+	_, _ = repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 100}, TransactionMeta{})
+	// rejected operations must not be replayed
+	_, _ = repo.WithdrawAccount(ctx, toAccID, Money{Amount: 1000}, TransactionMeta{})
+	_ = repo.AddTransaction(ctx, BatchTransaction{{From: fromAccID, To: toAccID, Amount: 100, When: time.Now()}})
+	journal, _ := repo.GetJournal(ctx)
+	if err := repo.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+
+	fromAcc, _ := repo.GetAccount(ctx, fromAccID)
+	toAcc, _ := repo.GetAccount(ctx, toAccID)
+	if fromAcc.Balance != 150 || toAcc.Balance != 100 {
+		t.Errorf("replay gotFrom = %v, want %v; gotTo = %v, want %v", fromAcc.Balance, 150, toAcc.Balance, 100)
+	}
+	if trans, _ := repo.GetTransactions(ctx); len(trans) != 1 {
+		t.Errorf("replay got = %v transactions, want %v", len(trans), 1)
+	}
+	replayed, _ := repo.GetJournal(ctx)
+	if len(replayed) != len(journal) || replayed[len(replayed)-1].ID != journal[len(journal)-1].ID {
+		t.Errorf("replay got journal %+v, want %+v", replayed, journal)
+	}
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() after replay error = %v", err)
+	}
+
+	// new accounts continue after the replayed ids
+	nextID, _ := repo.CreateAccount(ctx)
+	if nextID != AccountID("3") {
+		t.Errorf("CreateAccount() after replay got = %v, want %v", nextID, AccountID("3"))
+	}
+}
+
+func TestDurableRepositoryReplaysReversal(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	fromAccID, _ := repo.CreateAccount(ctx)
+	toAccID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, fromAccID, Money{Amount: 100}, TransactionMeta{})
+	transfer, _ := repo.TransferAccount(ctx, fromAccID, toAccID, Money{Amount: 60}, TransactionMeta{})
+	_, _ = repo.ReverseTransaction(ctx, transfer.ID, Money{Amount: 20}, TransactionMeta{})
+	if err := repo.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+
+	toAcc, _ := repo.GetAccount(ctx, toAccID)
+	if toAcc.Balance != 40 {
+		t.Errorf("replay got = %v, want %v", toAcc.Balance, 40)
+	}
+	// the replayed reversal still counts against the transfer
+	if _, err := repo.ReverseTransaction(ctx, transfer.ID, Money{Amount: 50}, TransactionMeta{}); !errors.Is(err, ErrReversalExceedsAmount) {
+		t.Errorf("ReverseTransaction() after replay error = %v, want %v", err, ErrReversalExceedsAmount)
+	}
+}
+
+func TestDurableRepositoryKeepsOutbox(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	accID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{Memo: "first"})
+	_, _ = repo.RelayTransactions(ctx, 10, nil)
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 20}, TransactionMeta{Memo: "second"})
+	if err := repo.Snapshot(); err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 3}, TransactionMeta{Memo: "third"})
+	// the server stops before the last entries are relayed
+	repo.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	if depth, _ := repo.OutboxDepth(ctx); depth != 2 {
+		t.Errorf("OutboxDepth() after reopen got = %v, want %v", depth, 2)
+	}
+	_, _ = repo.RelayTransactions(ctx, 10, nil)
+	trans, _ := repo.GetTransactions(ctx)
+	if len(trans) != 3 || trans[0].Memo != "first" || trans[1].Memo != "second" || trans[2].Memo != "third" {
+		t.Errorf("GetTransactions() after reopen got = %+v", trans)
+	}
+}
+
+func TestDurableRepositoryTornRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	accID, _ := repo.CreateAccount(ctx)
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 100}, TransactionMeta{})
+	repo.Close()
+
+	walPath := filepath.Join(dir, "wal-00000000000000000001.log")
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goodSize := info.Size()
+
+	// simulate a crash in the middle of writing the next record
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, '{', '"', 'o'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() with torn record error = %v", err)
+	}
+
+	if info, _ := os.Stat(walPath); info.Size() != goodSize {
+		t.Errorf("torn record not truncated: size = %v, want %v", info.Size(), goodSize)
+	}
+	acc, _ := repo.GetAccount(ctx, accID)
+	if acc.Balance != 100 {
+		t.Errorf("replay got = %v, want %v", acc.Balance, 100)
+	}
+
+	// the log keeps working after the truncation
+	_, _ = repo.DepositAccount(ctx, accID, Money{Amount: 20}, TransactionMeta{})
+	repo.Close()
+	repo, err = NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() reopen error = %v", err)
+	}
+	defer repo.Close()
+	acc, _ = repo.GetAccount(ctx, accID)
+	if acc.Balance != 120 {
+		t.Errorf("replay after truncation got = %v, want %v", acc.Balance, 120)
+	}
+}
+
+func TestDurableRepositoryReplaysNumericIDs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// records written while account ids were numbers
+	w, _, err := openWAL(dir, 1)
+	if err != nil {
+		t.Fatalf("openWAL() error = %v", err)
+	}
+	for _, raw := range []string{
+		`{"op":"create_account","id":7}`,
+		`{"op":"create_account","id":8}`,
+		`{"op":"deposit_account","id":7,"amount":100,"entry":1}`,
+		`{"op":"transfer_account","from":7,"to":8,"amount":30,"entry":2}`,
+	} {
+		var rec walRecord
+		if err := json.Unmarshal([]byte(raw), &rec); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		if err := w.append(rec); err != nil {
+			t.Fatalf("append() error = %v", err)
+		}
+	}
+	w.close()
+
+	repo, err := NewDurableRepository(dir)
+	if err != nil {
+		t.Fatalf("NewDurableRepository() error = %v", err)
+	}
+	defer repo.Close()
+	acc, err := repo.GetAccount(ctx, "8")
+	if err != nil || acc.Balance != 30 {
+		t.Errorf("GetAccount() got = %v, %v, want balance %v", acc, err, 30)
+	}
+	if nextID, _ := repo.CreateAccount(ctx); nextID != "9" {
+		t.Errorf("CreateAccount() after replay got = %v, want %v", nextID, "9")
+	}
+	if err := repo.CheckLedger(ctx); err != nil {
+		t.Errorf("CheckLedger() error = %v", err)
+	}
+}
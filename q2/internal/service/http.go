@@ -2,8 +2,13 @@ package service
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/Yougigun/meepshop_q2/internal/audit"
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/broker"
 	"github.com/Yougigun/meepshop_q2/internal/handler"
 	"github.com/Yougigun/meepshop_q2/internal/repository"
 	"github.com/gin-gonic/gin"
@@ -14,26 +19,179 @@ type HttpService struct {
 	Engine *gin.Engine
 }
 
-func Build(ctx context.Context, log *zap.Logger, repo *repository.Repository) *http.Server {
+// Config tunes the service. The zero value uses the defaults.
+type Config struct {
+	// IdempotencyTTL is how long idempotency keys are remembered, 24 hours by default.
+	IdempotencyTTL time.Duration
+	// RelayInterval is how often the transaction log outbox is relayed, every second by default.
+	RelayInterval time.Duration
+	// InterestInterval is how often overdraft interest is charged, daily by default.
+	InterestInterval time.Duration
+	// HoldExpiryInterval is how often expired holds are released, every minute by default.
+	HoldExpiryInterval time.Duration
+	// EscrowReleaseInterval is how often due escrows are released, every minute by default.
+	EscrowReleaseInterval time.Duration
+	// Events receives account and transaction events. Nil publishes none.
+	Events broker.EventPublisher
+	// Auth authenticates every request. Build refuses a nil Auth unless
+	// Insecure is set.
+	Auth auth.Authenticator
+	// Insecure serves the API to anyone when Auth is nil, for development
+	// and tests only.
+	Insecure bool
+	// Policy grants the roles of callers their permissions, auth.DefaultPolicy
+	// by default.
+	Policy *auth.Policy
+	// Audit records denied requests and the changes staff make, in memory
+	// by default.
+	Audit audit.Log
+}
+
+// ErrNoAuth means Build was given no authenticator and not told the API may
+// be open.
+var ErrNoAuth = errors.New("no authenticator configured and Insecure is not set")
+
+// Build wires the routes and starts the background workers, which stop with
+// ctx. It fails with ErrNoAuth when cfg has no Auth and is not Insecure.
+func Build(ctx context.Context, log *zap.Logger, repo repository.AccountStore, cfg Config) (*http.Server, error) {
+	if cfg.Auth == nil && !cfg.Insecure {
+		// fail before any worker starts
+		return nil, ErrNoAuth
+	}
 	r := gin.Default()
-	h := handler.NewAccountHandler(ctx, log, repo)
+	h := handler.NewAccountHandler(log, repo, cfg.Events)
+
+	if cfg.IdempotencyTTL == 0 {
+		cfg.IdempotencyTTL = 24 * time.Hour
+	}
+	idempotency := handler.Idempotency(log, repository.NewMemoryIdempotencyStore(cfg.IdempotencyTTL))
+
+	if cfg.RelayInterval == 0 {
+		cfg.RelayInterval = time.Second
+	}
+	// the relay stops with ctx; flush it on shutdown, see main
+	relay := handler.NewTransactionRelay(log, repo, cfg.Events)
+	go relay.Run(ctx, cfg.RelayInterval)
+
+	if cfg.InterestInterval == 0 {
+		cfg.InterestInterval = 24 * time.Hour
+	}
+	go handler.NewInterestCharger(log, repo).Run(ctx, cfg.InterestInterval)
+
+	if cfg.HoldExpiryInterval == 0 {
+		cfg.HoldExpiryInterval = time.Minute
+	}
+	go handler.NewHoldExpirer(log, repo).Run(ctx, cfg.HoldExpiryInterval)
+
+	if cfg.EscrowReleaseInterval == 0 {
+		cfg.EscrowReleaseInterval = time.Minute
+	}
+	go handler.NewEscrowReleaser(log, repo).Run(ctx, cfg.EscrowReleaseInterval)
+
+	if cfg.Policy == nil {
+		cfg.Policy = auth.DefaultPolicy()
+	}
+	if cfg.Audit == nil {
+		cfg.Audit = audit.NewMemoryLog()
+	}
+	// every route requires a permission; customers may hold it for their own
+	// accounts only, which the handlers check
+	can := auth.NewEnforcer(log, cfg.Policy, cfg.Audit, repo).Require
+	switch {
+	case cfg.Auth != nil:
+		r.Use(auth.Middleware(log, cfg.Auth, cfg.Audit))
+	case cfg.Insecure:
+		log.Warn("serving the API without authentication")
+		can = func(string) gin.HandlerFunc { return func(ctx *gin.Context) { ctx.Next() } }
+	}
+	audits := handler.NewAuditHandler(log, cfg.Audit)
+	customers := handler.NewCustomerHandler(log, repo)
+	admin := handler.NewAdminHandler(log, repo, cfg.Audit)
+	holds := handler.NewHoldHandler(log, repo)
+	escrows := handler.NewEscrowHandler(log, repo)
+	splits := handler.NewSplitHandler(log, repo)
+
+	r.POST("/accounts", can(auth.PermAccountsCreate), h.CreateAccount)
+
+	r.POST("/accounts/deposit", can(auth.PermDeposit), idempotency, h.DepositAccount)
+
+	r.POST("/accounts/withdraw", can(auth.PermWithdraw), idempotency, h.WithdrawAccount)
+
+	r.POST("/accounts/transfer", can(auth.PermTransfer), idempotency, h.TransferAccount)
+
+	r.POST("/accounts/split-transfer", can(auth.PermTransfer), idempotency, splits.SplitTransfer)
+
+	r.POST("/transactions/:id/reverse", can(auth.PermReverse), idempotency, h.ReverseTransaction)
+
+	r.GET("/accounts/:id", can(auth.PermAccountsRead), h.GetAccount)
+
+	r.GET("/accounts/:id/transactions", can(auth.PermAccountsRead), h.GetAccountTransactions)
+
+	r.GET("/accounts/:id/statements", can(auth.PermStatementsRead), h.GetStatement)
+
+	r.PUT("/accounts/:id/status", can(auth.PermAccountsStatus), admin.SetAccountStatus)
+
+	r.GET("/accounts/:id/overdraft", can(auth.PermAccountsRead), h.GetOverdraftHistory)
+
+	r.PUT("/accounts/:id/overdraft", can(auth.PermOverdraftManage), admin.SetOverdraft)
+
+	r.GET("/accounts/:id/holds", can(auth.PermAccountsRead), holds.GetAccountHolds)
+
+	r.GET("/accounts/:id/escrows", can(auth.PermAccountsRead), escrows.GetAccountEscrows)
+
+	r.GET("/accounts/:id/fees", can(auth.PermAccountsRead), splits.GetFeeSchedule)
+
+	r.PUT("/accounts/:id/fees", can(auth.PermFeesManage), admin.SetFeeSchedule)
+
+	r.GET("/accounts/:id/holders", can(auth.PermAccountsRead), customers.GetAccountHolders)
+
+	r.PUT("/accounts/:id/holders", can(auth.PermHoldersManage), customers.SetAccountHolder)
+
+	r.DELETE("/accounts/:id/holders/:customer_id", can(auth.PermHoldersManage), customers.RemoveAccountHolder)
+
+	r.POST("/customers", can(auth.PermCustomersCreate), customers.CreateCustomer)
+
+	r.GET("/customers", can(auth.PermCustomersRead), customers.ListCustomers)
+
+	r.GET("/customers/:id", can(auth.PermCustomersRead), customers.GetCustomer)
+
+	r.PUT("/customers/:id", can(auth.PermCustomersUpdate), customers.UpdateCustomer)
+
+	r.DELETE("/customers/:id", can(auth.PermCustomersDelete), customers.DeleteCustomer)
+
+	r.GET("/customers/:id/accounts", can(auth.PermCustomersRead), customers.GetCustomerAccounts)
+
+	r.POST("/holds", can(auth.PermHoldsPlace), idempotency, holds.PlaceHold)
+
+	r.GET("/holds/:id", can(auth.PermAccountsRead), holds.GetHold)
+
+	r.POST("/holds/:id/capture", can(auth.PermHoldsManage), idempotency, holds.CaptureHold)
+
+	r.POST("/holds/:id/release", can(auth.PermHoldsManage), holds.ReleaseHold)
+
+	r.POST("/escrows", can(auth.PermEscrowOpen), idempotency, escrows.OpenEscrow)
+
+	r.GET("/escrows/:order_id", can(auth.PermAccountsRead), escrows.GetEscrow)
 
-	r.POST("/accounts", h.CreateAccount)
+	r.POST("/escrows/:order_id/release", can(auth.PermEscrowSettle), escrows.ReleaseEscrow)
 
-	r.POST("/accounts/deposit", h.DepositAccount)
+	r.POST("/escrows/:order_id/refund", can(auth.PermEscrowSettle), escrows.RefundEscrow)
 
-	r.POST("/accounts/withdraw", h.WithdrawAccount)
+	r.GET("/exchange-rates", can(auth.PermRatesRead), h.ListExchangeRates)
 
-	r.POST("/accounts/transfer", h.TransferAccount)
+	r.PUT("/exchange-rates", can(auth.PermRatesManage), admin.SetExchangeRate)
 	{
-		// internal api for admin. todo: add auth middleware
-		r.GET("/accounts/:id", h.GetAccount)
-		r.GET("/transactions", h.GetTransactionLog)
+		// internal api for staff
+		r.GET("/transactions", can(auth.PermTransactionsRead), h.GetTransactionLog)
+		r.GET("/journal", can(auth.PermJournalRead), h.GetJournal)
+		r.GET("/ledger/check", can(auth.PermLedgerCheck), h.CheckLedger)
+		r.GET("/metrics", can(auth.PermMetricsRead), relay.Metrics)
+		r.GET("/audit", can(auth.PermAuditRead), audits.GetAuditLog)
 	}
 
 	srv := &http.Server{
 		Addr:    ":8080",
 		Handler: r,
 	}
-	return srv
+	return srv, nil
 }
@@ -0,0 +1,126 @@
+package statement
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType returns the MIME type of format.
+func ContentType(format string) (string, error) {
+	switch format {
+	case FormatJSON:
+		return "application/json", nil
+	case FormatCSV:
+		return "text/csv; charset=utf-8", nil
+	case FormatPDF:
+		return "application/pdf", nil
+	default:
+		return "", fmt.Errorf("unknown statement format %q", format)
+	}
+}
+
+// Write renders s to w in format.
+func (s *Statement) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		return s.WriteJSON(w)
+	case FormatCSV:
+		return s.WriteCSV(w)
+	case FormatPDF:
+		return s.WritePDF(w)
+	default:
+		_, err := ContentType(format)
+		return err
+	}
+}
+
+func (s *Statement) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+// WriteCSV writes one row per movement between an opening_balance and a
+// closing_balance row, so every row has the same columns. Every row names
+// the currency of its amount and balance.
+func (s *Statement) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	currency := string(s.Currency)
+	rows := [][]string{
+		{"when", "transaction_id", "type", "counterparty", "memo", "reference", "currency", "amount", "balance"},
+		{s.From.Format(time.RFC3339), "", "opening_balance", "", "", "", currency, "", strconv.FormatInt(s.OpeningBalance, 10)},
+	}
+	for _, l := range s.Lines {
+		rows = append(rows, []string{
+			l.When.Format(time.RFC3339),
+			strconv.FormatInt(l.TransactionID, 10),
+			string(l.Type),
+			string(l.Counterparty),
+			csvText(l.Memo),
+			csvText(l.Reference),
+			currency,
+			strconv.FormatInt(l.Amount, 10),
+			strconv.FormatInt(l.Balance, 10),
+		})
+	}
+	rows = append(rows, []string{s.To.Format(time.RFC3339), "", "closing_balance", "", "", "", currency, "", strconv.FormatInt(s.ClosingBalance, 10)})
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// csvText returns text written by clients as a cell that spreadsheets do not
+// evaluate: a leading =, +, - or @ would start a formula, so it is quoted
+// with a '.
+func csvText(v string) string {
+	if v != "" && strings.ContainsRune("=+-@", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// text returns the statement as lines of monospaced text, used by the PDF.
+func (s *Statement) text() []string {
+	const row = "%-16s %8s %-10s %-14s %12s %12s  %s"
+	lines := []string{
+		"ACCOUNT STATEMENT",
+		"",
+		"Account:         " + string(s.AccountID),
+		"Currency:        " + string(s.Currency),
+		"Period:          " + s.From.Format(time.RFC3339) + " to " + s.To.Format(time.RFC3339),
+		"Opening balance: " + strconv.FormatInt(s.OpeningBalance, 10),
+		"",
+		fmt.Sprintf(row, "Date", "ID", "Type", "Counterparty", "Amount", "Balance", "Memo"),
+	}
+	for _, l := range s.Lines {
+		lines = append(lines, fmt.Sprintf(row,
+			l.When.UTC().Format("2006-01-02 15:04"),
+			strconv.FormatInt(l.TransactionID, 10),
+			truncate(string(l.Type), 10),
+			truncate(string(l.Counterparty), 14),
+			strconv.FormatInt(l.Amount, 10),
+			strconv.FormatInt(l.Balance, 10),
+			truncate(l.Memo, 20),
+		))
+	}
+	return append(lines,
+		"",
+		"Money in:        "+strconv.FormatInt(s.TotalIn, 10),
+		"Money out:       "+strconv.FormatInt(s.TotalOut, 10),
+		"Closing balance: "+strconv.FormatInt(s.ClosingBalance, 10),
+		"",
+		"Generated "+s.GeneratedAt.UTC().Format(time.RFC3339),
+	)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "~"
+}
@@ -0,0 +1,110 @@
+// Package statement builds account statements from the transaction history
+// and renders them as JSON, CSV or PDF.
+package statement
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+)
+
+var ErrInvalidPeriod = errors.New("statement period must end after it starts")
+
+// Formats accepted by Write.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+	FormatPDF  = "pdf"
+)
+
+// Line is one movement of a statement. Amount is positive for money coming
+// into the account and negative for money leaving it; Balance is the balance
+// of the account right after it.
+type Line struct {
+	TransactionID int64
+	Type          repository.TransactionType
+	When          time.Time
+	Counterparty  repository.AccountID
+	Memo          string
+	Reference     string
+	Amount        int64
+	Balance       int64
+}
+
+// Statement lists the movements of an account from From, inclusive, to To,
+// exclusive, between its opening and closing balance. Every amount is in the
+// Currency of the account.
+type Statement struct {
+	AccountID      repository.AccountID
+	Currency       repository.Currency
+	From           time.Time
+	To             time.Time
+	OpeningBalance int64
+	ClosingBalance int64
+	TotalIn        int64
+	TotalOut       int64
+	Lines          []Line
+	GeneratedAt    time.Time
+}
+
+// Build reads the statement of account id for [from, to) from the account
+// history of store. Only entries already relayed to the transaction log are
+// included.
+func Build(ctx context.Context, store repository.AccountStore, id repository.AccountID, from, to time.Time) (*Statement, error) {
+	if !to.After(from) {
+		return nil, ErrInvalidPeriod
+	}
+	account, err := store.GetAccount(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s := &Statement{AccountID: id, Currency: account.Currency, From: from, To: to, Lines: make([]Line, 0), GeneratedAt: time.Now()}
+
+	// the opening balance is the balance after the last entry before the period
+	before, err := store.ListAccountTransactions(ctx, id, repository.TransactionQuery{Until: from, Descending: true, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(before.Entries) > 0 {
+		s.OpeningBalance = before.Entries[0].Balance
+	}
+	s.ClosingBalance = s.OpeningBalance
+
+	q := repository.TransactionQuery{Since: from, Until: to, Limit: repository.MaxPageSize}
+	for {
+		history, err := store.ListAccountTransactions(ctx, id, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range history.Entries {
+			s.add(e)
+		}
+		if history.NextCursor == "" {
+			return s, nil
+		}
+		q.Cursor = history.NextCursor
+	}
+}
+
+func (s *Statement) add(e repository.AccountEntry) {
+	line := Line{
+		TransactionID: e.ID,
+		Type:          e.Type,
+		When:          e.When,
+		Memo:          e.Memo,
+		Reference:     e.Reference,
+		Balance:       e.Balance,
+	}
+	if e.To == s.AccountID {
+		// a cross-currency transfer credits the converted amount
+		line.Amount, line.Counterparty = e.Credited(), e.From
+		s.TotalIn += e.Credited()
+	} else {
+		line.Amount, line.Counterparty = -e.Amount, e.To
+		s.TotalOut += e.Amount
+	}
+	s.Lines = append(s.Lines, line)
+	s.ClosingBalance = e.Balance
+}
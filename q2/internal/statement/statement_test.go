@@ -0,0 +1,158 @@
+package statement
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Yougigun/meepshop_q2/internal/repository"
+)
+
+var march = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// newStore returns a store where account "1" got 1000 in February, made
+// transfers to account "2" in March, and got 5 in April.
+func newStore(t *testing.T, transfers int) repository.AccountStore {
+	t.Helper()
+	ctx := context.Background()
+	repo := repository.NewRepository()
+	repo.CreateAccount(ctx)
+	repo.CreateAccount(ctx)
+	at := func(month time.Month, day int) time.Time { return time.Date(2024, month, day, 9, 0, 0, 0, time.UTC) }
+	batch := repository.BatchTransaction{
+		{ID: 1, Type: repository.TransactionDeposit, From: repository.CashInAccount, To: "1", Amount: 1000, ToBalance: 1000, When: at(2, 10)},
+	}
+	balance := int64(1000)
+	for i := 0; i < transfers; i++ {
+		balance -= 10
+		batch = append(batch, repository.TransactionLog{ID: int64(i + 2), Type: repository.TransactionTransfer, From: "1", To: "2", Amount: 10, FromBalance: balance, ToBalance: int64(10 * (i + 1)), Memo: "rent (march)", When: at(3, 1+i%28)})
+	}
+	batch = append(batch, repository.TransactionLog{ID: int64(transfers + 2), Type: repository.TransactionDeposit, From: repository.CashInAccount, To: "1", Amount: 5, ToBalance: balance + 5, When: at(4, 2)})
+	if err := repo.AddTransaction(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestBuild(t *testing.T) {
+	ctx := context.Background()
+	s, err := Build(ctx, newStore(t, 3), "1", march, march.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if s.OpeningBalance != 1000 || s.ClosingBalance != 970 || s.TotalIn != 0 || s.TotalOut != 30 || len(s.Lines) != 3 {
+		t.Errorf("Build() got = %+v", s)
+	}
+	if l := s.Lines[0]; l.Amount != -10 || l.Counterparty != "2" || l.Balance != 990 {
+		t.Errorf("Build() first line got = %+v", l)
+	}
+
+	// a period without movements keeps the balance
+	s, _ = Build(ctx, newStore(t, 3), "1", march.AddDate(0, 2, 0), march.AddDate(0, 3, 0))
+	if s.OpeningBalance != 975 || s.ClosingBalance != 975 || len(s.Lines) != 0 {
+		t.Errorf("Build() of June got = %+v", s)
+	}
+	if s, _ := Build(ctx, newStore(t, 3), "2", march, march.AddDate(0, 1, 0)); s.ClosingBalance != 30 || s.TotalIn != 30 {
+		t.Errorf("Build() of the receiver got = %+v", s)
+	}
+
+	if _, err := Build(ctx, newStore(t, 0), "1", march, march); !errors.Is(err, ErrInvalidPeriod) {
+		t.Errorf("Build() empty period error = %v, want %v", err, ErrInvalidPeriod)
+	}
+	if _, err := Build(ctx, newStore(t, 0), "9", march, march.AddDate(0, 1, 0)); !errors.Is(err, repository.ErrAccountNotFound) {
+		t.Errorf("Build() unknown account error = %v, want %v", err, repository.ErrAccountNotFound)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	s, _ := Build(context.Background(), newStore(t, 1), "1", march, march.AddDate(0, 1, 0))
+	var buf bytes.Buffer
+	if err := s.Write(&buf, FormatCSV); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	want := `when,transaction_id,type,counterparty,memo,reference,currency,amount,balance
+2024-03-01T00:00:00Z,,opening_balance,,,,TWD,,1000
+2024-03-01T09:00:00Z,2,transfer,2,rent (march),,TWD,-10,990
+2024-04-01T00:00:00Z,,closing_balance,,,,TWD,,990
+`
+	if buf.String() != want {
+		t.Errorf("WriteCSV() got\n%v\nwant\n%v", buf.String(), want)
+	}
+}
+
+func TestWriteCSVFormulas(t *testing.T) {
+	s := &Statement{Currency: repository.DefaultCurrency, Lines: []Line{
+		{Memo: "=HYPERLINK(\"http://example.com\")", Reference: "+1", Amount: -10},
+		{Memo: "-2+3", Reference: "@SUM(A1)", Amount: 10},
+		{Memo: "rent = 10", Reference: "order-1", Amount: 10},
+	}}
+	var buf bytes.Buffer
+	if err := s.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV() error = %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"'=HYPERLINK(\"http://example.com\")", "'+1", "-10"},
+		{"'-2+3", "'@SUM(A1)", "10"},
+		{"rent = 10", "order-1", "10"},
+	}
+	for i, w := range want {
+		// memo, reference and amount of the movement rows
+		if got := []string{rows[i+2][4], rows[i+2][5], rows[i+2][7]}; strings.Join(got, "|") != strings.Join(w, "|") {
+			t.Errorf("WriteCSV() row %v got %q, want %q", i+1, got, w)
+		}
+	}
+}
+
+func TestWritePDF(t *testing.T) {
+	// enough movements for two pages
+	s, _ := Build(context.Background(), newStore(t, pdfLinesPerPage), "1", march, march.AddDate(0, 1, 0))
+	var buf bytes.Buffer
+	if err := s.Write(&buf, FormatPDF); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	pdf := buf.String()
+	if !strings.HasPrefix(pdf, "%PDF-1.4\n") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Fatalf("WritePDF() is not a PDF: %q", pdf)
+	}
+	if !strings.Contains(pdf, "/Count 2") || !strings.Contains(pdf, `(Page 2 of 2) Tj`) {
+		t.Errorf("WritePDF() does not have two pages")
+	}
+	if !strings.Contains(pdf, `rent \(march\)`) {
+		t.Errorf("WritePDF() does not escape parentheses")
+	}
+
+	// startxref points at the table and every entry at its object
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(pdf)
+	if m == nil {
+		t.Fatalf("WritePDF() has no startxref")
+	}
+	xref, _ := strconv.Atoi(m[1])
+	if !strings.HasPrefix(pdf[xref:], "xref\n") {
+		t.Fatalf("startxref %v does not point at the xref table", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(pdf[xref:], -1)
+	for i, e := range entries {
+		offset, _ := strconv.Atoi(e[1])
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !strings.HasPrefix(pdf[offset:], want) {
+			t.Errorf("xref entry %v points at %q", i+1, pdf[offset:offset+10])
+		}
+	}
+}
+
+func TestWriteUnknownFormat(t *testing.T) {
+	s, _ := Build(context.Background(), newStore(t, 0), "1", march, march.AddDate(0, 1, 0))
+	if err := s.Write(&bytes.Buffer{}, "xml"); err == nil {
+		t.Errorf("Write() unknown format got nil error")
+	}
+}
@@ -6,9 +6,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/Yougigun/meepshop_q2/internal/audit"
+	"github.com/Yougigun/meepshop_q2/internal/auth"
+	"github.com/Yougigun/meepshop_q2/internal/broker"
+	"github.com/Yougigun/meepshop_q2/internal/handler"
 	"github.com/Yougigun/meepshop_q2/internal/repository"
 	"github.com/Yougigun/meepshop_q2/internal/service"
 	"go.uber.org/zap"
@@ -19,8 +24,88 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	repo := repository.NewRepository()
-	srv := service.Build(context.Background(), logger, repo)
+	// workers started here and by Build stop when ctx is cancelled
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	repo, err := newStore(ctx, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer repo.Close()
+	// the rate table file sets rates at startup, the admin api changes them later
+	if path := os.Getenv("EXCHANGE_RATES"); path != "" {
+		rates, err := repository.LoadExchangeRates(path)
+		if err != nil {
+			panic(err)
+		}
+		for _, rate := range rates {
+			if _, err := repo.SetExchangeRate(context.Background(), rate); err != nil {
+				panic(err)
+			}
+		}
+	}
+	cfg := service.Config{}
+	if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+		if cfg.IdempotencyTTL, err = time.ParseDuration(v); err != nil {
+			panic(err)
+		}
+	}
+	if v := os.Getenv("RELAY_INTERVAL"); v != "" {
+		if cfg.RelayInterval, err = time.ParseDuration(v); err != nil {
+			panic(err)
+		}
+	}
+	if v := os.Getenv("INTEREST_INTERVAL"); v != "" {
+		if cfg.InterestInterval, err = time.ParseDuration(v); err != nil {
+			panic(err)
+		}
+	}
+	if v := os.Getenv("HOLD_EXPIRY_INTERVAL"); v != "" {
+		if cfg.HoldExpiryInterval, err = time.ParseDuration(v); err != nil {
+			panic(err)
+		}
+	}
+	if v := os.Getenv("ESCROW_RELEASE_INTERVAL"); v != "" {
+		if cfg.EscrowReleaseInterval, err = time.ParseDuration(v); err != nil {
+			panic(err)
+		}
+	}
+	if path := os.Getenv("AUTH_CONFIG"); path != "" {
+		authCfg, err := auth.LoadConfig(path)
+		if err != nil {
+			panic(err)
+		}
+		if cfg.Auth, err = auth.New(authCfg); err != nil {
+			panic(err)
+		}
+	}
+	// without AUTH_CONFIG, Build refuses to serve unless told the API may be open
+	cfg.Insecure = os.Getenv("INSECURE_NO_AUTH") == "true"
+	if path := os.Getenv("RBAC_POLICY"); path != "" {
+		if cfg.Policy, err = auth.LoadPolicy(path); err != nil {
+			panic(err)
+		}
+	}
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		auditLog, err := audit.OpenFileLog(path)
+		if err != nil {
+			panic(err)
+		}
+		defer auditLog.Close()
+		cfg.Audit = auditLog
+	}
+	if dir := os.Getenv("EVENTS_DIR"); dir != "" {
+		events, err := broker.NewFileBroker(dir, 0)
+		if err != nil {
+			panic(err)
+		}
+		defer events.Close()
+		cfg.Events = events
+	}
+	srv, err := service.Build(ctx, logger, repo, cfg)
+	if err != nil {
+		panic(err)
+	}
 	go func() {
 		// Service connections
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -35,11 +120,69 @@ func main() {
 
 	// The context is used to inform the server it has 5 seconds to finish
 	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		fmt.Println("Server forced to shutdown:", err)
 	}
+	stop()
+	// move every transaction log entry still in the outbox before the store closes
+	if err := handler.NewTransactionRelay(logger, repo, cfg.Events).Flush(shutdownCtx); err != nil {
+		logger.Error("flush transaction log", zap.Error(err))
+	}
 
 	fmt.Println("Server exiting")
 }
+
+// newStore picks the storage backend from the environment: SQLite when
+// SQLITE_PATH is set, the in-memory repository with a write-ahead log when
+// DATA_DIR is set, and a purely in-memory repository otherwise. ID_STRATEGY
+// picks how account ids are made. Periodic snapshots stop with ctx.
+func newStore(ctx context.Context, logger *zap.Logger) (repository.AccountStore, error) {
+	var node int64
+	if v := os.Getenv("SNOWFLAKE_NODE"); v != "" {
+		var err error
+		if node, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	ids, err := repository.NewIDGenerator(os.Getenv("ID_STRATEGY"), node)
+	if err != nil {
+		return nil, err
+	}
+	withIDs := repository.WithIDGenerator(ids)
+
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		return repository.NewSQLiteRepository(path, withIDs)
+	}
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		return repository.NewRepository(withIDs), nil
+	}
+	repo, err := repository.NewDurableRepository(dataDir, withIDs)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Minute
+	if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+	// snapshot periodically so startup only replays the recent log
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := repo.Snapshot(); err != nil {
+					logger.Error("snapshot", zap.Error(err))
+				}
+			}
+		}
+	}()
+	return repo, nil
+}